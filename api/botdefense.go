@@ -0,0 +1,175 @@
+package api
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/arkami8/image-gem/config"
+)
+
+// BotHook decides whether the requests of a client are served, e.g. by asking an existing bot-defense system.
+// Check is called for every request before anything is parsed or fetched, so it should be fast.
+type BotHook interface {
+	Check(r *http.Request, client ClientInfo) BotDecision
+}
+
+// BotDecision is what a BotHook decided for a request.
+type BotDecision int
+
+const (
+	// BotAllow serves the request.
+	BotAllow BotDecision = iota
+	// BotThrottle answers 429 Too Many Requests.
+	BotThrottle
+	// BotDeny answers 403 Forbidden.
+	BotDeny
+)
+
+// ClientInfo describes the client and connection of a request.
+type ClientInfo struct {
+	// RemoteAddr is the address of the client, behind the trusted proxies.
+	RemoteAddr string
+	// TLS is the state of the TLS connection the request arrived on, nil for plain HTTP.
+	TLS *tls.ConnectionState
+	// Fingerprint is the JA3-style fingerprint of the client's TLS ClientHello, see FingerprintTLS, or the one a
+	// trusted proxy sent in config.TLSFingerprintHeader. It is empty when neither is known.
+	Fingerprint string
+}
+
+var botHook BotHook
+
+// SetBotHook installs the hook that decides whether requests are served. It must be called before the router
+// serves requests; nil removes the hook.
+func SetBotHook(hook BotHook) {
+	botHook = hook
+}
+
+// botHandler answers requests the bot hook throttles or denies.
+func botHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if botHook == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		client := ClientInfo{RemoteAddr: r.RemoteAddr, TLS: r.TLS, Fingerprint: connFingerprint(r.Context())}
+		// Behind a trusted proxy, the client and its fingerprint are the ones the proxy reports
+		if ip := clientIP(r); ip != "" {
+			client.RemoteAddr = ip
+			if config.TLSFingerprintHeader != "" {
+				client.Fingerprint = r.Header.Get(config.TLSFingerprintHeader)
+			}
+		}
+
+		switch botHook.Check(r, client) {
+		case BotThrottle:
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		case BotDeny:
+			http.Error(w, "Forbidden", http.StatusForbidden)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+type connContextKey struct{}
+
+// fingerprints are the ClientHello fingerprints of the open TLS connections, by their underlying connection.
+var fingerprints sync.Map
+
+// FingerprintTLS records a JA3-style fingerprint of the ClientHello of every TLS connection of the server for
+// the bot hook. It must be called before the server starts serving, and keeps the server's own
+// GetConfigForClient, ConnContext and ConnState hooks. crypto/tls doesn't expose the extensions of the
+// ClientHello, so the fingerprint is the MD5 of the JA3 string with an empty list of extensions, e.g.
+// 771,4865-4866-4867-49195,,29-23-24,0.
+func FingerprintTLS(srv *http.Server) {
+	if srv.TLSConfig == nil {
+		srv.TLSConfig = &tls.Config{}
+	}
+	getConfigForClient := srv.TLSConfig.GetConfigForClient
+	srv.TLSConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		fingerprints.Store(hello.Conn, ja3(hello))
+		if getConfigForClient != nil {
+			return getConfigForClient(hello)
+		}
+		return nil, nil
+	}
+
+	connContext := srv.ConnContext
+	srv.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		if connContext != nil {
+			ctx = connContext(ctx, c)
+		}
+		return context.WithValue(ctx, connContextKey{}, c)
+	}
+
+	connState := srv.ConnState
+	srv.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateClosed || state == http.StateHijacked {
+			if tlsConn, ok := c.(*tls.Conn); ok {
+				fingerprints.Delete(tlsConn.NetConn())
+			}
+		}
+		if connState != nil {
+			connState(c, state)
+		}
+	}
+}
+
+// connFingerprint returns the fingerprint recorded for the TLS connection of the request context, if any.
+func connFingerprint(ctx context.Context) string {
+	tlsConn, ok := ctx.Value(connContextKey{}).(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	fingerprint, _ := fingerprints.Load(tlsConn.NetConn())
+	value, _ := fingerprint.(string)
+	return value
+}
+
+// ja3 returns the JA3-style fingerprint of the ClientHello. GREASE values are left out as in JA3.
+func ja3(hello *tls.ClientHelloInfo) string {
+	var version uint16
+	for _, v := range hello.SupportedVersions {
+		if !grease(v) && v > version {
+			version = v
+		}
+	}
+	ciphers := make([]uint16, len(hello.CipherSuites))
+	copy(ciphers, hello.CipherSuites)
+	curves := make([]uint16, len(hello.SupportedCurves))
+	for i, curve := range hello.SupportedCurves {
+		curves[i] = uint16(curve)
+	}
+	points := make([]uint16, len(hello.SupportedPoints))
+	for i, point := range hello.SupportedPoints {
+		points[i] = uint16(point)
+	}
+
+	fields := []string{strconv.Itoa(int(version)), ja3List(ciphers), "", ja3List(curves), ja3List(points)}
+	sum := md5.Sum([]byte(strings.Join(fields, ",")))
+	return hex.EncodeToString(sum[:])
+}
+
+// ja3List joins the values with dashes, leaving out GREASE values.
+func ja3List(values []uint16) string {
+	parts := make([]string, 0, len(values))
+	for _, v := range values {
+		if !grease(v) {
+			parts = append(parts, strconv.Itoa(int(v)))
+		}
+	}
+	return strings.Join(parts, "-")
+}
+
+// grease reports whether the value is one of the reserved GREASE values (RFC 8701) clients send at random.
+func grease(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
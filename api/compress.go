@@ -0,0 +1,155 @@
+package api
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/arkami8/image-gem/config"
+
+	"github.com/andybalholm/brotli"
+)
+
+// compressibleTypes are the content types worth compressing. Raster image formats are compressed already,
+// so gzipping them only costs CPU.
+var compressibleTypes = []string{"text/", "image/svg+xml", "application/json", "application/javascript", "application/xml"}
+
+// compressHandler compresses SVG, JSON and text responses with gzip, or brotli when it is enabled and
+// accepted by the client. Other responses are written unchanged.
+func compressHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Always vary on Accept-Encoding to prevent intermediate caches serving the wrong encoding
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressResponseWriter{ResponseWriter: w, encoding: encoding}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// negotiateEncoding returns the preferred supported encoding from an Accept-Encoding header, or an empty string.
+func negotiateEncoding(acceptEncoding string) string {
+	var gzipAccepted, brotliAccepted bool
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if q := strings.TrimSpace(params); q == "q=0" || q == "q=0.0" {
+			continue
+		}
+		switch strings.TrimSpace(name) {
+		case "gzip":
+			gzipAccepted = true
+		case "br":
+			brotliAccepted = true
+		}
+	}
+
+	if brotliAccepted && config.CompressionBrotli {
+		return "br"
+	}
+	if gzipAccepted {
+		return "gzip"
+	}
+	return ""
+}
+
+// compressResponseWriter decides whether to compress when the response header is written, based on its content type.
+type compressResponseWriter struct {
+	http.ResponseWriter
+	encoding    string
+	compressor  io.WriteCloser
+	status      int
+	wroteHeader bool
+}
+
+// WriteHeader writes the header once the content type is known. Without a Content-Type header it is deferred
+// to the first Write, where the content type is sniffed.
+func (cw *compressResponseWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.status = status
+	if cw.Header().Get("Content-Type") != "" {
+		cw.writeHeader()
+	}
+}
+
+func (cw *compressResponseWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		if cw.Header().Get("Content-Type") == "" {
+			cw.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		cw.writeHeader()
+	}
+
+	if cw.compressor != nil {
+		return cw.compressor.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+func (cw *compressResponseWriter) Flush() {
+	if !cw.wroteHeader {
+		return
+	}
+	if flusher, ok := cw.compressor.(interface{ Flush() error }); ok {
+		_ = flusher.Flush()
+	}
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Close writes a deferred header and finishes the compressed stream.
+func (cw *compressResponseWriter) Close() error {
+	if !cw.wroteHeader && cw.status != 0 {
+		cw.writeHeader()
+	}
+	if cw.compressor != nil {
+		return cw.compressor.Close()
+	}
+	return nil
+}
+
+func (cw *compressResponseWriter) writeHeader() {
+	cw.wroteHeader = true
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+
+	if cw.shouldCompress() {
+		cw.Header().Set("Content-Encoding", cw.encoding)
+		cw.Header().Del("Content-Length")
+		if cw.encoding == "br" {
+			cw.compressor = brotli.NewWriter(cw.ResponseWriter)
+		} else {
+			cw.compressor = gzip.NewWriter(cw.ResponseWriter)
+		}
+	}
+
+	cw.ResponseWriter.WriteHeader(cw.status)
+}
+
+func (cw *compressResponseWriter) shouldCompress() bool {
+	// Partial, empty and already encoded responses are left alone
+	if cw.status == http.StatusPartialContent || cw.status == http.StatusNoContent || cw.status == http.StatusNotModified {
+		return false
+	}
+	if cw.Header().Get("Content-Encoding") != "" || cw.Header().Get("Content-Range") != "" {
+		return false
+	}
+
+	contentType := strings.ToLower(cw.Header().Get("Content-Type"))
+	for _, compressible := range compressibleTypes {
+		if strings.HasPrefix(contentType, compressible) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,36 @@
+package api
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/arkami8/image-gem/config"
+
+	"golang.org/x/time/rate"
+)
+
+var (
+	crawlerLimiterOnce sync.Once
+	crawlerLimiter     *rate.Limiter
+)
+
+// crawlerHandler answers requests from crawlers with 429 Too Many Requests when they exceed
+// config.CrawlerRequestsPerSecond together, so that bots can't take up the capacity for processing images.
+func crawlerHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if config.CrawlerRequestsPerSecond > 0 && config.IsCrawler(r.UserAgent()) {
+			crawlerLimiterOnce.Do(func() {
+				crawlerLimiter = rate.NewLimiter(rate.Limit(config.CrawlerRequestsPerSecond), config.CrawlerBurst)
+			})
+			if !crawlerLimiter.Allow() {
+				retryAfter := math.Ceil(1 / config.CrawlerRequestsPerSecond)
+				w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter)))
+				http.Error(w, "Too many requests from crawlers", http.StatusTooManyRequests)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
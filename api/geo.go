@@ -0,0 +1,54 @@
+package api
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/arkami8/image-gem/config"
+	"github.com/arkami8/image-gem/geo"
+
+	"golang.org/x/time/rate"
+)
+
+// countryLimiters holds a *rate.Limiter per throttled country, shared by all of its clients.
+var countryLimiters sync.Map
+
+// geoHandler looks up the country of the client and stores it in the request context for the metrics, the
+// audit log and per-domain rules. Requests from BlockedCountries are refused with 451 Unavailable For Legal
+// Reasons and those over the limit of their country in CountryRequestsPerSecond with 429 Too Many Requests.
+func geoHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !geo.Enabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ip := r.RemoteAddr
+		if host, _, err := net.SplitHostPort(ip); err == nil {
+			ip = host
+		}
+		country := geo.Country(ip)
+
+		if config.CountryBlocked(country, "") {
+			http.Error(w, "Not available in your country", http.StatusUnavailableForLegalReasons)
+			return
+		}
+		if limit, ok := config.CountryRequestsPerSecond[country]; ok && !countryLimiter(country, limit).Allow() {
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(geo.NewContext(r.Context(), country)))
+	})
+}
+
+func countryLimiter(country string, limit float64) *rate.Limiter {
+	if limiter, ok := countryLimiters.Load(country); ok {
+		return limiter.(*rate.Limiter)
+	}
+	burst := int(math.Max(1, math.Ceil(limit)))
+	limiter, _ := countryLimiters.LoadOrStore(country, rate.NewLimiter(rate.Limit(limit), burst))
+	return limiter.(*rate.Limiter)
+}
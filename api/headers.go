@@ -0,0 +1,52 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/arkami8/image-gem/config"
+)
+
+// headersHandler sets the configured ResponseHeaders on every response when its header is written, so they
+// replace the values set by the handlers.
+func headersHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&headersResponseWriter{ResponseWriter: w}, r)
+	})
+}
+
+type headersResponseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (hw *headersResponseWriter) WriteHeader(status int) {
+	if !hw.wroteHeader {
+		hw.wroteHeader = true
+		header := hw.Header()
+		for name, value := range config.ResponseHeaders {
+			if value == "" {
+				header.Del(name)
+			} else {
+				header.Set(name, value)
+			}
+		}
+	}
+	hw.ResponseWriter.WriteHeader(status)
+}
+
+func (hw *headersResponseWriter) Write(p []byte) (int, error) {
+	if !hw.wroteHeader {
+		hw.WriteHeader(http.StatusOK)
+	}
+	return hw.ResponseWriter.Write(p)
+}
+
+// Flush writes the header if needed and flushes the underlying writer, for streamed responses.
+func (hw *headersResponseWriter) Flush() {
+	if !hw.wroteHeader {
+		hw.WriteHeader(http.StatusOK)
+	}
+	if flusher, ok := hw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
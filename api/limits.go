@@ -0,0 +1,48 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/arkami8/image-gem/config"
+)
+
+// limitHandler rejects requests whose URL is longer than config.MaxURLLength or whose query string has more
+// than config.MaxQueryParams parameters or repeats a key more than config.MaxRepeatedParams times, before
+// anything is parsed or fetched.
+func limitHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.RequestURI) > config.MaxURLLength {
+			http.Error(w, fmt.Sprintf("URL must be at most %d bytes", config.MaxURLLength), http.StatusRequestURITooLong)
+			return
+		}
+		if err := checkQuery(r.URL.RawQuery); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkQuery counts the parameters in the raw query string. The keys are compared as they were sent, so
+// "w" and "%77" count as different keys; this is only meant to stop pathological requests.
+func checkQuery(rawQuery string) error {
+	if rawQuery == "" {
+		return nil
+	}
+
+	if strings.Count(rawQuery, "&")+1 > config.MaxQueryParams {
+		return fmt.Errorf("query must have at most %d parameters", config.MaxQueryParams)
+	}
+
+	keys := make(map[string]int)
+	for _, param := range strings.Split(rawQuery, "&") {
+		key, _, _ := strings.Cut(param, "=")
+		keys[key]++
+		if keys[key] > config.MaxRepeatedParams {
+			return fmt.Errorf("parameter %s must be given at most %d times", key, config.MaxRepeatedParams)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package api
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arkami8/image-gem/audit"
+	"github.com/arkami8/image-gem/config"
+	"github.com/arkami8/image-gem/geo"
+	"github.com/arkami8/image-gem/metrics"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	requestsTotal = metrics.NewCounter("image_gem_http_requests_total",
+		"HTTP requests by route, method, status code and client country.", "route", "method", "status", "country")
+	requestDuration = metrics.NewHistogram("image_gem_http_request_duration_seconds",
+		"HTTP request latency by route.", metrics.LatencyBuckets, "route")
+)
+
+// metricsMiddleware records the request count and latency of the matched route.
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		requestsTotal.Inc(route, r.Method, strconv.Itoa(recorder.status), geo.FromContext(r.Context()))
+		requestDuration.Observe(time.Since(start).Seconds(), route)
+	})
+}
+
+// metricsHandler serves /metrics: all the series with MetricsToken, or without a token when it's empty, and
+// only the series of a tenant with the tenant's token.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token != "" {
+		for name, tenant := range config.MetricsTenants {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(tenant.Token)) == 1 {
+				metrics.FilteredHandler("tenant", name).ServeHTTP(w, r)
+				return
+			}
+		}
+	}
+
+	if !metricsAuthorized(r) {
+		audit.Record(r, "metrics.unauthorized", "")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	metrics.Handler().ServeHTTP(w, r)
+}
+
+// metricsAuthorized reports whether the request carries MetricsToken, or none is configured.
+func metricsAuthorized(r *http.Request) bool {
+	if config.MetricsToken == "" {
+		return true
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(config.MetricsToken)) == 1
+}
+
+// statusRecorder remembers the status code written to the response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Flush() {
+	if flusher, ok := sr.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
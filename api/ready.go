@@ -0,0 +1,29 @@
+package api
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// notReady is set while the instance shouldn't take traffic yet, e.g. while the cache is prewarmed.
+var notReady int32
+
+// SetReady sets whether the /ready endpoint reports the instance ready for traffic. Instances are ready
+// unless SetReady(false) is called.
+func SetReady(ready bool) {
+	value := int32(1)
+	if ready {
+		value = 0
+	}
+	atomic.StoreInt32(&notReady, value)
+}
+
+// readyHandler responds with 200 when the instance is ready for traffic and 503 otherwise, for load
+// balancer and orchestrator readiness checks.
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&notReady) != 0 {
+		http.Error(w, "Warming up", http.StatusServiceUnavailable)
+		return
+	}
+	_, _ = w.Write([]byte("OK"))
+}
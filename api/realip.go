@@ -0,0 +1,93 @@
+package api
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/arkami8/image-gem/config"
+)
+
+// realIPHandler replaces the request's RemoteAddr with the client IP when the request comes through a trusted
+// proxy, so that logging and access checks see the client rather than the load balancer. The client is the
+// rightmost address in the Forwarded, X-Forwarded-For or X-Real-IP header that isn't itself a trusted proxy.
+func realIPHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(config.TrustedProxies) > 0 {
+			if ip := clientIP(r); ip != "" {
+				r.RemoteAddr = ip
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIP returns the address of the client behind the trusted proxies, or an empty string if the request
+// didn't come from a trusted proxy.
+func clientIP(r *http.Request) string {
+	remote := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+	if !trustedProxy(remote) {
+		return ""
+	}
+
+	var chain []string
+	if forwarded := r.Header.Values("Forwarded"); len(forwarded) > 0 {
+		chain = parseForwarded(forwarded)
+	} else if forwardedFor := r.Header.Values("X-Forwarded-For"); len(forwardedFor) > 0 {
+		for _, value := range forwardedFor {
+			for _, ip := range strings.Split(value, ",") {
+				chain = append(chain, strings.TrimSpace(ip))
+			}
+		}
+	} else if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+		chain = []string{strings.TrimSpace(realIP)}
+	}
+
+	// Walk back from the proxy that connected to us until an address isn't one of ours
+	for i := len(chain) - 1; i >= 0; i-- {
+		if net.ParseIP(chain[i]) == nil {
+			break
+		}
+		if !trustedProxy(chain[i]) || i == 0 {
+			return chain[i]
+		}
+	}
+	return ""
+}
+
+// parseForwarded returns the for= addresses of RFC 7239 Forwarded headers, without quotes or ports.
+func parseForwarded(values []string) []string {
+	var chain []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, node, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok || !strings.EqualFold(key, "for") {
+					continue
+				}
+				node = strings.Trim(node, `"`)
+				if host, _, err := net.SplitHostPort(node); err == nil {
+					node = host
+				}
+				chain = append(chain, strings.Trim(node, "[]"))
+			}
+		}
+	}
+	return chain
+}
+
+func trustedProxy(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range config.TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
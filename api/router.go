@@ -0,0 +1,82 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	v1 "github.com/arkami8/image-gem/api/v1"
+	"github.com/arkami8/image-gem/config"
+
+	gorillaHandlers "github.com/gorilla/handlers"
+	"github.com/gorilla/mux"
+	"github.com/rs/cors"
+)
+
+// NewRouter registers the image routes and wraps them in the recovery, response header, compression and CORS middleware.
+// The returned handler can be served by a plain http.Server or by one of the serverless adapters.
+func NewRouter() http.Handler {
+	// Create router and register subrouters (subdomains)
+	r := mux.NewRouter()
+	r.Use(metricsMiddleware)
+
+	img := r.PathPrefix("/img").Subrouter()
+	img.Use(requireSignature)
+	img.HandleFunc("/url/{url:.*}", v1.ImageGet).Methods("GET")
+	img.HandleFunc("/enc/{enc}", v1.ImageEncrypted).Methods("GET")
+	img.HandleFunc("/og/{url:.*}", v1.ImageOpenGraph).Methods("GET")
+	img.HandleFunc("/ladder/{url:.*}", v1.ImageLadder).Methods("GET")
+	img.HandleFunc("/iiif/{url:.+}/info.json", v1.IIIFInfo).Methods("GET")
+	img.HandleFunc("/iiif/{url:.+}/{region}/{size}/{rotation}/{quality}.{format}", v1.IIIFImage).Methods("GET")
+
+	r.HandleFunc("/i/{id}", v1.LinkGet).Methods("GET")
+
+	r.HandleFunc("/ready", readyHandler).Methods("GET")
+
+	if config.MetricsEnabled {
+		r.HandleFunc("/metrics", metricsHandler).Methods("GET")
+		r.HandleFunc("/varz", varzHandler).Methods("GET")
+	}
+
+	admin := r.PathPrefix("/admin").Subrouter()
+	admin.Use(requireAdmin)
+	admin.HandleFunc("/watermark/detect", v1.WatermarkDetect).Methods("POST")
+	admin.HandleFunc("/uploads", v1.UploadCreate).Methods("POST")
+	admin.HandleFunc("/links", v1.LinkCreate).Methods("POST")
+	admin.HandleFunc("/usage", v1.UsageList).Methods("GET")
+	admin.HandleFunc("/dedup", v1.DedupLookup).Methods("GET")
+	admin.HandleFunc("/dedup/{hash}", v1.DedupLookup).Methods("GET")
+	admin.HandleFunc("/cache", v1.CacheList).Methods("GET")
+	admin.HandleFunc("/cache", v1.CacheEvict).Methods("DELETE")
+	admin.HandleFunc("/cache/{id}", v1.CacheInfo).Methods("GET")
+	admin.HandleFunc("/cache/{id}", v1.CacheEvict).Methods("DELETE")
+	admin.HandleFunc("/selftest", v1.SelfTest).Methods("GET")
+
+	// Add middleware handlers
+	recoveryHandler := gorillaHandlers.RecoveryHandler(gorillaHandlers.PrintRecoveryStack(true))(r)
+	compressedHandler := compressHandler(headersHandler(recoveryHandler))
+	return botHandler(realIPHandler(geoHandler(limitHandler(crawlerHandler(corsHandler(compressedHandler))))))
+}
+
+// corsHandler applies the CORS configuration of the admin routes to them and the one of the other routes to
+// the rest, answering preflight requests before they reach the router.
+func corsHandler(next http.Handler) http.Handler {
+	public := newCORS(config.CORS).Handler(next)
+	admin := newCORS(config.AdminCORS).Handler(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/admin" || strings.HasPrefix(r.URL.Path, "/admin/") {
+			admin.ServeHTTP(w, r)
+			return
+		}
+		public.ServeHTTP(w, r)
+	})
+}
+
+func newCORS(policy config.CORSPolicy) *cors.Cors {
+	return cors.New(cors.Options{
+		AllowedOrigins:   policy.AllowedOrigins,
+		AllowedMethods:   policy.AllowedMethods,
+		AllowedHeaders:   policy.AllowedHeaders,
+		AllowCredentials: policy.AllowCredentials,
+		MaxAge:           policy.MaxAgeSeconds,
+	})
+}
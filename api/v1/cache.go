@@ -0,0 +1,104 @@
+package v1
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/arkami8/image-gem/audit"
+	"github.com/arkami8/image-gem/cache"
+
+	"github.com/gorilla/mux"
+)
+
+// defaultCacheListLimit is the number of entries CacheList responds with when no limit is given.
+const defaultCacheListLimit = 1000
+
+// CacheList is an HTTP handler that responds with the metadata of the cached images as JSON, filtered by
+// the "prefix" of their source URL and their "tenant" (source host) query parameters and limited to "limit"
+// entries. Only the entries this instance has stored, served or found on disk are listed.
+func CacheList(w http.ResponseWriter, r *http.Request) {
+	if !cache.Enabled() {
+		http.Error(w, "Cache is not configured", http.StatusNotImplemented)
+		return
+	}
+
+	limit := defaultCacheListLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	entries := cache.List(r.URL.Query().Get("prefix"), r.URL.Query().Get("tenant"))
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	if entries == nil {
+		entries = []cache.Metadata{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(entries)
+}
+
+// CacheInfo is an HTTP handler that responds with the metadata of the cached image with the "id" mux path
+// variable as JSON.
+func CacheInfo(w http.ResponseWriter, r *http.Request) {
+	if !cache.Enabled() {
+		http.Error(w, "Cache is not configured", http.StatusNotImplemented)
+		return
+	}
+
+	meta, ok := cache.Info(mux.Vars(r)["id"])
+	if !ok {
+		http.Error(w, "Unknown cache entry", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(meta)
+}
+
+// CacheEvict is an HTTP handler that evicts the cached image with the "id" mux path variable or, without
+// one, the images matching the "prefix" and "tenant" query parameters, at least one of which is required.
+// It responds with the number of evicted entries as JSON.
+func CacheEvict(w http.ResponseWriter, r *http.Request) {
+	if !cache.Enabled() {
+		http.Error(w, "Cache is not configured", http.StatusNotImplemented)
+		return
+	}
+
+	var ids []string
+	if id := mux.Vars(r)["id"]; id != "" {
+		ids = []string{id}
+		audit.Record(r, "cache.evict", id)
+	} else {
+		prefix, tenant := r.URL.Query().Get("prefix"), r.URL.Query().Get("tenant")
+		if prefix == "" && tenant == "" {
+			http.Error(w, "prefix or tenant is required", http.StatusBadRequest)
+			return
+		}
+		for _, meta := range cache.List(prefix, tenant) {
+			ids = append(ids, meta.ID)
+		}
+		audit.Record(r, "cache.evict", "prefix="+prefix+" tenant="+tenant)
+	}
+
+	evicted := 0
+	for _, id := range ids {
+		if err := cache.Evict(id); err == cache.ErrInvalidID {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		evicted++
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]int{"evicted": evicted})
+}
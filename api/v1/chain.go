@@ -0,0 +1,97 @@
+package v1
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/arkami8/image-gem/config"
+	"github.com/arkami8/image-gem/pipeline"
+	"github.com/arkami8/image-gem/signature"
+)
+
+const (
+	// maxChainDepth limits how many image-gem URLs can be nested in each other.
+	maxChainDepth = 8
+	// chainPrefix is the path of the image URLs that are collapsed when used as sources.
+	chainPrefix = "/img/url/"
+)
+
+// chainedStage is the transformation of an image-gem URL used as the source of another one.
+type chainedStage struct {
+	query url.Values
+	opts  *pipeline.Options
+}
+
+// unchainSource returns the source of targetUrl and the transformations of the image-gem URLs it is nested
+// in, innermost first, when targetUrl points back at this server. The stages are applied in-process instead
+// of requesting the URLs from ourselves, which would tie up a request per URL and encode the image each time.
+// Stages that need external services or change the response can't be collapsed and are rejected.
+func unchainSource(r *http.Request, targetUrl *url.URL) (*url.URL, []chainedStage, error) {
+	var stages []chainedStage
+	for isSelfURL(r, targetUrl) {
+		if len(stages) == maxChainDepth {
+			return nil, nil, fmt.Errorf("more than %d chained image-gem URLs", maxChainDepth)
+		}
+
+		query := targetUrl.Query()
+		query.Del(signature.ParamSignature)
+		query.Del(signature.ParamExpires)
+		query.Del(signature.ParamNonce)
+		query.Del(priorityParam)
+		opts, err := parseQueryOptions(query)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid parameters in chained URL %s: %v", targetUrl.Redacted(), err)
+		}
+		if option := unchainableOption(query, opts); option != "" {
+			return nil, nil, fmt.Errorf("chained image-gem URLs can't use %s (input: %s)", option, targetUrl.Redacted())
+		}
+		opts.MaxUpscale = config.MaxUpscaleFactor
+
+		source, err := normalizeURL(strings.TrimPrefix(targetUrl.Path, chainPrefix))
+		if err != nil {
+			return nil, nil, err
+		}
+		stages = append([]chainedStage{{query: query, opts: opts}}, stages...)
+		targetUrl = source
+	}
+	return targetUrl, stages, nil
+}
+
+// unchainableOption returns the first option of a chained URL that stages don't apply, as only the outermost
+// request calls external services, embeds watermarks and negotiates the output, or "" if there is none.
+func unchainableOption(query url.Values, opts *pipeline.Options) string {
+	switch {
+	case opts.RemoveBackground:
+		return "bg=remove"
+	case opts.AIUpscale:
+		return "up=ai"
+	case opts.Watermark != "":
+		return "wm"
+	case opts.Overlay != "":
+		return "overlay"
+	case opts.Envelope:
+		return "out=json"
+	case query.Get("webp") != "":
+		return "webp"
+	}
+	return ""
+}
+
+// isSelfURL reports whether the URL is an image URL of this server, reached at the request's host or one
+// of config.SelfHosts.
+func isSelfURL(r *http.Request, u *url.URL) bool {
+	if !strings.HasPrefix(u.Path, chainPrefix) {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, host := range config.SelfHosts {
+		if strings.EqualFold(u.Hostname(), host) {
+			return true
+		}
+	}
+	return false
+}
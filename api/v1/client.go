@@ -0,0 +1,50 @@
+package v1
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/arkami8/image-gem/config"
+)
+
+// transports holds an http.Transport per origin TLS configuration so connections to mutual TLS origins are reused.
+var transports sync.Map
+
+// originClient returns the HTTP client for fetching from the host. Requests wait for the per-origin rate
+// and concurrency limits. Hosts configured for mutual TLS get a client that presents their client certificate
+// and refuses redirects to hosts that don't share the configuration.
+func originClient(host string) *http.Client {
+	tlsConfig := config.TLSConfigForHost(host)
+	if tlsConfig == nil {
+		return &http.Client{Transport: limitTransport(http.DefaultTransport)}
+	}
+
+	transport, ok := transports.Load(tlsConfig)
+	if !ok {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = tlsConfig
+		transport, _ = transports.LoadOrStore(tlsConfig, t)
+	}
+
+	return &http.Client{
+		Transport: limitTransport(transport.(*http.Transport)),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return fmt.Errorf("stopped after 10 redirects")
+			}
+			if config.TLSConfigForHost(req.URL.Hostname()) != tlsConfig {
+				return fmt.Errorf("redirect to %s leaves the mutual TLS origin", req.URL.Hostname())
+			}
+			return nil
+		},
+	}
+}
+
+// limitTransport wraps the transport with the per-origin limits, if any are configured.
+func limitTransport(transport http.RoundTripper) http.RoundTripper {
+	if config.OriginRequestsPerSecond <= 0 && config.OriginMaxConcurrent <= 0 {
+		return transport
+	}
+	return &limitedTransport{base: transport}
+}
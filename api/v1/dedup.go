@@ -0,0 +1,42 @@
+package v1
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/arkami8/image-gem/audit"
+	"github.com/arkami8/image-gem/dedup"
+
+	"github.com/gorilla/mux"
+)
+
+// DedupLookup is an HTTP handler that responds with a stored source image's hash, content type, size and the
+// URLs known to serve it as JSON. The source is identified by the "hash" mux path variable, or by a source
+// URL in the "url" query parameter.
+func DedupLookup(w http.ResponseWriter, r *http.Request) {
+	if !dedup.Enabled() {
+		http.Error(w, "Deduplication store is not configured", http.StatusNotImplemented)
+		return
+	}
+
+	hash := mux.Vars(r)["hash"]
+	if hash == "" {
+		targetUrl, err := normalizeURL(r.URL.Query().Get("url"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		hash, _ = dedup.HashForURL(targetUrl.String())
+	}
+
+	audit.Record(r, "dedup.lookup", hash)
+
+	info, ok := dedup.Info(hash)
+	if !ok {
+		http.Error(w, "Unknown source", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(info)
+}
@@ -0,0 +1,149 @@
+package v1
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/arkami8/image-gem/config"
+	"github.com/arkami8/image-gem/geo"
+	"github.com/arkami8/image-gem/pipeline"
+
+	"github.com/davidbyttow/govips/v2/vips"
+	"github.com/gorilla/mux"
+)
+
+// iiifTile is a tile size offered in info.json with the scale factors it is available at.
+type iiifTile struct {
+	Width        int   `json:"width"`
+	ScaleFactors []int `json:"scaleFactors"`
+}
+
+// iiifInfo is the info.json of a IIIF Image API 3.0 image service.
+type iiifInfo struct {
+	Context      string     `json:"@context"`
+	ID           string     `json:"id"`
+	Type         string     `json:"type"`
+	Protocol     string     `json:"protocol"`
+	Profile      string     `json:"profile"`
+	Width        int        `json:"width"`
+	Height       int        `json:"height"`
+	Tiles        []iiifTile `json:"tiles"`
+	ExtraFormats []string   `json:"extraFormats"`
+	ExtraQuality []string   `json:"extraQualities"`
+}
+
+// IIIFInfo is an HTTP handler that responds with the IIIF Image API info.json of the image in the "url" mux
+// path variable, so deep zoom viewers like OpenSeadragon can request its tiles from IIIFImage.
+func IIIFInfo(w http.ResponseWriter, r *http.Request) {
+	img, ok := loadIIIFSource(w, r)
+	if !ok {
+		return
+	}
+	defer img.Close()
+
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	info := iiifInfo{
+		Context:      "http://iiif.io/api/image/3/context.json",
+		ID:           scheme + "://" + r.Host + strings.TrimSuffix(r.URL.EscapedPath(), "/info.json"),
+		Type:         "ImageService3",
+		Protocol:     "http://iiif.io/api/image",
+		Profile:      "level1",
+		Width:        img.Width(),
+		Height:       img.PageHeight(),
+		Tiles:        []iiifTile{{Width: config.IIIFTileSize, ScaleFactors: pipeline.IIIFScaleFactors(img.Width(), img.PageHeight(), config.IIIFTileSize)}},
+		ExtraFormats: pipeline.IIIFFormats,
+		ExtraQuality: []string{"color", "gray"},
+	}
+
+	w.Header().Set("Content-Type", `application/ld+json;profile="http://iiif.io/api/image/3/context.json"`)
+	_ = json.NewEncoder(w).Encode(info)
+}
+
+// IIIFImage is an HTTP handler that serves a region of the image in the "url" mux path variable according to
+// the IIIF Image API "region", "size", "rotation", "quality" and "format" mux path variables. Tiles are served
+// like ServeImage serves images, with the domain defaults, policy, moderation and cache of the source.
+func IIIFImage(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	req, err := pipeline.ParseIIIF(vars["region"], vars["size"], vars["rotation"], vars["quality"], vars["format"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	serveImage(w, r, vars["url"], req)
+}
+
+// loadIIIFSource fetches and decodes the image in the "url" mux path variable and applies the domain defaults
+// of its source, so its size is the one IIIFImage takes regions of. It responds with an error and returns
+// false when it can't.
+func loadIIIFSource(w http.ResponseWriter, r *http.Request) (*vips.ImageRef, bool) {
+	targetUrl, err := normalizeURL(mux.Vars(r)["url"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+
+	if config.CountryBlocked(geo.FromContext(r.Context()), targetUrl.Hostname()) {
+		http.Error(w, "Not available in your country", http.StatusUnavailableForLegalReasons)
+		return nil, false
+	}
+	if err := checkRestrictions(&pipeline.Options{IIIF: &pipeline.IIIFRequest{}}, targetUrl.Hostname()); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return nil, false
+	}
+	priority, err := requestPriority(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+
+	var defaultOpts *pipeline.Options
+	if defaults := config.DefaultsForHost(targetUrl.Hostname()); defaults != nil {
+		defaultOpts, err = pipeline.ParseOptions(defaults)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid default parameters for %s: %v", targetUrl.Hostname(), err), http.StatusInternalServerError)
+			return nil, false
+		}
+		defaultOpts.MaxUpscale = config.MaxUpscaleFactor
+	}
+
+	source, status, err := fetchSource(r.Context(), targetUrl)
+	if err != nil {
+		if !clientGone(w, r) {
+			http.Error(w, err.Error(), status)
+		}
+		return nil, false
+	}
+	defer source.Close()
+
+	release, err := queue.acquire(r.Context(), priority)
+	if err != nil {
+		// The client is gone
+		return nil, false
+	}
+	defer release()
+	processing.Add(1)
+	defer processing.Add(-1)
+
+	img, err := pipeline.Load(source)
+	if err != nil {
+		if !clientGone(w, r) {
+			http.Error(w, loadError(err), http.StatusBadRequest)
+		}
+		return nil, false
+	}
+	if defaultOpts != nil {
+		transformed, err := pipeline.Transform(img, defaultOpts)
+		if err != nil {
+			img.Close()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return nil, false
+		}
+		img = transformed
+	}
+	return img, true
+}
@@ -1,12 +1,28 @@
+// Package v1 serves transformed images fetched from remote URLs. ImageGet can be registered directly on a
+// gorilla/mux router with a {url} path variable; other routers can call ServeImage with the source URL.
 package v1
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/arkami8/image-gem/cache"
+	"github.com/arkami8/image-gem/config"
+	"github.com/arkami8/image-gem/dedup"
+	"github.com/arkami8/image-gem/geo"
+	"github.com/arkami8/image-gem/pipeline"
+	"github.com/arkami8/image-gem/signature"
 
 	"github.com/davidbyttow/govips/v2/vips"
 	"github.com/gorilla/mux"
@@ -15,12 +31,6 @@ import (
 const (
 	// maxImageSize is the maximum allowed image size in bytes.
 	maxImageSize = 5 * 1024 * 1024 // 5MB
-
-	// maxImageHeight is the maximum allowed image height in pixels.
-	maxImageHeight = 20000
-
-	// maxImageHeight is the maximum allowed image width in pixels.
-	maxImageWidth = 20000
 )
 
 // countingReader is a struct that wraps an io.Reader and counts the number of bytes read,
@@ -44,420 +54,1009 @@ func (cr *countingReader) Read(p []byte) (int, error) {
 
 // ImageGet is an HTTP handler function for processing and transforming images based on URL query parameters.
 // It supports image resizing, rotation, blurring, sharpening, and format conversion, as well as stripping metadata.
+// Processed images are first rotated upright as their EXIF orientation says, unless orient=false.
+// The source URL is read from the "url" mux path variable.
 func ImageGet(w http.ResponseWriter, r *http.Request) {
 	slugs := mux.Vars(r)
-	targetUrl, err := normalizeURL(slugs["url"])
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	ServeImage(w, r, slugs["url"])
+}
+
+// ImageEncrypted is ImageGet for source URLs encrypted with signature.EncryptURL, read from the "enc" mux
+// path variable. It responds with 404 when no SourceURLKey is configured.
+func ImageEncrypted(w http.ResponseWriter, r *http.Request) {
+	if config.SourceURLKey == nil {
+		http.NotFound(w, r)
 		return
 	}
 
-	height, width, err := parseDimensions(r)
+	sourceURL, err := signature.DecryptURL(config.SourceURLKey, mux.Vars(r)["enc"])
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	ServeImage(w, r, sourceURL)
+}
 
-	rotation, err := parseRotation(r)
+// ServeImage fetches the image at sourceURL, transforms it according to the request's query parameters
+// and writes the result to w. The scheme of sourceURL defaults to https when it is missing.
+// Default transformations configured for the source domain are applied before the request's own parameters.
+func ServeImage(w http.ResponseWriter, r *http.Request, sourceURL string) {
+	serveImage(w, r, sourceURL, nil)
+}
+
+// serveImage is ServeImage, applying the IIIF request, if any, before the request's own parameters and
+// encoding the image in its format.
+func serveImage(w http.ResponseWriter, r *http.Request, sourceURL string, iiif *pipeline.IIIFRequest) {
+	w, echo := echoPolicy(w, r)
+	targetUrl, err := normalizeURL(sourceURL)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	quality, err := parseQuality(r)
+	// Image URLs of this server used as sources are collapsed into transformation stages
+	targetUrl, stages, err := unchainSource(r, targetUrl)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	targetFormat, err := parseImageFormat(r)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	echo.add("host", targetUrl.Hostname())
+	if len(stages) > 0 {
+		echo.add("chain", strconv.Itoa(len(stages)))
+	}
+	if config.CountryBlocked(geo.FromContext(r.Context()), targetUrl.Hostname()) {
+		http.Error(w, "Not available in your country", http.StatusUnavailableForLegalReasons)
 		return
 	}
+	if country := geo.FromContext(r.Context()); country != "" {
+		echo.add("country", country)
+	}
 
-	sharpenAmount, err := parseSharpen(r)
+	opts, err := parseOptions(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	blurAmount, err := parseBlur(r)
+	priority, err := requestPriority(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	echo.add("priority", priority)
+	if err := checkRestrictions(opts, targetUrl.Hostname()); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	for _, stage := range stages {
+		if err := checkRestrictions(stage.opts, targetUrl.Hostname()); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	if config.RestrictionsForHost(targetUrl.Hostname()) != nil {
+		echo.add("restrictions", "domain")
+	}
+	request := newImageRequest(opts.Operations(), targetUrl.Hostname())
 
-	upscale := r.URL.Query().Get("up") == "true"
-	stripMetadata := r.URL.Query().Get("strip") == "true"
+	// The domain defaults fill in the parameters the request doesn't give, so the image is transformed once.
+	// IIIF regions are in the coordinates of the image with the defaults applied, as its info.json describes,
+	// so for IIIF requests the defaults are applied first instead.
+	defaults := config.DefaultsForHost(targetUrl.Hostname())
+	var defaultOpts *pipeline.Options
+	if defaults != nil {
+		if iiif != nil {
+			defaultOpts, err = pipeline.ParseOptions(defaults)
+			if err == nil {
+				defaultOpts.MaxUpscale = config.MaxUpscaleFactor
+			}
+		} else {
+			opts, err = parseQueryOptions(pipeline.MergeParams(r.URL.Query(), defaults, defaultOverrides(defaults)...))
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid default parameters for %s: %v", targetUrl.Hostname(), err), http.StatusInternalServerError)
+			return
+		}
+		echo.add("defaults", "domain")
+	}
+	opts.MaxUpscale = config.MaxUpscaleFactor
+	if iiif != nil {
+		opts.IIIF = iiif
+		opts.Format, opts.AutoFormat = iiif.Format, false
+	}
 
-	convertToWebP := convertImageToWebP(r)
+	var policy *pipeline.Policy
+	if script := config.PolicyForHost(targetUrl.Hostname()); script != "" {
+		policy, err = pipeline.CompilePolicy(script)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid policy for %s: %v", targetUrl.Hostname(), err), http.StatusInternalServerError)
+			return
+		}
+		echo.add("policy", "domain")
+	}
 
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", targetUrl, nil)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	// Request parameters take precedence over the domain defaults applied first for the output encoding
+	targetFormat := opts.Format
+	autoFormat := opts.AutoFormat || (opts.Format == vips.ImageTypeUnknown && defaultOpts != nil && defaultOpts.AutoFormat)
+	quality := opts.Quality
+	colors, dither := opts.Colors, opts.Dither
+	if defaultOpts != nil {
+		if targetFormat == vips.ImageTypeUnknown {
+			targetFormat = defaultOpts.Format
+		}
+		if quality == 0 {
+			quality = defaultOpts.Quality
+		}
+		if colors == 0 {
+			colors = defaultOpts.Colors
+		}
+		if dither == nil {
+			dither = defaultOpts.Dither
+		}
+	}
+	// The chained URLs would have encoded the image as they ask, the outermost one last
+	for i := len(stages) - 1; i >= 0; i-- {
+		if targetFormat == vips.ImageTypeUnknown && !autoFormat {
+			targetFormat = stages[i].opts.Format
+			autoFormat = stages[i].opts.AutoFormat
+		}
+		if quality == 0 {
+			quality = stages[i].opts.Quality
+		}
+	}
+	if quality == 0 && servesCrawler(r) {
+		quality = config.CrawlerQuality
+		echo.add("clamp", "crawler-quality")
 	}
 
-	req.Header.Set("User-Agent", "image-gem/v1.0")
-	resp, err := client.Do(req)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	if opts.RemoveBackground {
+		if config.BackgroundRemoverURL == "" {
+			http.Error(w, "Background removal is not configured", http.StatusNotImplemented)
+			return
+		}
+
+		// Keep the transparency unless a format was asked for explicitly
+		if targetFormat == vips.ImageTypeUnknown && !autoFormat {
+			targetFormat = vips.ImageTypePNG
+		}
 	}
-	defer resp.Body.Close()
 
-	// Check for HTTP status code
-	if resp.StatusCode != http.StatusOK {
-		http.Error(w, fmt.Sprintf("Received a %d status code from the server", resp.StatusCode), resp.StatusCode)
+	// A watermark from the domain defaults can't be replaced by the request
+	watermark := opts.Watermark
+	if defaultOpts != nil && defaultOpts.Watermark != "" {
+		watermark = defaultOpts.Watermark
+	}
+	if watermark != "" && config.WatermarkKey == "" {
+		http.Error(w, "Watermarking is not configured", http.StatusNotImplemented)
 		return
 	}
 
-	// Check for the content type
-	contentType := resp.Header.Get("Content-Type")
-	if !isSupportedImageFormat(contentType) {
-		http.Error(w, "Unsupported image format", http.StatusBadRequest)
+	// Captions with placeholders are marked for their viewer, so like watermarked images they aren't shared
+	captioned := []*pipeline.Options{opts, defaultOpts}
+	for _, stage := range stages {
+		captioned = append(captioned, stage.opts)
+	}
+	personalized, err := expandCaptions(r, captioned)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
 		return
 	}
+	if personalized {
+		w.Header().Set("Cache-Control", "private")
+	}
 
-	// Limit the size of the input image
-	countingReader := &countingReader{reader: resp.Body, maxImageSize: maxImageSize}
+	// An overlay from the domain defaults can't be replaced by the request either, e.g. the visible watermark
+	// of licensed photos
+	overlayOpts := opts
+	if defaultOpts != nil && defaultOpts.Overlay != "" {
+		overlayOpts = defaultOpts
+	}
+
+	convertToWebP := convertImageToWebP(r)
+	if autoFormat || convertToWebP {
+		w.Header().Add("Vary", "Accept")
+	}
 
 	// Check if there are any query parameters
-	hasQueryParams := len(r.URL.RawQuery) > 0
+	hasQueryParams := len(imageQuery(r)) > 0 || iiif != nil
+	processed := hasQueryParams || len(stages) > 0 || defaults != nil || policy != nil || config.ModerationURL != ""
+
+	// Processed images are served from the cache without fetching the source, except for watermarked ones
+	// which embed the time. In a cluster, they are served and cached by the peer owning their key.
+	var cacheKey string
+	if processed && watermark == "" && !personalized {
+		key := targetUrl.String() + "\n" + outputKey(r, targetUrl, stages, iiif, convertToWebP, autoFormat)
+		if peer := peerFor(r, key); peer != "" {
+			echo.add("peer", peer)
+			if proxyToPeer(w, r, peer) {
+				return
+			}
+		}
+		if cache.Enabled() {
+			cacheKey = key
+		}
+	}
+	if cacheKey != "" {
+		if data, meta, ok := cache.Get(cacheKey); ok {
+			echo.add("cache", "hit")
+			setHeaders(w, meta.Headers)
+			format := formatLabel(vips.DetermineImageType(data))
+			if opts.Envelope {
+				writeEnvelope(w, data, format)
+			} else {
+				_, _ = w.Write(data)
+			}
+			request.observe(format, cacheHit, int64(len(data)))
+			return
+		}
+	}
+
+	// Without domain defaults applied first, policies or external services the output size is known before
+	// fetching, so large sources can be fetched and decoded at a reduced size
+	var loadWidth, loadHeight int
+	var loadUpright bool
+	if defaultOpts == nil && policy == nil && len(stages) == 0 && !opts.RemoveBackground {
+		loadWidth, loadHeight, loadUpright = pipeline.ShrinkTarget(opts)
+	}
+
+	source, status, err := fetchSourceSized(r.Context(), targetUrl, loadWidth, loadHeight)
+	if err != nil {
+		if clientGone(w, r) {
+			return
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	defer source.Close()
+	contentType := source.contentType
+	setHeaders(w, source.headers)
 
-	// If there are no query parameters, write the original image data directly to the response and return
+	// If there are no query parameters, domain defaults or policies, write the original image data directly to the response and return
+	// Images always go through the pipeline when moderation is enabled so that they can be checked
 	// If the content type is SVG, write it directly to the response and return. SVGs should be handled in HTML or CSS, not here
-	if !hasQueryParams || contentType == "image/svg+xml" {
+	if !processed || contentType == "image/svg+xml" {
+		if contentType == "image/svg+xml" && config.SanitizeSVG {
+			data, err := io.ReadAll(source)
+			if err != nil {
+				http.Error(w, "Failed to process image", http.StatusInternalServerError)
+				return
+			}
+			data, err = pipeline.SanitizeSVG(data)
+			if err != nil {
+				http.Error(w, "Invalid SVG", http.StatusBadRequest)
+				return
+			}
+			source.Reader = bytes.NewReader(data)
+			w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; img-src data:")
+		}
+
+		// SVGs are rasterized to be checked by moderation, and blocked when flagged as they aren't blurred
+		if contentType == "image/svg+xml" && config.ModerationURL != "" {
+			data, err := io.ReadAll(source)
+			if err != nil {
+				http.Error(w, "Failed to process image", http.StatusInternalServerError)
+				return
+			}
+			if status, err := moderateSVG(r, data); err != nil {
+				http.Error(w, err.Error(), status)
+				return
+			}
+			source.Reader = bytes.NewReader(data)
+		}
+
+		if opts.Envelope {
+			data, err := io.ReadAll(source)
+			if err != nil {
+				http.Error(w, "Failed to process image", http.StatusInternalServerError)
+				return
+			}
+			writeEnvelope(w, data, strings.TrimPrefix(contentType, "image/"))
+			request.observe(strings.TrimPrefix(contentType, "image/"), cachePassthrough, int64(len(data)))
+			return
+		}
+
 		w.Header().Set("Content-Type", contentType)
-		_, err := io.Copy(w, countingReader)
+		w.Header().Set("Accept-Ranges", "bytes")
+
+		// Range requests are answered from the buffered image with a 206 response
+		if r.Header.Get("Range") != "" {
+			data, err := io.ReadAll(source)
+			if err != nil {
+				http.Error(w, "Failed to process image", http.StatusInternalServerError)
+				return
+			}
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+			request.observe(strings.TrimPrefix(contentType, "image/"), cachePassthrough, int64(len(data)))
+			return
+		}
+
+		n, err := io.Copy(w, source)
 		if err != nil {
+			if clientGone(w, r) {
+				return
+			}
 			http.Error(w, "Failed to process image", http.StatusInternalServerError)
 			return
 		}
+		request.observe(strings.TrimPrefix(contentType, "image/"), cachePassthrough, n)
 		return
 	}
 
-	var img *vips.ImageRef
-	if contentType == "image/gif" {
-		data, err := io.ReadAll(countingReader)
-		if err != nil {
-			http.Error(w, "Failed to decode image", http.StatusBadRequest)
+	// Identical sources share their processed outputs, except for watermarked ones which embed the time
+	var key string
+	if source.hash != "" && watermark == "" && !personalized {
+		key = outputKey(r, targetUrl, stages, iiif, convertToWebP, autoFormat)
+		if data, ok := dedup.Output(source.hash, key); ok {
+			echo.add("dedup", "hit")
+			format := formatLabel(vips.DetermineImageType(data))
+			if opts.Envelope {
+				writeEnvelope(w, data, format)
+			} else {
+				_, _ = w.Write(data)
+			}
+			request.observe(format, cacheHit, int64(len(data)))
+			return
+		}
+	}
+
+	release, err := queue.acquire(r.Context(), priority)
+	if err != nil {
+		// The client is gone
+		return
+	}
+	defer release()
+	processing.Add(1)
+	defer processing.Add(-1)
+
+	img, err := pipeline.LoadSized(source, loadWidth, loadHeight, loadUpright)
+	if err != nil {
+		if clientGone(w, r) {
 			return
 		}
+		http.Error(w, loadError(err), http.StatusBadRequest)
+		return
+	}
+	// The operation cache is trimmed after the image is closed, when its operations can be released
+	defer pipeline.TrimOperationCache(config.VipsCacheClasses[pipeline.OperationCacheClass(img)])
+	// Steps may return a new image, so each one is closed too; closing an image twice is harmless
+	defer img.Close()
 
-		intSet := vips.IntParameter{}
-		intSet.Set(-1)
+	// Animated GIFs keep their format so the frames are preserved, unless format=auto picks another animated format.
+	// IIIF requests get the format of their extension.
+	if img.Format() == vips.ImageTypeGIF && !autoFormat && iiif == nil {
+		targetFormat = vips.ImageTypeGIF
+	}
 
-		params := vips.NewImportParams()
-		params.NumPages = intSet
+	if clientGone(w, r) {
+		return
+	}
 
-		img, err = vips.LoadImageFromBuffer(data, params)
+	if defaultOpts != nil {
+		img, err = pipeline.Transform(img, defaultOpts)
 		if err != nil {
-			http.Error(w, "Failed to decode image", http.StatusBadRequest)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		targetFormat = vips.ImageTypeGIF
-	} else {
-		img, err = vips.NewImageFromReader(countingReader)
+		defer img.Close()
+	}
+
+	for _, stage := range stages {
+		img, err = pipeline.Transform(img, stage.opts)
 		if err != nil {
-			http.Error(w, "Failed to decode image", http.StatusBadRequest)
+			http.Error(w, err.Error(), transformStatus(err))
 			return
 		}
+		defer img.Close()
 	}
-	defer img.Close()
 
-	if rotation != 0 {
-		// Check if the image has an alpha channel and add one if it's missing
-		if !img.HasAlpha() {
-			err := img.BandJoinConst([]float64{255})
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+	if opts.RemoveBackground {
+		if img.Pages() > 1 {
+			http.Error(w, "Background removal is not supported for animated images", http.StatusBadRequest)
+			return
+		}
+
+		remover := &pipeline.RemoteBackgroundRemover{
+			Endpoint: config.BackgroundRemoverURL,
+			Client:   &http.Client{Timeout: time.Duration(config.BackgroundRemoverTimeoutSeconds) * time.Second},
+		}
+		img, err = remover.Remove(r.Context(), img)
+		if err != nil {
+			if clientGone(w, r) {
 				return
 			}
+			http.Error(w, fmt.Sprintf("Failed to remove background: %v", err), http.StatusBadGateway)
+			return
 		}
+		defer img.Close()
+	}
+
+	if opts.AIUpscale && img.Pages() == 1 {
+		img = upscaleWithAI(r, img, opts)
+		defer img.Close()
+	}
+
+	if clientGone(w, r) {
+		return
+	}
+
+	img, err = pipeline.Transform(img, opts)
+	if err != nil {
+		http.Error(w, err.Error(), transformStatus(err))
+		return
+	}
+	defer img.Close()
 
-		// Rotate the image
-		err := img.Similarity(1.0, float64(rotation), &vips.ColorRGBA{R: 0, G: 0, B: 0, A: 0}, 0, 0, 0, 0)
+	if policy != nil {
+		var policyFormat vips.ImageType
+		var policyQuality int
+		img, policyFormat, policyQuality, err = policy.Apply(img, targetFormat)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		defer img.Close()
+		if policyFormat != vips.ImageTypeUnknown {
+			targetFormat = policyFormat
+		}
+		if policyQuality != 0 {
+			quality = policyQuality
+		}
 	}
 
-	if blurAmount > 0 {
-		if err := img.GaussianBlur(blurAmount); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+	if config.ModerationURL != "" {
+		if status, err := moderateImage(r, img); err != nil {
+			http.Error(w, err.Error(), status)
 			return
 		}
 	}
 
-	if height > 0 || width > 0 {
-		img, err = resizeImage(img, width, height, upscale)
+	if overlayOpts.Overlay != "" {
+		img, err = applyOverlay(r.Context(), img, overlayOpts)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			if clientGone(w, r) {
+				return
+			}
+			http.Error(w, fmt.Sprintf("Failed to apply overlay: %v", err), http.StatusBadGateway)
 			return
 		}
+		defer img.Close()
 	}
 
-	if sharpenAmount > 0 {
-		if err := img.Sharpen(sharpenAmount, 0.6, 1.0); err != nil {
+	if watermark != "" && img.Pages() == 1 {
+		payload := fmt.Sprintf("%s|%d", watermark, time.Now().Unix())
+		img, err = pipeline.EmbedWatermark(img, config.WatermarkKey, payload)
+		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		defer img.Close()
+	}
+
+	// Encoding is where most of the work happens, so it isn't started for clients that have gone away
+	if clientGone(w, r) {
+		return
 	}
 
-	if stripMetadata {
-		err := img.RemoveMetadata()
+	if autoFormat && targetFormat == vips.ImageTypeUnknown {
+		targetFormat = negotiateFormat(r, img)
+	}
+	if convertToWebP {
+		targetFormat = vips.ImageTypeWEBP
+	}
+	if limit, ok := config.FormatMaxDimensions[outputFormat(img, targetFormat)]; ok {
+		width, height := img.Width(), img.PageHeight()
+		img, err = pipeline.FitWithin(img, limit.Width, limit.Height)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		defer img.Close()
+		if img.Width() != width || img.PageHeight() != height {
+			echo.add("clamp", "format-dimensions")
+		}
 	}
-
-	if convertToWebP {
-		targetFormat = vips.ImageTypeWEBP
+	exportOpts := pipeline.ExportOptions{Quality: quality, Colors: colors, Dither: dither}
+	// Degraded images are only cached briefly, so they are replaced once the load is over
+	degraded := overloaded()
+	if degraded {
+		exportOpts, targetFormat = degrade(r, exportOpts, targetFormat, autoFormat)
+		w.Header().Set("Cache-Control", "max-age=60")
+		degradedImages.Inc()
+		echo.add("clamp", "degraded")
 	}
-	imgBytes, _, err := ExportImage(img, quality, targetFormat)
+	imgBytes, metadata, err := pipeline.Export(img, exportOpts, targetFormat)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	_, _ = w.Write(imgBytes)
+	cacheStatus := cacheBypass
+	if degraded {
+		key, cacheKey = "", ""
+	}
+	if key != "" {
+		cacheStatus = cacheMiss
+		if err := dedup.PutOutput(source.hash, key, imgBytes); err != nil {
+			log.Printf("warning: cannot store output in dedup store: %s", err.Error())
+		}
+	}
+	if cacheKey != "" {
+		cacheStatus = cacheMiss
+		meta := cache.Metadata{URL: targetUrl.String(), Tenant: targetUrl.Hostname(), Params: imageQuery(r).Encode(), SourceETag: source.etag, Headers: source.headers}
+		if err := cache.Set(cacheKey, imgBytes, meta); err != nil {
+			log.Printf("warning: cannot store output in cache: %s", err.Error())
+		}
+	}
+	if opts.Envelope {
+		writeEnvelope(w, imgBytes, formatLabel(metadata.Format))
+	} else {
+		_, _ = w.Write(imgBytes)
+	}
+	request.observe(formatLabel(metadata.Format), cacheStatus, int64(len(imgBytes)))
 }
 
-// Helper functions for checking supported image formats, normalizing URLs,
-// parsing dimensions, rotations, quality, sharpening, blurring, and converting images.
+// imageEnvelope is the response of out=json requests.
+type imageEnvelope struct {
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Format string `json:"format"`
+	Bytes  int    `json:"bytes"`
+	Data   []byte `json:"data"`
+}
 
-func isSupportedImageFormat(contentType string) bool {
-	supportedFormats := map[string]bool{
-		"image/jpeg":    true,
-		"image/png":     true,
-		"image/gif":     true,
-		"image/svg+xml": true,
-		"image/webp":    true,
-		"image/heic":    true,
-		"image/heif":    true,
-		"image/tiff":    true,
-		"image/tif":     true,
-		"image/avif":    true,
-		"image/jp2":     true,
-		"image/j2k":     true,
+// writeEnvelope writes the encoded image base64-encoded in a JSON object with its dimensions and size.
+// The dimensions are read back from the encoded image, so they are those of a single frame for animations.
+func writeEnvelope(w http.ResponseWriter, data []byte, format string) {
+	envelope := imageEnvelope{Format: format, Bytes: len(data), Data: data}
+	if img, err := vips.NewImageFromBuffer(data); err == nil {
+		envelope.Width = img.Width()
+		envelope.Height = img.PageHeight()
+		img.Close()
 	}
 
-	return supportedFormats[contentType]
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(envelope)
 }
 
-func normalizeURL(inputURL string) (string, error) {
-	// Add the scheme if it's missing
-	if !strings.HasPrefix(inputURL, "http://") && !strings.HasPrefix(inputURL, "https://") {
-		inputURL = "https://" + inputURL
+// servesCrawler reports whether the request comes from a crawler that gets config.CrawlerQuality.
+func servesCrawler(r *http.Request) bool {
+	return config.CrawlerQuality != 0 && config.IsCrawler(r.UserAgent())
+}
+
+// statusClientClosedRequest is the status recorded for requests the client abandoned, as in nginx.
+const statusClientClosedRequest = 499
+
+// clientGone reports whether the client has disconnected or the request was otherwise canceled, in which case
+// the rest of the processing is skipped. The status is only written for the logs and metrics.
+func clientGone(w http.ResponseWriter, r *http.Request) bool {
+	if r.Context().Err() == nil {
+		return false
 	}
+	w.WriteHeader(statusClientClosedRequest)
+	return true
+}
 
-	// Parse the URL
-	parsedURL, err := url.Parse(inputURL)
-	if err != nil {
-		return "", err
+// imageQuery returns the request's query parameters without those of the URL signature and the priority,
+// which don't change the image.
+func imageQuery(r *http.Request) url.Values {
+	query := r.URL.Query()
+	query.Del(signature.ParamSignature)
+	query.Del(signature.ParamExpires)
+	query.Del(signature.ParamNonce)
+	query.Del(priorityParam)
+	return query
+}
+
+// parseOptions parses the request's query parameters, rejecting unknown ones if config.StrictParams is set.
+func parseOptions(r *http.Request) (*pipeline.Options, error) {
+	return parseQueryOptions(r.URL.Query())
+}
+
+// parseQueryOptions parses the query parameters, rejecting unknown ones if config.StrictParams is set.
+func parseQueryOptions(query url.Values) (*pipeline.Options, error) {
+	if config.StrictParams {
+		return pipeline.ParseStrictOptions(query)
 	}
+	return pipeline.ParseOptions(query)
+}
 
-	// Make sure the URL has a valid scheme
-	if parsedURL.Scheme != "http" && parsedURL.Scheme != "https" {
-		return "", fmt.Errorf("unsupported URL scheme: %s", parsedURL.Scheme)
+// defaultOverrides returns the parameters of the domain defaults that the request can't replace: the
+// watermark, and the overlay with its settings, e.g. the visible watermark of licensed photos.
+func defaultOverrides(defaults url.Values) []string {
+	overrides := []string{"wm"}
+	if defaults.Get("overlay") != "" {
+		overrides = append(overrides, "overlay", "overlay_pos", "overlay_opacity", "overlay_scale", "overlay_tile")
+	}
+	return overrides
+}
+
+// checkRestrictions checks the request's options against the global restrictions and those of the source host.
+func checkRestrictions(opts *pipeline.Options, host string) error {
+	if err := config.Restrictions.Check(opts); err != nil {
+		return err
+	}
+	if restrictions := config.RestrictionsForHost(host); restrictions != nil {
+		return restrictions.Check(opts)
 	}
+	return nil
+}
+
+// sourceImage is the body of a fetched source image, or its bytes from the deduplication store.
+type sourceImage struct {
+	io.Reader
+	contentType string
+	hash        string            // content hash, set when the deduplication store is enabled
+	etag        string            // ETag sent by the origin, if any
+	headers     map[string]string // origin headers listed in OriginHeaders
+	body        io.Closer
+}
 
-	return parsedURL.String(), nil
+// Close closes the response body the image is read from, if any.
+func (s *sourceImage) Close() error {
+	if s.body == nil {
+		return nil
+	}
+	return s.body.Close()
 }
 
-func parseDimensions(r *http.Request) (int, int, error) {
-	height, err := parseIntQueryParam(r, 0, maxImageHeight, "h", "height")
+// fetchSource fetches the image at targetUrl and returns the status code to respond with on failure.
+// The request to the origin, and reading the returned image, are aborted when ctx is done.
+// When the deduplication store is enabled, the image is buffered and stored by content hash, and
+// URLs fetched recently are served from the store without requesting them again.
+func fetchSource(ctx context.Context, targetUrl *url.URL) (*sourceImage, int, error) {
+	if data, info, ok := dedup.Lookup(targetUrl.String()); ok {
+		return &sourceImage{Reader: bytes.NewReader(data), contentType: info.ContentType, hash: info.Hash}, 0, nil
+	}
+
+	client := originClient(targetUrl.Hostname())
+	if config.OriginHeadCheck && sourceTooLarge(ctx, client, targetUrl) {
+		return nil, http.StatusBadRequest, fmt.Errorf("image size exceeds the allowed limit")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", targetUrl.String(), nil)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	req.Header.Set("User-Agent", "image-gem/v1.0")
+	resp, err := client.Do(req)
+	if err != nil {
+		// The URL is left out of the error, it may be encrypted to keep it from the client
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return nil, http.StatusInternalServerError, err
+	}
+
+	// Check for HTTP status code
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, resp.StatusCode, fmt.Errorf("Received a %d status code from the server", resp.StatusCode)
+	}
+
+	// Reject sources that declare a size over the limit before downloading them
+	if resp.ContentLength > maxImageSize {
+		resp.Body.Close()
+		return nil, http.StatusBadRequest, fmt.Errorf("image size exceeds the allowed limit")
+	}
+
+	// Check for the content type
+	contentType := resp.Header.Get("Content-Type")
+	if !isSupportedImageFormat(contentType) {
+		resp.Body.Close()
+		return nil, http.StatusBadRequest, fmt.Errorf("Unsupported image format")
+	}
+
+	// Limit the size of the input image
+	reader := &countingReader{reader: resp.Body, maxImageSize: maxImageSize}
+	etag, headers := resp.Header.Get("ETag"), originHeaders(resp.Header)
+	if !dedup.Enabled() {
+		return &sourceImage{Reader: reader, contentType: contentType, etag: etag, headers: headers, body: resp.Body}, 0, nil
+	}
+
+	defer resp.Body.Close()
+	data, err := io.ReadAll(reader)
 	if err != nil {
-		return 0, 0, err
+		return nil, http.StatusBadRequest, err
 	}
-	width, err := parseIntQueryParam(r, 0, maxImageWidth, "w", "width")
+
+	hash, err := dedup.PutSource(targetUrl.String(), contentType, data)
 	if err != nil {
-		return 0, 0, err
+		log.Printf("warning: cannot store source in dedup store: %s", err.Error())
+		hash = ""
 	}
-	return height, width, nil
+	return &sourceImage{Reader: bytes.NewReader(data), contentType: contentType, hash: hash, etag: etag, headers: headers}, 0, nil
 }
 
-func parseRotation(r *http.Request) (int, error) {
-	rotation, err := parseIntQueryParam(r, 0, 360, "rotate", "r")
+// originHeaders returns the headers of an origin response that are listed in OriginHeaders.
+func originHeaders(header http.Header) map[string]string {
+	var headers map[string]string
+	for _, name := range config.OriginHeaders {
+		if value := header.Get(name); value != "" {
+			if headers == nil {
+				headers = make(map[string]string)
+			}
+			headers[name] = value
+		}
+	}
+	return headers
+}
+
+// setHeaders sets response headers copied from the origin.
+func setHeaders(w http.ResponseWriter, headers map[string]string) {
+	for name, value := range headers {
+		w.Header().Set(name, value)
+	}
+}
+
+// sourceTooLarge sends a HEAD request for the source and reports whether its declared size exceeds the limit.
+// Origins that don't answer HEAD requests are given the benefit of the doubt.
+func sourceTooLarge(ctx context.Context, client *http.Client, targetUrl *url.URL) bool {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", targetUrl.String(), nil)
+	if err != nil {
+		return false
+	}
+
+	req.Header.Set("User-Agent", "image-gem/v1.0")
+	resp, err := client.Do(req)
 	if err != nil {
-		return 0, err
+		return false
 	}
-	return rotation, nil
+	resp.Body.Close()
+
+	return resp.StatusCode == http.StatusOK && resp.ContentLength > maxImageSize
 }
 
-func parseQuality(r *http.Request) (int, error) {
-	quality, err := parseIntQueryParam(r, 1, 100, "q", "quality")
+// outputKey identifies the output of a request among those of the same source: the request's parameters,
+// the chained URLs it was nested in, the domain defaults and policy configured for the source URL, the format negotiation and the crawler quality.
+// IIIF requests are told apart by their region, size, rotation, quality and format.
+func outputKey(r *http.Request, targetUrl *url.URL, stages []chainedStage, iiif *pipeline.IIIFRequest, webp, auto bool) string {
+	host := targetUrl.Hostname()
+	var accepted []string
+	if auto {
+		accepted = acceptedFormats(r)
+	}
+	var chain []string
+	for _, stage := range stages {
+		chain = append(chain, stage.query.Encode())
+	}
+	parts := []string{
+		imageQuery(r).Encode(),
+		strings.Join(chain, "|"),
+		config.DefaultsForHost(host).Encode(),
+		config.PolicyForHost(host),
+		strconv.FormatBool(webp),
+		strings.Join(accepted, ","),
+		strconv.FormatBool(servesCrawler(r)),
+	}
+	if iiif != nil {
+		parts = append(parts, iiif.String())
+	}
+	return strings.Join(parts, "\n")
+}
+
+// upscaleWithAI enlarges the image with the configured upscaling service when the requested size exceeds it.
+// If the service is not configured, times out or fails, the options fall back to a bicubic upscale (or the
+// requested kernel) and the original image is returned.
+func upscaleWithAI(r *http.Request, img *vips.ImageRef, opts *pipeline.Options) *vips.ImageRef {
+	requestedKernel := opts.UpscaleKernel
+	if opts.UpscaleKernel == vips.KernelAuto {
+		opts.UpscaleKernel = vips.KernelCubic
+	}
+
+	factor := pipeline.UpscaleFactor(img, opts)
+	if config.AIUpscalerURL == "" || factor <= 1 {
+		return img
+	}
+
+	upscaler := &pipeline.RemoteUpscaler{
+		Endpoint: config.AIUpscalerURL,
+		Client:   &http.Client{Timeout: time.Duration(config.AIUpscalerTimeoutSeconds) * time.Second},
+	}
+	upscaled, err := upscaler.Upscale(r.Context(), img, factor)
 	if err != nil {
-		return 0, err
+		log.Printf("warning: AI upscale failed, falling back to bicubic: %s", err.Error())
+		return img
 	}
-	return quality, nil
+
+	opts.UpscaleKernel = requestedKernel
+	return upscaled
 }
 
-func parseIntQueryParam(r *http.Request, min, max int, keys ...string) (int, error) {
-	for _, key := range keys {
-		value := r.URL.Query().Get(key)
-		if value != "" {
-			num, err := strconv.Atoi(value)
-			if err != nil {
-				return 0, fmt.Errorf("invalid value for %s: %v (input: %s)", key, err, value)
-			}
-			if num < min || num > max {
-				return 0, fmt.Errorf("value for %s must be between %d and %d (input: %d)", key, min, max, num)
-			}
-			return num, nil
+// expandCaptions replaces the placeholders of the captions of the options with the verified claims of the
+// request and the date, and reports whether any caption had placeholders. Nil options are skipped.
+func expandCaptions(r *http.Request, options []*pipeline.Options) (bool, error) {
+	claims := signature.ClaimsFromContext(r.Context())
+	fields := map[string]string{pipeline.TextFieldDate: time.Now().UTC().Format("2006-01-02")}
+	if claims.User != "" {
+		fields[pipeline.TextFieldUser] = claims.User
+	}
+	if claims.Tenant != "" {
+		fields[pipeline.TextFieldTenant] = claims.Tenant
+	}
+
+	personalized := false
+	for _, opts := range options {
+		if opts == nil || opts.Text == "" {
+			continue
+		}
+		text, expanded, err := pipeline.ExpandText(opts.Text, fields)
+		if err != nil {
+			return false, fmt.Errorf("%v: the URL or session must be signed with the claim", err)
 		}
+		opts.Text = text
+		personalized = personalized || expanded
 	}
-	return 0, nil
+	return personalized, nil
 }
 
-func parseSharpen(r *http.Request) (float64, error) {
-	return parseFloatQueryParam(r, 0, 1, "sharpen", "s")
+// applyOverlay fetches the overlay image of the options and composites it onto the image.
+func applyOverlay(ctx context.Context, img *vips.ImageRef, opts *pipeline.Options) (*vips.ImageRef, error) {
+	overlayUrl, err := normalizeURL(opts.Overlay)
+	if err != nil {
+		return nil, err
+	}
+	source, _, err := fetchSource(ctx, overlayUrl)
+	if err != nil {
+		return nil, err
+	}
+	defer source.Close()
+
+	overlay, err := pipeline.Load(source)
+	if err != nil {
+		return nil, err
+	}
+	defer overlay.Close()
+	return pipeline.Overlay(img, overlay, opts)
 }
 
-func parseBlur(r *http.Request) (float64, error) {
-	return parseFloatQueryParam(r, 0, 1, "blur", "b")
+// moderateImage checks the image with the configured moderation service and applies the moderation policy.
+// It returns an error and status code if the image must not be served; flagged images are blurred in place
+// under the blur policy.
+func moderateImage(r *http.Request, img *vips.ImageRef) (int, error) {
+	flagged, status, err := checkModeration(r, img)
+	if err != nil || !flagged {
+		return status, err
+	}
+	if config.ModerationAction == "blur" {
+		if err := pipeline.Obscure(img); err != nil {
+			return http.StatusInternalServerError, err
+		}
+		return 0, nil
+	}
+	return http.StatusForbidden, fmt.Errorf("Image blocked by content moderation")
 }
 
-func parseFloatQueryParam(r *http.Request, min, max float64, keys ...string) (float64, error) {
-	for _, key := range keys {
-		value := r.URL.Query().Get(key)
-		if value != "" {
-			num, err := strconv.ParseFloat(value, 64)
-			if err != nil {
-				return 0, fmt.Errorf("invalid value for %s: %v (input: %s)", key, err, value)
-			}
-			if num < min || num > max {
-				return 0, fmt.Errorf("value for %s must be between %f and %f (input: %f)", key, min, max, num)
-			}
-			return num, nil
+// moderateSVG checks an SVG that is served as is by moderating its rasterization. Flagged SVGs are blocked
+// under either policy.
+func moderateSVG(r *http.Request, data []byte) (int, error) {
+	// SVG isn't one of the formats pipeline.Load decodes, so it is rasterized by libvips directly
+	img, err := vips.NewImageFromBuffer(data)
+	if err != nil {
+		return http.StatusBadRequest, fmt.Errorf("Invalid SVG")
+	}
+	defer img.Close()
+	if img.Width() > pipeline.MaxImageWidth || img.Height() > pipeline.MaxImageHeight {
+		return http.StatusBadRequest, fmt.Errorf("image dimensions %dx%d exceed the allowed limit", img.Width(), img.Height())
+	}
+	flagged, status, err := checkModeration(r, img)
+	if err != nil || !flagged {
+		return status, err
+	}
+	return http.StatusForbidden, fmt.Errorf("Image blocked by content moderation")
+}
+
+// checkModeration scores the image with the configured moderation service and reports whether it is flagged.
+// Unless the service fails open, an unavailable service is an error.
+func checkModeration(r *http.Request, img *vips.ImageRef) (bool, int, error) {
+	moderator := &pipeline.RemoteModerator{
+		Endpoint: config.ModerationURL,
+		Client:   &http.Client{Timeout: time.Duration(config.ModerationTimeoutSeconds) * time.Second},
+	}
+	score, err := moderator.Score(r.Context(), img)
+	if err != nil {
+		if config.ModerationFailOpen {
+			log.Printf("warning: moderation unavailable, serving image unchecked: %s", err.Error())
+			return false, 0, nil
 		}
+		return false, http.StatusServiceUnavailable, fmt.Errorf("Image could not be checked by content moderation")
 	}
-	return 0, nil
+	return score >= config.ModerationThreshold, 0, nil
 }
 
-func convertImageToWebP(r *http.Request) bool {
-	if r.URL.Query().Get("webp") != "auto" {
-		return false
+// loadError returns the message for an image that pipeline.Load rejected.
+func loadError(err error) string {
+	var invalid *pipeline.InvalidImageError
+	if errors.As(err, &invalid) {
+		return invalid.Reason
 	}
+	return "Failed to decode image"
+}
 
-	return strings.Contains(r.Header.Get("Accept"), "image/webp")
+// transformStatus returns the status code for an error of pipeline.Transform: parameters that don't fit the
+// image, such as a frame range outside the animation, are the client's mistake.
+func transformStatus(err error) int {
+	var params pipeline.ParamErrors
+	if errors.As(err, &params) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
 }
 
-func resizeImage(img *vips.ImageRef, width, height int, upscale bool) (*vips.ImageRef, error) {
-	if width == 0 && height == 0 {
-		return img, nil
+// Helper functions for checking supported image formats, normalizing URLs and negotiating WebP output.
+
+func isSupportedImageFormat(contentType string) bool {
+	return contentType == "image/svg+xml" || pipeline.SupportedContentType(contentType)
+}
+
+func normalizeURL(inputURL string) (*url.URL, error) {
+	// Add the scheme if it's missing
+	if !strings.HasPrefix(inputURL, "http://") && !strings.HasPrefix(inputURL, "https://") {
+		inputURL = "https://" + inputURL
+	}
+
+	// Parse the URL
+	parsedURL, err := url.Parse(inputURL)
+	if err != nil {
+		return nil, err
+	}
+
+	// Make sure the URL has a valid scheme
+	if parsedURL.Scheme != "http" && parsedURL.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported URL scheme: %s", parsedURL.Scheme)
 	}
 
-	scale := -1.0
-	if width == 0 && height != 0 {
-		scale = float64(height) / float64(img.PageHeight())
+	return parsedURL, nil
+}
+
+// outputFormat returns the format the image is exported in: the target format, or the image's own.
+func outputFormat(img *vips.ImageRef, targetFormat vips.ImageType) vips.ImageType {
+	if targetFormat != vips.ImageTypeUnknown {
+		return targetFormat
 	}
-	if height == 0 && width != 0 {
-		scale = float64(width) / float64(img.Width())
+	return img.Format()
+}
+
+// negotiatedTypes are the formats clients may not support, with the media type they list in Accept.
+var negotiatedTypes = map[vips.ImageType]string{
+	vips.ImageTypeAVIF: "image/avif",
+	vips.ImageTypeWEBP: "image/webp",
+	vips.ImageTypeHEIF: "image/heic",
+	vips.ImageTypeJP2K: "image/jp2",
+	vips.ImageTypeTIFF: "image/tiff",
+}
+
+// acceptedFormats returns the media types of negotiatedTypes the client accepts, sorted.
+func acceptedFormats(r *http.Request) []string {
+	accept := r.Header.Get("Accept")
+	var accepted []string
+	for _, mediaType := range negotiatedTypes {
+		if strings.Contains(accept, mediaType) {
+			accepted = append(accepted, mediaType)
+		}
 	}
+	sort.Strings(accepted)
+	return accepted
+}
 
-	if (upscale || scale <= 1) && scale != -1.0 {
-		err := img.Resize(scale, vips.KernelAuto)
-		if err != nil {
-			return nil, err
+// negotiateFormat returns the first of the configured formats for the image's class that the client accepts,
+// or the last one. JPEG, PNG and GIF are assumed to be supported by every client.
+func negotiateFormat(r *http.Request, img *vips.ImageRef) vips.ImageType {
+	formats := config.AutoFormats[pipeline.ImageClass(img)]
+	accept := r.Header.Get("Accept")
+	for _, format := range formats {
+		mediaType, negotiated := negotiatedTypes[format]
+		if !negotiated || strings.Contains(accept, mediaType) {
+			return format
 		}
-		return img, nil
 	}
+	return formats[len(formats)-1]
+}
 
-	hScale := float64(width) / float64(img.Width())
-	vScale := float64(height) / float64(img.PageHeight())
-	if upscale || (hScale <= 1 && vScale <= 1) {
-		err := img.ResizeWithVScale(hScale, vScale, vips.KernelAuto)
-		if err != nil {
-			return nil, err
-		}
-	}
-
-	return img, nil
-}
-
-func ExportImage(img *vips.ImageRef, quality int, formats ...vips.ImageType) ([]byte, *vips.ImageMetadata, error) {
-	format := img.Format()
-	if len(formats) > 0 {
-		format = formats[0]
-	}
-
-	switch format {
-	case vips.ImageTypeJPEG:
-		params := vips.NewJpegExportParams()
-		if quality >= 1 && quality <= 100 {
-			params.Quality = quality
-		}
-		return img.ExportJpeg(params)
-	case vips.ImageTypePNG:
-		return img.ExportPng(vips.NewPngExportParams())
-	case vips.ImageTypeWEBP:
-		params := vips.NewWebpExportParams()
-		if quality >= 1 && quality <= 100 {
-			params.Quality = quality
-		}
-		return img.ExportWebp(params)
-	case vips.ImageTypeHEIF:
-		params := vips.NewHeifExportParams()
-		if quality >= 1 && quality <= 100 {
-			params.Quality = quality
-		}
-		return img.ExportHeif(params)
-	case vips.ImageTypeTIFF:
-		return img.ExportTiff(vips.NewTiffExportParams())
-	case vips.ImageTypeAVIF:
-		params := vips.NewAvifExportParams()
-		if quality >= 1 && quality <= 100 {
-			params.Quality = quality
-		}
-		return img.ExportAvif(params)
-	case vips.ImageTypeJP2K:
-		params := vips.NewJp2kExportParams()
-		if quality >= 1 && quality <= 100 {
-			params.Quality = quality
-		}
-		return img.ExportJp2k(params)
-	case vips.ImageTypeGIF:
-		params := vips.NewGifExportParams()
-		if quality >= 1 && quality <= 100 {
-			params.Quality = quality
-		}
-		return img.ExportGIF(params)
-	default:
-		return img.ExportNative()
-	}
-}
-
-func parseImageFormat(r *http.Request) (vips.ImageType, error) {
-	format := r.URL.Query().Get("format")
-	if format == "" {
-		format = r.URL.Query().Get("f")
-	}
-
-	switch strings.ToLower(format) {
-	case "":
-		return vips.ImageTypeUnknown, nil
-	case "jpeg", "jpg":
-		return vips.ImageTypeJPEG, nil
-	case "png":
-		return vips.ImageTypePNG, nil
-	case "webp":
-		return vips.ImageTypeWEBP, nil
-	case "heif", "heic":
-		return vips.ImageTypeHEIF, nil
-	case "tiff", "tif":
-		return vips.ImageTypeTIFF, nil
-	case "avif":
-		return vips.ImageTypeAVIF, nil
-	case "jp2k", "j2k":
-		return vips.ImageTypeJP2K, nil
-	case "gif":
-		return vips.ImageTypeGIF, nil
-	default:
-		return vips.ImageTypeUnknown, fmt.Errorf("unsupported image format: %s", format)
+func convertImageToWebP(r *http.Request) bool {
+	if r.URL.Query().Get("webp") != "auto" {
+		return false
 	}
+
+	return strings.Contains(r.Header.Get("Accept"), "image/webp")
 }
@@ -0,0 +1,148 @@
+package v1
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/arkami8/image-gem/config"
+	"github.com/arkami8/image-gem/geo"
+	"github.com/arkami8/image-gem/pipeline"
+
+	"github.com/davidbyttow/govips/v2/vips"
+	"github.com/gorilla/mux"
+)
+
+// ladderRendition describes one encoding of the ladder.
+type ladderRendition struct {
+	Width   int    `json:"width"`
+	Height  int    `json:"height"`
+	Format  string `json:"format"`
+	Quality int    `json:"quality,omitempty"`
+	Bytes   int    `json:"bytes"`
+}
+
+// ladderManifest is the response of ImageLadder.
+type ladderManifest struct {
+	Source     ladderRendition   `json:"source"`
+	Renditions []ladderRendition `json:"renditions"`
+}
+
+// ImageLadder is an HTTP handler that encodes the image in the "url" mux path variable at every width, format
+// and quality of the configured ladder and responds with a JSON manifest of the resulting sizes, to pick
+// encodings for adaptive delivery. Other transformation parameters are applied before the ladder; widths
+// larger than the image, and renditions larger than FormatMaxDimensions allows, are skipped.
+func ImageLadder(w http.ResponseWriter, r *http.Request) {
+	targetUrl, err := normalizeURL(mux.Vars(r)["url"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if config.CountryBlocked(geo.FromContext(r.Context()), targetUrl.Hostname()) {
+		http.Error(w, "Not available in your country", http.StatusUnavailableForLegalReasons)
+		return
+	}
+
+	opts, err := parseOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkRestrictions(opts, targetUrl.Hostname()); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	// The ladder decides the size and encoding
+	opts.Width, opts.Height, opts.LongEdge, opts.ShortEdge = 0, 0, 0, 0
+	opts.Format, opts.Quality = vips.ImageTypeUnknown, 0
+
+	source, status, err := fetchSource(r.Context(), targetUrl)
+	if err != nil {
+		if clientGone(w, r) {
+			return
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	defer source.Close()
+
+	data, err := io.ReadAll(source)
+	if err != nil {
+		if clientGone(w, r) {
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	img, err := pipeline.Load(bytes.NewReader(data))
+	if err != nil {
+		http.Error(w, loadError(err), http.StatusBadRequest)
+		return
+	}
+	defer img.Close()
+
+	manifest := ladderManifest{
+		Source: ladderRendition{Width: img.Width(), Height: img.PageHeight(), Format: formatLabel(img.Format()), Bytes: len(data)},
+	}
+
+	img, err = pipeline.Transform(img, opts)
+	if err != nil {
+		http.Error(w, err.Error(), transformStatus(err))
+		return
+	}
+	defer img.Close()
+
+	for _, width := range config.LadderWidths {
+		if width > img.Width() {
+			continue
+		}
+		if clientGone(w, r) {
+			return
+		}
+
+		copied, err := img.Copy()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rung, err := pipeline.Transform(copied, &pipeline.Options{Width: width})
+		if err != nil {
+			copied.Close()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		for _, formatName := range config.LadderFormats {
+			format, _ := pipeline.ParseFormatName(formatName)
+			if limit, ok := config.FormatMaxDimensions[format]; ok &&
+				((limit.Width > 0 && rung.Width() > limit.Width) || (limit.Height > 0 && rung.PageHeight() > limit.Height)) {
+				continue
+			}
+			for _, quality := range config.LadderQualities {
+				encoded, metadata, err := pipeline.ExportImage(rung, quality, format)
+				if err != nil {
+					rung.Close()
+					copied.Close()
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				manifest.Renditions = append(manifest.Renditions, ladderRendition{
+					Width:   metadata.Width,
+					Height:  metadata.Height,
+					Format:  formatLabel(metadata.Format),
+					Quality: quality,
+					Bytes:   len(encoded),
+				})
+			}
+		}
+		rung.Close()
+		copied.Close()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(manifest)
+}
@@ -0,0 +1,80 @@
+package v1
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+
+	"github.com/arkami8/image-gem/audit"
+	"github.com/arkami8/image-gem/links"
+
+	"github.com/gorilla/mux"
+)
+
+// linkResponse is the response of LinkCreate.
+type linkResponse struct {
+	ID       string `json:"id"`
+	ImageURL string `json:"imageUrl"`
+}
+
+// LinkCreate is an HTTP handler that maps a source URL and transformation parameters, posted as a links.Link,
+// to a short ID served by LinkGet. It responds with 501 when no link store is configured.
+func LinkCreate(w http.ResponseWriter, r *http.Request) {
+	if !links.Enabled() {
+		http.Error(w, "Link store is not configured", http.StatusNotImplemented)
+		return
+	}
+
+	var link links.Link
+	if err := json.NewDecoder(r.Body).Decode(&link); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := normalizeURL(link.URL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	params, err := url.ParseQuery(link.Params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := parseQueryOptions(params); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id, err := links.Create(link)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	audit.Record(r, "link.create", id)
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(linkResponse{ID: id, ImageURL: "/i/" + id})
+}
+
+// LinkGet is ImageGet for the source URL and parameters of a link created by LinkCreate, read from the "id"
+// mux path variable. The request's own query parameters are ignored.
+func LinkGet(w http.ResponseWriter, r *http.Request) {
+	if !links.Enabled() {
+		http.NotFound(w, r)
+		return
+	}
+
+	link, ok, err := links.Lookup(mux.Vars(r)["id"])
+	if err == links.ErrInvalidID || (err == nil && !ok) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	r = r.Clone(r.Context())
+	r.URL.RawQuery = link.Params
+	ServeImage(w, r, link.URL)
+}
@@ -0,0 +1,107 @@
+package v1
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/arkami8/image-gem/config"
+	"github.com/arkami8/image-gem/metrics"
+	"github.com/arkami8/image-gem/pipeline"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// cpuSampleInterval is the shortest time the CPU usage is measured over.
+const cpuSampleInterval = time.Second
+
+var (
+	// processing counts the images being decoded, transformed and encoded.
+	processing atomic.Int64
+
+	degradedImages = metrics.NewCounter("image_gem_degraded_images_total",
+		"Images encoded at a lower cost because the server was busy.")
+)
+
+// overloaded reports whether the images being processed or the CPU usage are over the Degradation thresholds.
+func overloaded() bool {
+	limits := config.Degradation
+	if limits.MaxProcessing > 0 && processing.Load() > int64(limits.MaxProcessing) {
+		return true
+	}
+	return limits.MaxCPU > 0 && cpu.usage() > limits.MaxCPU
+}
+
+// degrade lowers the cost of encoding an image: the least effort, at most the Degradation quality, and WebP
+// rather than AVIF when the format is negotiated and the client accepts WebP.
+func degrade(r *http.Request, opts pipeline.ExportOptions, format vips.ImageType, autoFormat bool) (pipeline.ExportOptions, vips.ImageType) {
+	opts.Fast = true
+	if quality := config.Degradation.Quality; quality > 0 && (opts.Quality == 0 || opts.Quality > quality) {
+		opts.Quality = quality
+	}
+	if autoFormat && format == vips.ImageTypeAVIF && pipeline.FormatSupported(vips.ImageTypeWEBP) &&
+		strings.Contains(r.Header.Get("Accept"), "image/webp") {
+		format = vips.ImageTypeWEBP
+	}
+	return opts, format
+}
+
+// cpuSampler measures the fraction of time the CPUs of the machine were busy from /proc/stat, between the
+// last two samples. Where /proc/stat can't be read, the usage is 0.
+type cpuSampler struct {
+	mu          sync.Mutex
+	sampled     time.Time
+	busy, total uint64
+	last        float64
+}
+
+var cpu cpuSampler
+
+func (s *cpuSampler) usage() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if time.Since(s.sampled) < cpuSampleInterval {
+		return s.last
+	}
+	busy, total, ok := readCPUTimes()
+	if !ok {
+		return 0
+	}
+	if total > s.total {
+		s.last = float64(busy-s.busy) / float64(total-s.total)
+	}
+	s.sampled, s.busy, s.total = time.Now(), busy, total
+	return s.last
+}
+
+// readCPUTimes returns the busy and total time of the CPUs since boot, from the first line of /proc/stat:
+// user, nice, system, idle, iowait, irq, softirq, steal...
+func readCPUTimes() (busy, total uint64, ok bool) {
+	data, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return 0, 0, false
+	}
+	line, _, _ := bytes.Cut(data, []byte("\n"))
+	fields := bytes.Fields(line)
+	if len(fields) < 5 || string(fields[0]) != "cpu" {
+		return 0, 0, false
+	}
+	for i, field := range fields[1:] {
+		value, err := strconv.ParseUint(string(field), 10, 64)
+		if err != nil {
+			return 0, 0, false
+		}
+		total += value
+		// idle and iowait
+		if i != 3 && i != 4 {
+			busy += value
+		}
+	}
+	return busy, total, true
+}
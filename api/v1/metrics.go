@@ -0,0 +1,64 @@
+package v1
+
+import (
+	"strings"
+	"time"
+
+	"github.com/arkami8/image-gem/config"
+	"github.com/arkami8/image-gem/metrics"
+	"github.com/arkami8/image-gem/statedb"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+var (
+	imageDuration = metrics.NewHistogram("image_gem_image_duration_seconds",
+		"Time to serve an image, by requested operations, output format, cache status and tenant.",
+		metrics.LatencyBuckets, "operations", "format", "cache", "tenant")
+	imageOutputBytes = metrics.NewHistogram("image_gem_image_output_bytes",
+		"Size of served images, by requested operations, output format, cache status and tenant.",
+		metrics.SizeBuckets, "operations", "format", "cache", "tenant")
+)
+
+// Cache statuses of an image response.
+const (
+	cachePassthrough = "passthrough" // the source was served unchanged
+	cacheHit         = "hit"         // the output was served from the deduplication store
+	cacheMiss        = "miss"        // the output was processed and stored
+	cacheBypass      = "bypass"      // the output was processed and not stored
+)
+
+// imageRequest times an image response for the image metrics.
+type imageRequest struct {
+	start      time.Time
+	operations string
+	host       string
+	tenant     string
+}
+
+// newImageRequest starts timing a request for an image from the given source host.
+func newImageRequest(operations []string, host string) *imageRequest {
+	label := strings.Join(operations, "+")
+	if label == "" {
+		label = "none"
+	}
+	return &imageRequest{start: time.Now(), operations: label, host: host, tenant: config.MetricsTenantForHost(host)}
+}
+
+// observe records a served image in the metrics and the usage counters. The format is a label from
+// formatLabel, or the subtype of a passthrough image's content type.
+func (ir *imageRequest) observe(format, cache string, size int64) {
+	imageDuration.Observe(time.Since(ir.start).Seconds(), ir.operations, format, cache, ir.tenant)
+	imageOutputBytes.Observe(float64(size), ir.operations, format, cache, ir.tenant)
+	statedb.CountUsage(ir.host, size)
+}
+
+func formatLabel(format vips.ImageType) string {
+	if format == vips.ImageTypeAVIF {
+		return "avif"
+	}
+	if name, ok := vips.ImageTypes[format]; ok {
+		return name
+	}
+	return "unknown"
+}
@@ -0,0 +1,139 @@
+package v1
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/net/html"
+)
+
+const (
+	// maxPageSize is the maximum number of bytes of a web page that are searched for its preview image.
+	maxPageSize = 1024 * 1024 // 1MB
+)
+
+// openGraphProperties are the meta tags naming a page's preview image, in order of preference.
+var openGraphProperties = []string{"og:image", "og:image:url", "og:image:secure_url", "twitter:image", "twitter:image:src"}
+
+// ImageOpenGraph is an HTTP handler that fetches the web page in the "url" mux path variable, finds its
+// og:image or twitter:image preview image and serves it transformed according to the URL query parameters.
+func ImageOpenGraph(w http.ResponseWriter, r *http.Request) {
+	pageUrl, err := normalizeURL(mux.Vars(r)["url"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	imageUrl, status, err := resolveOpenGraphImage(r.Context(), pageUrl)
+	if err != nil {
+		if clientGone(w, r) {
+			return
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	ServeImage(w, r, imageUrl.String())
+}
+
+// resolveOpenGraphImage fetches the web page and returns the absolute URL of its preview image,
+// or an error and the status code to respond with.
+func resolveOpenGraphImage(ctx context.Context, pageUrl *url.URL) (*url.URL, int, error) {
+	client := originClient(pageUrl.Hostname())
+	req, err := http.NewRequestWithContext(ctx, "GET", pageUrl.String(), nil)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	req.Header.Set("User-Agent", "image-gem/v1.0")
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.StatusCode, fmt.Errorf("Received a %d status code from the server", resp.StatusCode)
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	if !strings.HasPrefix(contentType, "text/html") && !strings.HasPrefix(contentType, "application/xhtml+xml") {
+		return nil, http.StatusBadRequest, fmt.Errorf("Unsupported page format")
+	}
+
+	// Relative image URLs are resolved against the final URL after redirects
+	imageUrl, ok := findOpenGraphImage(io.LimitReader(resp.Body, maxPageSize), resp.Request.URL)
+	if !ok {
+		return nil, http.StatusNotFound, fmt.Errorf("No OpenGraph image found")
+	}
+
+	return imageUrl, 0, nil
+}
+
+// findOpenGraphImage scans the head of an HTML document for preview image meta tags and returns the
+// preferred one, resolved against the document's base URL.
+func findOpenGraphImage(page io.Reader, base *url.URL) (*url.URL, bool) {
+	found := map[string]string{}
+
+	tokenizer := html.NewTokenizer(page)
+scan:
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			break scan
+		case html.EndTagToken:
+			if name, _ := tokenizer.TagName(); string(name) == "head" {
+				break scan
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			switch token.Data {
+			case "body":
+				break scan
+			case "base":
+				if href := attribute(token, "href"); href != "" {
+					if resolved, err := base.Parse(href); err == nil {
+						base = resolved
+					}
+				}
+			case "meta":
+				// OpenGraph uses the property attribute, Twitter cards the name attribute
+				property := strings.ToLower(attribute(token, "property"))
+				if property == "" {
+					property = strings.ToLower(attribute(token, "name"))
+				}
+				if _, ok := found[property]; !ok {
+					found[property] = strings.TrimSpace(attribute(token, "content"))
+				}
+			}
+		}
+	}
+
+	for _, property := range openGraphProperties {
+		if found[property] == "" {
+			continue
+		}
+		imageUrl, err := base.Parse(found[property])
+		if err != nil || (imageUrl.Scheme != "http" && imageUrl.Scheme != "https") {
+			continue
+		}
+		return imageUrl, true
+	}
+
+	return nil, false
+}
+
+func attribute(token html.Token, key string) string {
+	for _, attr := range token.Attr {
+		if attr.Key == key {
+			return attr.Val
+		}
+	}
+	return ""
+}
@@ -0,0 +1,82 @@
+package v1
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/arkami8/image-gem/cache"
+	"github.com/arkami8/image-gem/config"
+	"github.com/arkami8/image-gem/signature"
+)
+
+// peerHeader marks requests forwarded by a peer, which are always served by the instance receiving them.
+const peerHeader = "X-Image-Gem-Peer"
+
+var (
+	peerRing     *cache.Ring
+	peerRingOnce sync.Once
+	peerClient   = &http.Client{}
+)
+
+// hopHeaders are the hop-by-hop headers that aren't forwarded between peers.
+var hopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade"}
+
+// peerFor returns the peer owning the cache key when it's another instance of the cluster, or an empty
+// string when the request is served locally. Requests forwarded by peers and single-use signed URLs, whose
+// nonces are only known to this instance, are always served locally.
+func peerFor(r *http.Request, key string) string {
+	if len(config.Peers) == 0 || r.Header.Get(peerHeader) != "" || r.URL.Query().Get(signature.ParamNonce) != "" {
+		return ""
+	}
+
+	peerRingOnce.Do(func() {
+		peerRing = cache.NewRing(config.Peers)
+	})
+	if owner := peerRing.Owner(key); owner != config.PeerSelf {
+		return owner
+	}
+	return ""
+}
+
+// proxyToPeer forwards the request to the peer and copies its response to w. It returns false, without
+// writing anything, if the peer can't be reached, so the request can be served locally instead.
+func proxyToPeer(w http.ResponseWriter, r *http.Request, peer string) bool {
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, strings.TrimRight(peer, "/")+r.URL.RequestURI(), nil)
+	if err != nil {
+		return false
+	}
+	req.Header = r.Header.Clone()
+	for _, name := range hopHeaders {
+		req.Header.Del(name)
+	}
+	req.Header.Set(peerHeader, "1")
+	// The peer sees the client address if this instance is one of its TrustedProxies
+	client := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+	req.Header.Set("X-Forwarded-For", client)
+
+	resp, err := peerClient.Do(req)
+	if err != nil {
+		if r.Context().Err() == nil {
+			log.Printf("warning: cannot reach peer %s: %s", peer, err.Error())
+		}
+		return false
+	}
+	defer resp.Body.Close()
+
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	for _, name := range hopHeaders {
+		w.Header().Del(name)
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, resp.Body)
+	return true
+}
@@ -0,0 +1,99 @@
+package v1
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/arkami8/image-gem/config"
+	"github.com/arkami8/image-gem/signature"
+)
+
+// policyHeader is the response header the policy decisions made for an image request are echoed in.
+const policyHeader = "X-Image-Policy"
+
+// policyEcho collects the policy decisions made for an image request as name=value pairs, e.g. how the
+// request was authorized, which domain rules matched and which limits were clamped. A nil *policyEcho
+// records nothing, so the decisions are only collected for callers that may see them.
+type policyEcho struct {
+	decisions []string
+}
+
+func (e *policyEcho) add(name, value string) {
+	if e != nil {
+		e.decisions = append(e.decisions, name+"="+value)
+	}
+}
+
+func (e *policyEcho) String() string {
+	return strings.Join(e.decisions, "; ")
+}
+
+// echoPolicy returns the writer to respond to an image request through and the echo to record its policy
+// decisions in. Requests with config.DebugToken or config.AdminToken as bearer token get the decisions in
+// the X-Image-Policy header of the response, which is then private to them; others get a nil echo.
+func echoPolicy(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *policyEcho) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !matchesToken(token, config.DebugToken) && !matchesToken(token, config.AdminToken) {
+		return w, nil
+	}
+
+	echo := &policyEcho{}
+	echo.add("signature", signatureStatus(r))
+	return &policyWriter{ResponseWriter: w, echo: echo}, echo
+}
+
+func matchesToken(token, expected string) bool {
+	return expected != "" && subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+// signatureStatus returns how the request passed the URL signature check of the /img routes: disabled
+// without a signing key, url for signed URLs, session for session cookies, and none otherwise, e.g. for
+// short links.
+func signatureStatus(r *http.Request) string {
+	switch {
+	case config.URLSigningKey == "":
+		return "disabled"
+	case r.URL.Query().Get(signature.ParamSignature) != "":
+		return "url"
+	}
+	if _, err := r.Cookie(config.SessionCookieName); err == nil {
+		return "session"
+	}
+	return "none"
+}
+
+// policyWriter sets the X-Image-Policy header when the response header is written.
+type policyWriter struct {
+	http.ResponseWriter
+	echo        *policyEcho
+	wroteHeader bool
+}
+
+func (pw *policyWriter) WriteHeader(status int) {
+	if !pw.wroteHeader {
+		pw.wroteHeader = true
+		header := pw.Header()
+		header.Set(policyHeader, pw.echo.String())
+		// Shared caches mustn't serve the decisions to others
+		header.Set("Cache-Control", "private")
+	}
+	pw.ResponseWriter.WriteHeader(status)
+}
+
+func (pw *policyWriter) Write(p []byte) (int, error) {
+	if !pw.wroteHeader {
+		pw.WriteHeader(http.StatusOK)
+	}
+	return pw.ResponseWriter.Write(p)
+}
+
+// Flush writes the header if needed and flushes the underlying writer, for streamed responses.
+func (pw *policyWriter) Flush() {
+	if !pw.wroteHeader {
+		pw.WriteHeader(http.StatusOK)
+	}
+	if flusher, ok := pw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,171 @@
+package v1
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/arkami8/image-gem/config"
+	"github.com/arkami8/image-gem/metrics"
+	"github.com/arkami8/image-gem/signature"
+)
+
+// apiKeyHeader is the header clients send their API key in, whose tier in config.Priority.APIKeys sets the
+// priority class of their requests.
+const apiKeyHeader = "X-Api-Key"
+
+// priorityParam is the query parameter that sets the priority class of a request.
+const priorityParam = "priority"
+
+var queueWait = metrics.NewHistogram("image_gem_queue_wait_seconds",
+	"Time image requests waited for a processing slot, by priority class.",
+	[]float64{.01, .05, .1, .5, 1, 5, 10}, "class")
+
+type priorityContextKey struct{}
+
+// WithPriority returns a context whose image requests are in the priority class unless their API key or
+// parameters lower it, e.g. for requests made in-process like prewarming.
+func WithPriority(ctx context.Context, class string) context.Context {
+	return context.WithValue(ctx, priorityContextKey{}, class)
+}
+
+// requestPriority returns the priority class of an image request: the tier of its API key, else the class
+// of its context or config.Priority.Default. priority=batch lowers it; priority=interactive only raises it
+// in signed URLs, whose parameters are vouched for by the signing key.
+func requestPriority(r *http.Request) (string, error) {
+	class, ok := config.Priority.APIKeys[r.Header.Get(apiKeyHeader)]
+	if !ok {
+		if class, ok = r.Context().Value(priorityContextKey{}).(string); !ok {
+			class = config.Priority.Default
+		}
+	}
+
+	query := r.URL.Query()
+	switch value := query.Get(priorityParam); value {
+	case "":
+	case config.PriorityBatch:
+		class = config.PriorityBatch
+	case config.PriorityInteractive:
+		if config.URLSigningKey != "" && query.Get(signature.ParamSignature) != "" {
+			class = config.PriorityInteractive
+		}
+	default:
+		return "", fmt.Errorf("unsupported value for priority: %s (accepted: %s, %s)", value, config.PriorityInteractive, config.PriorityBatch)
+	}
+	return class, nil
+}
+
+// workQueue hands out the config.Priority.MaxProcessing processing slots, to waiting interactive requests
+// first and then to batch requests, in the order they arrived within a class.
+type workQueue struct {
+	mu           sync.Mutex
+	running      int
+	runningBatch int
+	interactive  []chan struct{}
+	batch        []chan struct{}
+}
+
+var queue workQueue
+
+// acquire waits for a processing slot for a request of the class and returns the function that releases
+// it, or the context's error if it is done first.
+func (q *workQueue) acquire(ctx context.Context, class string) (func(), error) {
+	if config.Priority.MaxProcessing <= 0 {
+		return func() {}, nil
+	}
+	batch := class == config.PriorityBatch
+	release := func() { q.release(batch) }
+	start := time.Now()
+	defer func() { queueWait.Observe(time.Since(start).Seconds(), class) }()
+
+	q.mu.Lock()
+	// Requests that arrive don't overtake those of their class, or interactive ones, already waiting
+	if len(q.interactive) == 0 && (!batch || len(q.batch) == 0) && q.free(batch) {
+		q.take(batch)
+		q.mu.Unlock()
+		return release, nil
+	}
+	ready := make(chan struct{})
+	if batch {
+		q.batch = append(q.batch, ready)
+	} else {
+		q.interactive = append(q.interactive, ready)
+	}
+	q.mu.Unlock()
+
+	select {
+	case <-ready:
+		return release, nil
+	case <-ctx.Done():
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var ok bool
+	if batch {
+		q.batch, ok = removeWaiter(q.batch, ready)
+	} else {
+		q.interactive, ok = removeWaiter(q.interactive, ready)
+	}
+	if !ok {
+		// The slot was handed over as the context was done
+		q.give(batch)
+	}
+	return nil, ctx.Err()
+}
+
+func (q *workQueue) release(batch bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.give(batch)
+}
+
+// give returns a slot held by a request and hands the free slots to the waiting requests.
+func (q *workQueue) give(batch bool) {
+	q.running--
+	if batch {
+		q.runningBatch--
+	}
+	for {
+		switch {
+		case len(q.interactive) > 0 && q.free(false):
+			q.take(false)
+			close(q.interactive[0])
+			q.interactive = q.interactive[1:]
+		case len(q.batch) > 0 && q.free(true):
+			q.take(true)
+			close(q.batch[0])
+			q.batch = q.batch[1:]
+		default:
+			return
+		}
+	}
+}
+
+// free reports whether a request of the class can take a slot.
+func (q *workQueue) free(batch bool) bool {
+	limits := config.Priority
+	if q.running >= limits.MaxProcessing {
+		return false
+	}
+	return !batch || limits.MaxBatch == 0 || q.runningBatch < limits.MaxBatch
+}
+
+func (q *workQueue) take(batch bool) {
+	q.running++
+	if batch {
+		q.runningBatch++
+	}
+}
+
+// removeWaiter removes a waiting request from the queue, reporting whether it was still in it.
+func removeWaiter(waiting []chan struct{}, ready chan struct{}) ([]chan struct{}, bool) {
+	for i, w := range waiting {
+		if w == ready {
+			return append(waiting[:i], waiting[i+1:]...), true
+		}
+	}
+	return waiting, false
+}
@@ -0,0 +1,103 @@
+package v1
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/arkami8/image-gem/config"
+	"github.com/arkami8/image-gem/pipeline"
+)
+
+// rangeBlockSize is the least number of bytes requested at once, so the small reads of TIFF directories
+// don't each need a request.
+const rangeBlockSize = 64 << 10
+
+// fetchSourceSized fetches the image at targetUrl like fetchSource. With RangeFetch enabled and only
+// width × height pixels needed, TIFF sources are read with range requests instead, downloading only the
+// smallest pyramid level that is still large enough. Origins that don't answer range requests, and TIFFs
+// that aren't tiled or stripped pyramids, are fetched in full.
+func fetchSourceSized(ctx context.Context, targetUrl *url.URL, width, height int) (*sourceImage, int, error) {
+	ext := strings.ToLower(path.Ext(targetUrl.Path))
+	if config.RangeFetch && (width > 0 || height > 0) && (ext == ".tif" || ext == ".tiff") {
+		data, err := fetchTIFFLevel(ctx, targetUrl, width, height)
+		if err == nil {
+			return &sourceImage{Reader: bytes.NewReader(data), contentType: "image/tiff"}, 0, nil
+		}
+		if ctx.Err() != nil {
+			return nil, http.StatusInternalServerError, ctx.Err()
+		}
+	}
+	return fetchSource(ctx, targetUrl)
+}
+
+// fetchTIFFLevel reads the pyramid level of the TIFF at targetUrl with range requests.
+func fetchTIFFLevel(ctx context.Context, targetUrl *url.URL, width, height int) ([]byte, error) {
+	reader := &rangeReader{ctx: ctx, client: originClient(targetUrl.Hostname()), url: targetUrl.String()}
+
+	// The first block tells whether the origin serves ranges of a TIFF
+	if _, err := reader.ReadAt(make([]byte, 8), 0); err != nil {
+		return nil, err
+	}
+	if reader.contentType != "image/tiff" && reader.contentType != "image/tif" {
+		return nil, fmt.Errorf("unexpected content type %q", reader.contentType)
+	}
+	return pipeline.ExtractTIFFLevel(reader, width, height, maxImageSize)
+}
+
+// rangeReader reads a source with HTTP range requests. The last block read is kept for the reads that follow.
+type rangeReader struct {
+	ctx         context.Context
+	client      *http.Client
+	url         string
+	contentType string // of the first response
+
+	blockOffset int64
+	block       []byte
+}
+
+func (rr *rangeReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= rr.blockOffset && off+int64(len(p)) <= rr.blockOffset+int64(len(rr.block)) {
+		return copy(p, rr.block[off-rr.blockOffset:]), nil
+	}
+
+	length := int64(len(p))
+	if length < rangeBlockSize {
+		length = rangeBlockSize
+	}
+	req, err := http.NewRequestWithContext(rr.ctx, "GET", rr.url, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("User-Agent", "image-gem/v1.0")
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+length-1))
+	resp, err := rr.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return 0, fmt.Errorf("Received a %d status code from the server", resp.StatusCode)
+	}
+	if rr.contentType == "" {
+		rr.contentType = resp.Header.Get("Content-Type")
+	}
+
+	block, err := io.ReadAll(io.LimitReader(resp.Body, length))
+	if err != nil {
+		return 0, err
+	}
+	rr.blockOffset, rr.block = off, block
+
+	n := copy(p, block)
+	if n < len(p) {
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, nil
+}
@@ -0,0 +1,87 @@
+package v1
+
+import (
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/arkami8/image-gem/config"
+
+	"golang.org/x/time/rate"
+)
+
+// originLimiters holds an *originLimiter per origin host.
+var originLimiters sync.Map
+
+// originLimiter limits the rate of requests to an origin host and the number of them in flight.
+type originLimiter struct {
+	rate  *rate.Limiter // nil when the rate isn't limited
+	slots chan struct{} // nil when concurrency isn't limited
+}
+
+func limiterForHost(host string) *originLimiter {
+	if limiter, ok := originLimiters.Load(host); ok {
+		return limiter.(*originLimiter)
+	}
+
+	limiter := &originLimiter{}
+	if config.OriginRequestsPerSecond > 0 {
+		limiter.rate = rate.NewLimiter(rate.Limit(config.OriginRequestsPerSecond), config.OriginBurst)
+	}
+	if config.OriginMaxConcurrent > 0 {
+		limiter.slots = make(chan struct{}, config.OriginMaxConcurrent)
+	}
+	actual, _ := originLimiters.LoadOrStore(host, limiter)
+	return actual.(*originLimiter)
+}
+
+// limitedTransport waits for the origin's limits before sending a request. A request holds its concurrency
+// slot until the response body is closed, so slow downloads count as in flight.
+type limitedTransport struct {
+	base http.RoundTripper
+}
+
+func (t *limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	limiter := limiterForHost(req.URL.Host)
+
+	if limiter.slots != nil {
+		select {
+		case limiter.slots <- struct{}{}:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+	release := func() {
+		if limiter.slots != nil {
+			<-limiter.slots
+		}
+	}
+
+	if limiter.rate != nil {
+		if err := limiter.rate.Wait(req.Context()); err != nil {
+			release()
+			return nil, err
+		}
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// releasingBody releases the request's concurrency slot when the body is closed.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
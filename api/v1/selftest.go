@@ -0,0 +1,37 @@
+package v1
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/arkami8/image-gem/pipeline"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// selfTestReport is the response of SelfTest.
+type selfTestReport struct {
+	OK      bool                      `json:"ok"`
+	Libvips string                    `json:"libvips"`
+	Results []pipeline.SelfTestResult `json:"results"`
+}
+
+// SelfTest is an HTTP handler that runs pipeline.SelfTest and responds with the outcome of every check as
+// JSON, with status 500 if any of them failed.
+func SelfTest(w http.ResponseWriter, r *http.Request) {
+	report := selfTestReport{
+		OK:      true,
+		Libvips: fmt.Sprintf("%d.%d.%d", vips.MajorVersion, vips.MinorVersion, vips.MicroVersion),
+		Results: pipeline.SelfTest(),
+	}
+	for _, result := range report.Results {
+		report.OK = report.OK && result.OK
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !report.OK {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	_ = json.NewEncoder(w).Encode(report)
+}
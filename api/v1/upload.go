@@ -0,0 +1,114 @@
+package v1
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/arkami8/image-gem/audit"
+	"github.com/arkami8/image-gem/config"
+	"github.com/arkami8/image-gem/pipeline"
+	"github.com/arkami8/image-gem/signature"
+	"github.com/arkami8/image-gem/storage"
+)
+
+// uploadRequest is the body of UploadCreate.
+type uploadRequest struct {
+	ContentType string `json:"contentType"`
+	Params      string `json:"params"`
+}
+
+// uploadTarget is the response of UploadCreate.
+type uploadTarget struct {
+	Key       string            `json:"key"`
+	UploadURL string            `json:"uploadUrl"`
+	Method    string            `json:"method"`
+	Headers   map[string]string `json:"headers"`
+	ExpiresAt time.Time         `json:"expiresAt"`
+	ImageURL  string            `json:"imageUrl"`
+}
+
+// UploadCreate is an HTTP handler that issues a short-lived presigned URL for uploading an original directly
+// to the object store, together with the path that serves the upload transformed with the given parameters.
+func UploadCreate(w http.ResponseWriter, r *http.Request) {
+	if config.ObjectStoreBucket == "" {
+		http.Error(w, "Object store is not configured", http.StatusNotImplemented)
+		return
+	}
+
+	var body uploadRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !isSupportedImageFormat(body.ContentType) {
+		http.Error(w, "Unsupported image format", http.StatusBadRequest)
+		return
+	}
+	params, err := url.ParseQuery(body.Params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := pipeline.ParseOptions(params); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	store := &storage.S3{
+		Endpoint:        config.ObjectStoreEndpoint,
+		Region:          config.ObjectStoreRegion,
+		Bucket:          config.ObjectStoreBucket,
+		AccessKeyID:     config.ObjectStoreAccessKeyID,
+		SecretAccessKey: config.ObjectStoreSecretAccessKey,
+	}
+	key, err := storage.NewKey(config.ObjectStoreUploadPrefix, uploadExtension(body.ContentType))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	expires := time.Duration(config.UploadURLExpirySeconds) * time.Second
+	uploadURL, err := store.PresignPut(key, body.ContentType, expires)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Uploads are fetched from the public URL when it's configured, e.g. a CDN in front of the bucket
+	sourceURL := store.ObjectURL(key)
+	if config.ObjectStorePublicURL != "" {
+		sourceURL = strings.TrimRight(config.ObjectStorePublicURL, "/") + "/" + key
+	}
+	imageURL := "/img/url/" + strings.TrimPrefix(sourceURL, "https://")
+	if config.URLSigningKey != "" {
+		imageURL = signature.SignURL([]byte(config.URLSigningKey), (&url.URL{Path: imageURL}).EscapedPath(), params)
+	} else if len(params) > 0 {
+		imageURL += "?" + params.Encode()
+	}
+
+	audit.Record(r, "upload.issue", key)
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(uploadTarget{
+		Key:       key,
+		UploadURL: uploadURL,
+		Method:    "PUT",
+		Headers:   map[string]string{"Content-Type": body.ContentType},
+		ExpiresAt: time.Now().Add(expires).UTC(),
+		ImageURL:  imageURL,
+	})
+}
+
+func uploadExtension(contentType string) string {
+	switch contentType {
+	case "image/jpeg":
+		return ".jpg"
+	case "image/svg+xml":
+		return ".svg"
+	default:
+		return "." + strings.TrimPrefix(contentType, "image/")
+	}
+}
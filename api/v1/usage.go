@@ -0,0 +1,38 @@
+package v1
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/arkami8/image-gem/statedb"
+)
+
+// UsageList is an HTTP handler that responds with the number and size of the images served per source host
+// and day as JSON, from the "from" to the "to" day (YYYY-MM-DD, UTC) and for the "host" query parameters.
+// Usage is counted in the SQLite or PostgreSQL database; the last few seconds may not be included yet.
+func UsageList(w http.ResponseWriter, r *http.Request) {
+	if !statedb.Enabled() {
+		http.Error(w, "State database is not configured", http.StatusNotImplemented)
+		return
+	}
+
+	query := r.URL.Query()
+	for _, name := range []string{"from", "to"} {
+		if value := query.Get(name); value != "" {
+			if _, err := time.Parse("2006-01-02", value); err != nil {
+				http.Error(w, name+" must be a day as YYYY-MM-DD", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	usage, err := statedb.Default().Usage(query.Get("from"), query.Get("to"), query.Get("host"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(usage)
+}
@@ -0,0 +1,61 @@
+package v1
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arkami8/image-gem/audit"
+	"github.com/arkami8/image-gem/config"
+	"github.com/arkami8/image-gem/pipeline"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// watermarkDetection is the response of WatermarkDetect.
+type watermarkDetection struct {
+	Found    bool       `json:"found"`
+	ID       string     `json:"id,omitempty"`
+	Embedded *time.Time `json:"embedded,omitempty"`
+}
+
+// WatermarkDetect is an HTTP handler that reads the invisible watermark from an image posted as the request body
+// and responds with the embedded ID and time as JSON.
+func WatermarkDetect(w http.ResponseWriter, r *http.Request) {
+	if config.WatermarkKey == "" {
+		http.Error(w, "Watermarking is not configured", http.StatusNotImplemented)
+		return
+	}
+
+	data, err := io.ReadAll(&countingReader{reader: r.Body, maxImageSize: maxImageSize})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	img, err := vips.NewImageFromBuffer(data)
+	if err != nil {
+		http.Error(w, "Failed to decode image", http.StatusBadRequest)
+		return
+	}
+	defer img.Close()
+
+	detection := watermarkDetection{}
+	payload, err := pipeline.DetectWatermark(img, config.WatermarkKey)
+	if err == nil {
+		detection.Found = true
+		id, timestamp, _ := strings.Cut(payload, "|")
+		detection.ID = id
+		if seconds, err := strconv.ParseInt(timestamp, 10, 64); err == nil {
+			embedded := time.Unix(seconds, 0).UTC()
+			detection.Embedded = &embedded
+		}
+	}
+	audit.Record(r, "watermark.detect", payload)
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(detection)
+}
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/arkami8/image-gem/audit"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// startTime is when the process started, for the uptime in /varz.
+var startTime = time.Now()
+
+// varz are the process variables served by /varz.
+type varz struct {
+	UptimeSeconds    int64  `json:"uptimeSeconds"`
+	Goroutines       int    `json:"goroutines"`
+	HeapBytes        uint64 `json:"heapBytes"`
+	SysBytes         uint64 `json:"sysBytes"`
+	GCCycles         uint32 `json:"gcCycles"`
+	VipsMemBytes     int64  `json:"vipsMemBytes"`
+	VipsMemHighBytes int64  `json:"vipsMemHighBytes"`
+	VipsOpenFiles    int64  `json:"vipsOpenFiles"`
+	VipsAllocations  int64  `json:"vipsAllocations"`
+}
+
+// varzHandler serves the memory and runtime state of the process as JSON, with the same token as /metrics.
+// Tenant tokens aren't accepted, as the numbers are shared by all tenants.
+func varzHandler(w http.ResponseWriter, r *http.Request) {
+	if !metricsAuthorized(r) {
+		audit.Record(r, "metrics.unauthorized", "")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	var vipsMem vips.MemoryStats
+	vips.ReadVipsMemStats(&vipsMem)
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(varz{
+		UptimeSeconds:    int64(time.Since(startTime).Seconds()),
+		Goroutines:       runtime.NumGoroutine(),
+		HeapBytes:        mem.HeapAlloc,
+		SysBytes:         mem.Sys,
+		GCCycles:         mem.NumGC,
+		VipsMemBytes:     vipsMem.Mem,
+		VipsMemHighBytes: vipsMem.MemHigh,
+		VipsOpenFiles:    vipsMem.Files,
+		VipsAllocations:  vipsMem.Allocs,
+	})
+}
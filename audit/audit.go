@@ -0,0 +1,133 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/arkami8/image-gem/geo"
+)
+
+// Event is a single entry in the audit log.
+type Event struct {
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"`
+	RemoteIP string    `json:"remote_ip,omitempty"`
+	Country  string    `json:"country,omitempty"`
+	Path     string    `json:"path,omitempty"`
+	Detail   string    `json:"detail,omitempty"`
+}
+
+// logger is an append-only JSON lines writer that rotates its file once it grows past maxSize bytes.
+type logger struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+var std *logger
+
+// Init opens (or creates) the audit log at path. Once the file exceeds maxSize bytes it is
+// rotated to path.1, path.2, ... keeping at most maxBackups old files. Until Init is called,
+// Record is a no-op.
+func Init(path string, maxSize int64, maxBackups int) error {
+	l := &logger{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := l.open(); err != nil {
+		return err
+	}
+	std = l
+	return nil
+}
+
+// Record appends an event for the given action to the audit log. The request, if any,
+// supplies the remote address, country and path of the caller.
+func Record(r *http.Request, action, detail string) {
+	if std == nil {
+		return
+	}
+
+	event := Event{
+		Time:   time.Now().UTC(),
+		Action: action,
+		Detail: detail,
+	}
+	if r != nil {
+		event.RemoteIP = r.RemoteAddr
+		event.Country = geo.FromContext(r.Context())
+		event.Path = r.URL.Path
+	}
+
+	if err := std.write(event); err != nil {
+		log.Printf("error: cannot write audit event %s: %s", action, err.Error())
+	}
+}
+
+func (l *logger) open() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+func (l *logger) write(event Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.maxSize > 0 && l.size+int64(len(line)) > l.maxSize && l.size > 0 {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	return err
+}
+
+// rotate shifts the existing backups up by one, moves the current file to path.1 and opens a new one.
+func (l *logger) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+
+	if l.maxBackups < 1 {
+		if err := os.Remove(l.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return l.open()
+	}
+
+	for i := l.maxBackups - 1; i >= 1; i-- {
+		from := fmt.Sprintf("%s.%d", l.path, i)
+		to := fmt.Sprintf("%s.%d", l.path, i+1)
+		if err := os.Rename(from, to); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		return err
+	}
+
+	return l.open()
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/arkami8/image-gem/api"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// benchResult is the outcome of a single request.
+type benchResult struct {
+	latency time.Duration
+	status  int
+	bytes   int64
+	err     error
+}
+
+// Bench runs the bench subcommand. It replays the request paths in a file, one per line, against a running
+// instance or, without -target, against the handler in-process, and reports latency percentiles. In-process
+// runs also report the Go heap and libvips memory high-water marks.
+//
+//	bench -urls urls.txt -target http://localhost:8080 -c 16 -n 5000
+func Bench(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	urlsFile := fs.String("urls", "", "file of request paths such as /img/url/example.com/a.jpg?w=300, one per line")
+	target := fs.String("target", "", "base URL of a running instance; requests are served in-process if empty")
+	concurrency := fs.Int("c", 8, "number of concurrent requests")
+	total := fs.Int("n", 0, "number of requests to send, cycling through the file (default: one per line)")
+	_ = fs.Parse(args)
+
+	if *urlsFile == "" {
+		return fmt.Errorf("-urls is required")
+	}
+	paths, err := readBenchPaths(*urlsFile)
+	if err != nil {
+		return err
+	}
+	if *total <= 0 {
+		*total = len(paths)
+	}
+	if *concurrency <= 0 {
+		*concurrency = 1
+	}
+
+	send := benchRemote(strings.TrimRight(*target, "/"))
+	if *target == "" {
+		send = benchInProcess(api.NewRouter())
+	}
+
+	// Sample the heap while the requests run; the runtime only reports the current size
+	var peakHeap uint64
+	stopSampling := make(chan struct{})
+	samplingDone := make(chan struct{})
+	go func() {
+		defer close(samplingDone)
+		var stats runtime.MemStats
+		for {
+			runtime.ReadMemStats(&stats)
+			if stats.HeapAlloc > peakHeap {
+				peakHeap = stats.HeapAlloc
+			}
+			select {
+			case <-stopSampling:
+				return
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+	}()
+
+	results := make([]benchResult, *total)
+	var next int64 = -1
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				n := atomic.AddInt64(&next, 1)
+				if n >= int64(*total) {
+					return
+				}
+				results[n] = send(paths[n%int64(len(paths))])
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	close(stopSampling)
+	<-samplingDone
+
+	printBenchReport(results, elapsed)
+	if *target == "" {
+		var vipsStats vips.MemoryStats
+		vips.ReadVipsMemStats(&vipsStats)
+		fmt.Printf("memory:     go heap peak %s, vips high-water %s\n", formatBytes(int64(peakHeap)), formatBytes(vipsStats.MemHigh))
+	}
+	return nil
+}
+
+// readBenchPaths reads the request paths in the file, see parseRequestPaths.
+func readBenchPaths(name string) ([]string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	paths, err := parseRequestPaths(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no request paths in %s", name)
+	}
+	return paths, nil
+}
+
+// parseRequestPaths reads request paths, one per line. Lines can also be absolute URLs, or access log lines
+// in the common or combined log format whose GET requests are replayed. Empty lines, comments starting with
+// # and log lines of other methods are skipped.
+func parseRequestPaths(reader io.Reader) ([]string, error) {
+	var paths []string
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, request, found := strings.Cut(line, `"`); found {
+			method, rest, _ := strings.Cut(request, " ")
+			if method != "GET" {
+				continue
+			}
+			line, _, _ = strings.Cut(rest, " ")
+		}
+		if !strings.HasPrefix(line, "/") {
+			parsed, err := url.Parse(line)
+			if err != nil {
+				return nil, fmt.Errorf("invalid URL %s: %v", line, err)
+			}
+			line = parsed.RequestURI()
+		}
+		if _, err := url.ParseRequestURI(line); err != nil {
+			return nil, fmt.Errorf("invalid request path %s: %v", line, err)
+		}
+		paths = append(paths, line)
+	}
+	return paths, scanner.Err()
+}
+
+func benchRemote(target string) func(path string) benchResult {
+	client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: 256}}
+	return func(path string) benchResult {
+		start := time.Now()
+		resp, err := client.Get(target + path)
+		if err != nil {
+			return benchResult{latency: time.Since(start), err: err}
+		}
+		defer resp.Body.Close()
+		n, err := io.Copy(io.Discard, resp.Body)
+		return benchResult{latency: time.Since(start), status: resp.StatusCode, bytes: n, err: err}
+	}
+}
+
+func benchInProcess(handler http.Handler) func(path string) benchResult {
+	return func(path string) benchResult {
+		start := time.Now()
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+		return benchResult{latency: time.Since(start), status: recorder.Code, bytes: int64(recorder.Body.Len())}
+	}
+}
+
+func printBenchReport(results []benchResult, elapsed time.Duration) {
+	latencies := make([]time.Duration, 0, len(results))
+	statuses := map[int]int{}
+	var failed int
+	var bytes int64
+	for _, result := range results {
+		if result.err != nil {
+			failed++
+			continue
+		}
+		latencies = append(latencies, result.latency)
+		statuses[result.status]++
+		bytes += result.bytes
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	fmt.Printf("requests:   %d in %s (%.1f/s), %d failed\n", len(results), elapsed.Round(time.Millisecond), float64(len(results))/elapsed.Seconds(), failed)
+	fmt.Printf("received:   %s\n", formatBytes(bytes))
+
+	codes := make([]int, 0, len(statuses))
+	for code := range statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Printf("status %d: %d\n", code, statuses[code])
+	}
+
+	if len(latencies) > 0 {
+		fmt.Printf("latency:    p50 %s, p90 %s, p99 %s, max %s\n",
+			percentile(latencies, 50), percentile(latencies, 90), percentile(latencies, 99), latencies[len(latencies)-1])
+	}
+}
+
+// percentile returns the p-th percentile of sorted latencies using the nearest-rank method.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1].Round(time.Microsecond)
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,172 @@
+// Package cache stores processed images so repeated requests are served without fetching and transforming
+// the source again. Caches can be stacked in tiers, e.g. memory in front of disk in front of Redis or S3:
+// lookups go through the tiers in order and entries found in a slower tier are copied to the faster ones.
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"time"
+)
+
+// Cache is a store of processed images by key. The keys passed to a Cache are hex-encoded SHA-256 hashes,
+// so they can be used as file names or object keys directly.
+type Cache interface {
+	// Get returns the entry stored under the key, and false if there is none.
+	Get(key string) ([]byte, bool, error)
+	// Set stores an entry, replacing any entry with the same key.
+	Set(key string, data []byte) error
+	// Delete removes an entry. Deleting a missing entry succeeds.
+	Delete(key string) error
+}
+
+// Tiered is a Cache over caches ordered from the fastest to the slowest. Entries are stored in every tier
+// and looked up in order; a hit in a later tier is promoted to the tiers before it. A tier that fails is
+// skipped with a warning, so a Redis or S3 outage only makes the cache slower.
+type Tiered []Cache
+
+func (t Tiered) Get(key string) ([]byte, bool, error) {
+	for i, tier := range t {
+		data, ok, err := tier.Get(key)
+		if err != nil {
+			log.Printf("warning: cache tier %d: %s", i, err.Error())
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		for _, faster := range t[:i] {
+			if err := faster.Set(key, data); err != nil {
+				log.Printf("warning: cannot promote cache entry: %s", err.Error())
+			}
+		}
+		return data, true, nil
+	}
+	return nil, false, nil
+}
+
+func (t Tiered) Set(key string, data []byte) error {
+	var first error
+	for _, tier := range t {
+		if err := tier.Set(key, data); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (t Tiered) Delete(key string) error {
+	var first error
+	for _, tier := range t {
+		if err := tier.Delete(key); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+var std Cache
+
+// Init enables the cache with the given tiers, fastest first, and indexes the metadata of the entries of
+// the tiers that can list them in the background. Until Init is called, Enabled reports false and the other
+// functions do nothing.
+func Init(tiers ...Cache) {
+	std = Tiered(tiers)
+	for _, tier := range tiers {
+		if l, ok := tier.(lister); ok {
+			go indexEntries(l)
+		}
+	}
+}
+
+// Close closes the tiers that need to be, e.g. so that disk tiers save their index.
+func Close() error {
+	tiers, _ := std.(Tiered)
+	var first error
+	for _, tier := range tiers {
+		if closer, ok := tier.(io.Closer); ok {
+			if err := closer.Close(); err != nil && first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// Enabled reports whether the cache has been initialized.
+func Enabled() bool {
+	return std != nil
+}
+
+// Get returns the image cached under the key with its metadata, and counts the hit.
+func Get(key string) ([]byte, Metadata, bool) {
+	if std == nil {
+		return nil, Metadata{}, false
+	}
+
+	id := hash(key)
+	entry, ok, err := std.Get(id)
+	if err != nil {
+		log.Printf("warning: cannot read cache: %s", err.Error())
+		return nil, Metadata{}, false
+	}
+	if !ok {
+		// The entry may have been evicted by a tier's size limit or expiry
+		unindex(id)
+		return nil, Metadata{}, false
+	}
+
+	meta, data := decode(entry)
+	meta.ID = id
+	hit(meta)
+	return data, meta, true
+}
+
+// Set caches an image under the key. The URL, tenant, parameters, source ETag and headers of meta are stored with the
+// image; its ID, creation time and size are set by Set.
+func Set(key string, data []byte, meta Metadata) error {
+	if std == nil {
+		return nil
+	}
+
+	meta.ID, meta.Created, meta.Size, meta.Hits = hash(key), time.Now().UTC(), len(data), 0
+	entry, err := encode(meta, data)
+	if err != nil {
+		return err
+	}
+	if err := std.Set(meta.ID, entry); err != nil {
+		return err
+	}
+	index(meta)
+	return nil
+}
+
+// Delete removes the image cached under the key.
+func Delete(key string) error {
+	return Evict(hash(key))
+}
+
+// ErrInvalidID is returned by Evict for IDs that aren't hashes of a key.
+var ErrInvalidID = errors.New("invalid cache entry ID")
+
+// Evict removes the entry with the given ID.
+func Evict(id string) error {
+	if std == nil {
+		return nil
+	}
+	if _, err := hex.DecodeString(id); err != nil || len(id) != sha256.Size*2 {
+		return ErrInvalidID
+	}
+
+	unindex(id)
+	return std.Delete(id)
+}
+
+func hash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,294 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/arkami8/image-gem/metrics"
+)
+
+// Disk is a Cache of files under a directory, sharded by the first two characters of the key. Beyond a total
+// size, the least recently used files are removed.
+//
+// Each file starts with a header holding the length and CRC-32C checksum of the entry, so truncated and
+// corrupted files are detected when they are read and removed. The index of entries and their last use is
+// saved by Close; after an unclean shutdown it is rebuilt from the files, removing the truncated ones.
+type Disk struct {
+	mu       sync.Mutex
+	dir      string
+	maxBytes int64
+	size     int64
+	used     map[string]diskEntry
+}
+
+type diskEntry struct {
+	Size int64     `json:"size"`
+	Used time.Time `json:"used"`
+}
+
+var (
+	// diskMagic starts the header of disk entries, followed by the length of the entry and its checksum as
+	// big-endian uint32s.
+	diskMagic  = []byte("IGD1")
+	castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+	corruptEntries = metrics.NewCounter("image_gem_cache_corrupt_entries_total",
+		"Disk cache entries removed because they were truncated or corrupted.")
+)
+
+const (
+	diskHeaderSize = 12
+	// diskIndexFile is the index saved by Close, in the cache directory.
+	diskIndexFile = "index.json"
+)
+
+// NewDisk returns a disk cache in dir holding up to maxBytes of entries; 0 doesn't limit its size. Entries
+// already in the directory are kept.
+func NewDisk(dir string, maxBytes int64) (*Disk, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	d := &Disk{dir: dir, maxBytes: maxBytes, used: make(map[string]diskEntry)}
+	if !d.loadIndex() {
+		if err := d.rebuildIndex(); err != nil {
+			return nil, err
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.evict()
+	return d, nil
+}
+
+// loadIndex reads the index saved by Close and removes it, so that it isn't trusted again if the process
+// doesn't shut down cleanly.
+func (d *Disk) loadIndex() bool {
+	path := filepath.Join(d.dir, diskIndexFile)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	if err := os.Remove(path); err != nil || json.Unmarshal(data, &d.used) != nil {
+		d.used = make(map[string]diskEntry)
+		return false
+	}
+
+	for _, entry := range d.used {
+		d.size += entry.Size
+	}
+	return true
+}
+
+// rebuildIndex indexes the files in the directory, ordered by their modification time. Leftovers of
+// interrupted writes and files whose length doesn't match their header are removed.
+func (d *Disk) rebuildIndex() error {
+	removed := 0
+	err := filepath.WalkDir(d.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || filepath.Dir(path) == filepath.Clean(d.dir) {
+			return err
+		}
+		if entry.Name()[0] == '.' || !d.validFile(path) {
+			removed++
+			return os.Remove(path)
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		d.used[entry.Name()] = diskEntry{Size: info.Size(), Used: info.ModTime()}
+		d.size += info.Size()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(d.used) > 0 || removed > 0 {
+		log.Printf("warning: disk cache %s wasn't closed cleanly, indexed %d entries and removed %d damaged files", d.dir, len(d.used), removed)
+	}
+	return nil
+}
+
+// validFile reports whether the file has a header matching its length. Checksums are only verified on read.
+func (d *Disk) validFile(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	header := make([]byte, diskHeaderSize)
+	if _, err := io.ReadFull(file, header); err != nil || !bytes.Equal(header[:4], diskMagic) {
+		return false
+	}
+	info, err := file.Stat()
+	return err == nil && info.Size() == diskHeaderSize+int64(binary.BigEndian.Uint32(header[4:]))
+}
+
+// Close saves the index, so the next NewDisk on the directory doesn't need to rebuild it.
+func (d *Disk) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	data, err := json.Marshal(d.used)
+	if err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(d.dir, diskIndexFile), data)
+}
+
+func (d *Disk) Get(key string) ([]byte, bool, error) {
+	file, err := os.ReadFile(d.path(key))
+	if os.IsNotExist(err) {
+		d.forget(key)
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	if len(file) < diskHeaderSize || !bytes.Equal(file[:4], diskMagic) ||
+		int64(binary.BigEndian.Uint32(file[4:])) != int64(len(file)-diskHeaderSize) ||
+		binary.BigEndian.Uint32(file[8:]) != crc32.Checksum(file[diskHeaderSize:], castagnoli) {
+		log.Printf("warning: removing damaged disk cache entry %s", key)
+		corruptEntries.Inc()
+		return nil, false, d.Delete(key)
+	}
+
+	d.mu.Lock()
+	if entry, ok := d.used[key]; ok {
+		entry.Used = time.Now()
+		d.used[key] = entry
+	}
+	d.mu.Unlock()
+	return file[diskHeaderSize:], true, nil
+}
+
+func (d *Disk) Set(key string, data []byte) error {
+	file := make([]byte, diskHeaderSize, diskHeaderSize+len(data))
+	copy(file, diskMagic)
+	binary.BigEndian.PutUint32(file[4:], uint32(len(data)))
+	binary.BigEndian.PutUint32(file[8:], crc32.Checksum(data, castagnoli))
+	file = append(file, data...)
+	if err := writeFile(d.path(key), file); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.size += int64(len(file)) - d.used[key].Size
+	d.used[key] = diskEntry{Size: int64(len(file)), Used: time.Now()}
+	d.evict()
+	return nil
+}
+
+func (d *Disk) Delete(key string) error {
+	if err := os.Remove(d.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	d.forget(key)
+	return nil
+}
+
+// forget removes an entry from the index.
+func (d *Disk) forget(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.size -= d.used[key].Size
+	delete(d.used, key)
+}
+
+// evict removes the least recently used entries when the cache exceeds maxBytes, down to 90% of it so
+// that the entries aren't sorted again on every write.
+func (d *Disk) evict() {
+	if d.maxBytes <= 0 || d.size <= d.maxBytes {
+		return
+	}
+	target := d.maxBytes - d.maxBytes/10
+
+	keys := make([]string, 0, len(d.used))
+	for key := range d.used {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return d.used[keys[i]].Used.Before(d.used[keys[j]].Used) })
+
+	for _, key := range keys {
+		if d.size <= target {
+			break
+		}
+		if err := os.Remove(d.path(key)); err != nil && !os.IsNotExist(err) {
+			continue
+		}
+		d.size -= d.used[key].Size
+		delete(d.used, key)
+	}
+}
+
+func (d *Disk) path(key string) string {
+	return filepath.Join(d.dir, key[:2], key)
+}
+
+// writeFile writes data to a temporary file and renames it into place, so readers never see partial files.
+func writeFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Keys returns the keys of the entries on disk.
+func (d *Disk) Keys() ([]string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	keys := make([]string, 0, len(d.used))
+	for key := range d.used {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// Head returns up to the first n bytes of an entry.
+func (d *Disk) Head(key string, n int) ([]byte, error) {
+	file, err := os.Open(d.path(key))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	head := make([]byte, diskHeaderSize+n)
+	read, err := io.ReadFull(file, head)
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	if read < diskHeaderSize {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return head[diskHeaderSize:read], err
+}
@@ -0,0 +1,73 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Memory is a Cache in memory that evicts the least recently used entries beyond a total size.
+type Memory struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	entries  map[string]*list.Element
+	lru      *list.List // of *memoryEntry, most recently used first
+}
+
+type memoryEntry struct {
+	key  string
+	data []byte
+}
+
+// NewMemory returns an empty memory cache holding up to maxBytes of entries.
+func NewMemory(maxBytes int64) *Memory {
+	return &Memory{maxBytes: maxBytes, entries: make(map[string]*list.Element), lru: list.New()}
+}
+
+func (m *Memory) Get(key string) ([]byte, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	element, ok := m.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	m.lru.MoveToFront(element)
+	return element.Value.(*memoryEntry).data, true, nil
+}
+
+func (m *Memory) Set(key string, data []byte) error {
+	// Entries that would evict everything else aren't worth keeping
+	if int64(len(data)) > m.maxBytes/2 {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.remove(key)
+	m.entries[key] = m.lru.PushFront(&memoryEntry{key: key, data: data})
+	m.size += int64(len(data))
+	for m.size > m.maxBytes {
+		m.remove(m.lru.Back().Value.(*memoryEntry).key)
+	}
+	return nil
+}
+
+func (m *Memory) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.remove(key)
+	return nil
+}
+
+func (m *Memory) remove(key string) {
+	element, ok := m.entries[key]
+	if !ok {
+		return
+	}
+	m.lru.Remove(element)
+	delete(m.entries, key)
+	m.size -= int64(len(element.Value.(*memoryEntry).data))
+}
@@ -0,0 +1,182 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metadata describes a cache entry.
+type Metadata struct {
+	// ID identifies the entry, it is the hash of its key.
+	ID string `json:"id"`
+	// URL is the source URL the image was made from, and Tenant the host it belongs to.
+	URL    string `json:"url"`
+	Tenant string `json:"tenant"`
+	// Params are the query parameters of the request that made the image.
+	Params string `json:"params"`
+	// SourceETag is the ETag of the source when it was fetched, if the origin sent one.
+	SourceETag string `json:"sourceETag,omitempty"`
+	// Headers are the origin response headers served with the image.
+	Headers map[string]string `json:"headers,omitempty"`
+	Created time.Time         `json:"created"`
+	Size    int               `json:"size"`
+	// Hits counts the requests this instance served from the entry. It isn't stored in the tiers.
+	Hits int64 `json:"hits"`
+}
+
+// entryMagic starts entries with metadata: the magic, the length of the JSON metadata as a big-endian
+// uint32, the metadata, then the image. Entries without it are images without metadata.
+var entryMagic = []byte("IGC1")
+
+// maxIndexed limits the number of entries whose metadata is kept in memory.
+const maxIndexed = 100000
+
+var (
+	indexMu sync.Mutex
+	indexed = make(map[string]*Metadata)
+)
+
+func encode(meta Metadata, data []byte) ([]byte, error) {
+	header, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := make([]byte, 0, len(entryMagic)+4+len(header)+len(data))
+	entry = append(entry, entryMagic...)
+	entry = binary.BigEndian.AppendUint32(entry, uint32(len(header)))
+	entry = append(entry, header...)
+	return append(entry, data...), nil
+}
+
+// decode splits an entry into its metadata and image.
+func decode(entry []byte) (Metadata, []byte) {
+	var meta Metadata
+	length, ok := headerLength(entry)
+	if !ok || len(entry) < len(entryMagic)+4+length || json.Unmarshal(entry[len(entryMagic)+4:len(entryMagic)+4+length], &meta) != nil {
+		meta.Size = len(entry)
+		return meta, entry
+	}
+	return meta, entry[len(entryMagic)+4+length:]
+}
+
+// headerLength returns the length of the metadata of an entry from its first 8 bytes.
+func headerLength(entry []byte) (int, bool) {
+	if len(entry) < len(entryMagic)+4 || !bytes.Equal(entry[:len(entryMagic)], entryMagic) {
+		return 0, false
+	}
+	return int(binary.BigEndian.Uint32(entry[len(entryMagic):])), true
+}
+
+// index adds the metadata of an entry to the index, dropping an arbitrary entry when it is full.
+func index(meta Metadata) {
+	indexMu.Lock()
+	defer indexMu.Unlock()
+
+	if _, ok := indexed[meta.ID]; !ok && len(indexed) >= maxIndexed {
+		for id := range indexed {
+			delete(indexed, id)
+			break
+		}
+	}
+	indexed[meta.ID] = &meta
+}
+
+// hit counts a hit of the entry, indexing its metadata if it isn't yet.
+func hit(meta Metadata) {
+	indexMu.Lock()
+	if indexedMeta, ok := indexed[meta.ID]; ok {
+		indexedMeta.Hits++
+		indexMu.Unlock()
+		return
+	}
+	indexMu.Unlock()
+
+	meta.Hits = 1
+	index(meta)
+}
+
+func unindex(id string) {
+	indexMu.Lock()
+	defer indexMu.Unlock()
+	delete(indexed, id)
+}
+
+// lister is implemented by tiers that can enumerate their entries without reading them in full.
+type lister interface {
+	Keys() ([]string, error)
+	// Head returns up to the first n bytes of an entry.
+	Head(key string, n int) ([]byte, error)
+}
+
+// indexEntries adds the metadata of the entries of the tier to the index.
+func indexEntries(l lister) {
+	keys, err := l.Keys()
+	if err != nil {
+		log.Printf("warning: cannot list cache entries: %s", err.Error())
+		return
+	}
+
+	for _, key := range keys {
+		head, err := l.Head(key, len(entryMagic)+4)
+		if err != nil {
+			continue
+		}
+		length, ok := headerLength(head)
+		if !ok {
+			continue
+		}
+		if head, err = l.Head(key, len(entryMagic)+4+length); err != nil {
+			continue
+		}
+
+		var meta Metadata
+		if json.Unmarshal(head[len(entryMagic)+4:], &meta) == nil && meta.ID == key {
+			indexMu.Lock()
+			_, known := indexed[key]
+			indexMu.Unlock()
+			if !known {
+				index(meta)
+			}
+		}
+	}
+}
+
+// Info returns the metadata of the indexed entry with the given ID.
+func Info(id string) (Metadata, bool) {
+	indexMu.Lock()
+	defer indexMu.Unlock()
+
+	meta, ok := indexed[id]
+	if !ok {
+		return Metadata{}, false
+	}
+	return *meta, true
+}
+
+// List returns the metadata of the indexed entries whose source URL starts with prefix and whose tenant is
+// tenant, ordered by URL. Empty filters match every entry.
+func List(prefix, tenant string) []Metadata {
+	indexMu.Lock()
+	var entries []Metadata
+	for _, meta := range indexed {
+		if strings.HasPrefix(meta.URL, prefix) && (tenant == "" || meta.Tenant == tenant) {
+			entries = append(entries, *meta)
+		}
+	}
+	indexMu.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].URL != entries[j].URL {
+			return entries[i].URL < entries[j].URL
+		}
+		return entries[i].ID < entries[j].ID
+	})
+	return entries
+}
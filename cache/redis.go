@@ -0,0 +1,180 @@
+package cache
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// redisTimeout bounds each command sent to Redis.
+const redisTimeout = 2 * time.Second
+
+// Redis is a Cache in a Redis server, spoken to with the RESP protocol over a small pool of connections.
+type Redis struct {
+	address  string
+	password string
+	db       int
+	prefix   string
+	ttl      time.Duration
+	pool     chan *redisConn
+}
+
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// NewRedis returns a cache in the Redis server at address, using the given database. Keys are prefixed
+// with prefix and expire after ttl; 0 keeps them until Redis evicts them.
+func NewRedis(address, password string, db int, prefix string, ttl time.Duration) *Redis {
+	return &Redis{address: address, password: password, db: db, prefix: prefix, ttl: ttl, pool: make(chan *redisConn, 8)}
+}
+
+func (r *Redis) Get(key string) ([]byte, bool, error) {
+	reply, err := r.do("GET", r.prefix+key)
+	if err != nil {
+		return nil, false, err
+	}
+	if reply == nil {
+		return nil, false, nil
+	}
+	return reply, true, nil
+}
+
+func (r *Redis) Set(key string, data []byte) error {
+	args := []string{"SET", r.prefix + key, string(data)}
+	if r.ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(r.ttl.Milliseconds(), 10))
+	}
+	_, err := r.do(args...)
+	return err
+}
+
+// SetNX stores data at key only if the key doesn't exist yet, expiring it after ttl instead of the cache's
+// TTL, and reports whether it was stored.
+func (r *Redis) SetNX(key string, data []byte, ttl time.Duration) (bool, error) {
+	args := []string{"SET", r.prefix + key, string(data), "NX"}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	}
+	reply, err := r.do(args...)
+	if err != nil {
+		return false, err
+	}
+	return reply != nil, nil
+}
+
+func (r *Redis) Delete(key string) error {
+	_, err := r.do("DEL", r.prefix+key)
+	return err
+}
+
+// do sends a command and returns its reply: the value of bulk strings, nil for nil replies and the text
+// of simple strings and integers.
+func (r *Redis) do(args ...string) ([]byte, error) {
+	conn, err := r.conn()
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := conn.command(args...)
+	var redisErr redisError
+	if err != nil && !errors.As(err, &redisErr) {
+		// The connection may be out of sync with the server
+		conn.conn.Close()
+		return nil, err
+	}
+
+	select {
+	case r.pool <- conn:
+	default:
+		conn.conn.Close()
+	}
+	return reply, err
+}
+
+// conn returns a pooled connection, or a new one that is authenticated and has the database selected.
+func (r *Redis) conn() (*redisConn, error) {
+	select {
+	case conn := <-r.pool:
+		return conn, nil
+	default:
+	}
+
+	netConn, err := net.DialTimeout("tcp", r.address, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{conn: netConn, reader: bufio.NewReader(netConn)}
+	if r.password != "" {
+		if _, err := conn.command("AUTH", r.password); err != nil {
+			netConn.Close()
+			return nil, err
+		}
+	}
+	if r.db != 0 {
+		if _, err := conn.command("SELECT", strconv.Itoa(r.db)); err != nil {
+			netConn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// redisError is an error reply of the server.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+func (c *redisConn) command(args ...string) ([]byte, error) {
+	if err := c.conn.SetDeadline(time.Now().Add(redisTimeout)); err != nil {
+		return nil, err
+	}
+
+	request := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		request = append(request, "$"+strconv.Itoa(len(arg))+"\r\n"...)
+		request = append(request, arg...)
+		request = append(request, "\r\n"...)
+	}
+	if _, err := c.conn.Write(request); err != nil {
+		return nil, err
+	}
+
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 {
+		return nil, fmt.Errorf("redis: invalid reply %q", line)
+	}
+	line = line[:len(line)-2]
+
+	switch line[0] {
+	case '+', ':':
+		return []byte(line[1:]), nil
+	case '-':
+		return nil, redisError(line[1:])
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: invalid reply %q", line)
+		}
+		if length < 0 {
+			return nil, nil
+		}
+		value := make([]byte, length+2)
+		if _, err := io.ReadFull(c.reader, value); err != nil {
+			return nil, err
+		}
+		return value[:length], nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply %q", line)
+	}
+}
@@ -0,0 +1,46 @@
+package cache
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+// ringReplicas is the number of points each peer has on the ring, which evens out the share of keys each
+// peer owns.
+const ringReplicas = 64
+
+// Ring assigns keys to peers by consistent hashing, so that a cluster of instances caches each image on one
+// of them, and adding or removing a peer only moves the keys of its neighbors on the ring.
+type Ring struct {
+	points []uint32
+	owners map[uint32]string
+}
+
+// NewRing returns a ring of the given peers. Every instance of a cluster must use the same peer list.
+func NewRing(peers []string) *Ring {
+	ring := &Ring{owners: make(map[uint32]string, len(peers)*ringReplicas)}
+	for _, peer := range peers {
+		for i := 0; i < ringReplicas; i++ {
+			point := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + peer))
+			ring.points = append(ring.points, point)
+			ring.owners[point] = peer
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool { return ring.points[i] < ring.points[j] })
+	return ring
+}
+
+// Owner returns the peer owning the key, or an empty string if the ring has no peers.
+func (r *Ring) Owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+
+	point := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= point })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
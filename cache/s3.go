@@ -0,0 +1,37 @@
+package cache
+
+import (
+	"errors"
+
+	"github.com/arkami8/image-gem/storage"
+)
+
+// S3 is a Cache of objects in an S3-compatible bucket.
+type S3 struct {
+	store  *storage.S3
+	prefix string
+}
+
+// NewS3 returns a cache of objects under the key prefix in the bucket.
+func NewS3(store *storage.S3, prefix string) *S3 {
+	return &S3{store: store, prefix: prefix}
+}
+
+func (s *S3) Get(key string) ([]byte, bool, error) {
+	data, err := s.store.Get(s.prefix + key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
+func (s *S3) Set(key string, data []byte) error {
+	return s.store.Put(s.prefix+key, "application/octet-stream", data)
+}
+
+func (s *S3) Delete(key string) error {
+	return s.store.Delete(s.prefix + key)
+}
@@ -1,20 +1,563 @@
 package config
 
 import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
 	"strings"
+	"time"
+
+	"github.com/arkami8/image-gem/pipeline"
+	"github.com/arkami8/image-gem/statedb"
+
+	"github.com/davidbyttow/govips/v2/vips"
 )
 
+// CORSPolicy is the CORS configuration of a group of routes.
+type CORSPolicy struct {
+	// AllowedOrigins may make cross-origin requests; "*" or an empty list allows any origin.
+	AllowedOrigins []string `json:"AllowedOrigins"`
+	// AllowedMethods default to GET, POST and HEAD.
+	AllowedMethods []string `json:"AllowedMethods"`
+	// AllowedHeaders are the request headers allowed besides the simple ones, "*" for any.
+	AllowedHeaders []string `json:"AllowedHeaders"`
+	// AllowCredentials lets requests send cookies and authorization. It can't be combined with the "*" origin.
+	AllowCredentials bool `json:"AllowCredentials"`
+	// MaxAgeSeconds is how long browsers may cache preflight responses, 0 for their default.
+	MaxAgeSeconds int `json:"MaxAgeSeconds"`
+}
+
 var (
-	ServerPort         string
-	CORSAllowedOrigins []string
+	ServerPort string
+
+	// CORS is the CORS configuration of the image and other public routes, from the CORSAllowedOrigins,
+	// CORSAllowedMethods, CORSAllowedHeaders, CORSAllowCredentials and CORSMaxAgeSeconds keys.
+	CORS CORSPolicy
+	// AdminCORS is the CORS configuration of the /admin routes, the same as CORS unless set in the config file.
+	AdminCORS CORSPolicy
+
+	// ResponseHeaders are set on every response, replacing the values set by the handlers. They default to
+	// X-Content-Type-Options: nosniff, X-Frame-Options: DENY and X-XSS-Protection: 1; mode=block; headers
+	// missing from the config file keep their defaults and an empty value removes a header.
+	ResponseHeaders map[string]string
+	// OriginHeaders are the headers of origin responses copied to the images made from them, e.g. X-Robots-Tag
+	// or Link. Cached images keep the headers of the response they were made from.
+	OriginHeaders []string
+
+	// ServerReadTimeout, ServerWriteTimeout, ServerIdleTimeout and ServerReadHeaderTimeout configure the HTTP
+	// server. 0 in the config file defaults to 15, 30 and 60 seconds, and to the read timeout for the headers.
+	// ServerMaxHeaderBytes 0 keeps the net/http default of 1MB.
+	ServerReadTimeout       time.Duration
+	ServerWriteTimeout      time.Duration
+	ServerIdleTimeout       time.Duration
+	ServerReadHeaderTimeout time.Duration
+	ServerMaxHeaderBytes    int
+
+	// DomainDefaults maps a source host (or a "*.example.com" wildcard) to the
+	// transformation parameters that are always applied to images from that host.
+	DomainDefaults map[string]url.Values
+
+	// DomainPolicies maps a source host (or a "*.example.com" wildcard) to a policy script that is
+	// evaluated after the request's transformations. See pipeline.Policy for the syntax.
+	DomainPolicies map[string]string
+
+	// AuditLogPath is the file admin actions and signature failures are recorded to. Empty disables auditing.
+	AuditLogPath       string
+	AuditLogMaxSizeMB  int
+	AuditLogMaxBackups int
+	// Digest is the hex SHA-256 of the config file that was read, recorded to the audit log on every load.
+	Digest string
+
+	// AIUpscalerURL is the super-resolution endpoint used for up=ai. Empty disables it in favour of bicubic upscaling.
+	AIUpscalerURL            string
+	AIUpscalerTimeoutSeconds int
+
+	// BackgroundRemoverURL is the rembg-compatible endpoint used for bg=remove. Empty disables background removal.
+	BackgroundRemoverURL            string
+	BackgroundRemoverTimeoutSeconds int
+
+	// ModerationURL is the NSFW/abuse classification endpoint every processed image is checked with. Empty disables moderation.
+	// Images scoring at or above ModerationThreshold are handled according to ModerationAction ("block" or "blur").
+	// ModerationFailOpen serves images when the classifier is unavailable instead of refusing them.
+	ModerationURL            string
+	ModerationThreshold      float64
+	ModerationAction         string
+	ModerationFailOpen       bool
+	ModerationTimeoutSeconds int
+
+	// WatermarkKey is the secret that invisible watermarks (wm=) are embedded and detected with. Empty disables them.
+	WatermarkKey string
+
+	// AdminToken is the bearer token required by the /admin endpoints. Empty disables them.
+	AdminToken string
+	// DebugToken is a bearer token that makes image responses list the policy decisions made for them in an
+	// X-Image-Policy header, for support investigations; AdminToken does too. Empty only accepts AdminToken.
+	DebugToken string
+
+	// DedupStoreDir is the directory source images and outputs are stored in by content hash. Empty disables the store.
+	// A source URL is served from the store without fetching it again for DedupURLTTLSeconds after it was fetched.
+	DedupStoreDir      string
+	DedupURLTTLSeconds int
+
+	// OriginTLSConfigs maps a source host (or a "*.example.com" wildcard) to the TLS settings, including the
+	// client certificate, used to fetch images from origins that require mutual TLS.
+	OriginTLSConfigs map[string]*tls.Config
+
+	// OriginHeadCheck sends a HEAD request before fetching a source so oversized images are rejected without downloading them.
+	OriginHeadCheck bool
+
+	// TrustedProxies are the networks of the load balancers and proxies whose client IP headers
+	// (Forwarded, X-Forwarded-For, X-Real-IP) are believed.
+	TrustedProxies []*net.IPNet
+
+	// TLSFingerprintHeader is the header a TLS-terminating trusted proxy puts the JA3 fingerprint of the
+	// client in, e.g. X-JA3-Fingerprint, for the bot hook. Empty ignores it. See api.SetBotHook.
+	TLSFingerprintHeader string
+
+	// Restrictions limit the operations, formats and values every request may use, and DomainRestrictions
+	// add further limits for images from a source host (or a "*.example.com" wildcard).
+	Restrictions       pipeline.Restrictions
+	DomainRestrictions map[string]pipeline.Restrictions
+
+	// ObjectStoreBucket is the S3-compatible bucket clients upload originals to with URLs from /admin/uploads.
+	// Empty disables uploads. Uploaded objects are served from ObjectStorePublicURL when it is set.
+	ObjectStoreEndpoint        string
+	ObjectStoreRegion          string
+	ObjectStoreBucket          string
+	ObjectStoreAccessKeyID     string
+	ObjectStoreSecretAccessKey string
+	ObjectStorePublicURL       string
+	ObjectStoreUploadPrefix    string
+	UploadURLExpirySeconds     int
+
+	// LadderWidths, LadderFormats and LadderQualities are the encodings /img/ladder reports sizes for.
+	LadderWidths    []int
+	LadderFormats   []string
+	LadderQualities []int
+
+	// MaxUpscaleFactor caps how much up=true enlarges images. 0 in the config file defaults to 4.
+	MaxUpscaleFactor float64
+
+	// Degradation lowers the cost of encoding while the server is busy, to keep latency bounded during
+	// traffic spikes. Zero thresholds never degrade.
+	Degradation DegradationConfig
+	// Priority queues image processing by the priority class of requests, so that interactive traffic is
+	// processed before batch and backfill traffic.
+	Priority PriorityConfig
+
+	// MetricsEnabled exposes request and image metrics in the Prometheus format on /metrics.
+	MetricsEnabled bool
+	// MetricsToken is the bearer token /metrics and /varz require; empty leaves them open. MetricsTenants split
+	// the image metrics by tenant, keyed by name: images from the Hosts of a tenant are labelled with its
+	// name and others with "other", and the Token of a tenant scrapes only its own series from /metrics.
+	MetricsToken   string
+	MetricsTenants map[string]MetricsTenant
+
+	// CompressionBrotli enables brotli compression of SVG, JSON and text responses for clients that accept it.
+	CompressionBrotli bool
+
+	// SanitizeSVG strips scripts, event handlers and external references from SVGs served from origins.
+	// It is enabled unless the config file sets it to false.
+	SanitizeSVG bool
+
+	// MaxURLLength, MaxQueryParams and MaxRepeatedParams limit the size of request URLs. 0 in the config
+	// file defaults to 8192 bytes, 64 parameters and 4 occurrences of the same key.
+	MaxURLLength      int
+	MaxQueryParams    int
+	MaxRepeatedParams int
+
+	// OriginRequestsPerSecond and OriginMaxConcurrent limit the requests sent to each origin host; 0 doesn't
+	// limit them. OriginBurst is the number of requests that may be sent at once before the rate applies,
+	// 0 in the config file defaults to 1.
+	OriginRequestsPerSecond float64
+	OriginBurst             int
+	OriginMaxConcurrent     int
+
+	// CrawlerUserAgents are case-insensitive substrings of the user agents of crawlers. Their requests share
+	// CrawlerRequestsPerSecond (0 doesn't limit them, CrawlerBurst defaults to 1) and are served at
+	// CrawlerQuality unless they ask for a quality (0 keeps the usual default).
+	CrawlerUserAgents        []string
+	CrawlerRequestsPerSecond float64
+	CrawlerBurst             int
+	CrawlerQuality           int
+
+	// GeoIPDatabase is the path of a MaxMind country or city database for looking up the country of clients.
+	// Empty disables the country rules below.
+	GeoIPDatabase string
+	// BlockedCountries are the ISO country codes of clients that are refused, and DomainBlockedCountries those
+	// that are refused images from a source host (or a "*.example.com" wildcard).
+	BlockedCountries       []string
+	DomainBlockedCountries map[string][]string
+	// CountryRequestsPerSecond limits the requests from each of the listed countries, shared by their clients.
+	CountryRequestsPerSecond map[string]float64
+
+	// URLSigningKey is the HMAC key image URLs must be signed with. Empty serves unsigned URLs.
+	// Nonces of single-use URLs are kept in NonceStoreDir or the Redis server of NonceStore, or in memory if
+	// neither is set. Instances behind a load balancer need a store they share.
+	URLSigningKey string
+	NonceStoreDir string
+	NonceStore    NonceStoreConfig
+	// SessionCookieName is the cookie that authorizes unsigned URLs with a session signed with URLSigningKey.
+	// It defaults to "image_gem_session".
+	SessionCookieName string
+	// SourceURLKey is the AES key of encrypted source URLs (/img/enc/), hex-encoded in the config file as 16,
+	// 24 or 32 bytes. Empty disables them.
+	SourceURLKey []byte
+
+	// AutoFormats are the output formats format=auto chooses from for animated, transparent and opaque
+	// images, in order of preference. The first format the client accepts is used, or the last one if it
+	// accepts none of them. Classes missing from the config file keep their defaults.
+	AutoFormats map[string][]vips.ImageType
+
+	// DisabledFormats are image formats that are neither decoded nor encoded, e.g. to reduce the attack surface.
+	// Formats can also be left out of the build, see pipeline.DisableFormats.
+	DisabledFormats []string
+
+	// LUTs are named tone curves for lut=, e.g. the filters of a filter pack, in the syntax of
+	// pipeline.ParseCurves. Invalid curves are rejected at startup.
+	LUTs map[string]string
+
+	// FormatMaxDimensions caps the output dimensions per format, e.g. to keep AVIF encodes at 4K. Larger
+	// images are shrunk to fit after all other transformations. It is keyed by format name in the config file.
+	FormatMaxDimensions map[vips.ImageType]Dimensions
+
+	// Peers are the base URLs of the instances of a cluster, e.g. http://10.0.0.1:8080, and PeerSelf is the one
+	// of this instance. Each processed image is requested from the peer owning its cache key, so the cluster
+	// keeps one copy of it instead of one per instance. The list must be the same on every instance.
+	Peers    []string
+	PeerSelf string
+
+	// PrewarmURLs is a file or http(s) URL listing request paths or access log lines, which are requested
+	// in-process on startup to fill the cache. /ready reports 503 until they are done, or PrewarmTimeout
+	// has passed. PrewarmConcurrency requests are processed at once.
+	PrewarmURLs        string
+	PrewarmConcurrency int
+	PrewarmTimeout     time.Duration
+
+	// CacheTiers are the caches processed images are stored in, fastest first, e.g. memory, then disk, then
+	// Redis or S3. Images found in a later tier are copied to the earlier ones. Empty disables the cache.
+	CacheTiers []CacheTier
+
+	// LinkStore is where the short links served at /i/{id} are kept. An empty Type disables them.
+	LinkStore LinkStoreConfig
+
+	// SQLitePath is an SQLite database for single-node deployments, created if needed, and PostgresURL a
+	// postgres:// URL of a PostgreSQL database shared by a cluster; only one can be set. The database counts
+	// the images served per source host and day, listed by /admin/usage, and stores the short links of a
+	// LinkStore of Type sqlite or postgres. Its schema is migrated on startup.
+	SQLitePath  string
+	PostgresURL string
+
+	// SelfHosts are other host names this server is reachable at, e.g. behind a CDN. Image URLs of these hosts,
+	// or of the request's host, used as sources are processed in-process instead of being fetched.
+	SelfHosts []string
+
+	// IIIFTileSize is the tile size deep zoom viewers are told to request from the IIIF endpoint.
+	IIIFTileSize int
+
+	// RangeFetch reads TIFF sources with HTTP range requests when only a thumbnail is needed, downloading
+	// only the pyramid level the output is made from instead of the whole original.
+	RangeFetch bool
+
+	// StrictParams rejects requests with unknown query parameters, as if they all had strict=true.
+	StrictParams bool
+
+	// VipsCache bounds the libvips operation cache of the whole process, and VipsCacheClasses bounds it after
+	// requests for animated and still images, e.g. to drop it after animations, whose operations are rarely
+	// reused. See pipeline.OperationCacheLimits.
+	VipsCache        pipeline.OperationCacheLimits
+	VipsCacheClasses map[string]pipeline.OperationCacheLimits
+)
+
+// defaultCrawlerUserAgents are the crawlers recognized when CrawlerUserAgents isn't in the config file.
+var defaultCrawlerUserAgents = []string{
+	"googlebot", "bingbot", "yandexbot", "baiduspider", "duckduckbot", "slurp", "applebot",
+	"ahrefsbot", "semrushbot", "mj12bot", "dotbot", "petalbot", "bytespider", "gptbot", "ccbot",
+}
+
+// upperCase returns a copy of the country codes in upper case.
+func upperCase(codes []string) []string {
+	upper := make([]string, len(codes))
+	for i, code := range codes {
+		upper[i] = strings.ToUpper(code)
+	}
+	return upper
+}
+
+// supportedFormats returns the formats that pipeline.FormatSupported reports supported, in order.
+func supportedFormats(formats ...vips.ImageType) []vips.ImageType {
+	var supported []vips.ImageType
+	for _, format := range formats {
+		if pipeline.FormatSupported(format) {
+			supported = append(supported, format)
+		}
+	}
+	return supported
+}
+
+func validPriority(class string) bool {
+	return class == PriorityInteractive || class == PriorityBatch
+}
+
+// secondsOrDefault converts a number of seconds from the config file to a duration, using the default
+// number of seconds when it isn't positive.
+func secondsOrDefault(seconds, defaultSeconds int) time.Duration {
+	if seconds <= 0 {
+		seconds = defaultSeconds
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func (p *CORSPolicy) validate() error {
+	if p.MaxAgeSeconds < 0 {
+		return fmt.Errorf("negative MaxAgeSeconds: %d", p.MaxAgeSeconds)
+	}
+	if p.AllowCredentials {
+		for _, origin := range p.AllowedOrigins {
+			if origin == "*" {
+				return fmt.Errorf("credentials can't be allowed for the * origin")
+			}
+		}
+	}
+	return nil
+}
+
+// CacheTier configures a tier of the cache of processed images.
+type CacheTier struct {
+	// Type is memory, disk, redis or s3.
+	Type string `json:"Type"`
+	// MaxBytes limits the size of memory and disk tiers; it is required for memory tiers.
+	MaxBytes int64 `json:"MaxBytes"`
+	// Dir is the directory of disk tiers.
+	Dir string `json:"Dir"`
+	// Address, Password and DB locate the server of redis tiers, whose entries expire after TTLSeconds.
+	Address    string `json:"Address"`
+	Password   string `json:"Password"`
+	DB         int    `json:"DB"`
+	TTLSeconds int    `json:"TTLSeconds"`
+	// Prefix is prepended to the keys of redis and s3 tiers. s3 tiers use the ObjectStore settings.
+	Prefix string `json:"Prefix"`
+}
+
+// LinkStoreConfig configures the store of short links.
+type LinkStoreConfig struct {
+	// Type is redis, or sqlite or postgres to keep the links in SQLitePath or PostgresURL.
+	Type string `json:"Type"`
+	// Address, Password and DB locate the Redis server. Links don't expire.
+	Address  string `json:"Address"`
+	Password string `json:"Password"`
+	DB       int    `json:"DB"`
+	// Prefix is prepended to the keys of the links. It defaults to "link:".
+	Prefix string `json:"Prefix"`
+}
+
+// NonceStoreConfig configures a Redis server keeping the nonces of single-use URLs.
+type NonceStoreConfig struct {
+	// Type is redis. Empty keeps the nonces in NonceStoreDir or in memory.
+	Type string `json:"Type"`
+	// Address, Password and DB locate the Redis server. Nonces expire with their URLs.
+	Address  string `json:"Address"`
+	Password string `json:"Password"`
+	DB       int    `json:"DB"`
+	// Prefix is prepended to the keys of the nonces. It defaults to "nonce:".
+	Prefix string `json:"Prefix"`
+}
+
+// DegradationConfig sets when and how much image encoding is degraded under load.
+type DegradationConfig struct {
+	// MaxProcessing is the number of images processed at once, and MaxCPU the fraction of CPU time busy
+	// between 0 and 1, above which images are degraded.
+	MaxProcessing int     `json:"MaxProcessing"`
+	MaxCPU        float64 `json:"MaxCPU"`
+	// Quality caps the quality of degraded images; 0 keeps it. Degraded images are also encoded with the
+	// least effort, and as WebP rather than AVIF when the format is negotiated.
+	Quality int `json:"Quality"`
+}
+
+// Priority classes of image requests.
+const (
+	PriorityInteractive = "interactive"
+	PriorityBatch       = "batch"
 )
 
+// PriorityConfig sets how image requests are queued by priority class.
+type PriorityConfig struct {
+	// MaxProcessing is the number of images processed at once. Further requests wait, and interactive ones
+	// are taken from the queue before batch ones. 0 doesn't queue requests.
+	MaxProcessing int `json:"MaxProcessing"`
+	// MaxBatch is the number of those slots batch requests may hold at once, keeping the others for
+	// interactive requests; 0 lets batch requests use them all.
+	MaxBatch int `json:"MaxBatch"`
+	// APIKeys maps the API keys clients send in the X-Api-Key header to their class. Requests without a known
+	// key are in the Default class, interactive if empty.
+	APIKeys map[string]string `json:"APIKeys"`
+	Default string            `json:"Default"`
+}
+
+// MetricsTenant is a tenant the image metrics are split by.
+type MetricsTenant struct {
+	// Hosts are the source hosts of the tenant's images, or "*.example.com" wildcards.
+	Hosts []string `json:"Hosts"`
+	// Token is the bearer token the tenant's team scrapes its metrics with.
+	Token string `json:"Token"`
+}
+
+// OtherTenant labels the metrics of images from hosts of no tenant.
+const OtherTenant = "other"
+
+// metricsTenantHosts maps the hosts of MetricsTenants to their tenant.
+var metricsTenantHosts map[string]string
+
+// Dimensions is a maximum width and height in pixels; 0 doesn't limit a dimension.
+type Dimensions struct {
+	Width  int `json:"Width"`
+	Height int `json:"Height"`
+}
+
+// clientCertificate is the configuration of the client certificate presented to an origin.
+// CAFile optionally replaces the system roots for verifying the origin's certificate.
+type clientCertificate struct {
+	CertFile string `json:"CertFile"`
+	KeyFile  string `json:"KeyFile"`
+	CAFile   string `json:"CAFile"`
+}
+
 type config struct {
-	ServerPort         string   `json:"ServerPort"`
-	CORSAllowedOrigins []string `json:"CORSAllowedOrigins"`
+	ServerPort string `json:"ServerPort"`
+
+	ServerReadTimeoutSeconds       int `json:"ServerReadTimeoutSeconds"`
+	ServerWriteTimeoutSeconds      int `json:"ServerWriteTimeoutSeconds"`
+	ServerIdleTimeoutSeconds       int `json:"ServerIdleTimeoutSeconds"`
+	ServerReadHeaderTimeoutSeconds int `json:"ServerReadHeaderTimeoutSeconds"`
+	ServerMaxHeaderBytes           int `json:"ServerMaxHeaderBytes"`
+
+	CORSAllowedOrigins   []string    `json:"CORSAllowedOrigins"`
+	CORSAllowedMethods   []string    `json:"CORSAllowedMethods"`
+	CORSAllowedHeaders   []string    `json:"CORSAllowedHeaders"`
+	CORSAllowCredentials bool        `json:"CORSAllowCredentials"`
+	CORSMaxAgeSeconds    int         `json:"CORSMaxAgeSeconds"`
+	AdminCORS            *CORSPolicy `json:"AdminCORS"`
+
+	ResponseHeaders    map[string]string `json:"ResponseHeaders"`
+	OriginHeaders      []string          `json:"OriginHeaders"`
+	DomainDefaults     map[string]string `json:"DomainDefaults"`
+	DomainPolicies     map[string]string `json:"DomainPolicies"`
+	AuditLogPath       string            `json:"AuditLogPath"`
+	AuditLogMaxSizeMB  int               `json:"AuditLogMaxSizeMB"`
+	AuditLogMaxBackups int               `json:"AuditLogMaxBackups"`
+
+	AIUpscalerURL            string `json:"AIUpscalerURL"`
+	AIUpscalerTimeoutSeconds int    `json:"AIUpscalerTimeoutSeconds"`
+
+	BackgroundRemoverURL            string `json:"BackgroundRemoverURL"`
+	BackgroundRemoverTimeoutSeconds int    `json:"BackgroundRemoverTimeoutSeconds"`
+
+	ModerationURL            string  `json:"ModerationURL"`
+	ModerationThreshold      float64 `json:"ModerationThreshold"`
+	ModerationAction         string  `json:"ModerationAction"`
+	ModerationFailOpen       bool    `json:"ModerationFailOpen"`
+	ModerationTimeoutSeconds int     `json:"ModerationTimeoutSeconds"`
+
+	WatermarkKey string `json:"WatermarkKey"`
+	AdminToken   string `json:"AdminToken"`
+	DebugToken   string `json:"DebugToken"`
+
+	DedupStoreDir      string `json:"DedupStoreDir"`
+	DedupURLTTLSeconds int    `json:"DedupURLTTLSeconds"`
+
+	OriginClientCertificates map[string]clientCertificate `json:"OriginClientCertificates"`
+	OriginHeadCheck          bool                         `json:"OriginHeadCheck"`
+
+	TLSFingerprintHeader string `json:"TLSFingerprintHeader"`
+
+	TrustedProxies    []string `json:"TrustedProxies"`
+	CompressionBrotli bool     `json:"CompressionBrotli"`
+	MetricsEnabled    bool     `json:"MetricsEnabled"`
+	SanitizeSVG       *bool    `json:"SanitizeSVG"`
+
+	MetricsToken   string                   `json:"MetricsToken"`
+	MetricsTenants map[string]MetricsTenant `json:"MetricsTenants"`
+
+	MaxURLLength      int `json:"MaxURLLength"`
+	MaxQueryParams    int `json:"MaxQueryParams"`
+	MaxRepeatedParams int `json:"MaxRepeatedParams"`
+
+	StrictParams bool `json:"StrictParams"`
+
+	VipsCache        pipeline.OperationCacheLimits            `json:"VipsCache"`
+	VipsCacheClasses map[string]pipeline.OperationCacheLimits `json:"VipsCacheClasses"`
+
+	RangeFetch bool `json:"RangeFetch"`
+
+	IIIFTileSize int `json:"IIIFTileSize"`
+
+	SelfHosts []string `json:"SelfHosts"`
+
+	CacheTiers  []CacheTier     `json:"CacheTiers"`
+	LinkStore   LinkStoreConfig `json:"LinkStore"`
+	SQLitePath  string          `json:"SQLitePath"`
+	PostgresURL string          `json:"PostgresURL"`
+
+	Peers    []string `json:"Peers"`
+	PeerSelf string   `json:"PeerSelf"`
+
+	PrewarmURLs           string `json:"PrewarmURLs"`
+	PrewarmConcurrency    int    `json:"PrewarmConcurrency"`
+	PrewarmTimeoutSeconds int    `json:"PrewarmTimeoutSeconds"`
+
+	FormatMaxDimensions map[string]Dimensions `json:"FormatMaxDimensions"`
+	DisabledFormats     []string              `json:"DisabledFormats"`
+	LUTs                map[string]string     `json:"LUTs"`
+
+	AutoFormats map[string][]string `json:"AutoFormats"`
+
+	URLSigningKey string           `json:"URLSigningKey"`
+	NonceStoreDir string           `json:"NonceStoreDir"`
+	NonceStore    NonceStoreConfig `json:"NonceStore"`
+
+	SessionCookieName string `json:"SessionCookieName"`
+	SourceURLKey      string `json:"SourceURLKey"`
+
+	GeoIPDatabase            string              `json:"GeoIPDatabase"`
+	BlockedCountries         []string            `json:"BlockedCountries"`
+	DomainBlockedCountries   map[string][]string `json:"DomainBlockedCountries"`
+	CountryRequestsPerSecond map[string]float64  `json:"CountryRequestsPerSecond"`
+
+	CrawlerUserAgents        []string `json:"CrawlerUserAgents"`
+	CrawlerRequestsPerSecond float64  `json:"CrawlerRequestsPerSecond"`
+	CrawlerBurst             int      `json:"CrawlerBurst"`
+	CrawlerQuality           int      `json:"CrawlerQuality"`
+
+	OriginRequestsPerSecond float64 `json:"OriginRequestsPerSecond"`
+	OriginBurst             int     `json:"OriginBurst"`
+	OriginMaxConcurrent     int     `json:"OriginMaxConcurrent"`
+
+	Restrictions       pipeline.Restrictions            `json:"Restrictions"`
+	DomainRestrictions map[string]pipeline.Restrictions `json:"DomainRestrictions"`
+
+	ObjectStoreEndpoint        string `json:"ObjectStoreEndpoint"`
+	ObjectStoreRegion          string `json:"ObjectStoreRegion"`
+	ObjectStoreBucket          string `json:"ObjectStoreBucket"`
+	ObjectStoreAccessKeyID     string `json:"ObjectStoreAccessKeyID"`
+	ObjectStoreSecretAccessKey string `json:"ObjectStoreSecretAccessKey"`
+	ObjectStorePublicURL       string `json:"ObjectStorePublicURL"`
+	ObjectStoreUploadPrefix    string `json:"ObjectStoreUploadPrefix"`
+	UploadURLExpirySeconds     int    `json:"UploadURLExpirySeconds"`
+
+	LadderWidths    []int    `json:"LadderWidths"`
+	LadderFormats   []string `json:"LadderFormats"`
+	LadderQualities []int    `json:"LadderQualities"`
+
+	MaxUpscaleFactor float64           `json:"MaxUpscaleFactor"`
+	Degradation      DegradationConfig `json:"Degradation"`
+	Priority         PriorityConfig    `json:"Priority"`
 }
 
 func ReadConfig() error {
@@ -27,19 +570,557 @@ func ReadConfig() error {
 		panic(err)
 	}
 
-	fmt.Println(string(file))
-
 	err = json.Unmarshal(file, &config)
 	if err != nil {
 		panic(err)
 	}
+	digest := sha256.Sum256(file)
+	Digest = hex.EncodeToString(digest[:])
+
+	// Formats are disabled first, so the format names below are checked against the remaining ones
+	DisabledFormats = config.DisabledFormats
+	if err := pipeline.DisableFormats(DisabledFormats...); err != nil {
+		panic(fmt.Errorf("invalid DisabledFormats: %s", err.Error()))
+	}
+	LUTs = config.LUTs
+	if err := pipeline.SetLUTs(LUTs); err != nil {
+		panic(fmt.Errorf("invalid LUTs: %s", err.Error()))
+	}
 
 	ServerPort = config.ServerPort
 	if ServerPort != "" && !strings.HasPrefix(ServerPort, ":") {
 		ServerPort = fmt.Sprintf(":%s", ServerPort)
 	}
 
-	CORSAllowedOrigins = config.CORSAllowedOrigins
+	ServerReadTimeout = secondsOrDefault(config.ServerReadTimeoutSeconds, 15)
+	ServerWriteTimeout = secondsOrDefault(config.ServerWriteTimeoutSeconds, 30)
+	ServerIdleTimeout = secondsOrDefault(config.ServerIdleTimeoutSeconds, 60)
+	ServerReadHeaderTimeout = secondsOrDefault(config.ServerReadHeaderTimeoutSeconds, 0)
+	ServerMaxHeaderBytes = config.ServerMaxHeaderBytes
+	if ServerMaxHeaderBytes < 0 {
+		panic(fmt.Errorf("invalid ServerMaxHeaderBytes: %d", ServerMaxHeaderBytes))
+	}
+
+	CORS = CORSPolicy{
+		AllowedOrigins:   config.CORSAllowedOrigins,
+		AllowedMethods:   config.CORSAllowedMethods,
+		AllowedHeaders:   config.CORSAllowedHeaders,
+		AllowCredentials: config.CORSAllowCredentials,
+		MaxAgeSeconds:    config.CORSMaxAgeSeconds,
+	}
+	if err := CORS.validate(); err != nil {
+		panic(fmt.Errorf("invalid CORS configuration: %s", err.Error()))
+	}
+	AdminCORS = CORS
+	if config.AdminCORS != nil {
+		AdminCORS = *config.AdminCORS
+		if err := AdminCORS.validate(); err != nil {
+			panic(fmt.Errorf("invalid AdminCORS: %s", err.Error()))
+		}
+	}
+
+	ResponseHeaders = map[string]string{
+		"X-Content-Type-Options": "nosniff",
+		"X-Frame-Options":        "DENY",
+		"X-Xss-Protection":       "1; mode=block",
+	}
+	for name, value := range config.ResponseHeaders {
+		if name == "" {
+			panic(fmt.Errorf("invalid ResponseHeaders: empty header name"))
+		}
+		ResponseHeaders[http.CanonicalHeaderKey(name)] = value
+	}
+	OriginHeaders = make([]string, len(config.OriginHeaders))
+	for i, name := range config.OriginHeaders {
+		if name == "" {
+			panic(fmt.Errorf("invalid OriginHeaders: empty header name"))
+		}
+		OriginHeaders[i] = http.CanonicalHeaderKey(name)
+	}
+
+	DomainDefaults = make(map[string]url.Values, len(config.DomainDefaults))
+	for domain, params := range config.DomainDefaults {
+		values, err := url.ParseQuery(params)
+		if err != nil {
+			panic(fmt.Errorf("invalid defaults for domain %s: %v", domain, err))
+		}
+		DomainDefaults[strings.ToLower(domain)] = values
+	}
+
+	DomainPolicies = make(map[string]string, len(config.DomainPolicies))
+	for domain, script := range config.DomainPolicies {
+		DomainPolicies[strings.ToLower(domain)] = script
+	}
+
+	AuditLogPath = config.AuditLogPath
+	AuditLogMaxSizeMB = config.AuditLogMaxSizeMB
+	if AuditLogMaxSizeMB <= 0 {
+		AuditLogMaxSizeMB = 100
+	}
+	AuditLogMaxBackups = config.AuditLogMaxBackups
+
+	AIUpscalerURL = config.AIUpscalerURL
+	AIUpscalerTimeoutSeconds = config.AIUpscalerTimeoutSeconds
+	if AIUpscalerTimeoutSeconds <= 0 {
+		AIUpscalerTimeoutSeconds = 10
+	}
+
+	BackgroundRemoverURL = config.BackgroundRemoverURL
+	BackgroundRemoverTimeoutSeconds = config.BackgroundRemoverTimeoutSeconds
+	if BackgroundRemoverTimeoutSeconds <= 0 {
+		BackgroundRemoverTimeoutSeconds = 30
+	}
+
+	ModerationURL = config.ModerationURL
+	ModerationThreshold = config.ModerationThreshold
+	if ModerationThreshold <= 0 {
+		ModerationThreshold = 0.8
+	}
+	ModerationAction = config.ModerationAction
+	if ModerationAction == "" {
+		ModerationAction = "block"
+	}
+	if ModerationAction != "block" && ModerationAction != "blur" {
+		panic(fmt.Errorf("invalid ModerationAction: %s", ModerationAction))
+	}
+	ModerationFailOpen = config.ModerationFailOpen
+	ModerationTimeoutSeconds = config.ModerationTimeoutSeconds
+	if ModerationTimeoutSeconds <= 0 {
+		ModerationTimeoutSeconds = 5
+	}
+
+	WatermarkKey = config.WatermarkKey
+	AdminToken = config.AdminToken
+	DebugToken = config.DebugToken
+
+	DedupStoreDir = config.DedupStoreDir
+	DedupURLTTLSeconds = config.DedupURLTTLSeconds
+	if DedupURLTTLSeconds <= 0 {
+		DedupURLTTLSeconds = 3600
+	}
+
+	OriginTLSConfigs = make(map[string]*tls.Config, len(config.OriginClientCertificates))
+	for domain, certificate := range config.OriginClientCertificates {
+		tlsConfig, err := certificate.tlsConfig()
+		if err != nil {
+			panic(fmt.Errorf("invalid client certificate for domain %s: %v", domain, err))
+		}
+		OriginTLSConfigs[strings.ToLower(domain)] = tlsConfig
+	}
+
+	OriginHeadCheck = config.OriginHeadCheck
+
+	TrustedProxies = make([]*net.IPNet, 0, len(config.TrustedProxies))
+	for _, proxy := range config.TrustedProxies {
+		// Single addresses are accepted as well as CIDR ranges
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			panic(fmt.Errorf("invalid trusted proxy %s: %v", proxy, err))
+		}
+		TrustedProxies = append(TrustedProxies, network)
+	}
+	TLSFingerprintHeader = config.TLSFingerprintHeader
+
+	CompressionBrotli = config.CompressionBrotli
+	MetricsEnabled = config.MetricsEnabled
+	MetricsToken = config.MetricsToken
+	MetricsTenants = config.MetricsTenants
+	metricsTenantHosts = make(map[string]string)
+	for name, tenant := range MetricsTenants {
+		if name == "" || name == OtherTenant {
+			panic(fmt.Errorf("invalid MetricsTenants name: %q", name))
+		}
+		if tenant.Token == "" || tenant.Token == MetricsToken {
+			panic(fmt.Errorf("invalid MetricsTenants token for %s: tenants need their own token", name))
+		}
+		for _, host := range tenant.Hosts {
+			host = strings.ToLower(host)
+			if other, ok := metricsTenantHosts[host]; ok {
+				panic(fmt.Errorf("invalid MetricsTenants host %s: listed for %s and %s", host, other, name))
+			}
+			metricsTenantHosts[host] = name
+		}
+	}
+	SanitizeSVG = config.SanitizeSVG == nil || *config.SanitizeSVG
+
+	MaxURLLength = config.MaxURLLength
+	if MaxURLLength <= 0 {
+		MaxURLLength = 8192
+	}
+	MaxQueryParams = config.MaxQueryParams
+	if MaxQueryParams <= 0 {
+		MaxQueryParams = 64
+	}
+	MaxRepeatedParams = config.MaxRepeatedParams
+	if MaxRepeatedParams <= 0 {
+		MaxRepeatedParams = 4
+	}
+	StrictParams = config.StrictParams
+	RangeFetch = config.RangeFetch
+
+	VipsCache = config.VipsCache
+	VipsCacheClasses = config.VipsCacheClasses
+	for class := range VipsCacheClasses {
+		if class != pipeline.CacheClassAnimated && class != pipeline.CacheClassStill {
+			panic(fmt.Errorf("invalid VipsCacheClasses class: %q", class))
+		}
+	}
+
+	SelfHosts = config.SelfHosts
+
+	Peers, PeerSelf = config.Peers, config.PeerSelf
+	if len(Peers) > 0 {
+		self := false
+		for _, peer := range Peers {
+			self = self || peer == PeerSelf
+		}
+		if !self {
+			panic(fmt.Errorf("PeerSelf %q is not one of the Peers", PeerSelf))
+		}
+	}
+
+	PrewarmURLs = config.PrewarmURLs
+	PrewarmConcurrency = config.PrewarmConcurrency
+	if PrewarmConcurrency <= 0 {
+		PrewarmConcurrency = 4
+	}
+	PrewarmTimeout = secondsOrDefault(config.PrewarmTimeoutSeconds, 300)
+
+	CacheTiers = config.CacheTiers
+	for i, tier := range CacheTiers {
+		switch {
+		case tier.Type == "memory" && tier.MaxBytes > 0:
+		case tier.Type == "disk" && tier.Dir != "" && tier.MaxBytes >= 0:
+		case tier.Type == "redis" && tier.Address != "" && tier.TTLSeconds >= 0:
+		case tier.Type == "s3" && config.ObjectStoreBucket != "":
+		default:
+			panic(fmt.Errorf("invalid CacheTiers[%d]: %s tiers need MaxBytes (memory), Dir (disk), Address (redis) or ObjectStoreBucket (s3)", i, tier.Type))
+		}
+	}
+
+	SQLitePath, PostgresURL = config.SQLitePath, config.PostgresURL
+	if SQLitePath != "" && PostgresURL != "" {
+		panic(fmt.Errorf("SQLitePath and PostgresURL can't both be set"))
+	}
+	if PostgresURL != "" && statedb.DriverFor(PostgresURL) != statedb.DriverPostgres {
+		panic(fmt.Errorf("invalid PostgresURL: must be a postgres:// URL"))
+	}
+	LinkStore = config.LinkStore
+	switch {
+	case LinkStore.Type == "":
+	case LinkStore.Type == "redis" && LinkStore.Address != "":
+	case LinkStore.Type == "sqlite" && SQLitePath != "":
+	case LinkStore.Type == "postgres" && PostgresURL != "":
+	default:
+		panic(fmt.Errorf("invalid LinkStore: %s stores need Address (redis), SQLitePath (sqlite) or PostgresURL (postgres)", LinkStore.Type))
+	}
+	if LinkStore.Prefix == "" {
+		LinkStore.Prefix = "link:"
+	}
+
+	IIIFTileSize = config.IIIFTileSize
+	if IIIFTileSize == 0 {
+		IIIFTileSize = 512
+	}
+	if IIIFTileSize < 0 {
+		panic(fmt.Errorf("invalid IIIFTileSize: %d", IIIFTileSize))
+	}
+
+	FormatMaxDimensions = make(map[vips.ImageType]Dimensions, len(config.FormatMaxDimensions))
+	for name, dimensions := range config.FormatMaxDimensions {
+		format, err := pipeline.ParseFormatName(name)
+		if err != nil || format == vips.ImageTypeUnknown {
+			panic(fmt.Errorf("invalid FormatMaxDimensions format: %q", name))
+		}
+		if dimensions.Width < 0 || dimensions.Height < 0 {
+			panic(fmt.Errorf("invalid FormatMaxDimensions for %s: %dx%d", name, dimensions.Width, dimensions.Height))
+		}
+		FormatMaxDimensions[format] = dimensions
+	}
+
+	AutoFormats = map[string][]vips.ImageType{
+		pipeline.ClassAnimated:    supportedFormats(vips.ImageTypeWEBP, vips.ImageTypeGIF),
+		pipeline.ClassTransparent: supportedFormats(vips.ImageTypeAVIF, vips.ImageTypeWEBP, vips.ImageTypePNG),
+		pipeline.ClassOpaque:      supportedFormats(vips.ImageTypeAVIF, vips.ImageTypeWEBP, vips.ImageTypeJPEG),
+	}
+	for class, names := range config.AutoFormats {
+		if _, ok := AutoFormats[class]; !ok || len(names) == 0 {
+			panic(fmt.Errorf("invalid AutoFormats class: %q", class))
+		}
+		formats := make([]vips.ImageType, len(names))
+		for i, name := range names {
+			format, err := pipeline.ParseFormatName(name)
+			if err != nil || format == vips.ImageTypeUnknown {
+				panic(fmt.Errorf("invalid AutoFormats format for %s: %q", class, name))
+			}
+			formats[i] = format
+		}
+		AutoFormats[class] = formats
+	}
+	// The defaults of a class are empty when all of its formats are disabled or not compiled in
+	for class, formats := range AutoFormats {
+		if len(formats) == 0 {
+			panic(fmt.Errorf("invalid AutoFormats: no supported format for %s, set AutoFormats.%s", class, class))
+		}
+	}
+
+	URLSigningKey = config.URLSigningKey
+	NonceStoreDir = config.NonceStoreDir
+	NonceStore = config.NonceStore
+	switch {
+	case NonceStore.Type == "":
+	case NonceStore.Type != "redis" || NonceStore.Address == "":
+		panic(fmt.Errorf("invalid NonceStore: %q, only redis stores with an Address are supported", NonceStore.Type))
+	case NonceStoreDir != "":
+		panic(fmt.Errorf("invalid NonceStore: set either NonceStore or NonceStoreDir"))
+	}
+	if NonceStore.Prefix == "" {
+		NonceStore.Prefix = "nonce:"
+	}
+	SessionCookieName = config.SessionCookieName
+	if SessionCookieName == "" {
+		SessionCookieName = "image_gem_session"
+	}
+	if config.SourceURLKey != "" {
+		key, err := hex.DecodeString(config.SourceURLKey)
+		if err != nil || (len(key) != 16 && len(key) != 24 && len(key) != 32) {
+			panic(fmt.Errorf("invalid SourceURLKey: must be 16, 24 or 32 hex-encoded bytes"))
+		}
+		SourceURLKey = key
+	}
+
+	GeoIPDatabase = config.GeoIPDatabase
+	BlockedCountries = upperCase(config.BlockedCountries)
+	DomainBlockedCountries = make(map[string][]string, len(config.DomainBlockedCountries))
+	for domain, countries := range config.DomainBlockedCountries {
+		DomainBlockedCountries[strings.ToLower(domain)] = upperCase(countries)
+	}
+	CountryRequestsPerSecond = make(map[string]float64, len(config.CountryRequestsPerSecond))
+	for country, limit := range config.CountryRequestsPerSecond {
+		if limit <= 0 {
+			panic(fmt.Errorf("invalid CountryRequestsPerSecond for %s: %f", country, limit))
+		}
+		CountryRequestsPerSecond[strings.ToUpper(country)] = limit
+	}
+
+	CrawlerUserAgents = defaultCrawlerUserAgents
+	if config.CrawlerUserAgents != nil {
+		CrawlerUserAgents = make([]string, len(config.CrawlerUserAgents))
+		for i, agent := range config.CrawlerUserAgents {
+			CrawlerUserAgents[i] = strings.ToLower(agent)
+		}
+	}
+	CrawlerRequestsPerSecond = config.CrawlerRequestsPerSecond
+	CrawlerBurst = config.CrawlerBurst
+	if CrawlerBurst <= 0 {
+		CrawlerBurst = 1
+	}
+	CrawlerQuality = config.CrawlerQuality
+	if CrawlerQuality < 0 || CrawlerQuality > 100 {
+		panic(fmt.Errorf("invalid CrawlerQuality: %d", CrawlerQuality))
+	}
+
+	OriginRequestsPerSecond = config.OriginRequestsPerSecond
+	OriginBurst = config.OriginBurst
+	if OriginBurst <= 0 {
+		OriginBurst = 1
+	}
+	OriginMaxConcurrent = config.OriginMaxConcurrent
+
+	ObjectStoreEndpoint = config.ObjectStoreEndpoint
+	ObjectStoreRegion = config.ObjectStoreRegion
+	if ObjectStoreRegion == "" {
+		ObjectStoreRegion = "us-east-1"
+	}
+	if ObjectStoreEndpoint == "" {
+		ObjectStoreEndpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", ObjectStoreRegion)
+	}
+	ObjectStoreBucket = config.ObjectStoreBucket
+	ObjectStoreAccessKeyID = config.ObjectStoreAccessKeyID
+	ObjectStoreSecretAccessKey = config.ObjectStoreSecretAccessKey
+	ObjectStorePublicURL = config.ObjectStorePublicURL
+	ObjectStoreUploadPrefix = config.ObjectStoreUploadPrefix
+	if ObjectStoreUploadPrefix == "" {
+		ObjectStoreUploadPrefix = "uploads"
+	}
+	UploadURLExpirySeconds = config.UploadURLExpirySeconds
+	if UploadURLExpirySeconds <= 0 {
+		UploadURLExpirySeconds = 900
+	}
+
+	LadderWidths = config.LadderWidths
+	if len(LadderWidths) == 0 {
+		LadderWidths = []int{320, 640, 960, 1280, 1920}
+	}
+	LadderFormats = config.LadderFormats
+	if len(LadderFormats) == 0 {
+		LadderFormats = []string{"webp"}
+		if pipeline.FormatSupported(vips.ImageTypeAVIF) {
+			LadderFormats = append(LadderFormats, "avif")
+		}
+	}
+	for _, format := range LadderFormats {
+		if _, err := pipeline.ParseFormatName(format); format == "" || err != nil {
+			panic(fmt.Errorf("invalid ladder format: %q", format))
+		}
+	}
+	LadderQualities = config.LadderQualities
+	if len(LadderQualities) == 0 {
+		// The encoder defaults
+		LadderQualities = []int{0}
+	}
+
+	MaxUpscaleFactor = config.MaxUpscaleFactor
+	if MaxUpscaleFactor <= 0 {
+		MaxUpscaleFactor = 4
+	}
+
+	Degradation = config.Degradation
+	if d := Degradation; d.MaxProcessing < 0 || d.MaxCPU < 0 || d.MaxCPU > 1 || d.Quality < 0 || d.Quality > 100 {
+		panic(fmt.Errorf("invalid Degradation: MaxCPU must be between 0 and 1, Quality between 0 and 100"))
+	}
+
+	Priority = config.Priority
+	if Priority.Default == "" {
+		Priority.Default = PriorityInteractive
+	}
+	if p := Priority; p.MaxProcessing < 0 || p.MaxBatch < 0 || !validPriority(p.Default) {
+		panic(fmt.Errorf("invalid Priority: MaxProcessing and MaxBatch can't be negative, Default must be %s or %s", PriorityInteractive, PriorityBatch))
+	}
+	for key, class := range Priority.APIKeys {
+		if key == "" || !validPriority(class) {
+			panic(fmt.Errorf("invalid Priority.APIKeys: keys must be non-empty and classes %s or %s", PriorityInteractive, PriorityBatch))
+		}
+	}
+
+	Restrictions = config.Restrictions
+	if err := Restrictions.Validate(); err != nil {
+		panic(err)
+	}
+	DomainRestrictions = make(map[string]pipeline.Restrictions, len(config.DomainRestrictions))
+	for domain, restrictions := range config.DomainRestrictions {
+		if err := restrictions.Validate(); err != nil {
+			panic(fmt.Errorf("invalid restrictions for domain %s: %v", domain, err))
+		}
+		DomainRestrictions[strings.ToLower(domain)] = restrictions
+	}
 
 	return nil
 }
+
+// DefaultsForHost returns the default transformation parameters configured for the given host.
+// It returns nil if nothing is configured for the host.
+func DefaultsForHost(host string) url.Values {
+	values, _ := matchDomain(DomainDefaults, host)
+	return values
+}
+
+// PolicyForHost returns the policy script configured for the given host, or an empty string.
+func PolicyForHost(host string) string {
+	script, _ := matchDomain(DomainPolicies, host)
+	return script
+}
+
+// RestrictionsForHost returns the restrictions configured for the given host, or nil.
+func RestrictionsForHost(host string) *pipeline.Restrictions {
+	restrictions, ok := matchDomain(DomainRestrictions, host)
+	if !ok {
+		return nil
+	}
+	return &restrictions
+}
+
+// MetricsTenantForHost returns the name of the tenant of MetricsTenants the host belongs to, or OtherTenant.
+func MetricsTenantForHost(host string) string {
+	if name, ok := matchDomain(metricsTenantHosts, host); ok {
+		return name
+	}
+	return OtherTenant
+}
+
+// IsCrawler reports whether the user agent matches one of CrawlerUserAgents.
+func IsCrawler(userAgent string) bool {
+	userAgent = strings.ToLower(userAgent)
+	for _, agent := range CrawlerUserAgents {
+		if agent != "" && strings.Contains(userAgent, agent) {
+			return true
+		}
+	}
+	return false
+}
+
+// CountryBlocked reports whether clients from the country are refused, either everywhere or for images from
+// the given host. An unknown country (empty string) is never blocked.
+func CountryBlocked(country, host string) bool {
+	if country == "" {
+		return false
+	}
+	countries := BlockedCountries
+	if host != "" {
+		domainCountries, _ := matchDomain(DomainBlockedCountries, host)
+		countries = append(append([]string{}, countries...), domainCountries...)
+	}
+	for _, blocked := range countries {
+		if blocked == country {
+			return true
+		}
+	}
+	return false
+}
+
+// TLSConfigForHost returns the TLS settings for fetching from the given host, or nil if the host doesn't use mutual TLS.
+func TLSConfigForHost(host string) *tls.Config {
+	tlsConfig, _ := matchDomain(OriginTLSConfigs, host)
+	return tlsConfig
+}
+
+// tlsConfig loads the certificate files.
+func (c clientCertificate) tlsConfig() (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{certificate}}
+
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CAFile)
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// matchDomain looks the host up in a map keyed by host names and "*.example.com" wildcards.
+// An exact host match takes precedence over wildcard matches, and the longest wildcard wins.
+func matchDomain[V any](domains map[string]V, host string) (V, bool) {
+	host = strings.ToLower(host)
+	if value, ok := domains[host]; ok {
+		return value, true
+	}
+
+	var match string
+	for domain := range domains {
+		if strings.HasPrefix(domain, "*.") && strings.HasSuffix(host, domain[1:]) && len(domain) > len(match) {
+			match = domain
+		}
+	}
+	if match == "" {
+		var zero V
+		return zero, false
+	}
+
+	return domains[match], true
+}
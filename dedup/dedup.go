@@ -0,0 +1,230 @@
+// Package dedup is a content-addressed store for source images and their processed outputs. Sources are
+// stored once per SHA-256 of their bytes, so identical images fetched from different URLs share storage
+// and output entries. A URL index remembers which hash each URL served and which URLs are known for a hash.
+package dedup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SourceInfo describes a stored source image.
+type SourceInfo struct {
+	Hash        string   `json:"hash"`
+	ContentType string   `json:"contentType"`
+	Size        int      `json:"size"`
+	URLs        []string `json:"urls"`
+}
+
+// urlEntry maps a source URL to the hash of the bytes it served.
+type urlEntry struct {
+	URL     string    `json:"url"`
+	Hash    string    `json:"hash"`
+	Fetched time.Time `json:"fetched"`
+}
+
+// store keeps its data under a directory:
+//
+//	sources/ab/<hash>        source bytes
+//	sources/ab/<hash>.json   SourceInfo
+//	urls/cd/<sha of url>     urlEntry
+//	outputs/ab/<hash>-<key>  processed output bytes
+type store struct {
+	mu     sync.Mutex
+	dir    string
+	urlTTL time.Duration
+}
+
+var std *store
+
+// Init enables the store in dir. A URL's source is reused without fetching it again for urlTTL after it
+// was last fetched. Until Init is called, Enabled reports false and the other functions do nothing.
+func Init(dir string, urlTTL time.Duration) error {
+	for _, sub := range []string{"sources", "urls", "outputs"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return err
+		}
+	}
+	std = &store{dir: dir, urlTTL: urlTTL}
+	return nil
+}
+
+// Enabled reports whether the store has been initialized.
+func Enabled() bool {
+	return std != nil
+}
+
+// Hash returns the content hash of data.
+func Hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Lookup returns the stored source of a URL that was fetched less than the URL TTL ago.
+func Lookup(url string) ([]byte, *SourceInfo, bool) {
+	if std == nil {
+		return nil, nil, false
+	}
+
+	var entry urlEntry
+	if !readJSON(std.urlPath(url), &entry) || time.Since(entry.Fetched) > std.urlTTL {
+		return nil, nil, false
+	}
+
+	info, ok := Info(entry.Hash)
+	if !ok {
+		return nil, nil, false
+	}
+	data, err := ioutil.ReadFile(std.sourcePath(entry.Hash))
+	if err != nil {
+		return nil, nil, false
+	}
+	return data, info, true
+}
+
+// PutSource stores the bytes fetched from a URL, unless identical bytes are already stored,
+// and records the URL against their hash. It returns the hash.
+func PutSource(url, contentType string, data []byte) (string, error) {
+	hash := Hash(data)
+	if std == nil {
+		return hash, nil
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	info := SourceInfo{Hash: hash, ContentType: contentType, Size: len(data)}
+	if !readJSON(std.sourcePath(hash)+".json", &info) {
+		if err := writeFile(std.sourcePath(hash), data); err != nil {
+			return "", err
+		}
+	}
+
+	known := false
+	for _, u := range info.URLs {
+		known = known || u == url
+	}
+	if !known {
+		info.URLs = append(info.URLs, url)
+		sort.Strings(info.URLs)
+	}
+	if err := writeJSON(std.sourcePath(hash)+".json", info); err != nil {
+		return "", err
+	}
+
+	return hash, writeJSON(std.urlPath(url), urlEntry{URL: url, Hash: hash, Fetched: time.Now()})
+}
+
+// Info returns what is known about the source with the given hash.
+func Info(hash string) (*SourceInfo, bool) {
+	if std == nil || !validHash(hash) {
+		return nil, false
+	}
+
+	var info SourceInfo
+	if !readJSON(std.sourcePath(hash)+".json", &info) {
+		return nil, false
+	}
+	return &info, true
+}
+
+// HashForURL returns the hash of the bytes the URL served when it was last fetched.
+func HashForURL(url string) (string, bool) {
+	if std == nil {
+		return "", false
+	}
+
+	var entry urlEntry
+	if !readJSON(std.urlPath(url), &entry) {
+		return "", false
+	}
+	return entry.Hash, true
+}
+
+// Output returns a processed output of the source with the given hash. The key identifies the
+// transformation that produced it.
+func Output(hash, key string) ([]byte, bool) {
+	if std == nil {
+		return nil, false
+	}
+
+	data, err := ioutil.ReadFile(std.outputPath(hash, key))
+	if err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+// PutOutput stores a processed output of the source with the given hash.
+func PutOutput(hash, key string, data []byte) error {
+	if std == nil {
+		return nil
+	}
+	return writeFile(std.outputPath(hash, key), data)
+}
+
+func (s *store) sourcePath(hash string) string {
+	return filepath.Join(s.dir, "sources", hash[:2], hash)
+}
+
+func (s *store) urlPath(url string) string {
+	hash := Hash([]byte(url))
+	return filepath.Join(s.dir, "urls", hash[:2], hash)
+}
+
+func (s *store) outputPath(hash, key string) string {
+	return filepath.Join(s.dir, "outputs", hash[:2], hash+"-"+Hash([]byte(key)))
+}
+
+func validHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+func readJSON(path string, v interface{}) bool {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(data, v) == nil
+}
+
+func writeJSON(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeFile(path, data)
+}
+
+// writeFile writes data to a temporary file and renames it into place, so readers never see partial files.
+func writeFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
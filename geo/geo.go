@@ -0,0 +1,64 @@
+// Package geo looks up the country of client IP addresses in a MaxMind GeoIP2 or GeoLite2 database.
+package geo
+
+import (
+	"context"
+	"net"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+var std *maxminddb.Reader
+
+// Init opens the database at path. Until Init is called, Country returns an empty string.
+func Init(path string) error {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return err
+	}
+	std = reader
+	return nil
+}
+
+// Enabled reports whether a database has been opened.
+func Enabled() bool {
+	return std != nil
+}
+
+// record is the part of a country or city database record that is read.
+type record struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+// Country returns the ISO 3166-1 alpha-2 code of the country of the IP address, or an empty string if the
+// address isn't in the database or no database is open.
+func Country(ip string) string {
+	if std == nil {
+		return ""
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ""
+	}
+
+	var r record
+	if err := std.Lookup(addr, &r); err != nil {
+		return ""
+	}
+	return r.Country.ISOCode
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying the country of the request's client.
+func NewContext(ctx context.Context, country string) context.Context {
+	return context.WithValue(ctx, contextKey{}, country)
+}
+
+// FromContext returns the country stored by NewContext, or an empty string.
+func FromContext(ctx context.Context) string {
+	country, _ := ctx.Value(contextKey{}).(string)
+	return country
+}
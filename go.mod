@@ -3,17 +3,23 @@ module github.com/arkami8/image-gem
 go 1.20
 
 require (
+	github.com/andybalholm/brotli v1.0.6
+	github.com/aws/aws-lambda-go v1.47.0
 	github.com/davidbyttow/govips/v2 v2.15.0
 	github.com/gorilla/handlers v1.5.2
 	github.com/gorilla/mux v1.8.1
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.22
+	github.com/oschwald/maxminddb-golang v1.12.0
 	github.com/rs/cors v1.11.0
-	github.com/unrolled/secure v1.15.0
+	golang.org/x/net v0.27.0
+	golang.org/x/time v0.5.0
 )
 
 require (
 	github.com/davidbyttow/govips v0.0.0-20201026223743-b1b72c7305d9 // indirect
 	github.com/felixge/httpsnoop v1.0.4 // indirect
 	golang.org/x/image v0.18.0 // indirect
-	golang.org/x/net v0.27.0 // indirect
+	golang.org/x/sys v0.22.0 // indirect
 	golang.org/x/text v0.16.0 // indirect
 )
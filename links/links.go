@@ -0,0 +1,69 @@
+// Package links maps short opaque IDs to source URLs and the parameters to transform them with, so that
+// public pages can reference images at /i/{id} without revealing their origin or parameters.
+package links
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+
+	"github.com/arkami8/image-gem/cache"
+)
+
+// Link is the source URL and query parameters an ID stands for.
+type Link struct {
+	URL    string `json:"url"`
+	Params string `json:"params"`
+}
+
+// idSize is the number of bytes of the SHA-256 of a link its ID is made of.
+const idSize = 12
+
+// ErrInvalidID is returned by Lookup for strings that can't be link IDs.
+var ErrInvalidID = errors.New("invalid link ID")
+
+var std cache.Cache
+
+// Init stores the links in the given store, e.g. a cache.Redis without expiry. Until Init is called,
+// Enabled reports false.
+func Init(store cache.Cache) {
+	std = store
+}
+
+// Enabled reports whether links have been initialized.
+func Enabled() bool {
+	return std != nil
+}
+
+// Create stores the link and returns its ID. The ID is derived from the link, so creating the same link
+// again returns the same ID; it only reveals the link to those who already know it.
+func Create(link Link) (string, error) {
+	data, err := json.Marshal(link)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	id := base64.RawURLEncoding.EncodeToString(sum[:idSize])
+	if err := std.Set(id, data); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// Lookup returns the link with the given ID, and false if there is none.
+func Lookup(id string) (Link, bool, error) {
+	if decoded, err := base64.RawURLEncoding.DecodeString(id); err != nil || len(decoded) != idSize {
+		return Link{}, false, ErrInvalidID
+	}
+
+	data, ok, err := std.Get(id)
+	if err != nil || !ok {
+		return Link{}, false, err
+	}
+	var link Link
+	if err := json.Unmarshal(data, &link); err != nil {
+		return Link{}, false, err
+	}
+	return link, true, nil
+}
@@ -1,17 +1,53 @@
 package main
 
 import (
-	"github.com/arkami8/image-gem/config"
+	"log"
+	"os"
+
+	"github.com/arkami8/image-gem/api"
+	"github.com/arkami8/image-gem/serverless"
+	"github.com/arkami8/image-gem/startup"
 
 	"github.com/davidbyttow/govips/v2/vips"
 )
 
 func main() {
-	config.ReadConfig()
-
 	vips.LoggingSettings(nil, vips.LogLevelWarning)
-	vips.Startup(nil)
+
+	// Subcommands work on local files and don't need the server config
+	if len(os.Args) > 1 {
+		var command func([]string) error
+		switch os.Args[1] {
+		case "transform":
+			command = Transform
+		case "watch":
+			command = Watch
+		case "bench":
+			command = Bench
+		case "selftest":
+			command = SelfTest
+		case "migrate":
+			command = Migrate
+		}
+		if command != nil {
+			vips.Startup(nil)
+			err := command(os.Args[2:])
+			vips.Shutdown()
+			if err != nil {
+				log.Fatalf("error: %s", err.Error())
+			}
+			return
+		}
+	}
+
+	startup.Init()
 	defer vips.Shutdown()
 
+	// When running inside AWS Lambda, serve invocations instead of listening on a port
+	if os.Getenv("AWS_LAMBDA_RUNTIME_API") != "" {
+		serverless.StartLambda(api.NewRouter())
+		return
+	}
+
 	Serve()
 }
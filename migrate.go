@@ -0,0 +1,35 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/arkami8/image-gem/statedb"
+)
+
+// Migrate runs the migrate subcommand. It applies the migrations of the state database, e.g. before rolling
+// out a new version to a cluster; servers also apply them on startup.
+//
+//	migrate -db postgres://image-gem@db.internal/image_gem
+func Migrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dataSource := fs.String("db", "", "SQLite database or postgres:// URL to migrate")
+	_ = fs.Parse(args)
+
+	if *dataSource == "" {
+		return fmt.Errorf("-db is required")
+	}
+	db, err := statedb.Open(statedb.DriverFor(*dataSource), *dataSource)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	version, err := db.Version()
+	if err != nil {
+		return err
+	}
+	log.Printf("database is at schema version %d", version)
+	return nil
+}
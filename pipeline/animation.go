@@ -0,0 +1,68 @@
+package pipeline
+
+import (
+	"fmt"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// minFrameDelay is the shortest frame delay in milliseconds. Browsers play shorter delays at 100ms.
+const minFrameDelay = 20
+
+// trimAnimation keeps the requested frame range of an animation and adjusts its frame delays.
+// Single-frame images are returned unchanged.
+func trimAnimation(img *vips.ImageRef, opts *Options) (*vips.ImageRef, error) {
+	pages := img.Pages()
+	if pages <= 1 {
+		return img, nil
+	}
+
+	delays, err := img.PageDelay()
+	if err != nil {
+		return nil, err
+	}
+
+	start, end := opts.FrameStart, opts.FrameEnd
+	if end == 0 || end > pages {
+		end = pages
+	}
+	if start >= end {
+		return nil, ParamErrors{fmt.Errorf("frames %d:%d are outside the animation of %d frames", opts.FrameStart, opts.FrameEnd, pages)}
+	}
+
+	if start != 0 || end != pages {
+		// Treat the frame strip as a single page so the frames can be cut out of it
+		pageHeight := img.PageHeight()
+		if err := img.SetPageHeight(img.Height()); err != nil {
+			return nil, err
+		}
+		if err := img.ExtractArea(0, start*pageHeight, img.Width(), (end-start)*pageHeight); err != nil {
+			return nil, err
+		}
+		if err := img.SetPageHeight(pageHeight); err != nil {
+			return nil, err
+		}
+		if err := img.SetPages(end - start); err != nil {
+			return nil, err
+		}
+		if len(delays) >= end {
+			delays = delays[start:end]
+		}
+	}
+
+	for i := range delays {
+		if opts.FPS > 0 {
+			delays[i] = 1000 / opts.FPS
+		} else if opts.Speed > 0 {
+			delays[i] = int(float64(delays[i]) / opts.Speed)
+		}
+		if delays[i] < minFrameDelay {
+			delays[i] = minFrameDelay
+		}
+	}
+	if err := img.SetPageDelay(delays); err != nil {
+		return nil, err
+	}
+
+	return img, nil
+}
@@ -0,0 +1,24 @@
+package pipeline
+
+import (
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// Image classes for choosing the output format of format=auto.
+const (
+	ClassAnimated    = "animated"
+	ClassTransparent = "transparent"
+	ClassOpaque      = "opaque"
+)
+
+// ImageClass returns whether the image is animated, has transparency or is opaque, in that order of precedence.
+func ImageClass(img *vips.ImageRef) string {
+	switch {
+	case img.Pages() > 1:
+		return ClassAnimated
+	case img.HasAlpha():
+		return ClassTransparent
+	default:
+		return ClassOpaque
+	}
+}
@@ -0,0 +1,47 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"mime/multipart"
+	"net/http"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// RemoteBackgroundRemover cuts out the subject of an image with a rembg-compatible HTTP API.
+// The image is POSTed as the "file" field of a multipart form, and a PNG with a transparent
+// background is expected as the response body.
+type RemoteBackgroundRemover struct {
+	Endpoint string
+	Client   *http.Client
+}
+
+// Remove sends the image to the service and decodes the transparent result.
+// The caller keeps ownership of img and must close the returned image.
+func (b *RemoteBackgroundRemover) Remove(ctx context.Context, img *vips.ImageRef) (*vips.ImageRef, error) {
+	png, _, err := img.ExportPng(vips.NewPngExportParams())
+	if err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", "image.png")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := part.Write(png); err != nil {
+		return nil, err
+	}
+	if err := form.Close(); err != nil {
+		return nil, err
+	}
+
+	data, err := postImage(ctx, b.Client, b.Endpoint, form.FormDataContentType(), &body)
+	if err != nil {
+		return nil, err
+	}
+
+	return vips.NewImageFromBuffer(data)
+}
@@ -0,0 +1,134 @@
+package pipeline
+
+import (
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// adjustColors changes the brightness, saturation and hue of the image in the LCh color space, then turns it
+// to grayscale if asked. Brightness and saturation are percentages between -100 and 100 added to the
+// current values, -100 making the image black or gray; hue rotates the colors by this many degrees.
+func adjustColors(img *vips.ImageRef, brightness, saturation, hue int, grayscale bool) (*vips.ImageRef, error) {
+	if grayscale {
+		// The saturation would be dropped anyway
+		saturation = 0
+	}
+	if brightness != 0 || saturation != 0 || hue != 0 {
+		if err := img.Modulate(1+float64(brightness)/100, 1+float64(saturation)/100, float64(hue)); err != nil {
+			return nil, err
+		}
+	}
+
+	if grayscale {
+		if err := img.ToColorSpace(vips.InterpretationBW); err != nil {
+			return nil, err
+		}
+	}
+	return img, nil
+}
+
+// luminanceWeights are the Rec. 709 weights of the red, green and blue bands in the luminance.
+var luminanceWeights = []float64{0.2126, 0.7152, 0.0722}
+
+// sepiaMatrix is the usual sepia recombination of the red, green and blue bands.
+var sepiaMatrix = [][]float64{
+	{0.393, 0.769, 0.189},
+	{0.349, 0.686, 0.168},
+	{0.272, 0.534, 0.131},
+}
+
+// sepia tones the image brown like an old photograph.
+func sepia(img *vips.ImageRef) (*vips.ImageRef, error) {
+	return recomb(img, sepiaMatrix, nil)
+}
+
+// tint turns the image into shades of the color, from black for the darkest pixels to the color itself
+// for white ones.
+func tint(img *vips.ImageRef, color vips.Color) (*vips.ImageRef, error) {
+	return duotone(img, vips.Color{}, color)
+}
+
+// duotone maps the luminance of the image to a gradient from the shadows color to the highlights color.
+func duotone(img *vips.ImageRef, shadows, highlights vips.Color) (*vips.ImageRef, error) {
+	from := []float64{float64(shadows.R), float64(shadows.G), float64(shadows.B)}
+	to := []float64{float64(highlights.R), float64(highlights.G), float64(highlights.B)}
+
+	matrix := make([][]float64, 3)
+	for i := range matrix {
+		matrix[i] = make([]float64, 3)
+		for j, weight := range luminanceWeights {
+			matrix[i][j] = weight * (to[i] - from[i]) / 255
+		}
+	}
+	return recomb(img, matrix, from)
+}
+
+// Color vision deficiencies simulated by cb=.
+const (
+	Deuteranopia = "deuteranopia"
+	Protanopia   = "protanopia"
+	Tritanopia   = "tritanopia"
+)
+
+// colorBlindnessMatrices are the linear RGB transforms of Machado, Oliveira and Fernandes (2009) simulating
+// the full deficiency of the green, red and blue cones.
+var colorBlindnessMatrices = map[string][][]float64{
+	Deuteranopia: {
+		{0.367322, 0.860646, -0.227968},
+		{0.280085, 0.672501, 0.047413},
+		{-0.011820, 0.042940, 0.968881},
+	},
+	Protanopia: {
+		{0.152286, 1.052583, -0.204868},
+		{0.114503, 0.786281, 0.099216},
+		{-0.003882, -0.048116, 1.051998},
+	},
+	Tritanopia: {
+		{1.255528, -0.076749, -0.178779},
+		{-0.078411, 0.930809, 0.147602},
+		{0.004733, 0.691367, 0.303900},
+	},
+}
+
+// simulateColorBlindness shows the image as seen with the color vision deficiency. The colors are mixed in
+// linear light, where the simulation matrices apply, and converted back to sRGB.
+func simulateColorBlindness(img *vips.ImageRef, deficiency string) (*vips.ImageRef, error) {
+	if err := img.ToColorSpace(vips.InterpretationScRGB); err != nil {
+		return nil, err
+	}
+	if err := img.Recomb(colorBlindnessMatrices[deficiency]); err != nil {
+		return nil, err
+	}
+	if err := img.ToColorSpace(vips.InterpretationSRGB); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// recomb replaces the red, green and blue bands of the image by the combinations of them in the rows of the
+// matrix, plus offset if it isn't nil. The alpha channel is left untouched.
+func recomb(img *vips.ImageRef, matrix [][]float64, offset []float64) (*vips.ImageRef, error) {
+	if img.ColorSpace() != vips.InterpretationSRGB || img.BandFormat() != vips.BandFormatUchar {
+		if err := img.ToColorSpace(vips.InterpretationSRGB); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := img.Recomb(matrix); err != nil {
+		return nil, err
+	}
+	if offset != nil {
+		a := []float64{1, 1, 1}
+		b := append([]float64{}, offset...)
+		if img.HasAlpha() {
+			a, b = append(a, 1), append(b, 0)
+		}
+		if err := img.Linear(a, b); err != nil {
+			return nil, err
+		}
+	}
+	// Casting back clips the combined values to 0-255
+	if err := img.Cast(vips.BandFormatUchar); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
@@ -0,0 +1,5 @@
+// Package pipeline parses image transformation parameters and applies them with libvips.
+//
+// A typical caller decodes a source with Load, parses the parameters with ParseOptions, applies them with
+// Transform and encodes the result with ExportImage. libvips must have been started with vips.Startup.
+package pipeline
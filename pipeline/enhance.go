@@ -0,0 +1,229 @@
+package pipeline
+
+import (
+	"math"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+const (
+	// enhanceShadowClip and enhanceHighlightClip are the fractions of the darkest and brightest pixels that the
+	// contrast stretch may clip. Fewer highlights are clipped so skies and white products don't blow out.
+	enhanceShadowClip    = 0.005
+	enhanceHighlightClip = 0.001
+	// enhanceMaxGain limits the stretch of very flat images, which would otherwise mostly amplify noise.
+	enhanceMaxGain = 2.0
+	// enhanceSampleSize is the longest edge of the copy the levels are measured on.
+	enhanceSampleSize = 256
+
+	// whiteBalanceMinGain and whiteBalanceMaxGain limit the correction of each band, so that images of mostly
+	// one color, like a red product on red, aren't turned gray.
+	whiteBalanceMinGain = 0.7
+	whiteBalanceMaxGain = 1.5
+	// whiteBalanceShadow and whiteBalanceHighlight bound the levels of the pixels the cast is measured on.
+	// Clipped highlights and deep shadows carry no cast.
+	whiteBalanceShadow    = 8
+	whiteBalanceHighlight = 247
+)
+
+// enhance stretches the contrast of the image so its tones span the full range, clipping only a small
+// fraction of the shadows and even fewer highlights. The alpha channel is left untouched.
+func enhance(img *vips.ImageRef) (*vips.ImageRef, error) {
+	if img.BandFormat() != vips.BandFormatUchar {
+		if err := img.ToColorSpace(vips.InterpretationSRGB); err != nil {
+			return nil, err
+		}
+	}
+
+	low, high, err := luminanceLevels(img)
+	if err != nil {
+		return nil, err
+	}
+	if high <= low {
+		return img, nil
+	}
+
+	gain := 255 / float64(high-low)
+	if gain > enhanceMaxGain {
+		gain = enhanceMaxGain
+	}
+	if gain <= 1 {
+		return img, nil
+	}
+	offset := -float64(low) * gain
+
+	a := make([]float64, img.Bands())
+	b := make([]float64, img.Bands())
+	for i := range a {
+		a[i], b[i] = gain, offset
+	}
+	if img.HasAlpha() {
+		a[len(a)-1], b[len(b)-1] = 1, 0
+	}
+
+	if err := img.Linear(a, b); err != nil {
+		return nil, err
+	}
+	// Casting back clips the stretched values to 0-255
+	if err := img.Cast(vips.BandFormatUchar); err != nil {
+		return nil, err
+	}
+
+	return img, nil
+}
+
+// luminanceLevels returns the luminance values below and above which the clip fractions of the pixels lie,
+// measured on a downscaled copy.
+func luminanceLevels(img *vips.ImageRef) (int, int, error) {
+	sample, err := img.Copy()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer sample.Close()
+
+	longEdge := sample.Width()
+	if sample.Height() > longEdge {
+		longEdge = sample.Height()
+	}
+	if longEdge > enhanceSampleSize {
+		if err := sample.Resize(float64(enhanceSampleSize)/float64(longEdge), vips.KernelLinear); err != nil {
+			return 0, 0, err
+		}
+	}
+	if err := sample.ToColorSpace(vips.InterpretationBW); err != nil {
+		return 0, 0, err
+	}
+
+	pixels, err := sample.ToBytes()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// The first band is the luminance, followed by alpha if there is one
+	var histogram [256]int
+	bands := sample.Bands()
+	for i := 0; i < len(pixels); i += bands {
+		histogram[pixels[i]]++
+	}
+	total := len(pixels) / bands
+
+	low, high := 0, 255
+	for count := 0; low < 255; low++ {
+		count += histogram[low]
+		if float64(count) > enhanceShadowClip*float64(total) {
+			break
+		}
+	}
+	for count := 0; high > 0; high-- {
+		count += histogram[high]
+		if float64(count) > enhanceHighlightClip*float64(total) {
+			break
+		}
+	}
+
+	return low, high, nil
+}
+
+// whiteBalance neutralizes the color cast of the image, as left by tinted or mixed lighting, by scaling its red,
+// green and blue so that their averages match (the gray world assumption). The alpha channel is left untouched.
+func whiteBalance(img *vips.ImageRef) (*vips.ImageRef, error) {
+	if img.ColorSpace() != vips.InterpretationSRGB || img.BandFormat() != vips.BandFormatUchar {
+		if err := img.ToColorSpace(vips.InterpretationSRGB); err != nil {
+			return nil, err
+		}
+	}
+
+	means, err := channelMeans(img)
+	if err != nil {
+		return nil, err
+	}
+	gray := (means[0] + means[1] + means[2]) / 3
+	if gray == 0 {
+		return img, nil
+	}
+
+	a := make([]float64, img.Bands())
+	b := make([]float64, img.Bands())
+	for i := range a {
+		a[i] = 1
+	}
+	for i, mean := range means {
+		a[i] = math.Min(math.Max(gray/mean, whiteBalanceMinGain), whiteBalanceMaxGain)
+	}
+	if err := img.Linear(a, b); err != nil {
+		return nil, err
+	}
+	// Casting back clips the scaled values to 0-255
+	if err := img.Cast(vips.BandFormatUchar); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// channelMeans returns the average red, green and blue of the sRGB image's opaque pixels that are neither
+// clipped nor in deep shadow, measured on a downscaled copy. Bands without such pixels average 0.
+func channelMeans(img *vips.ImageRef) ([3]float64, error) {
+	var means [3]float64
+	sample, err := img.Copy()
+	if err != nil {
+		return means, err
+	}
+	defer sample.Close()
+
+	longEdge := sample.Width()
+	if sample.Height() > longEdge {
+		longEdge = sample.Height()
+	}
+	if longEdge > enhanceSampleSize {
+		if err := sample.Resize(float64(enhanceSampleSize)/float64(longEdge), vips.KernelLinear); err != nil {
+			return means, err
+		}
+	}
+	pixels, err := sample.ToBytes()
+	if err != nil {
+		return means, err
+	}
+
+	var sums [3]int
+	count := 0
+	bands := sample.Bands()
+	for i := 0; i+2 < len(pixels); i += bands {
+		if sample.HasAlpha() && pixels[i+bands-1] == 0 {
+			continue
+		}
+		r, g, b := pixels[i], pixels[i+1], pixels[i+2]
+		if r > whiteBalanceHighlight || g > whiteBalanceHighlight || b > whiteBalanceHighlight ||
+			(r < whiteBalanceShadow && g < whiteBalanceShadow && b < whiteBalanceShadow) {
+			continue
+		}
+		sums[0], sums[1], sums[2] = sums[0]+int(r), sums[1]+int(g), sums[2]+int(b)
+		count++
+	}
+	if count == 0 {
+		return means, nil
+	}
+	for i, sum := range sums {
+		means[i] = float64(sum) / float64(count)
+	}
+	return means, nil
+}
+
+// exposure brightens or darkens the image by a number of stops, scaling its light in linear RGB by 2^ev as a
+// longer or shorter exposure would. The alpha channel is left untouched.
+func exposure(img *vips.ImageRef, ev float64) (*vips.ImageRef, error) {
+	if err := img.ToColorSpace(vips.InterpretationScRGB); err != nil {
+		return nil, err
+	}
+	a := []float64{math.Exp2(ev), math.Exp2(ev), math.Exp2(ev)}
+	b := []float64{0, 0, 0}
+	if img.HasAlpha() {
+		a, b = append(a, 1), append(b, 0)
+	}
+	if err := img.Linear(a, b); err != nil {
+		return nil, err
+	}
+	if err := img.ToColorSpace(vips.InterpretationSRGB); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
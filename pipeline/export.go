@@ -0,0 +1,108 @@
+package pipeline
+
+import (
+	"fmt"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// ExportOptions are the encoder settings of an export.
+type ExportOptions struct {
+	// Quality between 1 and 100 is applied to the lossy encoders; 0 keeps the encoder default.
+	Quality int
+	// Colors limits PNG and GIF output to a palette of at most this many colors, rounded up to a power of two.
+	// 0 keeps full color PNGs and 256 color GIFs.
+	Colors int
+	// Dither is the amount of dithering between 0 and 1 for palette output; nil keeps the encoder default.
+	Dither *float64
+	// Fast encodes AVIF, HEIF and WebP with (nearly) the least effort, trading compression for time.
+	Fast bool
+}
+
+// ExportImage encodes the image in the first of formats, or in its own format if none is given.
+// A quality between 1 and 100 is applied to the lossy encoders; 0 keeps the encoder default.
+func ExportImage(img *vips.ImageRef, quality int, formats ...vips.ImageType) ([]byte, *vips.ImageMetadata, error) {
+	return Export(img, ExportOptions{Quality: quality}, formats...)
+}
+
+// Export encodes the image with the given settings in the first of formats, or in its own format if none is given.
+// Formats left out of this build or disabled with DisableFormats are an error.
+func Export(img *vips.ImageRef, opts ExportOptions, formats ...vips.ImageType) ([]byte, *vips.ImageMetadata, error) {
+	imageType := img.Format()
+	if len(formats) > 0 {
+		imageType = formats[0]
+	}
+
+	if f, ok := lookupFormat(imageType); ok {
+		return f.export(img, opts)
+	}
+	if name, ok := unavailableFormat(imageType); ok {
+		return nil, nil, fmt.Errorf("unsupported output format: %s", name)
+	}
+	return img.ExportNative()
+}
+
+func exportJpeg(img *vips.ImageRef, opts ExportOptions) ([]byte, *vips.ImageMetadata, error) {
+	// JPEG has no alpha channel. Transparent areas not flattened with bg= are made white, rather than the
+	// black libvips would leave.
+	if img.HasAlpha() {
+		if err := img.Flatten(&vips.Color{R: 255, G: 255, B: 255}); err != nil {
+			return nil, nil, err
+		}
+	}
+	params := vips.NewJpegExportParams()
+	if opts.Quality >= 1 && opts.Quality <= 100 {
+		params.Quality = opts.Quality
+	}
+	return img.ExportJpeg(params)
+}
+
+func exportPng(img *vips.ImageRef, opts ExportOptions) ([]byte, *vips.ImageMetadata, error) {
+	params := vips.NewPngExportParams()
+	if opts.Colors > 0 {
+		params.Palette = true
+		params.Bitdepth = paletteBitdepth(opts.Colors)
+	}
+	if opts.Dither != nil {
+		params.Dither = *opts.Dither
+	}
+	return img.ExportPng(params)
+}
+
+func exportWebp(img *vips.ImageRef, opts ExportOptions) ([]byte, *vips.ImageMetadata, error) {
+	params := vips.NewWebpExportParams()
+	if opts.Quality >= 1 && opts.Quality <= 100 {
+		params.Quality = opts.Quality
+	}
+	if opts.Fast {
+		params.ReductionEffort = 0
+	}
+	return img.ExportWebp(params)
+}
+
+func exportTiff(img *vips.ImageRef, opts ExportOptions) ([]byte, *vips.ImageMetadata, error) {
+	return img.ExportTiff(vips.NewTiffExportParams())
+}
+
+func exportGIF(img *vips.ImageRef, opts ExportOptions) ([]byte, *vips.ImageMetadata, error) {
+	params := vips.NewGifExportParams()
+	if opts.Quality >= 1 && opts.Quality <= 100 {
+		params.Quality = opts.Quality
+	}
+	if opts.Colors > 0 {
+		params.Bitdepth = paletteBitdepth(opts.Colors)
+	}
+	if opts.Dither != nil {
+		params.Dither = *opts.Dither
+	}
+	return img.ExportGIF(params)
+}
+
+// paletteBitdepth returns the number of bits per pixel needed to index the given number of colors.
+func paletteBitdepth(colors int) int {
+	bitdepth := 1
+	for 1<<bitdepth < colors && bitdepth < 8 {
+		bitdepth++
+	}
+	return bitdepth
+}
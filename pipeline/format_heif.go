@@ -0,0 +1,36 @@
+//go:build !noheif
+
+package pipeline
+
+import (
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+var (
+	heifFormats = []format{{[]string{"heif", "heic"}, vips.ImageTypeHEIF, []string{"image/heif", "image/heic"}, exportHeif}}
+	avifFormats = []format{{[]string{"avif"}, vips.ImageTypeAVIF, []string{"image/avif"}, exportAvif}}
+)
+
+func exportHeif(img *vips.ImageRef, opts ExportOptions) ([]byte, *vips.ImageMetadata, error) {
+	params := vips.NewHeifExportParams()
+	if opts.Quality >= 1 && opts.Quality <= 100 {
+		params.Quality = opts.Quality
+	}
+	if opts.Fast {
+		// 0 would leave the encoder default
+		params.Effort = 1
+	}
+	return img.ExportHeif(params)
+}
+
+func exportAvif(img *vips.ImageRef, opts ExportOptions) ([]byte, *vips.ImageMetadata, error) {
+	params := vips.NewAvifExportParams()
+	if opts.Quality >= 1 && opts.Quality <= 100 {
+		params.Quality = opts.Quality
+	}
+	if opts.Fast {
+		// 0 would leave the encoder default
+		params.Effort = 1
+	}
+	return img.ExportAvif(params)
+}
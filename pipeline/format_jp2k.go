@@ -0,0 +1,17 @@
+//go:build !nojp2k
+
+package pipeline
+
+import (
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+var jp2kFormats = []format{{[]string{"jp2k", "j2k"}, vips.ImageTypeJP2K, []string{"image/jp2", "image/j2k"}, exportJp2k}}
+
+func exportJp2k(img *vips.ImageRef, opts ExportOptions) ([]byte, *vips.ImageMetadata, error) {
+	params := vips.NewJp2kExportParams()
+	if opts.Quality >= 1 && opts.Quality <= 100 {
+		params.Quality = opts.Quality
+	}
+	return img.ExportJp2k(params)
+}
@@ -0,0 +1,6 @@
+//go:build noheif
+
+package pipeline
+
+// heifFormats and avifFormats are left out of builds without libheif.
+var heifFormats, avifFormats []format
@@ -0,0 +1,6 @@
+//go:build nojp2k
+
+package pipeline
+
+// jp2kFormats is left out of builds without OpenJPEG.
+var jp2kFormats []format
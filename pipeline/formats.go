@@ -0,0 +1,158 @@
+package pipeline
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// format is an image format the pipeline decodes and encodes.
+type format struct {
+	// names are the names ParseFormatName accepts, the canonical one first.
+	names     []string
+	imageType vips.ImageType
+	// contentTypes are the media types origins serve the format with.
+	contentTypes []string
+	export       func(img *vips.ImageRef, opts ExportOptions) ([]byte, *vips.ImageMetadata, error)
+}
+
+var (
+	jpegFormat = format{[]string{"jpeg", "jpg"}, vips.ImageTypeJPEG, []string{"image/jpeg"}, exportJpeg}
+	pngFormat  = format{[]string{"png"}, vips.ImageTypePNG, []string{"image/png"}, exportPng}
+	webpFormat = format{[]string{"webp"}, vips.ImageTypeWEBP, []string{"image/webp"}, exportWebp}
+	tiffFormat = format{[]string{"tiff", "tif"}, vips.ImageTypeTIFF, []string{"image/tiff", "image/tif"}, exportTiff}
+	gifFormat  = format{[]string{"gif"}, vips.ImageTypeGIF, []string{"image/gif"}, exportGIF}
+)
+
+// formats are the formats of this build, in the order they are listed. HEIF and AVIF, which need libheif, are
+// left out by the noheif build tag, and JPEG 2000, which needs OpenJPEG, by the nojp2k tag, so that images
+// can be built with a libvips without those libraries.
+var formats = joinFormats([]format{jpegFormat, pngFormat, webpFormat}, heifFormats, []format{tiffFormat},
+	avifFormats, jp2kFormats, []format{gifFormat})
+
+// optionalFormats are the names of the formats that builds may leave out.
+var optionalFormats = map[vips.ImageType]string{
+	vips.ImageTypeHEIF: "heif",
+	vips.ImageTypeAVIF: "avif",
+	vips.ImageTypeJP2K: "jp2k",
+}
+
+// disabledFormats are the formats of this build turned off by DisableFormats.
+var disabledFormats = map[vips.ImageType]bool{}
+
+func joinFormats(lists ...[]format) []format {
+	var joined []format
+	for _, list := range lists {
+		joined = append(joined, list...)
+	}
+	return joined
+}
+
+// DisableFormats turns the named formats off, so they are neither decoded nor encoded, as if this build had
+// left them out. It must be called before images are processed, e.g. from the configuration.
+func DisableFormats(names ...string) error {
+	for _, name := range names {
+		imageType, err := ParseFormatName(name)
+		if err != nil || imageType == vips.ImageTypeUnknown {
+			return fmt.Errorf("unknown image format: %q", name)
+		}
+		disabledFormats[imageType] = true
+	}
+	return nil
+}
+
+// lookupFormat returns the format of the image type if this build supports it and it isn't disabled.
+func lookupFormat(imageType vips.ImageType) (*format, bool) {
+	if disabledFormats[imageType] {
+		return nil, false
+	}
+	for i := range formats {
+		if formats[i].imageType == imageType {
+			return &formats[i], true
+		}
+	}
+	return nil, false
+}
+
+// unavailableFormat returns the name of an image type left out of this build or disabled.
+func unavailableFormat(imageType vips.ImageType) (string, bool) {
+	if _, ok := lookupFormat(imageType); ok {
+		return "", false
+	}
+	if name, ok := optionalFormats[imageType]; ok {
+		return name, true
+	}
+	if disabledFormats[imageType] {
+		return formatName(imageType), true
+	}
+	return "", false
+}
+
+// FormatSupported reports whether images of the type are decoded and encoded, i.e. the format is in this
+// build and isn't disabled.
+func FormatSupported(imageType vips.ImageType) bool {
+	_, ok := lookupFormat(imageType)
+	return ok
+}
+
+// SupportedContentType reports whether the media type is that of a supported format.
+func SupportedContentType(contentType string) bool {
+	for _, f := range formats {
+		for _, t := range f.contentTypes {
+			if t == contentType {
+				return !disabledFormats[f.imageType]
+			}
+		}
+	}
+	return false
+}
+
+// ParseFormatName returns the image type for an output format name such as "jpg" or "webp".
+// An empty name returns vips.ImageTypeUnknown. Formats left out of this build or disabled are an error.
+func ParseFormatName(name string) (vips.ImageType, error) {
+	name = strings.ToLower(name)
+	if name == "" {
+		return vips.ImageTypeUnknown, nil
+	}
+	for _, f := range formats {
+		for _, n := range f.names {
+			if n == name && !disabledFormats[f.imageType] {
+				return f.imageType, nil
+			}
+			if n == name {
+				return vips.ImageTypeUnknown, fmt.Errorf("image format %s is disabled on this server", name)
+			}
+		}
+	}
+	for _, n := range optionalFormats {
+		if n == name {
+			return vips.ImageTypeUnknown, fmt.Errorf("image format %s is not supported by this build", name)
+		}
+	}
+	return vips.ImageTypeUnknown, fmt.Errorf("unsupported image format: %s (accepted: %s)", name, strings.Join(formatNames(), ", "))
+}
+
+// formatNames returns the canonical names of the supported formats.
+func formatNames() []string {
+	var names []string
+	for _, f := range formats {
+		if !disabledFormats[f.imageType] {
+			names = append(names, f.names[0])
+		}
+	}
+	return names
+}
+
+// formatName returns the canonical name of an image type, or "unknown".
+func formatName(imageType vips.ImageType) string {
+	for _, f := range formats {
+		if f.imageType == imageType {
+			return f.names[0]
+		}
+	}
+	if name, ok := optionalFormats[imageType]; ok {
+		return name
+	}
+	return "unknown"
+}
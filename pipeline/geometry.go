@@ -0,0 +1,655 @@
+package pipeline
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+const (
+	// straightenMaxAngle is the largest tilt in degrees straighten=auto corrects. Larger angles are more
+	// likely to be intended, e.g. a diagonal composition.
+	straightenMaxAngle = 10.0
+	// straightenMinAngle is the smallest tilt in degrees worth correcting.
+	straightenMinAngle = 0.2
+	// straightenSampleSize is the longest edge of the copy edges are analysed on.
+	straightenSampleSize = 512
+)
+
+// crop extracts the region at left, top of the given size from every frame of the image, clipped to the
+// image. A region entirely outside of the image is an error.
+func crop(img *vips.ImageRef, left, top, width, height int) (*vips.ImageRef, error) {
+	if left >= img.Width() || top >= img.PageHeight() {
+		return nil, ParamErrors{fmt.Errorf("crop region %d,%d is outside of the %dx%d image", left, top, img.Width(), img.PageHeight())}
+	}
+	if left+width > img.Width() {
+		width = img.Width() - left
+	}
+	if top+height > img.PageHeight() {
+		height = img.PageHeight() - top
+	}
+	if left == 0 && top == 0 && width == img.Width() && height == img.PageHeight() {
+		return img, nil
+	}
+
+	if err := img.ExtractArea(left, top, width, height); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// TrimThreshold is the Options.Trim of trim=true, the default of libvips.
+const TrimThreshold = 10
+
+// trim removes the border of a uniform color around the image, the color of its top-left pixel, measured on
+// the first frame of animations. Pixels differing from it by less than the threshold are part of the border.
+// Images that are all border are kept whole.
+func trim(img *vips.ImageRef, threshold float64) (*vips.ImageRef, error) {
+	measure, err := img.Copy()
+	if err != nil {
+		return nil, err
+	}
+	defer measure.Close()
+	if measure.Pages() > 1 {
+		if err := measure.SetPageHeight(measure.Height()); err != nil {
+			return nil, err
+		}
+		if err := measure.ExtractArea(0, 0, measure.Width(), img.PageHeight()); err != nil {
+			return nil, err
+		}
+	}
+	if measure.ColorSpace() != vips.InterpretationSRGB || measure.BandFormat() != vips.BandFormatUchar {
+		if err := measure.ToColorSpace(vips.InterpretationSRGB); err != nil {
+			return nil, err
+		}
+	}
+
+	point, err := measure.GetPoint(0, 0)
+	if err != nil {
+		return nil, err
+	}
+	background := vips.Color{R: uint8(point[0]), G: uint8(point[1]), B: uint8(point[2])}
+	if measure.HasAlpha() {
+		// A transparent border becomes the color of its top-left pixel
+		if err := measure.Flatten(&background); err != nil {
+			return nil, err
+		}
+	}
+
+	left, top, width, height, err := measure.FindTrim(threshold, &background)
+	if err != nil {
+		return nil, err
+	}
+	if width == 0 || height == 0 {
+		return img, nil
+	}
+	return crop(img, left, top, width, height)
+}
+
+// cropAtGravity crops the image to an area of the given size, clipped to the image, placed at the gravity.
+// With GravitySmart and GravityEntropy libvips finds the most interesting area, except in animations, whose
+// frames are cropped around the center.
+func cropAtGravity(img *vips.ImageRef, gravity string, width, height int) (*vips.ImageRef, error) {
+	if width > img.Width() {
+		width = img.Width()
+	}
+	if height > img.PageHeight() {
+		height = img.PageHeight()
+	}
+
+	if img.Pages() == 1 && (gravity == GravitySmart || gravity == GravityEntropy) {
+		interesting := vips.InterestingAttention
+		if gravity == GravityEntropy {
+			interesting = vips.InterestingEntropy
+		}
+		if err := img.SmartCrop(width, height, interesting); err != nil {
+			return nil, err
+		}
+		return img, nil
+	}
+	left, top := gravityOrigin(gravity, img.Width(), img.PageHeight(), width, height)
+	return crop(img, left, top, width, height)
+}
+
+// gravityOrigin returns the top left corner of an area of the given size placed within the image at the
+// gravity, e.g. against the top edge and centered horizontally for GravityNorth. Areas larger than the image
+// start at its edge.
+func gravityOrigin(gravity string, width, height, areaWidth, areaHeight int) (int, int) {
+	left, top := (width-areaWidth)/2, (height-areaHeight)/2
+	switch gravity {
+	case GravityWest, GravityNorthWest, GravitySouthWest:
+		left = 0
+	case GravityEast, GravityNorthEast, GravitySouthEast:
+		left = width - areaWidth
+	}
+	switch gravity {
+	case GravityNorth, GravityNorthEast, GravityNorthWest:
+		top = 0
+	case GravitySouth, GravitySouthEast, GravitySouthWest:
+		top = height - areaHeight
+	}
+	if left < 0 {
+		left = 0
+	}
+	if top < 0 {
+		top = 0
+	}
+	return left, top
+}
+
+// pad extends the canvas of the image, or of each frame of animations, to width × height, with the image at
+// left, top. The new area is filled with the background color, or transparent if it is nil.
+func pad(img *vips.ImageRef, left, top, width, height int, background *vips.Color) (*vips.ImageRef, error) {
+	// The background is given for the sRGB bands
+	if img.Bands() < 3 {
+		if err := img.ToColorSpace(vips.InterpretationSRGB); err != nil {
+			return nil, err
+		}
+	}
+
+	if background != nil {
+		if err := img.EmbedBackground(left, top, width, height, background); err != nil {
+			return nil, err
+		}
+		return img, nil
+	}
+	if !img.HasAlpha() {
+		if err := img.BandJoinConst([]float64{255}); err != nil {
+			return nil, err
+		}
+	}
+	if err := img.EmbedBackgroundRGBA(left, top, width, height, &vips.ColorRGBA{}); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// extend adds top, right, bottom and left pixels to the canvas of the image, or of each frame of animations,
+// filled as ExtendFill says: with the background color or transparency if it is nil, or from the edges.
+func extend(img *vips.ImageRef, top, right, bottom, left int, fill string, background *vips.Color) (*vips.ImageRef, error) {
+	width := left + img.Width() + right
+	height := top + img.PageHeight() + bottom
+	strategy := vips.ExtendMirror
+	switch fill {
+	case ExtendFillBackground:
+		return pad(img, left, top, width, height, background)
+	case ExtendFillCopy:
+		strategy = vips.ExtendCopy
+	}
+	if err := img.Embed(left, top, width, height, strategy); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// rotate rotates the image by the angle in degrees, filling the corners it reveals with the background.
+func rotate(img *vips.ImageRef, angle int, background *vips.ColorRGBA) (*vips.ImageRef, error) {
+	if background == nil {
+		background = &vips.ColorRGBA{R: 0, G: 0, B: 0, A: 0}
+	} else if img.Bands() < 3 {
+		// The background is given for the sRGB bands
+		if err := img.ToColorSpace(vips.InterpretationSRGB); err != nil {
+			return nil, err
+		}
+	}
+
+	// Check if the image has an alpha channel and add one if it's missing, unless the corners are opaque
+	if !img.HasAlpha() && background.A < 255 {
+		err := img.BandJoinConst([]float64{255})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Rotate the image
+	err := img.Similarity(1.0, float64(angle), background, 0, 0, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// flip mirrors the image horizontally and/or vertically. The frames of animations are each mirrored in place,
+// keeping their order.
+func flip(img *vips.ImageRef, horizontal, vertical bool) (*vips.ImageRef, error) {
+	if horizontal {
+		if err := img.Flip(vips.DirectionHorizontal); err != nil {
+			return nil, err
+		}
+	}
+	if !vertical {
+		return img, nil
+	}
+	if img.Pages() > 1 {
+		return flipFrames(img)
+	}
+	if err := img.Flip(vips.DirectionVertical); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// flipFrames flips each frame of an animation vertically. Flipping the whole frame strip would also
+// reverse the order of the frames.
+func flipFrames(img *vips.ImageRef) (*vips.ImageRef, error) {
+	return mapFrames(img, func(frame *vips.ImageRef) (*vips.ImageRef, error) {
+		if err := frame.Flip(vips.DirectionVertical); err != nil {
+			return nil, err
+		}
+		return frame, nil
+	})
+}
+
+// mapFrames applies fn to each frame of an animation and joins the frames it returns, which must all have the
+// same size, keeping the frame delays. Like Transform, fn returns the image to use in place of the frame.
+func mapFrames(img *vips.ImageRef, fn func(*vips.ImageRef) (*vips.ImageRef, error)) (*vips.ImageRef, error) {
+	pages, pageHeight := img.Pages(), img.PageHeight()
+	delays, err := img.PageDelay()
+	if err != nil {
+		return nil, err
+	}
+
+	frames := make([]*vips.ImageRef, 0, pages)
+	defer func() {
+		for _, frame := range frames {
+			frame.Close()
+		}
+	}()
+	for i := 0; i < pages; i++ {
+		frame, err := img.Copy()
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, frame)
+		// A single page spanning the strip, so the frame can be cut out of it
+		if err := frame.SetPageHeight(frame.Height()); err != nil {
+			return nil, err
+		}
+		if err := frame.ExtractArea(0, i*pageHeight, frame.Width(), pageHeight); err != nil {
+			return nil, err
+		}
+		if frames[i], err = fn(frame); err != nil {
+			frames[i] = frame
+			return nil, err
+		}
+	}
+
+	joined, err := frames[0].Copy()
+	if err != nil {
+		return nil, err
+	}
+	if err := joined.ArrayJoin(frames[1:], 1); err != nil {
+		joined.Close()
+		return nil, err
+	}
+	if err := joined.SetPageHeight(frames[0].Height()); err != nil {
+		joined.Close()
+		return nil, err
+	}
+	if err := joined.SetPageDelay(delays); err != nil {
+		joined.Close()
+		return nil, err
+	}
+	img.Close()
+	return joined, nil
+}
+
+// RadiusMax is the Options.Radius for the largest radius, which rounds square images into circles.
+const RadiusMax = -1
+
+// roundCorners makes the corners of the image, or of each frame of animations, transparent outside of a
+// quarter circle of the radius, or of RadiusMax. The radius is limited to half the shorter side.
+func roundCorners(img *vips.ImageRef, radius int) (*vips.ImageRef, error) {
+	if img.Pages() > 1 {
+		return mapFrames(img, func(frame *vips.ImageRef) (*vips.ImageRef, error) {
+			return roundCorners(frame, radius)
+		})
+	}
+
+	width, height := img.Width(), img.Height()
+	mask, err := roundedRect(width, height, radius, vips.Color{R: 255, G: 255, B: 255})
+	if err != nil {
+		return nil, err
+	}
+	defer mask.Close()
+	if err := mask.ExtractBand(3, 1); err != nil {
+		return nil, err
+	}
+
+	if err := withAlpha(img); err != nil {
+		return nil, err
+	}
+	alpha, err := img.Copy()
+	if err != nil {
+		return nil, err
+	}
+	defer alpha.Close()
+	if err := alpha.ExtractBand(img.Bands()-1, 1); err != nil {
+		return nil, err
+	}
+	if err := alpha.Multiply(mask); err != nil {
+		return nil, err
+	}
+	if err := alpha.Linear1(1.0/255, 0); err != nil {
+		return nil, err
+	}
+	if err := alpha.Cast(img.BandFormat()); err != nil {
+		return nil, err
+	}
+
+	if err := img.ExtractBand(0, img.Bands()-1); err != nil {
+		return nil, err
+	}
+	if err := img.BandJoin(alpha); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// border frames the image, or each frame of animations, with a band of the color and width. With a radius,
+// as given to roundCorners for the image, the outer corners of the border are rounded to match.
+func border(img *vips.ImageRef, width int, color vips.Color, radius int) (*vips.ImageRef, error) {
+	if img.Pages() > 1 {
+		return mapFrames(img, func(frame *vips.ImageRef) (*vips.ImageRef, error) {
+			return border(frame, width, color, radius)
+		})
+	}
+
+	if radius > 0 {
+		// Concentric with the rounded corners of the image, so the border is as wide around them
+		radius += width
+	}
+	framed, err := roundedRect(img.Width()+2*width, img.Height()+2*width, radius, color)
+	if err != nil {
+		return nil, err
+	}
+	if err := withAlpha(img); err != nil {
+		framed.Close()
+		return nil, err
+	}
+	if err := framed.Composite(img, vips.BlendModeOver, width, width); err != nil {
+		framed.Close()
+		return nil, err
+	}
+	img.Close()
+	return framed, nil
+}
+
+// shadow casts a shadow of the color behind the image, or each frame of animations, in the shape of its
+// opaque pixels, offset by x, y and blurred by the sigma. The canvas is extended to fit the shadow.
+func shadow(img *vips.ImageRef, x, y int, blur float64, color vips.ColorRGBA) (*vips.ImageRef, error) {
+	if img.Pages() > 1 {
+		return mapFrames(img, func(frame *vips.ImageRef) (*vips.ImageRef, error) {
+			return shadow(frame, x, y, blur, color)
+		})
+	}
+
+	if err := withAlpha(img); err != nil {
+		return nil, err
+	}
+	// The blur spreads the shadow by about twice its sigma
+	margin := int(math.Ceil(2 * blur))
+	left, top := margin, margin
+	if x < 0 {
+		left -= x
+	}
+	if y < 0 {
+		top -= y
+	}
+	width := img.Width() + 2*margin + abs(x)
+	height := img.Height() + 2*margin + abs(y)
+
+	alpha, err := img.Copy()
+	if err != nil {
+		return nil, err
+	}
+	defer alpha.Close()
+	if err := alpha.ExtractBand(img.Bands()-1, 1); err != nil {
+		return nil, err
+	}
+	maxAlpha := 255.0
+	if alpha.BandFormat() == vips.BandFormatUshort {
+		maxAlpha = 65535
+	}
+	if err := alpha.Linear1(float64(color.A)/maxAlpha, 0); err != nil {
+		return nil, err
+	}
+	if err := alpha.Embed(left+x, top+y, width, height, vips.ExtendBlack); err != nil {
+		return nil, err
+	}
+	if blur > 0 {
+		if err := alpha.GaussianBlur(blur); err != nil {
+			return nil, err
+		}
+	}
+	if err := alpha.Cast(vips.BandFormatUchar); err != nil {
+		return nil, err
+	}
+
+	// A canvas of the color, with the shadow as its alpha
+	canvas, err := roundedRect(width, height, 0, vips.Color{R: color.R, G: color.G, B: color.B})
+	if err != nil {
+		return nil, err
+	}
+	if err := canvas.ExtractBand(0, 3); err != nil {
+		canvas.Close()
+		return nil, err
+	}
+	if err := canvas.BandJoin(alpha); err != nil {
+		canvas.Close()
+		return nil, err
+	}
+	if err := canvas.Composite(img, vips.BlendModeOver, left, top); err != nil {
+		canvas.Close()
+		return nil, err
+	}
+	img.Close()
+	return canvas, nil
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// roundedRect renders an sRGB image of a rectangle of the color with corners of the radius, or of RadiusMax,
+// on a transparent background.
+func roundedRect(width, height, radius int, color vips.Color) (*vips.ImageRef, error) {
+	shorter := width
+	if height < shorter {
+		shorter = height
+	}
+	if radius == RadiusMax || radius > shorter/2 {
+		radius = shorter / 2
+	}
+	svg := fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d">`+
+		`<rect width="%d" height="%d" rx="%d" ry="%d" fill="#%02x%02x%02x"/></svg>`,
+		width, height, width, height, radius, radius, color.R, color.G, color.B)
+	return vips.NewImageFromBuffer([]byte(svg))
+}
+
+// withAlpha converts the image to sRGB with an alpha band, so it can be cut out or composited over sRGB.
+func withAlpha(img *vips.ImageRef) error {
+	if img.Bands() < 3 {
+		if err := img.ToColorSpace(vips.InterpretationSRGB); err != nil {
+			return err
+		}
+	}
+	if img.HasAlpha() {
+		return nil
+	}
+	return img.BandJoinConst([]float64{255})
+}
+
+// straighten detects a small tilt in the image and rotates it level, cropping the rotated corners away.
+// Document and receipt photos have lines of text and borders that line up with the page edges, so the
+// tilt is the angle at which the dark pixels project onto the fewest, densest rows.
+func straighten(img *vips.ImageRef) (*vips.ImageRef, error) {
+	// Animations are leveled by the tilt of their first frame, so that all frames keep the same size
+	sample := img
+	if img.Pages() > 1 {
+		first, err := img.Copy()
+		if err != nil {
+			return nil, err
+		}
+		defer first.Close()
+		if err := first.SetPageHeight(first.Height()); err != nil {
+			return nil, err
+		}
+		if err := first.ExtractArea(0, 0, first.Width(), img.PageHeight()); err != nil {
+			return nil, err
+		}
+		sample = first
+	}
+
+	angle, err := detectTilt(sample)
+	if err != nil {
+		return nil, err
+	}
+	if math.Abs(angle) < straightenMinAngle {
+		return img, nil
+	}
+
+	if img.Pages() > 1 {
+		return mapFrames(img, func(frame *vips.ImageRef) (*vips.ImageRef, error) {
+			return level(frame, angle)
+		})
+	}
+	return level(img, angle)
+}
+
+// level rotates the image by -angle degrees and crops the rotated corners away.
+func level(img *vips.ImageRef, angle float64) (*vips.ImageRef, error) {
+	width, height := img.Width(), img.Height()
+	if err := img.Similarity(1.0, -angle, &vips.ColorRGBA{R: 255, G: 255, B: 255, A: 255}, 0, 0, 0, 0); err != nil {
+		return nil, err
+	}
+
+	// Keep the largest upright rectangle that has no background in it
+	radians := math.Abs(angle) * math.Pi / 180
+	innerWidth := int(float64(width)*math.Cos(radians) - float64(height)*math.Sin(radians))
+	innerHeight := int(float64(height)*math.Cos(radians) - float64(width)*math.Sin(radians))
+	if innerWidth > 0 && innerHeight > 0 {
+		left := (img.Width() - innerWidth) / 2
+		top := (img.Height() - innerHeight) / 2
+		if err := img.ExtractArea(left, top, innerWidth, innerHeight); err != nil {
+			return nil, err
+		}
+	}
+
+	return img, nil
+}
+
+// detectTilt returns the clockwise tilt in degrees of the image content, measured on a downscaled greyscale copy.
+// Each candidate angle is scored by projecting the darker-than-average pixels along it onto rows; the sum of
+// squared row weights peaks when the projection follows the lines of text.
+func detectTilt(img *vips.ImageRef) (float64, error) {
+	sample, err := img.Copy()
+	if err != nil {
+		return 0, err
+	}
+	defer sample.Close()
+
+	longEdge := sample.Width()
+	if sample.Height() > longEdge {
+		longEdge = sample.Height()
+	}
+	if longEdge > straightenSampleSize {
+		if err := sample.Resize(float64(straightenSampleSize)/float64(longEdge), vips.KernelLinear); err != nil {
+			return 0, err
+		}
+	}
+	if err := sample.ToColorSpace(vips.InterpretationBW); err != nil {
+		return 0, err
+	}
+	if err := sample.Cast(vips.BandFormatUchar); err != nil {
+		return 0, err
+	}
+
+	pixels, err := sample.ToBytes()
+	if err != nil {
+		return 0, err
+	}
+	width, height, bands := sample.Width(), sample.Height(), sample.Bands()
+
+	var sum float64
+	for i := 0; i < len(pixels); i += bands {
+		sum += float64(pixels[i])
+	}
+	mean := sum / float64(width*height)
+
+	type darkPixel struct {
+		x, y   int
+		weight float64
+	}
+	var dark []darkPixel
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if weight := mean - float64(pixels[(y*width+x)*bands]); weight > 0 {
+				dark = append(dark, darkPixel{x, y, weight})
+			}
+		}
+	}
+
+	const step = 0.25
+	best, bestScore := 0.0, 0.0
+	rows := make([]float64, 2*(width+height))
+	for angle := -straightenMaxAngle; angle <= straightenMaxAngle; angle += step {
+		slope := math.Tan(angle * math.Pi / 180)
+		for i := range rows {
+			rows[i] = 0
+		}
+		for _, p := range dark {
+			rows[int(math.Round(float64(p.y)-slope*float64(p.x)))+width] += p.weight
+		}
+
+		var score float64
+		for _, weight := range rows {
+			score += weight * weight
+		}
+		if score > bestScore {
+			best, bestScore = angle, score
+		}
+	}
+
+	return best, nil
+}
+
+// skew shears the image by the given angles in degrees, horizontally and vertically, about its center.
+// Animations are sheared frame by frame.
+func skew(img *vips.ImageRef, horizontal, vertical float64) (*vips.ImageRef, error) {
+	if img.Pages() > 1 {
+		return mapFrames(img, func(frame *vips.ImageRef) (*vips.ImageRef, error) {
+			return shear(frame, horizontal, vertical)
+		})
+	}
+	return shear(img, horizontal, vertical)
+}
+
+// shear shears a single frame by the given angles in degrees about its center.
+func shear(img *vips.ImageRef, horizontal, vertical float64) (*vips.ImageRef, error) {
+	kx := math.Tan(horizontal * math.Pi / 180)
+	ky := math.Tan(vertical * math.Pi / 180)
+	width, height := img.Width(), img.Height()
+
+	// Map every output pixel to the input pixel it comes from: x - kx*(y - h/2), y - ky*(x - w/2)
+	index, err := vips.XYZ(width, height)
+	if err != nil {
+		return nil, err
+	}
+	defer index.Close()
+	if err := index.Recomb([][]float64{{1, -kx}, {-ky, 1}}); err != nil {
+		return nil, err
+	}
+	if err := index.Linear([]float64{1, 1}, []float64{kx * float64(height) / 2, ky * float64(width) / 2}); err != nil {
+		return nil, err
+	}
+
+	if err := img.Mapim(index); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
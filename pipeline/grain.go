@@ -0,0 +1,111 @@
+package pipeline
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"math/rand"
+	"sync"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+const (
+	// grainTileSize is the edge in pixels of the tile of noise repeated across images.
+	grainTileSize = 256
+	// grainTileSigma is the standard deviation in levels of the noise in the tile, around 128.
+	grainTileSigma = 32.0
+	// grainMaxSigma is the standard deviation in levels of the noise added by grain=100.
+	grainMaxSigma = 16.0
+)
+
+var (
+	grainOnce sync.Once
+	grainPNG  []byte
+	grainErr  error
+)
+
+// grainTile returns a PNG of gaussian noise. It is made once with a fixed seed, so an image gets the same
+// grain every time it is processed.
+func grainTile() ([]byte, error) {
+	grainOnce.Do(func() {
+		random := rand.New(rand.NewSource(1))
+		tile := image.NewGray(image.Rect(0, 0, grainTileSize, grainTileSize))
+		for i := range tile.Pix {
+			value := 128 + random.NormFloat64()*grainTileSigma
+			if value < 0 {
+				value = 0
+			} else if value > 255 {
+				value = 255
+			}
+			tile.Pix[i] = uint8(value)
+		}
+
+		var buf bytes.Buffer
+		grainErr = png.Encode(&buf, tile)
+		grainPNG = buf.Bytes()
+	})
+	return grainPNG, grainErr
+}
+
+// addGrain adds monochrome film grain to the image, with a standard deviation of up to grainMaxSigma levels
+// for an amount of 100. The alpha channel is left untouched.
+func addGrain(img *vips.ImageRef, amount int) (*vips.ImageRef, error) {
+	tile, err := grainTile()
+	if err != nil {
+		return nil, err
+	}
+	noise, err := vips.NewImageFromBuffer(tile)
+	if err != nil {
+		return nil, err
+	}
+	defer noise.Close()
+
+	across := (img.Width() + grainTileSize - 1) / grainTileSize
+	down := (img.Height() + grainTileSize - 1) / grainTileSize
+	if err := noise.Replicate(across, down); err != nil {
+		return nil, err
+	}
+	if err := noise.ExtractArea(0, 0, img.Width(), img.Height()); err != nil {
+		return nil, err
+	}
+
+	format := img.BandFormat()
+	scale := grainMaxSigma / grainTileSigma * float64(amount) / 100
+	if format == vips.BandFormatUshort {
+		scale *= 257
+	}
+	if err := noise.Linear1(scale, -128*scale); err != nil {
+		return nil, err
+	}
+
+	// The same noise for every color band, none for alpha
+	colorBands := img.Bands()
+	if img.HasAlpha() {
+		colorBands--
+	}
+	mono, err := noise.Copy()
+	if err != nil {
+		return nil, err
+	}
+	defer mono.Close()
+	for i := 1; i < colorBands; i++ {
+		if err := noise.BandJoin(mono); err != nil {
+			return nil, err
+		}
+	}
+	if img.HasAlpha() {
+		if err := noise.BandJoinConst([]float64{0}); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := img.Add(noise); err != nil {
+		return nil, err
+	}
+	// Casting back clips the noisy values
+	if err := img.Cast(format); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
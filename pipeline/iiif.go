@@ -0,0 +1,256 @@
+package pipeline
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// IIIFRequest is a parsed IIIF Image API 3.0 request: {region}/{size}/{rotation}/{quality}.{format}.
+type IIIFRequest struct {
+	path     string
+	region   string
+	size     string
+	rotation vips.Angle
+	mirror   bool
+	gray     bool
+	// Format is the output format named by the request's extension.
+	Format vips.ImageType
+}
+
+// iiifFormats are the output formats of IIIF requests by extension.
+var iiifFormats = map[string]vips.ImageType{
+	"jpg":  vips.ImageTypeJPEG,
+	"png":  vips.ImageTypePNG,
+	"gif":  vips.ImageTypeGIF,
+	"webp": vips.ImageTypeWEBP,
+	"tif":  vips.ImageTypeTIFF,
+}
+
+// IIIFFormats are the extensions of the IIIF output formats other than jpg, for info.json.
+var IIIFFormats = []string{"png", "gif", "webp", "tif"}
+
+// ParseIIIF parses the parameters of a IIIF image request. The region and size are validated against the
+// image by Apply. Rotations other than multiples of 90 degrees and the bitonal quality aren't supported.
+func ParseIIIF(region, size, rotation, quality, format string) (*IIIFRequest, error) {
+	req := &IIIFRequest{path: region + "/" + size + "/" + rotation + "/" + quality + "." + format, region: region, size: size}
+
+	req.mirror = strings.HasPrefix(rotation, "!")
+	switch strings.TrimPrefix(rotation, "!") {
+	case "0":
+		req.rotation = vips.Angle0
+	case "90":
+		req.rotation = vips.Angle90
+	case "180":
+		req.rotation = vips.Angle180
+	case "270":
+		req.rotation = vips.Angle270
+	default:
+		return nil, fmt.Errorf("unsupported rotation %q, must be 0, 90, 180 or 270", rotation)
+	}
+
+	switch quality {
+	case "default", "color":
+	case "gray":
+		req.gray = true
+	default:
+		return nil, fmt.Errorf("unsupported quality %q, must be default, color or gray", quality)
+	}
+
+	var ok bool
+	if req.Format, ok = iiifFormats[format]; !ok {
+		return nil, fmt.Errorf("unsupported format %q, must be jpg or one of %s", format, strings.Join(IIIFFormats, ", "))
+	}
+	return req, nil
+}
+
+// String returns the request as the end of its URL path, {region}/{size}/{rotation}/{quality}.{format}.
+func (req *IIIFRequest) String() string {
+	return req.path
+}
+
+// Apply extracts the region of the image, scales it to the size, and rotates, mirrors and converts it as
+// requested. Regions and sizes that don't fit the image are reported as ParamErrors. The returned image must
+// be used in place of the one passed in.
+func (req *IIIFRequest) Apply(img *vips.ImageRef) (*vips.ImageRef, error) {
+	left, top, width, height, err := iiifRegion(req.region, img.Width(), img.PageHeight())
+	if err != nil {
+		return nil, ParamErrors{err}
+	}
+	outWidth, outHeight, err := iiifSize(req.size, width, height)
+	if err != nil {
+		return nil, ParamErrors{err}
+	}
+
+	if left != 0 || top != 0 || width != img.Width() || height != img.PageHeight() {
+		if err := img.ExtractArea(left, top, width, height); err != nil {
+			return nil, err
+		}
+	}
+	if outWidth != width || outHeight != height {
+		hscale, vscale := float64(outWidth)/float64(width), float64(outHeight)/float64(height)
+		if err := img.ResizeWithVScale(hscale, vscale, vips.KernelAuto); err != nil {
+			return nil, err
+		}
+	}
+	if req.mirror {
+		if err := img.Flip(vips.DirectionHorizontal); err != nil {
+			return nil, err
+		}
+	}
+	if req.rotation != vips.Angle0 {
+		if err := img.Rotate(req.rotation); err != nil {
+			return nil, err
+		}
+	}
+	if req.gray {
+		if err := img.ToColorSpace(vips.InterpretationBW); err != nil {
+			return nil, err
+		}
+	}
+	return img, nil
+}
+
+// iiifRegion returns the area of an imgWidth × imgHeight image selected by a IIIF region: full, square,
+// x,y,w,h in pixels or pct:x,y,w,h in percent. Regions extending past the image are cropped to it.
+func iiifRegion(region string, imgWidth, imgHeight int) (left, top, width, height int, err error) {
+	switch {
+	case region == "full":
+		return 0, 0, imgWidth, imgHeight, nil
+	case region == "square":
+		side := imgWidth
+		if imgHeight < side {
+			side = imgHeight
+		}
+		return (imgWidth - side) / 2, (imgHeight - side) / 2, side, side, nil
+	}
+
+	pct := strings.HasPrefix(region, "pct:")
+	values, err := parseIIIFNumbers(strings.TrimPrefix(region, "pct:"), 4)
+	if err != nil {
+		return 0, 0, 0, 0, fmt.Errorf("invalid region %q: %v", region, err)
+	}
+	if pct {
+		values[0] *= float64(imgWidth) / 100
+		values[1] *= float64(imgHeight) / 100
+		values[2] *= float64(imgWidth) / 100
+		values[3] *= float64(imgHeight) / 100
+	} else if values[0] != math.Trunc(values[0]) || values[1] != math.Trunc(values[1]) ||
+		values[2] != math.Trunc(values[2]) || values[3] != math.Trunc(values[3]) {
+		return 0, 0, 0, 0, fmt.Errorf("invalid region %q: pixel values must be integers", region)
+	}
+
+	left, top = int(math.Round(values[0])), int(math.Round(values[1]))
+	right, bottom := int(math.Round(values[0]+values[2])), int(math.Round(values[1]+values[3]))
+	if right > imgWidth {
+		right = imgWidth
+	}
+	if bottom > imgHeight {
+		bottom = imgHeight
+	}
+	if left >= right || top >= bottom {
+		return 0, 0, 0, 0, fmt.Errorf("region %q is outside of the %dx%d image", region, imgWidth, imgHeight)
+	}
+	return left, top, right - left, bottom - top, nil
+}
+
+// iiifSize returns the output size of a width × height region for a IIIF size: max, w,; ,h; pct:n; w,h or
+// !w,h, optionally prefixed with ^ to allow enlarging the region.
+func iiifSize(size string, width, height int) (int, int, error) {
+	upscale := strings.HasPrefix(size, "^")
+	spec := strings.TrimPrefix(size, "^")
+	invalid := func(reason string) (int, int, error) {
+		return 0, 0, fmt.Errorf("invalid size %q: %s", size, reason)
+	}
+
+	var outWidth, outHeight float64
+	switch {
+	case spec == "max":
+		outWidth, outHeight = float64(width), float64(height)
+	case strings.HasPrefix(spec, "pct:"):
+		values, err := parseIIIFNumbers(strings.TrimPrefix(spec, "pct:"), 1)
+		if err != nil {
+			return invalid(err.Error())
+		}
+		outWidth, outHeight = float64(width)*values[0]/100, float64(height)*values[0]/100
+	default:
+		fit := strings.HasPrefix(spec, "!")
+		w, h, found := strings.Cut(strings.TrimPrefix(spec, "!"), ",")
+		if !found || (w == "" && h == "") || (fit && (w == "" || h == "")) {
+			return invalid("must be max, w,; ,h; pct:n; w,h or !w,h")
+		}
+		var err error
+		if w != "" {
+			if outWidth, err = parseIIIFDimension(w); err != nil {
+				return invalid(err.Error())
+			}
+		}
+		if h != "" {
+			if outHeight, err = parseIIIFDimension(h); err != nil {
+				return invalid(err.Error())
+			}
+		}
+
+		switch {
+		case fit:
+			scale := math.Min(outWidth/float64(width), outHeight/float64(height))
+			outWidth, outHeight = float64(width)*scale, float64(height)*scale
+		case h == "":
+			outHeight = float64(height) * outWidth / float64(width)
+		case w == "":
+			outWidth = float64(width) * outHeight / float64(height)
+		}
+	}
+
+	scaledWidth, scaledHeight := int(math.Round(outWidth)), int(math.Round(outHeight))
+	if scaledWidth < 1 || scaledHeight < 1 {
+		return invalid("the image would be empty")
+	}
+	if !upscale && (scaledWidth > width || scaledHeight > height) {
+		return invalid("larger than the region, use ^ to enlarge it")
+	}
+	if scaledWidth > MaxImageWidth || scaledHeight > MaxImageHeight {
+		return invalid("exceeds the maximum image size")
+	}
+	return scaledWidth, scaledHeight, nil
+}
+
+// parseIIIFNumbers parses n comma-separated non-negative numbers.
+func parseIIIFNumbers(value string, n int) ([]float64, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != n {
+		return nil, fmt.Errorf("expected %d comma-separated numbers", n)
+	}
+	values := make([]float64, n)
+	for i, part := range parts {
+		number, err := strconv.ParseFloat(part, 64)
+		if err != nil || number < 0 || math.IsInf(number, 0) {
+			return nil, fmt.Errorf("%q is not a non-negative number", part)
+		}
+		values[i] = number
+	}
+	return values, nil
+}
+
+// parseIIIFDimension parses a positive width or height in pixels.
+func parseIIIFDimension(value string) (float64, error) {
+	dimension, err := strconv.Atoi(value)
+	if err != nil || dimension < 1 {
+		return 0, fmt.Errorf("%q is not a positive integer", value)
+	}
+	return float64(dimension), nil
+}
+
+// IIIFScaleFactors returns the scale factors tiles of tileSize are offered at for an image, from 1 up to
+// the one at which the whole image fits in a single tile.
+func IIIFScaleFactors(width, height, tileSize int) []int {
+	factors := []int{1}
+	for factor := 1; (width+factor-1)/factor > tileSize || (height+factor-1)/factor > tileSize; {
+		factor *= 2
+		factors = append(factors, factor)
+	}
+	return factors
+}
@@ -0,0 +1,174 @@
+package pipeline
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"strconv"
+	"strings"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// Curves are tone curves of the red, green and blue bands, applied to images by lut=. They map each 8-bit
+// level of a band to a new one.
+type Curves [3][256]uint8
+
+// maxCurvePoints bounds the points of a curve.
+const maxCurvePoints = 32
+
+// namedCurves are the curves lut= applies by name, set from the configuration by SetLUTs.
+var namedCurves = map[string]*Curves{}
+
+// SetLUTs names curves for lut=, e.g. the filters of a filter pack, given in the syntax of ParseCurves. It
+// must be called before images are processed, e.g. from the configuration.
+func SetLUTs(luts map[string]string) error {
+	curves := make(map[string]*Curves, len(luts))
+	for name, value := range luts {
+		if name == "" || strings.Contains(name, ":") {
+			return fmt.Errorf("invalid LUT name: %q", name)
+		}
+		c, err := ParseCurves(value)
+		if err != nil {
+			return fmt.Errorf("LUT %s: %v", name, err)
+		}
+		curves[name] = c
+	}
+	namedCurves = curves
+	return nil
+}
+
+// ParseCurves parses curves given as channel:x,y,x,y,... entries separated by |, e.g.
+// rgb:0,20,128,140,255,235|b:0,40,255,220. The channel is r, g, b, or rgb for all three; the points are input
+// and output levels between 0 and 255 with increasing inputs, joined by straight lines. The curves of r, g
+// and b are applied before the one of rgb, and levels outside the points keep the output of the nearest one.
+func ParseCurves(value string) (*Curves, error) {
+	var curves Curves
+	var bandCurves [3][]float64
+	var masterCurve []float64
+	for _, entry := range strings.Split(value, "|") {
+		channel, pointsValue, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("curves must be channel:x,y,x,y,... entries separated by | (input: %s)", value)
+		}
+		points, err := parseCurvePoints(pointsValue)
+		if err != nil {
+			return nil, fmt.Errorf("invalid curve of %s: %v", channel, err)
+		}
+
+		var target *[]float64
+		switch channel {
+		case "rgb":
+			target = &masterCurve
+		case "r":
+			target = &bandCurves[0]
+		case "g":
+			target = &bandCurves[1]
+		case "b":
+			target = &bandCurves[2]
+		default:
+			return nil, fmt.Errorf("unsupported curve channel: %s (accepted: rgb, r, g, b)", channel)
+		}
+		if *target != nil {
+			return nil, fmt.Errorf("curve of %s is given twice", channel)
+		}
+		*target = points
+	}
+
+	for band := range curves {
+		for level := range curves[band] {
+			mapped := curveLevel(bandCurves[band], float64(level))
+			mapped = curveLevel(masterCurve, mapped)
+			curves[band][level] = uint8(mapped + 0.5)
+		}
+	}
+	return &curves, nil
+}
+
+// parseCurvePoints parses the x,y,x,y,... points of a curve.
+func parseCurvePoints(value string) ([]float64, error) {
+	parts := strings.Split(value, ",")
+	if len(parts)%2 != 0 || len(parts) < 4 || len(parts) > 2*maxCurvePoints {
+		return nil, fmt.Errorf("must be between 2 and %d x,y points (input: %s)", maxCurvePoints, value)
+	}
+	points := make([]float64, len(parts))
+	for i, part := range parts {
+		level, err := strconv.Atoi(part)
+		if err != nil || level < 0 || level > 255 {
+			return nil, fmt.Errorf("levels must be between 0 and 255 (input: %s)", value)
+		}
+		points[i] = float64(level)
+		if i%2 == 0 && i > 0 && points[i] <= points[i-2] {
+			return nil, fmt.Errorf("inputs must increase (input: %s)", value)
+		}
+	}
+	return points, nil
+}
+
+// curveLevel maps a level through the x,y points of a curve, or returns it for no curve.
+func curveLevel(points []float64, level float64) float64 {
+	if points == nil {
+		return level
+	}
+	if level <= points[0] {
+		return points[1]
+	}
+	for i := 2; i < len(points); i += 2 {
+		if level <= points[i] {
+			x0, y0, x1, y1 := points[i-2], points[i-1], points[i], points[i+1]
+			return y0 + (y1-y0)*(level-x0)/(x1-x0)
+		}
+	}
+	return points[len(points)-1]
+}
+
+// applyCurves maps the bands of the image through the curves. The alpha channel is left untouched.
+func applyCurves(img *vips.ImageRef, curves *Curves) (*vips.ImageRef, error) {
+	if img.ColorSpace() != vips.InterpretationSRGB || img.BandFormat() != vips.BandFormatUchar {
+		if err := img.ToColorSpace(vips.InterpretationSRGB); err != nil {
+			return nil, err
+		}
+	}
+
+	// The LUT is a 256×1 image whose pixel at x holds the levels that x maps to in each band
+	table := image.NewRGBA(image.Rect(0, 0, 256, 1))
+	for level := 0; level < 256; level++ {
+		table.SetRGBA(level, 0, color.RGBA{R: curves[0][level], G: curves[1][level], B: curves[2][level], A: 255})
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, table); err != nil {
+		return nil, err
+	}
+	lut, err := vips.NewImageFromBuffer(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	defer lut.Close()
+
+	if !img.HasAlpha() {
+		if err := img.Maplut(lut); err != nil {
+			return nil, err
+		}
+		return img, nil
+	}
+	alpha, err := img.Copy()
+	if err != nil {
+		return nil, err
+	}
+	defer alpha.Close()
+	if err := alpha.ExtractBand(img.Bands()-1, 1); err != nil {
+		return nil, err
+	}
+	if err := img.ExtractBand(0, img.Bands()-1); err != nil {
+		return nil, err
+	}
+	if err := img.Maplut(lut); err != nil {
+		return nil, err
+	}
+	if err := img.BandJoin(alpha); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
@@ -0,0 +1,69 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// moderationThumbnailSize is the longest edge of the thumbnail sent for classification.
+const moderationThumbnailSize = 512
+
+// RemoteModerator classifies images with an external NSFW/abuse detection service. A JPEG thumbnail is POSTed
+// to the endpoint, which must answer with a JSON object such as {"score": 0.93}, where score is the probability
+// in [0, 1] that the image is unsafe.
+type RemoteModerator struct {
+	Endpoint string
+	Client   *http.Client
+}
+
+// Score returns the service's unsafe-content score for the image. Only the first frame of animations is sent.
+func (m *RemoteModerator) Score(ctx context.Context, img *vips.ImageRef) (float64, error) {
+	thumb, err := img.Copy()
+	if err != nil {
+		return 0, err
+	}
+	defer thumb.Close()
+
+	if thumb.Pages() > 1 {
+		if err := thumb.ExtractArea(0, 0, thumb.Width(), thumb.PageHeight()); err != nil {
+			return 0, err
+		}
+	}
+	if err := thumb.ThumbnailWithSize(moderationThumbnailSize, moderationThumbnailSize, vips.InterestingNone, vips.SizeDown); err != nil {
+		return 0, err
+	}
+
+	jpeg, _, err := thumb.ExportJpeg(vips.NewJpegExportParams())
+	if err != nil {
+		return 0, err
+	}
+
+	data, err := postImage(ctx, m.Client, m.Endpoint, "image/jpeg", bytes.NewReader(jpeg))
+	if err != nil {
+		return 0, err
+	}
+
+	var result struct {
+		Score *float64 `json:"score"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return 0, fmt.Errorf("invalid moderation response: %v", err)
+	}
+	if result.Score == nil {
+		return 0, fmt.Errorf("moderation response has no score")
+	}
+
+	return *result.Score, nil
+}
+
+// Obscure blurs the image heavily enough that its content can't be made out.
+func Obscure(img *vips.ImageRef) error {
+	sigma := math.Max(float64(img.Width()), float64(img.PageHeight())) / 20
+	return img.GaussianBlur(math.Max(sigma, 10))
+}
@@ -0,0 +1,77 @@
+package pipeline
+
+import (
+	"sync"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// Classes of requests OperationCacheLimits apply to.
+const (
+	CacheClassAnimated = "animated"
+	CacheClassStill    = "still"
+)
+
+// OperationCacheLimits bound the libvips operation cache, which memoizes the results of operations and grows
+// with every distinct input. MaxOperations, MaxMemBytes and MaxFiles are the global limits libvips is started
+// with; 0 keeps the libvips default and a negative value disables the cache.
+//
+// Per class of request, Disabled drops the cache after each request of the class, and MaxMemBytes drops it
+// when the memory allocated by libvips exceeds it after a request of the class. The cache is shared by all
+// requests, so dropping it also drops the entries of requests of other classes.
+type OperationCacheLimits struct {
+	Disabled      bool  `json:"Disabled"`
+	MaxOperations int   `json:"MaxOperations"`
+	MaxMemBytes   int64 `json:"MaxMemBytes"`
+	MaxFiles      int   `json:"MaxFiles"`
+}
+
+// VipsConfig returns the libvips startup config for the global limits.
+func (l OperationCacheLimits) VipsConfig() *vips.Config {
+	limit := func(value int64) int {
+		switch {
+		case value < 0:
+			return 0
+		case value == 0:
+			return -1
+		}
+		return int(value)
+	}
+	return &vips.Config{
+		MaxCacheSize:  limit(int64(l.MaxOperations)),
+		MaxCacheMem:   limit(l.MaxMemBytes),
+		MaxCacheFiles: limit(int64(l.MaxFiles)),
+	}
+}
+
+// trimMu keeps concurrent requests from dropping the cache at once.
+var trimMu sync.Mutex
+
+// TrimOperationCache drops the libvips operation cache after a request, as the limits of its class require.
+func TrimOperationCache(limits OperationCacheLimits) {
+	if !limits.Disabled && limits.MaxMemBytes <= 0 {
+		return
+	}
+	if !trimMu.TryLock() {
+		return
+	}
+	defer trimMu.Unlock()
+
+	if limits.Disabled {
+		vips.ClearCache()
+		return
+	}
+	var stats vips.MemoryStats
+	vips.ReadVipsMemStats(&stats)
+	if stats.Mem > limits.MaxMemBytes {
+		vips.ClearCache()
+	}
+}
+
+// OperationCacheClass returns the class of request an image belongs to.
+func OperationCacheClass(img *vips.ImageRef) string {
+	if img.Pages() > 1 {
+		return CacheClassAnimated
+	}
+	return CacheClassStill
+}
@@ -0,0 +1,91 @@
+package pipeline
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// Operation is a custom transformation that deployments can add to the pipeline with Register,
+// e.g. proprietary LUTs or brand frames. It is enabled by a query parameter of the registered name.
+type Operation interface {
+	// Parse validates the parameter value. It is called before the source image is fetched,
+	// so invalid values are rejected like those of the built-in parameters.
+	Parse(value string) error
+	// Apply transforms the image with a value that passed Parse. The returned image replaces img.
+	Apply(img *vips.ImageRef, value string) (*vips.ImageRef, error)
+}
+
+// CustomStep is a registered operation requested with a given parameter value.
+type CustomStep struct {
+	Name  string
+	Value string
+}
+
+var (
+	operationsMu   sync.RWMutex
+	operations     = map[string]Operation{}
+	operationNames []string
+)
+
+// Register adds a custom operation under the given query parameter name. Custom operations run after the
+// built-in transformations, in registration order. It panics if the name is already registered or is the
+// name of a built-in parameter.
+func Register(name string, op Operation) {
+	operationsMu.Lock()
+	defer operationsMu.Unlock()
+
+	if _, ok := operations[name]; ok {
+		panic(fmt.Sprintf("pipeline: operation %s registered twice", name))
+	}
+	if _, ok := paramNames[name]; ok {
+		panic(fmt.Sprintf("pipeline: operation %s conflicts with a built-in parameter", name))
+	}
+	operations[name] = op
+	operationNames = append(operationNames, name)
+}
+
+// parseCustomSteps validates the parameters of every registered operation present in the query.
+func parseCustomSteps(query url.Values) ([]CustomStep, error) {
+	operationsMu.RLock()
+	defer operationsMu.RUnlock()
+
+	var steps []CustomStep
+	var errs ParamErrors
+	for _, name := range operationNames {
+		value := query.Get(name)
+		if value == "" {
+			continue
+		}
+		if err := operations[name].Parse(value); err != nil {
+			errs.add(fmt.Errorf("invalid value for %s: %v (input: %s)", name, err, value))
+			continue
+		}
+		steps = append(steps, CustomStep{Name: name, Value: value})
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return steps, nil
+}
+
+// applyCustomSteps runs the requested custom operations on the image.
+func applyCustomSteps(img *vips.ImageRef, steps []CustomStep) (*vips.ImageRef, error) {
+	operationsMu.RLock()
+	defer operationsMu.RUnlock()
+
+	for _, step := range steps {
+		op, ok := operations[step.Name]
+		if !ok {
+			return nil, fmt.Errorf("unknown operation: %s", step.Name)
+		}
+		var err error
+		img, err = op.Apply(img, step.Value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", step.Name, err)
+		}
+	}
+	return img, nil
+}
@@ -0,0 +1,1610 @@
+package pipeline
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+const (
+	// MaxImageHeight is the maximum allowed image height in pixels.
+	MaxImageHeight = 20000
+
+	// MaxImageWidth is the maximum allowed image width in pixels.
+	MaxImageWidth = 20000
+)
+
+// Options holds the transformations parsed from a set of query parameters.
+type Options struct {
+	Height   int
+	Width    int
+	Rotation int
+	Quality  int
+	Format   vips.ImageType
+	// AutoFormat leaves the output format to the server, depending on the image and the client (format=auto).
+	AutoFormat bool
+	// SharpenAmount is the sigma of the unsharp mask (sharpen=sigma[,x1,m2]). SharpenX1 is the threshold
+	// between flat and jaggy areas and SharpenM2 the slope of the sharpening in jaggy areas, SharpenX1Default
+	// and SharpenM2Default unless given.
+	SharpenAmount float64
+	SharpenX1     float64
+	SharpenM2     float64
+	BlurAmount    float64
+	Upscale       bool
+	StripMetadata bool
+	// KeepOrientation leaves the pixels as stored instead of rotating them upright as their EXIF Orientation
+	// tag says (orient=false).
+	KeepOrientation bool
+	// IIIF is the region, size, rotation and quality of a IIIF Image API request, applied before the other
+	// options. It isn't a query parameter, the IIIF handler sets it.
+	IIIF *IIIFRequest
+
+	// AIUpscale asks for the image to be enlarged by an external super-resolution service before resizing.
+	AIUpscale bool
+	// UpscaleKernel is the resampling kernel used when enlarging (kernel=). ParseOptions defaults it to vips.KernelAuto.
+	UpscaleKernel vips.Kernel
+	// MaxUpscale caps the factor images are enlarged by; 0 doesn't limit it. It isn't a query parameter,
+	// servers set it from their configuration.
+	MaxUpscale float64
+	// RemoveBackground asks for the background to be cut out by an external service, leaving it transparent.
+	RemoveBackground bool
+	// Background is the color transparent images are flattened against, and padding is filled with (bg=RRGGBB).
+	Background *vips.Color
+	// PadTop, PadRight, PadBottom and PadLeft extend the canvas by this many pixels on each side (pad=t,r,b,l,
+	// or pad=n for all sides), filled with Background or transparent.
+	PadTop    int
+	PadRight  int
+	PadBottom int
+	PadLeft   int
+	// ExtendTop, ExtendRight, ExtendBottom and ExtendLeft add this many pixels to each side of the canvas after
+	// padding (extend=t,r,b,l, or extend=n for all sides), e.g. bleed margins for print. ExtendFill is how
+	// the new area is filled (extend_fill=): ExtendFillBackground with Background or transparency, the
+	// default, ExtendFillMirror with a mirror image of the edges or ExtendFillCopy with their pixels repeated.
+	ExtendTop    int
+	ExtendRight  int
+	ExtendBottom int
+	ExtendLeft   int
+	ExtendFill   string
+	// BorderWidth frames the image with a band of BorderColor this many pixels wide (border=px[,RRGGBB], black
+	// by default).
+	BorderWidth int
+	BorderColor vips.Color
+	// Radius rounds the corners of the image to this radius in pixels, or RadiusMax (radius=px, or radius=max
+	// for circles), making them transparent.
+	Radius int
+	// ShadowX and ShadowY offset a shadow of ShadowColor cast behind the image in the shape of its opaque
+	// pixels, blurred by ShadowBlur (shadow=x,y,blur[,RRGGBB[AA]], half-opaque black by default). The canvas
+	// is extended to fit it.
+	ShadowX     int
+	ShadowY     int
+	ShadowBlur  float64
+	ShadowColor *vips.ColorRGBA
+	// Overlay is the URL of an image the server fetches and composites onto the output, e.g. a visible
+	// watermark (overlay=). OverlayPosition places it (overlay_pos=, bottom-right by default), OverlayOpacity
+	// fades it between 0 and 1 (overlay_opacity=, 1 by default) and OverlayScale sizes it to a fraction of
+	// the image's width (overlay_scale=, 0 keeps its size). OverlayTile repeats it across the whole image
+	// instead of placing it (overlay_tile=true), e.g. to deter scraping of previews.
+	Overlay string
+	// OverlayFill is a gradient or color composited over the whole image instead of an overlay image
+	// (overlay=linear-gradient(...) or overlay=RRGGBBAA), e.g. to darken hero images under their caption.
+	// OverlayOpacity fades it too.
+	OverlayFill     *Fill
+	OverlayPosition string
+	OverlayOpacity  float64
+	OverlayScale    float64
+	OverlayTile     bool
+	// Text is a caption rendered onto the image (text=), e.g. the title of a share image, in TextColor
+	// (text_color=RRGGBB, white by default) and TextSize in pixels (text_size=, 0 scales it to the image). It
+	// is wrapped to the image's width and placed at TextPosition (text_pos=, bottom by default). Servers
+	// replace its {user}, {tenant} and {date} placeholders, see ExpandText.
+	Text         string
+	TextColor    vips.Color
+	TextSize     int
+	TextPosition string
+	// Watermark is an identifier (e.g. a tenant or customer ID) to embed as an invisible watermark.
+	Watermark string
+	// Custom lists the registered operations requested by the parameters, in the order they are applied.
+	Custom []CustomStep
+	// FrameStart and FrameEnd trim animations to the frames [FrameStart, FrameEnd); FrameEnd 0 keeps the rest (frames=start:end).
+	FrameStart int
+	FrameEnd   int
+	// Speed multiplies the playback speed of animations (speed=), FPS replaces their frame delays (fps=).
+	Speed float64
+	FPS   int
+	// Colors limits PNG and GIF output to a palette of this many colors (colors=), rounded up to a power of two.
+	Colors int
+	// Dither is the amount of dithering between 0 and 1 for palette output (dither=), nil if not given.
+	Dither *float64
+	// LongEdge and ShortEdge resize the image so its longer or shorter edge has this length (longedge=, shortedge=).
+	LongEdge  int
+	ShortEdge int
+	// Pipeline is the order rotation, flip, blur, resize and sharpening run in, as Step names (pipeline=, e.g.
+	// pipeline=resize,blur). Those left out follow in their default order. Nil keeps the default order.
+	// Sharpening that comes last runs after the color adjustments.
+	Pipeline []string
+	// FlipHorizontal and FlipVertical mirror the image (flip=h, flip=v or flip=both).
+	FlipHorizontal bool
+	FlipVertical   bool
+	// SliceTop, SliceRight, SliceBottom and SliceLeft resize the image to exactly Width by Height as a
+	// nine-patch, keeping the borders within these insets from being stretched across them
+	// (slice=t,r,b,l, or slice=n for all sides).
+	SliceTop    int
+	SliceRight  int
+	SliceBottom int
+	SliceLeft   int
+	// Fit decides how images are resized when both Width and Height are given (fit=): FitCover, FitContain,
+	// FitPad, FitFill or FitInside. Empty stretches the image like FitFill without fitting the box exactly.
+	Fit string
+	// Pixelate replaces the image with blocks of this many source pixels of their average color, e.g. to
+	// redact previews (pixelate=N). PixelateX, PixelateY, PixelateWidth and PixelateHeight limit it to a
+	// region of the source image (pixelate_region=x,y,w,h); PixelateWidth 0 pixelates the whole image.
+	Pixelate       int
+	PixelateX      int
+	PixelateY      int
+	PixelateWidth  int
+	PixelateHeight int
+	// BlurX, BlurY, BlurWidth and BlurHeight limit the blur to a region of the source image instead
+	// (blur_region=x,y,w,h), e.g. a license plate. The blur is then relative to the region's size, BlurAmount
+	// 1 making its content impossible to make out; BlurWidth 0 blurs the whole image.
+	BlurX      int
+	BlurY      int
+	BlurWidth  int
+	BlurHeight int
+	// CropX, CropY, CropWidth and CropHeight extract a region of the source image before the other
+	// transformations (crop=x,y,w,h); CropWidth 0 doesn't crop. The region is clipped to the image.
+	// CropByGravity places the region by Gravity instead of CropX and CropY (crop=w,h).
+	CropX         int
+	CropY         int
+	CropWidth     int
+	CropHeight    int
+	CropByGravity bool
+	// Gravity is the part of the image kept when fit=cover or crop=w,h crops it (gravity=): GravityCenter,
+	// the default, a side such as GravityNorth, a corner such as GravitySouthEast, or the most interesting
+	// part with GravitySmart and GravityEntropy. crop=smart is short for fit=cover&gravity=smart.
+	Gravity string
+	// Trim removes the border of a uniform color around the image, with pixels differing from its color by
+	// less than this much counting as border (trim=true for TrimThreshold, or trim=N).
+	Trim float64
+	// Straighten levels small tilts detected from the image's edges (straighten=auto).
+	Straighten bool
+	// SkewX and SkewY shear the image by these angles in degrees (skew=x[,y]).
+	SkewX float64
+	SkewY float64
+	// RotationBackground fills the corners revealed by Rotation (rbg=RRGGBB[AA]), transparent if nil.
+	RotationBackground *vips.ColorRGBA
+	// RedEye darkens the red pupils of flash photos (redeye=true).
+	RedEye bool
+	// WhiteBalance neutralizes color casts from tinted or mixed lighting (wb=auto).
+	WhiteBalance bool
+	// Exposure brightens or darkens the image by this many stops between -2 and 2 (exposure=).
+	Exposure float64
+	// Enhance stretches the contrast of dull images with highlight protection (enhance=true).
+	Enhance bool
+	// Brightness and Saturation adjust the image by a percentage between -100 and 100 (bri=, sat=), Hue rotates
+	// its colors by degrees (hue=) and Grayscale drops them (grayscale=true).
+	Brightness int
+	Saturation int
+	Hue        int
+	Grayscale  bool
+	// Tint turns the image into shades of a color (tint=RRGGBB), Sepia tones it brown (sepia=true) and Duotone
+	// maps it to a gradient from a shadows to a highlights color (duotone=RRGGBB,RRGGBB). Only one of them
+	// can be given.
+	Tint    *vips.Color
+	Sepia   bool
+	Duotone []vips.Color
+	// Curves maps the red, green and blue levels through tone curves, given inline or by the name of a
+	// configured LUT (lut=), e.g. for filter packs. See ParseCurves.
+	Curves *Curves
+	// ColorBlindness simulates how the image is seen with a color vision deficiency: Deuteranopia,
+	// Protanopia or Tritanopia (cb=).
+	ColorBlindness string
+	// Grain adds film grain between 0 and 100 after resizing (grain=), e.g. to hide banding in gradients.
+	Grain int
+	// Placeholder replaces the output with a tiny image of the dominant colors (placeholder=color|gradient).
+	Placeholder string
+	// Envelope asks for the output to be returned base64-encoded in a JSON object with its dimensions (out=json).
+	Envelope bool
+}
+
+// ParseOptions parses and validates the transformation parameters in the given query values.
+// Parameters that are not present are left at their zero value. With strict=true, unknown parameters and
+// parameters given under more than one name are rejected, see CheckParams. Invalid parameters are reported
+// together in a ParamErrors.
+func ParseOptions(query url.Values) (*Options, error) {
+	strict, _ := queryParam(query, "strict")
+	return parseOptions(query, strict == "true")
+}
+
+// ParseStrictOptions is ParseOptions with unknown parameters rejected as if the query had strict=true.
+func ParseStrictOptions(query url.Values) (*Options, error) {
+	return parseOptions(query, true)
+}
+
+func parseOptions(query url.Values, strict bool) (*Options, error) {
+	// Every parameter is validated so that all the problems are reported at once
+	var errs ParamErrors
+	if strict {
+		if err := CheckParams(query); err != nil {
+			errs = append(errs, err.(ParamErrors)...)
+		}
+	}
+
+	height, err := parseIntQueryParam(query, 0, MaxImageHeight, "height")
+	errs.add(err)
+
+	width, err := parseIntQueryParam(query, 0, MaxImageWidth, "width")
+	errs.add(err)
+
+	rotation, err := parseRotation(query)
+	errs.add(err)
+
+	quality, err := parseQuality(query)
+	errs.add(err)
+
+	format, autoFormat, err := parseImageFormat(query)
+	errs.add(err)
+
+	sharpenAmount, sharpenX1, sharpenM2, err := parseSharpen(query)
+	errs.add(err)
+
+	blurAmount, err := parseBlur(query)
+	errs.add(err)
+
+	removeBackground, background, err := parseBackground(query)
+	errs.add(err)
+
+	watermark, err := parseWatermark(query)
+	errs.add(err)
+
+	custom, err := parseCustomSteps(query)
+	if err != nil {
+		errs = append(errs, err.(ParamErrors)...)
+	}
+
+	envelope, err := parseOutputMode(query)
+	errs.add(err)
+
+	frameStart, frameEnd, err := parseFrames(query)
+	errs.add(err)
+
+	colors, err := parseIntQueryParam(query, 2, 256, "colors")
+	errs.add(err)
+
+	dither, err := parseDither(query)
+	errs.add(err)
+
+	longEdge, shortEdge, err := parseEdges(query, height, width)
+	errs.add(err)
+
+	dpr, err := parseFloatQueryParam(query, 1, maxDPR, "dpr")
+	errs.add(err)
+	width, height, longEdge, shortEdge = applyDPR(dpr, width, height, longEdge, shortEdge)
+
+	fit, err := parseFit(query, width, height)
+	errs.add(err)
+
+	sliceTop, sliceRight, sliceBottom, sliceLeft, err := parseSlice(query, width, height, fit)
+	errs.add(err)
+
+	flipHorizontal, flipVertical, err := parseFlip(query)
+	errs.add(err)
+
+	order, err := parsePipeline(query)
+	errs.add(err)
+
+	pixelateSize, pixelateX, pixelateY, pixelateWidth, pixelateHeight, err := parsePixelate(query)
+	errs.add(err)
+
+	blurX, blurY, blurWidth, blurHeight, err := parseBlurRegion(query, blurAmount)
+	errs.add(err)
+
+	cropX, cropY, cropWidth, cropHeight, cropByGravity, err := parseCrop(query)
+	errs.add(err)
+
+	gravity, err := parseGravity(query, fit, cropByGravity)
+	errs.add(err)
+
+	padTop, padRight, padBottom, padLeft, err := parsePad(query)
+	errs.add(err)
+
+	extendTop, extendRight, extendBottom, extendLeft, extendFill, err := parseExtend(query)
+	errs.add(err)
+
+	borderWidth, borderColor, err := parseBorder(query)
+	errs.add(err)
+
+	radius, err := parseRadius(query)
+	errs.add(err)
+
+	shadowX, shadowY, shadowBlur, shadowColor, err := parseShadow(query)
+	errs.add(err)
+
+	overlay, overlayFill, overlayPosition, overlayOpacity, overlayScale, overlayTile, err := parseOverlay(query)
+	errs.add(err)
+
+	text, textColor, textSize, textPosition, err := parseText(query)
+	errs.add(err)
+
+	trimThreshold, err := parseTrim(query)
+	errs.add(err)
+
+	straightenAuto, err := parseStraighten(query)
+	errs.add(err)
+
+	skewX, skewY, err := parseSkew(query)
+	errs.add(err)
+
+	rotationBackground, err := parseRotationBackground(query)
+	errs.add(err)
+
+	brightness, err := parseIntQueryParam(query, -100, 100, "bri")
+	errs.add(err)
+
+	saturation, err := parseIntQueryParam(query, -100, 100, "sat")
+	errs.add(err)
+
+	hue, err := parseIntQueryParam(query, 0, 359, "hue")
+	errs.add(err)
+
+	tint, sepia, duotone, err := parseTone(query)
+	errs.add(err)
+
+	curves, err := parseLUT(query)
+	errs.add(err)
+
+	colorBlindness, err := parseColorBlindness(query)
+	errs.add(err)
+
+	grain, err := parseIntQueryParam(query, 0, 100, "grain")
+	errs.add(err)
+
+	placeholderMode, err := parsePlaceholder(query)
+	errs.add(err)
+
+	speed, err := parseFloatQueryParam(query, 0.1, 10, "speed")
+	errs.add(err)
+
+	fps, err := parseIntQueryParam(query, 1, 50, "fps")
+	errs.add(err)
+	if speed != 0 && fps != 0 {
+		errs.add(fmt.Errorf("speed and fps can't be combined"))
+	}
+
+	upscale, _ := queryParam(query, "up")
+	strip, _ := queryParam(query, "strip")
+
+	enhance, err := parseEnhance(query)
+	errs.add(err)
+
+	grayscale, err := parseGrayscale(query)
+	errs.add(err)
+
+	upscaleKernel, err := parseKernel(query)
+	errs.add(err)
+
+	redEye, err := parseRedEye(query)
+	errs.add(err)
+
+	whiteBalance, err := parseWhiteBalance(query)
+	errs.add(err)
+
+	exposure, err := parseFloatQueryParam(query, -2, 2, "exposure")
+	errs.add(err)
+
+	keepOrientation, err := parseOrient(query)
+	errs.add(err)
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	return &Options{
+		Height:        height,
+		Width:         width,
+		Rotation:      rotation,
+		Quality:       quality,
+		Format:        format,
+		AutoFormat:    autoFormat,
+		SharpenAmount: sharpenAmount,
+		SharpenX1:     sharpenX1,
+		SharpenM2:     sharpenM2,
+		BlurAmount:    blurAmount,
+		Upscale:       upscale == "true" || upscale == "ai",
+		StripMetadata: strip == "true",
+		AIUpscale:     upscale == "ai",
+		UpscaleKernel: upscaleKernel,
+
+		KeepOrientation: keepOrientation,
+
+		RemoveBackground: removeBackground,
+		Background:       background,
+		Watermark:        watermark,
+		Custom:           custom,
+		Envelope:         envelope,
+
+		PadTop:    padTop,
+		PadRight:  padRight,
+		PadBottom: padBottom,
+		PadLeft:   padLeft,
+
+		ExtendTop:    extendTop,
+		ExtendRight:  extendRight,
+		ExtendBottom: extendBottom,
+		ExtendLeft:   extendLeft,
+		ExtendFill:   extendFill,
+
+		BorderWidth: borderWidth,
+		BorderColor: borderColor,
+		Radius:      radius,
+
+		ShadowX:     shadowX,
+		ShadowY:     shadowY,
+		ShadowBlur:  shadowBlur,
+		ShadowColor: shadowColor,
+
+		Overlay:         overlay,
+		OverlayFill:     overlayFill,
+		OverlayPosition: overlayPosition,
+		OverlayOpacity:  overlayOpacity,
+		OverlayScale:    overlayScale,
+		OverlayTile:     overlayTile,
+
+		Text:         text,
+		TextColor:    textColor,
+		TextSize:     textSize,
+		TextPosition: textPosition,
+
+		FrameStart: frameStart,
+		FrameEnd:   frameEnd,
+		Speed:      speed,
+		FPS:        fps,
+
+		Colors: colors,
+		Dither: dither,
+
+		Placeholder:  placeholderMode,
+		RedEye:       redEye,
+		WhiteBalance: whiteBalance,
+		Exposure:     exposure,
+		Enhance:      enhance,
+
+		Brightness: brightness,
+		Saturation: saturation,
+		Hue:        hue,
+		Grayscale:  grayscale,
+
+		Tint:    tint,
+		Sepia:   sepia,
+		Duotone: duotone,
+
+		Curves:         curves,
+		ColorBlindness: colorBlindness,
+		Grain:          grain,
+
+		SliceTop:    sliceTop,
+		SliceRight:  sliceRight,
+		SliceBottom: sliceBottom,
+		SliceLeft:   sliceLeft,
+
+		Pixelate:       pixelateSize,
+		PixelateX:      pixelateX,
+		PixelateY:      pixelateY,
+		PixelateWidth:  pixelateWidth,
+		PixelateHeight: pixelateHeight,
+
+		BlurX:      blurX,
+		BlurY:      blurY,
+		BlurWidth:  blurWidth,
+		BlurHeight: blurHeight,
+
+		LongEdge:   longEdge,
+		ShortEdge:  shortEdge,
+		Fit:        fit,
+		CropX:      cropX,
+		CropY:      cropY,
+		CropWidth:  cropWidth,
+		CropHeight: cropHeight,
+		Trim:       trimThreshold,
+
+		CropByGravity: cropByGravity,
+		Gravity:       gravity,
+
+		Straighten: straightenAuto,
+		SkewX:      skewX,
+		SkewY:      skewY,
+
+		RotationBackground: rotationBackground,
+
+		FlipHorizontal: flipHorizontal,
+		FlipVertical:   flipVertical,
+
+		Pipeline: order,
+	}, nil
+}
+
+// Operations returns the names of the transformations the options ask for, sorted. The set is small and
+// fixed apart from registered operations, which makes it usable as a metrics label.
+func (o *Options) Operations() []string {
+	var operations []string
+	add := func(enabled bool, name string) {
+		if enabled {
+			operations = append(operations, name)
+		}
+	}
+
+	add(o.Height != 0 || o.Width != 0 || o.LongEdge != 0 || o.ShortEdge != 0, "resize")
+	add(o.SliceTop != 0 || o.SliceRight != 0 || o.SliceBottom != 0 || o.SliceLeft != 0, "slice")
+	add(o.Pixelate != 0, "pixelate")
+	add(o.IIIF != nil, "iiif")
+	add(o.CropWidth != 0, "crop")
+	add(o.Trim != 0, "trim")
+	add(o.PadTop != 0 || o.PadRight != 0 || o.PadBottom != 0 || o.PadLeft != 0, "pad")
+	add(o.ExtendFill != "", "extend")
+	add(o.BorderWidth != 0, "border")
+	add(o.Radius != 0, "radius")
+	add(o.ShadowColor != nil, "shadow")
+	add(o.Rotation != 0, "rotate")
+	add(o.FlipHorizontal || o.FlipVertical, "flip")
+	add(o.Quality != 0, "quality")
+	add(o.Format != vips.ImageTypeUnknown || o.AutoFormat, "format")
+	add(o.SharpenAmount != 0, "sharpen")
+	add(o.BlurAmount != 0, "blur")
+	add(o.Upscale && !o.AIUpscale, "upscale")
+	add(o.AIUpscale, "upscale-ai")
+	add(o.StripMetadata, "strip")
+	add(o.RemoveBackground, "bg")
+	add(o.Background != nil, "flatten")
+	add(o.Watermark != "", "wm")
+	add(o.Overlay != "" || o.OverlayFill != nil, "overlay")
+	add(o.Text != "", "text")
+	add(o.FrameStart != 0 || o.FrameEnd != 0, "frames")
+	add(o.Speed != 0, "speed")
+	add(o.FPS != 0, "fps")
+	add(o.Colors != 0 || o.Dither != nil, "palette")
+	add(o.RedEye, "redeye")
+	add(o.WhiteBalance, "wb")
+	add(o.Exposure != 0, "exposure")
+	add(o.Enhance, "enhance")
+	add(o.Brightness != 0 || o.Saturation != 0 || o.Hue != 0 || o.Grayscale, "color")
+	add(o.Tint != nil || o.Sepia || o.Duotone != nil, "tone")
+	add(o.Curves != nil, "lut")
+	add(o.ColorBlindness != "", "cb")
+	add(o.Grain != 0, "grain")
+	add(o.Straighten, "straighten")
+	add(o.SkewX != 0 || o.SkewY != 0, "skew")
+	add(o.Placeholder != "", "placeholder")
+	for _, step := range o.Custom {
+		operations = append(operations, step.Name)
+	}
+
+	sort.Strings(operations)
+	return operations
+}
+
+// Helper functions for parsing dimensions, rotations, quality, sharpening, blurring and output formats.
+
+func parseRotation(query url.Values) (int, error) {
+	rotation, err := parseIntQueryParam(query, 0, 360, "rotate")
+	if err != nil {
+		return 0, err
+	}
+	return rotation, nil
+}
+
+func parseRotationBackground(query url.Values) (*vips.ColorRGBA, error) {
+	value, _ := queryParam(query, "rbg")
+	if value == "" {
+		return nil, nil
+	}
+	color, err := parseHexColorAlpha(value, 255)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value for rbg: %v", err)
+	}
+	return &color, nil
+}
+
+func parseQuality(query url.Values) (int, error) {
+	quality, err := parseIntQueryParam(query, 1, 100, "quality")
+	if err != nil {
+		return 0, err
+	}
+	return quality, nil
+}
+
+func parseIntQueryParam(query url.Values, min, max int, name string) (int, error) {
+	value, key := queryParam(query, name)
+	if value == "" {
+		return 0, nil
+	}
+	num, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value for %s: %v (input: %s)", key, err, value)
+	}
+	if num < min || num > max {
+		return 0, fmt.Errorf("value for %s must be between %d and %d (input: %d)", key, min, max, num)
+	}
+	return num, nil
+}
+
+// Unsharp mask parameters of sharpen= when only the sigma is given.
+const (
+	SharpenX1Default = 0.6
+	SharpenM2Default = 1.0
+)
+
+// maxSharpenX1 and maxSharpenM2 bound the threshold and slope of sharpen=.
+const (
+	maxSharpenX1 = 10
+	maxSharpenM2 = 20
+)
+
+func parseSharpen(query url.Values) (float64, float64, float64, error) {
+	value, key := queryParam(query, "sharpen")
+	sigmaValue, rest, hasRest := strings.Cut(value, ",")
+	if !hasRest {
+		sigma, err := parseFloatQueryParam(query, 0, 1, "sharpen")
+		if err != nil || sigma == 0 {
+			return 0, 0, 0, err
+		}
+		return sigma, SharpenX1Default, SharpenM2Default, nil
+	}
+
+	x1Value, m2Value, ok := strings.Cut(rest, ",")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("invalid value for %s: must be sigma or sigma,x1,m2 (input: %s)", key, value)
+	}
+	sigma, err := strconv.ParseFloat(sigmaValue, 64)
+	if err != nil || sigma < 0 || sigma > 1 {
+		return 0, 0, 0, fmt.Errorf("invalid value for %s: sigma must be between 0 and 1 (input: %s)", key, value)
+	}
+	x1, err := strconv.ParseFloat(x1Value, 64)
+	if err != nil || x1 < 0 || x1 > maxSharpenX1 {
+		return 0, 0, 0, fmt.Errorf("invalid value for %s: x1 must be between 0 and %d (input: %s)", key, maxSharpenX1, value)
+	}
+	m2, err := strconv.ParseFloat(m2Value, 64)
+	if err != nil || m2 < 0 || m2 > maxSharpenM2 {
+		return 0, 0, 0, fmt.Errorf("invalid value for %s: m2 must be between 0 and %d (input: %s)", key, maxSharpenM2, value)
+	}
+	if sigma == 0 {
+		return 0, 0, 0, nil
+	}
+	return sigma, x1, m2, nil
+}
+
+func parseBlur(query url.Values) (float64, error) {
+	return parseFloatQueryParam(query, 0, 1, "blur")
+}
+
+func parseFloatQueryParam(query url.Values, min, max float64, name string) (float64, error) {
+	value, key := queryParam(query, name)
+	if value == "" {
+		return 0, nil
+	}
+	num, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value for %s: %v (input: %s)", key, err, value)
+	}
+	if num < min || num > max {
+		return 0, fmt.Errorf("value for %s must be between %f and %f (input: %f)", key, min, max, num)
+	}
+	return num, nil
+}
+
+func parseBackground(query url.Values) (bool, *vips.Color, error) {
+	switch value, _ := queryParam(query, "bg"); value {
+	case "":
+		return false, nil, nil
+	case "remove":
+		return true, nil, nil
+	default:
+		color, err := parseHexColor(value)
+		if err != nil {
+			return false, nil, fmt.Errorf("unsupported value for bg: %s (accepted: remove, RRGGBB)", value)
+		}
+		return false, &color, nil
+	}
+}
+
+// maxFrames bounds the frame indices of frames=.
+const maxFrames = 10000
+
+func parseFrames(query url.Values) (int, int, error) {
+	value, _ := queryParam(query, "frames")
+	if value == "" {
+		return 0, 0, nil
+	}
+
+	startValue, endValue, ok := strings.Cut(value, ":")
+	if !ok {
+		return 0, 0, fmt.Errorf("value for frames must be start:end (input: %s)", value)
+	}
+
+	var start, end int
+	var err error
+	if startValue != "" {
+		if start, err = strconv.Atoi(startValue); err != nil || start < 0 || start > maxFrames {
+			return 0, 0, fmt.Errorf("invalid start frame for frames (input: %s)", value)
+		}
+	}
+	if endValue != "" {
+		if end, err = strconv.Atoi(endValue); err != nil || end <= start || end > maxFrames {
+			return 0, 0, fmt.Errorf("invalid end frame for frames (input: %s)", value)
+		}
+	}
+	return start, end, nil
+}
+
+func parseDither(query url.Values) (*float64, error) {
+	if value, _ := queryParam(query, "dither"); value == "" {
+		return nil, nil
+	}
+	dither, err := parseFloatQueryParam(query, 0, 1, "dither")
+	if err != nil {
+		return nil, err
+	}
+	return &dither, nil
+}
+
+func parseEdges(query url.Values, height, width int) (int, int, error) {
+	maxEdge := MaxImageWidth
+	if MaxImageHeight > maxEdge {
+		maxEdge = MaxImageHeight
+	}
+
+	longEdge, err := parseIntQueryParam(query, 0, maxEdge, "longedge")
+	if err != nil {
+		return 0, 0, err
+	}
+	shortEdge, err := parseIntQueryParam(query, 0, maxEdge, "shortedge")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if longEdge != 0 && shortEdge != 0 {
+		return 0, 0, fmt.Errorf("longedge and shortedge can't be combined")
+	}
+	if (longEdge != 0 || shortEdge != 0) && (height != 0 || width != 0) {
+		return 0, 0, fmt.Errorf("longedge and shortedge can't be combined with width or height")
+	}
+	return longEdge, shortEdge, nil
+}
+
+// maxDPR bounds the device pixel ratio of dpr=.
+const maxDPR = 4
+
+// applyDPR multiplies the requested sizes by the device pixel ratio of dpr=, so that w=300&dpr=2 is 600
+// pixels wide. The ratio is lowered as needed for the sizes to stay within MaxImageWidth and MaxImageHeight,
+// keeping the aspect ratio of a requested box.
+func applyDPR(dpr float64, width, height, longEdge, shortEdge int) (int, int, int, int) {
+	if dpr <= 1 {
+		return width, height, longEdge, shortEdge
+	}
+	if width > 0 && float64(width)*dpr > MaxImageWidth {
+		dpr = float64(MaxImageWidth) / float64(width)
+	}
+	if height > 0 && float64(height)*dpr > MaxImageHeight {
+		dpr = float64(MaxImageHeight) / float64(height)
+	}
+	maxEdge := MaxImageWidth
+	if MaxImageHeight > maxEdge {
+		maxEdge = MaxImageHeight
+	}
+	if edge := longEdge + shortEdge; edge > 0 && float64(edge)*dpr > float64(maxEdge) {
+		dpr = float64(maxEdge) / float64(edge)
+	}
+
+	scale := func(size int) int {
+		return int(math.Round(float64(size) * dpr))
+	}
+	return scale(width), scale(height), scale(longEdge), scale(shortEdge)
+}
+
+// targetSize returns the width and height to resize the image to, resolving longedge and shortedge against
+// the image's orientation. Zero leaves a dimension to follow the aspect ratio.
+func (o *Options) targetSize(img *vips.ImageRef) (int, int) {
+	if o.LongEdge == 0 && o.ShortEdge == 0 {
+		return o.Width, o.Height
+	}
+
+	landscape := img.Width() >= img.PageHeight()
+	if (o.LongEdge != 0) == landscape {
+		return o.LongEdge + o.ShortEdge, 0
+	}
+	return 0, o.LongEdge + o.ShortEdge
+}
+
+func parseKernel(query url.Values) (vips.Kernel, error) {
+	switch value, _ := queryParam(query, "kernel"); value {
+	case "":
+		return vips.KernelAuto, nil
+	case "nearest":
+		return vips.KernelNearest, nil
+	case "linear":
+		return vips.KernelLinear, nil
+	case "cubic":
+		return vips.KernelCubic, nil
+	case "mitchell":
+		return vips.KernelMitchell, nil
+	case "lanczos2":
+		return vips.KernelLanczos2, nil
+	case "lanczos3":
+		return vips.KernelLanczos3, nil
+	default:
+		return vips.KernelAuto, fmt.Errorf("unsupported value for kernel: %s (accepted: nearest, linear, cubic, mitchell, lanczos2, lanczos3)", value)
+	}
+}
+
+func parseRedEye(query url.Values) (bool, error) {
+	switch value, _ := queryParam(query, "redeye"); value {
+	case "", "false":
+		return false, nil
+	case "true":
+		return true, nil
+	default:
+		return false, fmt.Errorf("unsupported value for redeye: %s (accepted: true, false)", value)
+	}
+}
+
+func parseEnhance(query url.Values) (bool, error) {
+	switch value, _ := queryParam(query, "enhance"); value {
+	case "", "false":
+		return false, nil
+	case "true":
+		return true, nil
+	default:
+		return false, fmt.Errorf("unsupported value for enhance: %s (accepted: true, false)", value)
+	}
+}
+
+func parseGrayscale(query url.Values) (bool, error) {
+	switch value, _ := queryParam(query, "grayscale"); value {
+	case "", "false":
+		return false, nil
+	case "true":
+		return true, nil
+	default:
+		return false, fmt.Errorf("unsupported value for grayscale: %s (accepted: true, false)", value)
+	}
+}
+
+func parseWhiteBalance(query url.Values) (bool, error) {
+	switch value, _ := queryParam(query, "wb"); value {
+	case "":
+		return false, nil
+	case "auto":
+		return true, nil
+	default:
+		return false, fmt.Errorf("unsupported value for wb: %s (accepted: auto)", value)
+	}
+}
+
+func parseOrient(query url.Values) (bool, error) {
+	switch value, _ := queryParam(query, "orient"); value {
+	case "", "true":
+		return false, nil
+	case "false":
+		return true, nil
+	default:
+		return false, fmt.Errorf("unsupported value for orient: %s (accepted: true, false)", value)
+	}
+}
+
+func parseStraighten(query url.Values) (bool, error) {
+	switch value, _ := queryParam(query, "straighten"); value {
+	case "":
+		return false, nil
+	case "auto":
+		return true, nil
+	default:
+		return false, fmt.Errorf("unsupported value for straighten: %s (accepted: auto)", value)
+	}
+}
+
+// parseTone parses the tint, sepia and duotone parameters, of which only one may be given.
+func parseTone(query url.Values) (*vips.Color, bool, []vips.Color, error) {
+	tintValue, _ := queryParam(query, "tint")
+	sepiaValue, _ := queryParam(query, "sepia")
+	duotoneValue, _ := queryParam(query, "duotone")
+
+	given := 0
+	for _, value := range []string{tintValue, sepiaValue, duotoneValue} {
+		if value != "" {
+			given++
+		}
+	}
+	if given > 1 {
+		return nil, false, nil, fmt.Errorf("tint, sepia and duotone can't be combined")
+	}
+
+	switch {
+	case tintValue != "":
+		color, err := parseHexColor(tintValue)
+		if err != nil {
+			return nil, false, nil, fmt.Errorf("invalid value for tint: %v", err)
+		}
+		return &color, false, nil, nil
+	case sepiaValue != "" && sepiaValue != "true":
+		return nil, false, nil, fmt.Errorf("unsupported value for sepia: %s (accepted: true)", sepiaValue)
+	case sepiaValue != "":
+		return nil, true, nil, nil
+	case duotoneValue != "":
+		shadows, highlights, ok := strings.Cut(duotoneValue, ",")
+		if !ok {
+			return nil, false, nil, fmt.Errorf("invalid value for duotone: must be two colors as RRGGBB,RRGGBB (input: %s)", duotoneValue)
+		}
+		from, err := parseHexColor(shadows)
+		if err != nil {
+			return nil, false, nil, fmt.Errorf("invalid value for duotone: %v", err)
+		}
+		to, err := parseHexColor(highlights)
+		if err != nil {
+			return nil, false, nil, fmt.Errorf("invalid value for duotone: %v", err)
+		}
+		return nil, false, []vips.Color{from, to}, nil
+	}
+	return nil, false, nil, nil
+}
+
+// parseHexColor parses a color given as RRGGBB hex digits.
+func parseHexColor(value string) (vips.Color, error) {
+	rgb, err := strconv.ParseUint(value, 16, 32)
+	if len(value) != 6 || err != nil {
+		return vips.Color{}, fmt.Errorf("color must be RRGGBB hex digits (input: %s)", value)
+	}
+	return vips.Color{R: uint8(rgb >> 16), G: uint8(rgb >> 8), B: uint8(rgb)}, nil
+}
+
+// parseHexColorAlpha parses a color given as RRGGBBAA hex digits, or RRGGBB with the alpha given.
+func parseHexColorAlpha(value string, alpha uint8) (vips.ColorRGBA, error) {
+	colorValue := value
+	if len(value) == 8 {
+		a, err := strconv.ParseUint(value[6:], 16, 8)
+		if err != nil {
+			return vips.ColorRGBA{}, fmt.Errorf("color must be RRGGBB or RRGGBBAA hex digits (input: %s)", value)
+		}
+		colorValue, alpha = value[:6], uint8(a)
+	}
+	rgb, err := strconv.ParseUint(colorValue, 16, 32)
+	if len(colorValue) != 6 || err != nil {
+		return vips.ColorRGBA{}, fmt.Errorf("color must be RRGGBB or RRGGBBAA hex digits (input: %s)", value)
+	}
+	return vips.ColorRGBA{R: uint8(rgb >> 16), G: uint8(rgb >> 8), B: uint8(rgb), A: alpha}, nil
+}
+
+func parseFlip(query url.Values) (bool, bool, error) {
+	switch value, _ := queryParam(query, "flip"); value {
+	case "":
+		return false, false, nil
+	case "h":
+		return true, false, nil
+	case "v":
+		return false, true, nil
+	case "both":
+		return true, true, nil
+	default:
+		return false, false, fmt.Errorf("unsupported value for flip: %s (accepted: h, v, both)", value)
+	}
+}
+
+func parsePipeline(query url.Values) ([]string, error) {
+	value, _ := queryParam(query, "pipeline")
+	if value == "" {
+		return nil, nil
+	}
+
+	order := make([]string, 0, len(orderedSteps))
+	given := make(map[string]bool, len(orderedSteps))
+	for _, step := range strings.Split(value, ",") {
+		known := false
+		for _, s := range orderedSteps {
+			known = known || s == step
+		}
+		if !known {
+			return nil, fmt.Errorf("unsupported operation in pipeline: %s (accepted: %s)", step, strings.Join(orderedSteps, ", "))
+		}
+		if given[step] {
+			return nil, fmt.Errorf("operation %s is given twice in pipeline", step)
+		}
+		given[step] = true
+		order = append(order, step)
+	}
+	for _, step := range orderedSteps {
+		if !given[step] {
+			order = append(order, step)
+		}
+	}
+	return order, nil
+}
+
+func parseFit(query url.Values, width, height int) (string, error) {
+	value, _ := queryParam(query, "fit")
+	// crop=smart is short for fit=cover&gravity=smart
+	if crop, _ := queryParam(query, "crop"); crop == CropSmart {
+		if value != "" && value != FitCover {
+			return "", fmt.Errorf("crop=%s can't be combined with fit=%s", CropSmart, value)
+		}
+		if width == 0 || height == 0 {
+			return "", fmt.Errorf("crop=%s requires both width and height", CropSmart)
+		}
+		return FitCover, nil
+	}
+	switch value {
+	case "":
+		return "", nil
+	case FitCover, FitContain, FitPad, FitFill, FitInside:
+		if width == 0 || height == 0 {
+			return "", fmt.Errorf("fit requires both width and height")
+		}
+		return value, nil
+	default:
+		return "", fmt.Errorf("unsupported value for fit: %s (accepted: %s, %s, %s, %s, %s)", value, FitCover, FitContain, FitPad, FitFill, FitInside)
+	}
+}
+
+// maxPad bounds each side of pad=.
+const maxPad = 5000
+
+// maxSlice bounds each inset of slice=.
+const maxSlice = 5000
+
+func parseSlice(query url.Values, width, height int, fit string) (int, int, int, int, error) {
+	if value, _ := queryParam(query, "slice"); value != "" {
+		if width == 0 || height == 0 {
+			return 0, 0, 0, 0, fmt.Errorf("slice requires both width and height")
+		}
+		if fit != "" {
+			return 0, 0, 0, 0, fmt.Errorf("slice can't be combined with fit")
+		}
+	}
+	return parseSides(query, "slice", maxSlice)
+}
+
+func parsePad(query url.Values) (int, int, int, int, error) {
+	return parseSides(query, "pad", maxPad)
+}
+
+// Fills of the area added by extend_fill=.
+const (
+	ExtendFillBackground = "background"
+	ExtendFillMirror     = "mirror"
+	ExtendFillCopy       = "copy"
+)
+
+// maxExtend bounds each side of extend=.
+const maxExtend = 5000
+
+func parseExtend(query url.Values) (int, int, int, int, string, error) {
+	top, right, bottom, left, err := parseSides(query, "extend", maxExtend)
+	if err != nil {
+		return 0, 0, 0, 0, "", err
+	}
+	fill, _ := queryParam(query, "extend_fill")
+	switch fill {
+	case "":
+		fill = ExtendFillBackground
+	case ExtendFillBackground, ExtendFillMirror, ExtendFillCopy:
+	default:
+		return 0, 0, 0, 0, "", fmt.Errorf("unsupported value for extend_fill: %s (accepted: %s, %s, %s)", fill, ExtendFillBackground, ExtendFillMirror, ExtendFillCopy)
+	}
+	if top == 0 && right == 0 && bottom == 0 && left == 0 {
+		if fill != ExtendFillBackground {
+			return 0, 0, 0, 0, "", fmt.Errorf("extend_fill requires extend")
+		}
+		return 0, 0, 0, 0, "", nil
+	}
+	return top, right, bottom, left, fill, nil
+}
+
+// parseSides parses the named parameter as top,right,bottom,left pixels, or a single value for all sides.
+func parseSides(query url.Values, name string, max int) (int, int, int, int, error) {
+	value, _ := queryParam(query, name)
+	if value == "" {
+		return 0, 0, 0, 0, nil
+	}
+
+	parts := strings.Split(value, ",")
+	if len(parts) != 1 && len(parts) != 4 {
+		return 0, 0, 0, 0, fmt.Errorf("invalid value for %s: must be top,right,bottom,left or a single value (input: %s)", name, value)
+	}
+	sides := make([]int, len(parts))
+	for i, part := range parts {
+		side, err := strconv.Atoi(part)
+		if err != nil || side < 0 || side > max {
+			return 0, 0, 0, 0, fmt.Errorf("invalid value for %s: sides must be between 0 and %d pixels (input: %s)", name, max, value)
+		}
+		sides[i] = side
+	}
+	if len(sides) == 1 {
+		return sides[0], sides[0], sides[0], sides[0], nil
+	}
+	return sides[0], sides[1], sides[2], sides[3], nil
+}
+
+// maxBorder bounds the width of border=.
+const maxBorder = 1000
+
+func parseBorder(query url.Values) (int, vips.Color, error) {
+	value, _ := queryParam(query, "border")
+	if value == "" {
+		return 0, vips.Color{}, nil
+	}
+
+	widthValue, colorValue, hasColor := strings.Cut(value, ",")
+	width, err := strconv.Atoi(widthValue)
+	if err != nil || width < 1 || width > maxBorder {
+		return 0, vips.Color{}, fmt.Errorf("invalid value for border: width must be between 1 and %d pixels (input: %s)", maxBorder, value)
+	}
+	var color vips.Color
+	if hasColor {
+		if color, err = parseHexColor(colorValue); err != nil {
+			return 0, vips.Color{}, fmt.Errorf("invalid value for border: %v", err)
+		}
+	}
+	return width, color, nil
+}
+
+// maxShadowOffset and maxShadowBlur bound the offsets and blur of shadow=.
+const (
+	maxShadowOffset = 1000
+	maxShadowBlur   = 100
+)
+
+func parseShadow(query url.Values) (int, int, float64, *vips.ColorRGBA, error) {
+	value, _ := queryParam(query, "shadow")
+	if value == "" {
+		return 0, 0, 0, nil, nil
+	}
+
+	parts := strings.Split(value, ",")
+	if len(parts) < 3 || len(parts) > 4 {
+		return 0, 0, 0, nil, fmt.Errorf("invalid value for shadow: expected x,y,blur[,RRGGBB[AA]] (input: %s)", value)
+	}
+	x, errX := strconv.Atoi(parts[0])
+	y, errY := strconv.Atoi(parts[1])
+	if errX != nil || errY != nil || abs(x) > maxShadowOffset || abs(y) > maxShadowOffset {
+		return 0, 0, 0, nil, fmt.Errorf("invalid value for shadow: offsets must be between -%d and %d pixels (input: %s)", maxShadowOffset, maxShadowOffset, value)
+	}
+	blur, err := strconv.ParseFloat(parts[2], 64)
+	if err != nil || blur < 0 || blur > maxShadowBlur {
+		return 0, 0, 0, nil, fmt.Errorf("invalid value for shadow: blur must be between 0 and %d (input: %s)", maxShadowBlur, value)
+	}
+
+	color := vips.ColorRGBA{A: 128}
+	if len(parts) == 4 {
+		if color, err = parseHexColorAlpha(parts[3], 128); err != nil {
+			return 0, 0, 0, nil, fmt.Errorf("invalid value for shadow: %v", err)
+		}
+	}
+	return x, y, blur, &color, nil
+}
+
+func parseOverlay(query url.Values) (string, *Fill, string, float64, float64, bool, error) {
+	overlay, _ := queryParam(query, "overlay")
+	position, _ := queryParam(query, "overlay_pos")
+	opacityValue, _ := queryParam(query, "overlay_opacity")
+	scaleValue, _ := queryParam(query, "overlay_scale")
+	tileValue, _ := queryParam(query, "overlay_tile")
+	if overlay == "" {
+		if position != "" || opacityValue != "" || scaleValue != "" || tileValue != "" {
+			return "", nil, "", 0, 0, false, fmt.Errorf("overlay_pos, overlay_opacity, overlay_scale and overlay_tile require overlay")
+		}
+		return "", nil, "", 0, 0, false, nil
+	}
+
+	opacity := 1.0
+	if opacityValue != "" {
+		var err error
+		if opacity, err = parseFloatQueryParam(query, 0, 1, "overlay_opacity"); err != nil {
+			return "", nil, "", 0, 0, false, err
+		}
+	}
+	fill, err := parseFill(overlay)
+	if err != nil {
+		return "", nil, "", 0, 0, false, fmt.Errorf("invalid value for overlay: %v", err)
+	}
+	if fill != nil {
+		if position != "" || scaleValue != "" || tileValue != "" {
+			return "", nil, "", 0, 0, false, fmt.Errorf("overlay_pos, overlay_scale and overlay_tile can't be combined with a gradient or color overlay")
+		}
+		return "", fill, "", opacity, 0, false, nil
+	}
+
+	switch tileValue {
+	case "", "false", "true":
+	default:
+		return "", nil, "", 0, 0, false, fmt.Errorf("unsupported value for overlay_tile: %s (accepted: true, false)", tileValue)
+	}
+	tile := tileValue == "true"
+	if tile && position != "" {
+		return "", nil, "", 0, 0, false, fmt.Errorf("overlay_pos can't be combined with overlay_tile")
+	}
+	if position == "" {
+		position = PositionBottomRight
+	}
+	if err := checkPosition(position, "overlay_pos"); err != nil {
+		return "", nil, "", 0, 0, false, err
+	}
+	scale, err := parseFloatQueryParam(query, 0.01, 1, "overlay_scale")
+	if err != nil {
+		return "", nil, "", 0, 0, false, err
+	}
+	return overlay, nil, position, opacity, scale, tile, nil
+}
+
+// maxFillStops bounds the colors of overlay=linear-gradient(...).
+const maxFillStops = 16
+
+// parseFill parses the value of overlay= as a color, RRGGBBAA or RRGGBB, or as a CSS-like
+// linear-gradient(angle, color [offset%], color [offset%], ...) whose angle is given in degrees (e.g. 180deg)
+// or as a side (e.g. to bottom, the default). Other values are overlay image URLs, for which it returns nil.
+func parseFill(value string) (*Fill, error) {
+	args, ok := strings.CutPrefix(value, "linear-gradient(")
+	if !ok {
+		if len(value) != 6 && len(value) != 8 {
+			return nil, nil
+		}
+		if _, err := strconv.ParseUint(value, 16, 32); err != nil {
+			return nil, nil
+		}
+		color, err := parseHexColorAlpha(value, 255)
+		if err != nil {
+			return nil, err
+		}
+		return &Fill{Stops: []FillStop{{Color: color}}}, nil
+	}
+
+	args, ok = strings.CutSuffix(args, ")")
+	if !ok {
+		return nil, fmt.Errorf("linear-gradient must end with ) (input: %s)", value)
+	}
+	parts := strings.Split(args, ",")
+	fill := &Fill{Angle: 180}
+	switch direction := strings.TrimSpace(parts[0]); {
+	case strings.HasSuffix(direction, "deg"):
+		angle, err := strconv.ParseFloat(strings.TrimSuffix(direction, "deg"), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid angle of linear-gradient: %s", direction)
+		}
+		fill.Angle = angle
+		parts = parts[1:]
+	case strings.HasPrefix(direction, "to "):
+		angle, ok := map[string]float64{"to top": 0, "to right": 90, "to bottom": 180, "to left": 270}[direction]
+		if !ok {
+			return nil, fmt.Errorf("unsupported direction of linear-gradient: %s (accepted: to top, to right, to bottom, to left, or an angle in deg)", direction)
+		}
+		fill.Angle = angle
+		parts = parts[1:]
+	}
+	if len(parts) < 2 || len(parts) > maxFillStops {
+		return nil, fmt.Errorf("linear-gradient must have between 2 and %d colors (input: %s)", maxFillStops, value)
+	}
+
+	// Stops without an offset are spread evenly between their neighbors, as in CSS
+	offsets := make([]float64, len(parts))
+	given := make([]bool, len(parts))
+	for i, part := range parts {
+		colorValue, offsetValue, hasOffset := strings.Cut(strings.TrimSpace(part), " ")
+		color, err := parseHexColorAlpha(colorValue, 255)
+		if err != nil {
+			return nil, err
+		}
+		fill.Stops = append(fill.Stops, FillStop{Color: color})
+		if hasOffset {
+			percent, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(offsetValue), "%"), 64)
+			if err != nil || !strings.HasSuffix(offsetValue, "%") || percent < 0 || percent > 100 {
+				return nil, fmt.Errorf("offsets of linear-gradient must be percentages between 0%% and 100%% (input: %s)", part)
+			}
+			offsets[i], given[i] = percent/100, true
+		}
+	}
+	if !given[0] {
+		offsets[0], given[0] = 0, true
+	}
+	if last := len(parts) - 1; !given[last] {
+		offsets[last], given[last] = 1, true
+	}
+	for i := 1; i < len(parts); i++ {
+		if given[i] {
+			continue
+		}
+		next := i + 1
+		for !given[next] {
+			next++
+		}
+		step := (offsets[next] - offsets[i-1]) / float64(next-i+1)
+		for ; i < next; i++ {
+			offsets[i] = offsets[i-1] + step
+		}
+	}
+	for i := range fill.Stops {
+		fill.Stops[i].Offset = offsets[i]
+	}
+	return fill, nil
+}
+
+// checkPosition validates the value of a parameter placing an overlay or caption.
+func checkPosition(position, name string) error {
+	switch position {
+	case PositionCenter, PositionTop, PositionBottom, PositionLeft, PositionRight,
+		PositionTopLeft, PositionTopRight, PositionBottomLeft, PositionBottomRight:
+		return nil
+	}
+	return fmt.Errorf("unsupported value for %s: %s (accepted: %s, %s, %s, %s, %s, %s, %s, %s, %s)", name, position,
+		PositionCenter, PositionTop, PositionBottom, PositionLeft, PositionRight, PositionTopLeft, PositionTopRight, PositionBottomLeft, PositionBottomRight)
+}
+
+// maxTextLength bounds the length of text= in bytes.
+const maxTextLength = 500
+
+func parseText(query url.Values) (string, vips.Color, int, string, error) {
+	text, _ := queryParam(query, "text")
+	colorValue, _ := queryParam(query, "text_color")
+	sizeValue, _ := queryParam(query, "text_size")
+	position, _ := queryParam(query, "text_pos")
+	white := vips.Color{R: 255, G: 255, B: 255}
+	if text == "" {
+		if colorValue != "" || sizeValue != "" || position != "" {
+			return "", white, 0, "", fmt.Errorf("text_color, text_size and text_pos require text")
+		}
+		return "", white, 0, "", nil
+	}
+	if len(text) > maxTextLength {
+		return "", white, 0, "", fmt.Errorf("text must be at most %d bytes", maxTextLength)
+	}
+
+	color := white
+	if colorValue != "" {
+		var err error
+		if color, err = parseHexColor(colorValue); err != nil {
+			return "", white, 0, "", fmt.Errorf("invalid value for text_color: %v", err)
+		}
+	}
+	size, err := parseIntQueryParam(query, 1, 1000, "text_size")
+	if err != nil {
+		return "", white, 0, "", err
+	}
+	if position == "" {
+		position = PositionBottom
+	}
+	if err := checkPosition(position, "text_pos"); err != nil {
+		return "", white, 0, "", err
+	}
+	return text, color, size, position, nil
+}
+
+// maxRadius bounds radius=, beyond which every image is rounded like radius=max.
+const maxRadius = 10000
+
+func parseRadius(query url.Values) (int, error) {
+	value, _ := queryParam(query, "radius")
+	switch value {
+	case "":
+		return 0, nil
+	case "max":
+		return RadiusMax, nil
+	}
+	radius, err := strconv.Atoi(value)
+	if err != nil || radius < 1 || radius > maxRadius {
+		return 0, fmt.Errorf("invalid value for radius: must be max or between 1 and %d pixels (input: %s)", maxRadius, value)
+	}
+	return radius, nil
+}
+
+func parseTrim(query url.Values) (float64, error) {
+	switch value, _ := queryParam(query, "trim"); value {
+	case "", "false":
+		return 0, nil
+	case "true":
+		return TrimThreshold, nil
+	default:
+		threshold, err := strconv.ParseFloat(value, 64)
+		if err != nil || threshold <= 0 || threshold > 255 {
+			return 0, fmt.Errorf("unsupported value for trim: %s (accepted: true, or a tolerance between 0 and 255)", value)
+		}
+		return threshold, nil
+	}
+}
+
+func parseCrop(query url.Values) (int, int, int, int, bool, error) {
+	value, _ := queryParam(query, "crop")
+	if value == CropSmart {
+		return 0, 0, 0, 0, false, nil
+	}
+	// Regions given by their size only are placed by gravity=
+	if widthValue, heightValue, ok := strings.Cut(value, ","); ok && !strings.Contains(heightValue, ",") {
+		width, widthErr := strconv.Atoi(widthValue)
+		height, heightErr := strconv.Atoi(heightValue)
+		if widthErr != nil || heightErr != nil || width < 1 || height < 1 || width > MaxImageWidth || height > MaxImageHeight {
+			return 0, 0, 0, 0, false, fmt.Errorf("crop size must be between 1x1 and %dx%d (input: %s)", MaxImageWidth, MaxImageHeight, value)
+		}
+		return 0, 0, width, height, true, nil
+	}
+	x, y, width, height, err := parseRegion(query, "crop")
+	return x, y, width, height, false, err
+}
+
+func parseGravity(query url.Values, fit string, cropByGravity bool) (string, error) {
+	value, _ := queryParam(query, "gravity")
+	if crop, _ := queryParam(query, "crop"); crop == CropSmart {
+		if value != "" && value != GravitySmart && value != GravityEntropy {
+			return "", fmt.Errorf("crop=%s can't be combined with gravity=%s", CropSmart, value)
+		}
+		if value == "" {
+			value = GravitySmart
+		}
+	}
+	switch value {
+	case "":
+		return GravityCenter, nil
+	case GravityCenter, GravityNorth, GravitySouth, GravityEast, GravityWest,
+		GravityNorthEast, GravityNorthWest, GravitySouthEast, GravitySouthWest, GravitySmart, GravityEntropy:
+		if fit != FitCover && !cropByGravity {
+			return "", fmt.Errorf("gravity requires fit=%s or crop=w,h", FitCover)
+		}
+		return value, nil
+	default:
+		return "", fmt.Errorf("unsupported value for gravity: %s (accepted: %s, %s, %s, %s, %s, %s, %s, %s, %s, %s, %s)", value,
+			GravityCenter, GravityNorth, GravitySouth, GravityEast, GravityWest,
+			GravityNorthEast, GravityNorthWest, GravitySouthEast, GravitySouthWest, GravitySmart, GravityEntropy)
+	}
+}
+
+// maxPixelate bounds the block size of pixelate=.
+const maxPixelate = 1000
+
+func parsePixelate(query url.Values) (int, int, int, int, int, error) {
+	size, err := parseIntQueryParam(query, 2, maxPixelate, "pixelate")
+	if err != nil {
+		return 0, 0, 0, 0, 0, err
+	}
+	x, y, width, height, err := parseRegion(query, "pixelate_region")
+	if err != nil {
+		return 0, 0, 0, 0, 0, err
+	}
+	if size == 0 && width != 0 {
+		return 0, 0, 0, 0, 0, fmt.Errorf("pixelate_region requires pixelate")
+	}
+	return size, x, y, width, height, nil
+}
+
+func parseBlurRegion(query url.Values, blurAmount float64) (int, int, int, int, error) {
+	x, y, width, height, err := parseRegion(query, "blur_region")
+	if err != nil {
+		return 0, 0, 0, 0, err
+	}
+	if width != 0 && blurAmount == 0 {
+		return 0, 0, 0, 0, fmt.Errorf("blur_region requires blur")
+	}
+	return x, y, width, height, nil
+}
+
+// parseRegion parses a region of the image given as x,y,w,h in the named parameter.
+func parseRegion(query url.Values, name string) (int, int, int, int, error) {
+	value, _ := queryParam(query, name)
+	if value == "" {
+		return 0, 0, 0, 0, nil
+	}
+
+	parts := strings.Split(value, ",")
+	if len(parts) != 4 {
+		return 0, 0, 0, 0, fmt.Errorf("value for %s must be x,y,w,h (input: %s)", name, value)
+	}
+	region := make([]int, 4)
+	for i, part := range parts {
+		num, err := strconv.Atoi(part)
+		if err != nil {
+			return 0, 0, 0, 0, fmt.Errorf("invalid value for %s: %v (input: %s)", name, err, value)
+		}
+		region[i] = num
+	}
+	x, y, width, height := region[0], region[1], region[2], region[3]
+	if x < 0 || y < 0 || x >= MaxImageWidth || y >= MaxImageHeight {
+		return 0, 0, 0, 0, fmt.Errorf("%s origin must be within %dx%d (input: %s)", name, MaxImageWidth, MaxImageHeight, value)
+	}
+	if width < 1 || height < 1 || width > MaxImageWidth || height > MaxImageHeight {
+		return 0, 0, 0, 0, fmt.Errorf("%s size must be between 1x1 and %dx%d (input: %s)", name, MaxImageWidth, MaxImageHeight, value)
+	}
+	return x, y, width, height, nil
+}
+
+// maxSkew is the largest shear angle in degrees.
+const maxSkew = 45
+
+func parseSkew(query url.Values) (float64, float64, error) {
+	value, _ := queryParam(query, "skew")
+	if value == "" {
+		return 0, 0, nil
+	}
+
+	parts := strings.Split(value, ",")
+	if len(parts) > 2 {
+		return 0, 0, fmt.Errorf("value for skew must be x or x,y (input: %s)", value)
+	}
+	angles := make([]float64, 2)
+	for i, part := range parts {
+		angle, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid value for skew: %v (input: %s)", err, value)
+		}
+		if angle < -maxSkew || angle > maxSkew {
+			return 0, 0, fmt.Errorf("value for skew must be between %d and %d degrees (input: %s)", -maxSkew, maxSkew, value)
+		}
+		angles[i] = angle
+	}
+	return angles[0], angles[1], nil
+}
+
+// parseLUT parses lut=, curves in the syntax of ParseCurves or the name of a LUT set by SetLUTs.
+func parseLUT(query url.Values) (*Curves, error) {
+	value, _ := queryParam(query, "lut")
+	if value == "" {
+		return nil, nil
+	}
+	if strings.Contains(value, ":") {
+		return ParseCurves(value)
+	}
+	curves, ok := namedCurves[value]
+	if !ok {
+		return nil, fmt.Errorf("unknown LUT: %s", value)
+	}
+	return curves, nil
+}
+
+func parseColorBlindness(query url.Values) (string, error) {
+	switch value, _ := queryParam(query, "cb"); value {
+	case "", Deuteranopia, Protanopia, Tritanopia:
+		return value, nil
+	default:
+		return "", fmt.Errorf("unsupported value for cb: %s (accepted: %s, %s, %s)", value, Deuteranopia, Protanopia, Tritanopia)
+	}
+}
+
+func parsePlaceholder(query url.Values) (string, error) {
+	switch value, _ := queryParam(query, "placeholder"); value {
+	case "", PlaceholderColor, PlaceholderGradient:
+		return value, nil
+	default:
+		return "", fmt.Errorf("unsupported value for placeholder: %s (accepted: %s, %s)", value, PlaceholderColor, PlaceholderGradient)
+	}
+}
+
+func parseOutputMode(query url.Values) (bool, error) {
+	switch value, _ := queryParam(query, "out"); value {
+	case "":
+		return false, nil
+	case "json":
+		return true, nil
+	default:
+		return false, fmt.Errorf("unsupported value for out: %s (accepted: json)", value)
+	}
+}
+
+// maxWatermarkID leaves room in the watermark payload for the "|" separator and a unix timestamp.
+const maxWatermarkID = MaxWatermarkPayload - 11
+
+func parseWatermark(query url.Values) (string, error) {
+	value, _ := queryParam(query, "wm")
+	if len(value) > maxWatermarkID {
+		return "", fmt.Errorf("value for wm must be at most %d bytes (input: %s)", maxWatermarkID, value)
+	}
+	for _, c := range value {
+		if c < 0x21 || c > 0x7e || c == '|' {
+			return "", fmt.Errorf("value for wm must be printable ASCII without | (input: %s)", value)
+		}
+	}
+	return value, nil
+}
+
+func parseImageFormat(query url.Values) (vips.ImageType, bool, error) {
+	format, _ := queryParam(query, "format")
+	if format == "auto" {
+		return vips.ImageTypeUnknown, true, nil
+	}
+	imageType, err := ParseFormatName(format)
+	return imageType, false, err
+}
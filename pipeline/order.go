@@ -0,0 +1,62 @@
+package pipeline
+
+import (
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// Operations whose order pipeline= sets.
+const (
+	StepRotate  = "rotate"
+	StepFlip    = "flip"
+	StepBlur    = "blur"
+	StepResize  = "resize"
+	StepSharpen = "sharpen"
+)
+
+// orderedSteps are the operations pipeline= orders, in their default order. Sharpening that comes last runs
+// later, after the color adjustments.
+var orderedSteps = []string{StepRotate, StepFlip, StepBlur, StepResize, StepSharpen}
+
+// runStep applies one of the operations pipeline= orders to the image, if the options ask for it.
+func runStep(img *vips.ImageRef, opts *Options, step string) (*vips.ImageRef, error) {
+	switch step {
+	case StepRotate:
+		if opts.Rotation != 0 {
+			return rotate(img, opts.Rotation, opts.RotationBackground)
+		}
+	case StepFlip:
+		if opts.FlipHorizontal || opts.FlipVertical {
+			return flip(img, opts.FlipHorizontal, opts.FlipVertical)
+		}
+	case StepBlur:
+		if opts.BlurAmount > 0 && opts.BlurWidth == 0 {
+			if err := img.GaussianBlur(opts.BlurAmount); err != nil {
+				return nil, err
+			}
+		}
+	case StepResize:
+		return resize(img, opts)
+	case StepSharpen:
+		if opts.SharpenAmount > 0 {
+			if err := img.Sharpen(opts.SharpenAmount, opts.SharpenX1, opts.SharpenM2); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return img, nil
+}
+
+// resize resizes the image to the size of the options, as a nine-patch with slice=, to fit the box with fit=,
+// or else to the width and height given.
+func resize(img *vips.ImageRef, opts *Options) (*vips.ImageRef, error) {
+	width, height := opts.targetSize(img)
+	switch {
+	case opts.SliceTop != 0 || opts.SliceRight != 0 || opts.SliceBottom != 0 || opts.SliceLeft != 0:
+		return nineSlice(img, width, height, opts.SliceTop, opts.SliceRight, opts.SliceBottom, opts.SliceLeft)
+	case opts.Fit != "" && width > 0 && height > 0:
+		return fitImage(img, width, height, opts.Fit, opts.Gravity, opts.Upscale, opts.UpscaleKernel, opts.MaxUpscale, opts.Background)
+	case height > 0 || width > 0:
+		return resizeImage(img, width, height, opts.Upscale, opts.UpscaleKernel, opts.MaxUpscale)
+	}
+	return img, nil
+}
@@ -0,0 +1,161 @@
+package pipeline
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// Positions of overlays for overlay_pos=.
+const (
+	PositionCenter      = "center"
+	PositionTop         = "top"
+	PositionBottom      = "bottom"
+	PositionLeft        = "left"
+	PositionRight       = "right"
+	PositionTopLeft     = "top-left"
+	PositionTopRight    = "top-right"
+	PositionBottomLeft  = "bottom-left"
+	PositionBottomRight = "bottom-right"
+)
+
+// Overlay composites the overlay image onto the image, or onto each frame of animations, at the position
+// and opacity of the options, or repeated across the whole image with opts.OverlayTile. The overlay is
+// scaled to opts.OverlayScale of the image's width, and shrunk to fit within the image if it is larger. The
+// returned image must be used in place of the one passed in; the caller keeps ownership of the overlay, which
+// is modified.
+func Overlay(img, overlay *vips.ImageRef, opts *Options) (*vips.ImageRef, error) {
+	width, height := img.Width(), img.PageHeight()
+
+	if overlay.Pages() > 1 {
+		// Only the first frame of animated overlays is used
+		if err := overlay.SetPageHeight(overlay.Height()); err != nil {
+			return nil, err
+		}
+		if err := overlay.ExtractArea(0, 0, overlay.Width(), overlay.PageHeight()); err != nil {
+			return nil, err
+		}
+	}
+	if opts.OverlayScale > 0 {
+		if err := overlay.Resize(opts.OverlayScale*float64(width)/float64(overlay.Width()), vips.KernelAuto); err != nil {
+			return nil, err
+		}
+	}
+	overlay, err := FitWithin(overlay, width, height)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := withAlpha(overlay); err != nil {
+		return nil, err
+	}
+	if opts.OverlayOpacity < 1 {
+		format := overlay.BandFormat()
+		if err := overlay.Linear([]float64{1, 1, 1, opts.OverlayOpacity}, []float64{0, 0, 0, 0}); err != nil {
+			return nil, err
+		}
+		if err := overlay.Cast(format); err != nil {
+			return nil, err
+		}
+	}
+
+	var left, top int
+	if opts.OverlayTile {
+		across := (width + overlay.Width() - 1) / overlay.Width()
+		down := (height + overlay.Height() - 1) / overlay.Height()
+		if err := overlay.Replicate(across, down); err != nil {
+			return nil, err
+		}
+		if err := overlay.ExtractArea(0, 0, width, height); err != nil {
+			return nil, err
+		}
+	} else {
+		left, top = overlayOffset(opts.OverlayPosition, width-overlay.Width(), height-overlay.Height())
+	}
+	if img.Pages() > 1 {
+		return mapFrames(img, func(frame *vips.ImageRef) (*vips.ImageRef, error) {
+			return composite(frame, overlay, left, top)
+		})
+	}
+	return composite(img, overlay, left, top)
+}
+
+// Fill is a linear gradient, or with a single stop a color, composited over images by overlay=.
+type Fill struct {
+	// Angle is the direction of the gradient in degrees, as in CSS: 0 goes up and 90 to the right.
+	Angle float64
+	Stops []FillStop
+}
+
+// FillStop is a color of a Fill, at an offset between 0 and 1 along its gradient.
+type FillStop struct {
+	Color  vips.ColorRGBA
+	Offset float64
+}
+
+// fillOverlay composites the fill, faded by the opacity, over the whole image or each frame of animations.
+func fillOverlay(img *vips.ImageRef, fill *Fill, opacity float64) (*vips.ImageRef, error) {
+	overlay, err := vips.NewImageFromBuffer([]byte(fill.svg(img.Width(), img.PageHeight(), opacity)))
+	if err != nil {
+		return nil, err
+	}
+	defer overlay.Close()
+	if img.Pages() > 1 {
+		return mapFrames(img, func(frame *vips.ImageRef) (*vips.ImageRef, error) {
+			return composite(frame, overlay, 0, 0)
+		})
+	}
+	return composite(img, overlay, 0, 0)
+}
+
+// svg renders the fill as an SVG of the size. As in CSS, the gradient line runs through the center at the
+// angle, long enough for the corners to get the first and last colors.
+func (f *Fill) svg(width, height int, opacity float64) string {
+	sin, cos := math.Sincos(f.Angle * math.Pi / 180)
+	length := math.Abs(float64(width)*sin) + math.Abs(float64(height)*cos)
+	dx, dy := sin*length/2, -cos*length/2
+	centerX, centerY := float64(width)/2, float64(height)/2
+
+	var stops strings.Builder
+	for _, stop := range f.Stops {
+		fmt.Fprintf(&stops, `<stop offset="%g" stop-color="#%02x%02x%02x" stop-opacity="%g"/>`,
+			stop.Offset, stop.Color.R, stop.Color.G, stop.Color.B, float64(stop.Color.A)/255*opacity)
+	}
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d">`+
+		`<linearGradient id="fill" gradientUnits="userSpaceOnUse" x1="%g" y1="%g" x2="%g" y2="%g">%s</linearGradient>`+
+		`<rect width="%d" height="%d" fill="url(#fill)"/></svg>`,
+		width, height, centerX-dx, centerY-dy, centerX+dx, centerY+dy, stops.String(), width, height)
+}
+
+// overlayOffset returns where an overlay at the position starts, given the space left around it.
+func overlayOffset(position string, spaceX, spaceY int) (int, int) {
+	left, top := spaceX/2, spaceY/2
+	switch position {
+	case PositionTop, PositionTopLeft, PositionTopRight:
+		top = 0
+	case PositionBottom, PositionBottomLeft, PositionBottomRight:
+		top = spaceY
+	}
+	switch position {
+	case PositionLeft, PositionTopLeft, PositionBottomLeft:
+		left = 0
+	case PositionRight, PositionTopRight, PositionBottomRight:
+		left = spaceX
+	}
+	return left, top
+}
+
+// composite draws the overlay over the image at left, top, in sRGB.
+func composite(img, overlay *vips.ImageRef, left, top int) (*vips.ImageRef, error) {
+	if img.Bands() < 3 {
+		if err := img.ToColorSpace(vips.InterpretationSRGB); err != nil {
+			return nil, err
+		}
+	}
+	if err := img.Composite(overlay, vips.BlendModeOver, left, top); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
@@ -0,0 +1,213 @@
+package pipeline
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// params lists the query parameters by name, followed by their aliases. When a parameter is given under
+// several names, the first one in this order is used.
+var params = [][]string{
+	{"width", "w"},
+	{"height", "h"},
+	{"dpr"},
+	{"rotate", "r"},
+	{"rbg"},
+	{"quality", "q"},
+	{"format", "f"},
+	{"sharpen", "s"},
+	{"blur", "b"},
+	{"up"},
+	{"kernel"},
+	{"strip"},
+	{"orient"},
+	{"bg"},
+	{"wm"},
+	{"overlay"},
+	{"overlay_pos"},
+	{"overlay_opacity"},
+	{"overlay_scale"},
+	{"overlay_tile"},
+	{"text"},
+	{"text_color"},
+	{"text_size"},
+	{"text_pos"},
+	{"out"},
+	{"frames"},
+	{"speed"},
+	{"fps"},
+	{"colors"},
+	{"dither"},
+	{"longedge"},
+	{"shortedge"},
+	{"pixelate"},
+	{"pixelate_region"},
+	{"blur_region"},
+	{"crop"},
+	{"trim"},
+	{"pad"},
+	{"extend"},
+	{"extend_fill"},
+	{"border"},
+	{"radius"},
+	{"shadow"},
+	{"fit"},
+	{"gravity"},
+	{"slice"},
+	{"flip"},
+	{"pipeline"},
+	{"straighten"},
+	{"skew"},
+	{"redeye"},
+	{"wb"},
+	{"exposure"},
+	{"enhance"},
+	{"bri"},
+	{"sat"},
+	{"hue"},
+	{"grayscale"},
+	{"tint"},
+	{"sepia"},
+	{"duotone"},
+	{"lut"},
+	{"cb"},
+	{"grain"},
+	{"placeholder"},
+	// Read by the server rather than ParseOptions
+	{"webp"},
+	{"strict"},
+	{"sig"},
+	{"expires"},
+	{"nonce"},
+	{"user"},
+	{"tenant"},
+	{"priority"},
+}
+
+// paramNames maps every name and alias to the name of its parameter.
+var paramNames = func() map[string]string {
+	names := make(map[string]string)
+	for _, param := range params {
+		for _, key := range param {
+			names[key] = param[0]
+		}
+	}
+	return names
+}()
+
+// queryParam returns the value of the named parameter and the key it was given under, looking at the
+// aliases in order. The key is empty if the parameter isn't present.
+func queryParam(query url.Values, name string) (string, string) {
+	for _, param := range params {
+		if param[0] != name {
+			continue
+		}
+		for _, key := range param {
+			if value := query.Get(key); value != "" {
+				return value, key
+			}
+		}
+		return "", ""
+	}
+	return query.Get(name), name
+}
+
+// MergeParams returns the query with the parameters of defaults that it doesn't give under any of their names,
+// so that both are parsed into one set of options. The parameters named in override are taken from defaults
+// alone, and left out if defaults doesn't give them.
+func MergeParams(query, defaults url.Values, override ...string) url.Values {
+	merged := make(url.Values, len(query)+len(defaults))
+	for key, values := range query {
+		merged[key] = values
+	}
+	for _, name := range override {
+		for _, key := range paramKeys(name) {
+			merged.Del(key)
+		}
+	}
+	for key, values := range defaults {
+		name, ok := paramNames[key]
+		if !ok {
+			name = key
+		}
+		if !hasParam(merged, name) {
+			merged[key] = values
+		}
+	}
+	return merged
+}
+
+// hasParam reports whether the query gives the named parameter under any of its names, even without a value.
+func hasParam(query url.Values, name string) bool {
+	for _, key := range paramKeys(name) {
+		if query.Has(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// paramKeys returns the name of the parameter followed by its aliases.
+func paramKeys(name string) []string {
+	for _, param := range params {
+		if param[0] == name {
+			return param
+		}
+	}
+	return []string{name}
+}
+
+// CheckParams returns a ParamErrors for query parameters that are neither known nor registered operations, and
+// for parameters given under more than one of their names. ParseOptions calls it when the query has strict=true;
+// servers can call ParseStrictOptions to be strict about every request.
+func CheckParams(query url.Values) error {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	operationsMu.RLock()
+	defer operationsMu.RUnlock()
+
+	var errs ParamErrors
+	given := make(map[string]string)
+	for _, key := range keys {
+		name, ok := paramNames[key]
+		if !ok {
+			if _, ok := operations[key]; !ok {
+				errs.add(fmt.Errorf("unknown parameter: %s", key))
+			}
+			continue
+		}
+		if other, ok := given[name]; ok {
+			errs.add(fmt.Errorf("%s and %s can't be combined", other, key))
+			continue
+		}
+		given[name] = key
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// ParamErrors lists the problems with the parameters of a query, one per invalid parameter.
+type ParamErrors []error
+
+// Error returns the messages one per line.
+func (e ParamErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+func (e *ParamErrors) add(err error) {
+	if err != nil {
+		*e = append(*e, err)
+	}
+}
@@ -0,0 +1,42 @@
+package pipeline
+
+import (
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// Placeholder modes for placeholder=.
+const (
+	// PlaceholderColor reduces the image to a single pixel of its average color.
+	PlaceholderColor = "color"
+	// PlaceholderGradient reduces the image to 3x3 pixels of its regional colors, which browsers stretch into a gradient.
+	PlaceholderGradient = "gradient"
+)
+
+// placeholder reduces the image to a tiny image of its colors, for use as a background placeholder.
+// Animations are reduced to their first frame.
+func placeholder(img *vips.ImageRef, mode string) (*vips.ImageRef, error) {
+	var err error
+	if img.Pages() > 1 {
+		img, err = trimAnimation(img, &Options{FrameEnd: 1})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	size := 1
+	if mode == PlaceholderGradient {
+		size = 3
+	}
+
+	// Shrinking averages the pixels of each region
+	hScale := float64(size) / float64(img.Width())
+	vScale := float64(size) / float64(img.PageHeight())
+	if err := img.ResizeWithVScale(hScale, vScale, vips.KernelLinear); err != nil {
+		return nil, err
+	}
+	if err := img.RemoveMetadata(); err != nil {
+		return nil, err
+	}
+
+	return img, nil
+}
@@ -0,0 +1,301 @@
+package pipeline
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// Policy is a compiled policy script. A script is a list of statements separated by semicolons or newlines,
+// each either an action or "if <condition> then <action>":
+//
+//	if width>2000 then resize 2000; if format==png and no alpha then jpeg; strip
+//
+// Conditions compare width, height, pages or format with >, <, >=, <=, == or !=, test the alpha and animated
+// flags, and are combined with and/or (and binds tighter) and negated with not/no. Actions are:
+// resize W, resize WxH, a format name (or format NAME), quality N, strip, or a raw parameter list such as
+// w=800&sharpen=0.5. Statements run in order and each sees the result of the previous ones.
+type Policy struct {
+	statements []policyStatement
+}
+
+type policyStatement struct {
+	condition policyCondition
+	action    policyAction
+}
+
+// policyCondition is a disjunction of conjunctions of terms. A nil condition always matches.
+type policyCondition [][]policyTerm
+
+type policyTerm struct {
+	negate bool
+	ident  string
+	op     string
+	value  string
+}
+
+type policyAction struct {
+	params  url.Values
+	format  vips.ImageType
+	quality int
+}
+
+// policyState is what conditions are evaluated against.
+type policyState struct {
+	img    *vips.ImageRef
+	format vips.ImageType
+}
+
+var policyTokenPattern = regexp.MustCompile(`>=|<=|==|!=|>|<|[^\s<>=!]+`)
+
+// CompilePolicy parses a policy script.
+func CompilePolicy(script string) (*Policy, error) {
+	policy := &Policy{}
+	for _, line := range strings.FieldsFunc(script, func(r rune) bool { return r == ';' || r == '\n' }) {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		var statement policyStatement
+		actionText := line
+		if strings.HasPrefix(line, "if ") {
+			conditionText, rest, ok := strings.Cut(line[3:], " then ")
+			if !ok {
+				return nil, fmt.Errorf("policy: missing then in %q", line)
+			}
+			condition, err := compilePolicyCondition(conditionText)
+			if err != nil {
+				return nil, err
+			}
+			statement.condition = condition
+			actionText = rest
+		}
+
+		action, err := compilePolicyAction(actionText)
+		if err != nil {
+			return nil, err
+		}
+		statement.action = action
+		policy.statements = append(policy.statements, statement)
+	}
+	return policy, nil
+}
+
+func compilePolicyCondition(text string) (policyCondition, error) {
+	tokens := policyTokenPattern.FindAllString(text, -1)
+	var condition policyCondition
+	var conjunction []policyTerm
+
+	for i := 0; i < len(tokens); {
+		term := policyTerm{}
+		for i < len(tokens) && (tokens[i] == "not" || tokens[i] == "no") {
+			term.negate = !term.negate
+			i++
+		}
+		if i >= len(tokens) {
+			return nil, fmt.Errorf("policy: incomplete condition %q", text)
+		}
+
+		term.ident = tokens[i]
+		i++
+		switch term.ident {
+		case "alpha", "animated":
+		case "width", "height", "pages", "format":
+			if i+1 >= len(tokens) {
+				return nil, fmt.Errorf("policy: %s needs a comparison in %q", term.ident, text)
+			}
+			term.op, term.value = tokens[i], tokens[i+1]
+			i += 2
+			if err := checkPolicyComparison(term); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("policy: unknown variable %s", term.ident)
+		}
+		conjunction = append(conjunction, term)
+
+		if i < len(tokens) {
+			switch tokens[i] {
+			case "and":
+			case "or":
+				condition = append(condition, conjunction)
+				conjunction = nil
+			default:
+				return nil, fmt.Errorf("policy: expected and/or, got %s", tokens[i])
+			}
+			i++
+			if i == len(tokens) {
+				return nil, fmt.Errorf("policy: incomplete condition %q", text)
+			}
+		}
+	}
+
+	if len(conjunction) == 0 {
+		return nil, fmt.Errorf("policy: empty condition")
+	}
+	return append(condition, conjunction), nil
+}
+
+func checkPolicyComparison(term policyTerm) error {
+	switch term.op {
+	case ">", "<", ">=", "<=", "==", "!=":
+	default:
+		return fmt.Errorf("policy: unknown operator %s", term.op)
+	}
+
+	if term.ident == "format" {
+		if term.op != "==" && term.op != "!=" {
+			return fmt.Errorf("policy: format can only be compared with == or !=")
+		}
+		_, err := ParseFormatName(term.value)
+		return err
+	}
+
+	_, err := strconv.Atoi(term.value)
+	if err != nil {
+		return fmt.Errorf("policy: %s must be compared with a number, got %s", term.ident, term.value)
+	}
+	return nil
+}
+
+func compilePolicyAction(text string) (policyAction, error) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return policyAction{}, fmt.Errorf("policy: missing action")
+	}
+
+	action := policyAction{}
+	switch {
+	case fields[0] == "resize" && len(fields) == 2:
+		width, height, _ := strings.Cut(fields[1], "x")
+		action.params = url.Values{"w": {width}}
+		if height != "" {
+			action.params.Set("h", height)
+		}
+	case fields[0] == "format" && len(fields) == 2:
+		action.params = url.Values{"f": {fields[1]}}
+	case fields[0] == "quality" && len(fields) == 2:
+		action.params = url.Values{"q": {fields[1]}}
+	case fields[0] == "strip" && len(fields) == 1:
+		action.params = url.Values{"strip": {"true"}}
+	case len(fields) == 1 && strings.Contains(fields[0], "="):
+		params, err := url.ParseQuery(fields[0])
+		if err != nil {
+			return policyAction{}, fmt.Errorf("policy: %v", err)
+		}
+		action.params = params
+	case len(fields) == 1:
+		action.params = url.Values{"f": {fields[0]}}
+	default:
+		return policyAction{}, fmt.Errorf("policy: unknown action %q", text)
+	}
+
+	// Validate the parameters now so broken scripts are caught when they are loaded
+	opts, err := ParseOptions(action.params)
+	if err != nil {
+		return policyAction{}, fmt.Errorf("policy: %q: %v", text, err)
+	}
+	action.format = opts.Format
+	action.quality = opts.Quality
+
+	return action, nil
+}
+
+// Apply evaluates the policy against the image, whose output format so far is format, and applies the
+// matching actions. It returns the resulting image and the output format and quality chosen by the policy,
+// which are vips.ImageTypeUnknown and 0 when the policy did not change them.
+func (p *Policy) Apply(img *vips.ImageRef, format vips.ImageType) (*vips.ImageRef, vips.ImageType, int, error) {
+	if format == vips.ImageTypeUnknown {
+		format = img.Format()
+	}
+	state := &policyState{img: img, format: format}
+
+	chosenFormat := vips.ImageTypeUnknown
+	quality := 0
+	for _, statement := range p.statements {
+		if !statement.condition.matches(state) {
+			continue
+		}
+
+		opts, err := ParseOptions(statement.action.params)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		state.img, err = Transform(state.img, opts)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+
+		if statement.action.format != vips.ImageTypeUnknown {
+			chosenFormat = statement.action.format
+			state.format = chosenFormat
+		}
+		if statement.action.quality != 0 {
+			quality = statement.action.quality
+		}
+	}
+
+	return state.img, chosenFormat, quality, nil
+}
+
+func (c policyCondition) matches(state *policyState) bool {
+	if c == nil {
+		return true
+	}
+	for _, conjunction := range c {
+		matched := true
+		for _, term := range conjunction {
+			if term.matches(state) == term.negate {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (t policyTerm) matches(state *policyState) bool {
+	switch t.ident {
+	case "alpha":
+		return state.img.HasAlpha()
+	case "animated":
+		return state.img.Pages() > 1
+	case "format":
+		format, _ := ParseFormatName(t.value)
+		return (format == state.format) == (t.op == "==")
+	}
+
+	var actual int
+	switch t.ident {
+	case "width":
+		actual = state.img.Width()
+	case "height":
+		actual = state.img.PageHeight()
+	case "pages":
+		actual = state.img.Pages()
+	}
+	expected, _ := strconv.Atoi(t.value)
+
+	switch t.op {
+	case ">":
+		return actual > expected
+	case "<":
+		return actual < expected
+	case ">=":
+		return actual >= expected
+	case "<=":
+		return actual <= expected
+	case "==":
+		return actual == expected
+	default:
+		return actual != expected
+	}
+}
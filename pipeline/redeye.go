@@ -0,0 +1,218 @@
+package pipeline
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+const (
+	// redEyeSampleSize is the longest edge of the copy red eyes are detected on.
+	redEyeSampleSize = 512
+	// redEyeMinRed and redEyeMinRedness are the red level, and its excess over green and blue, of the pixels
+	// of red eyes.
+	redEyeMinRed     = 80
+	redEyeMinRedness = 50
+	// redEyeMaxSize is the largest diameter of a red eye as a fraction of the shorter edge of the image.
+	// Larger red areas are lips, clothes or products.
+	redEyeMaxSize = 0.05
+	// redEyeMinFill is the smallest fraction of its bounding box a red eye fills; a disc fills about 0.79.
+	redEyeMinFill = 0.4
+)
+
+// removeRedEye desaturates red eyes, small round patches of saturated red, replacing their red with the
+// average of their green and blue so pupils turn dark. The alpha channel is left untouched.
+func removeRedEye(img *vips.ImageRef) (*vips.ImageRef, error) {
+	if img.ColorSpace() != vips.InterpretationSRGB || img.BandFormat() != vips.BandFormatUchar {
+		if err := img.ToColorSpace(vips.InterpretationSRGB); err != nil {
+			return nil, err
+		}
+	}
+
+	mask, found, err := redEyeMask(img)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return img, nil
+	}
+	defer mask.Close()
+
+	// The mask is upscaled smoothly, feathering the edges of the correction
+	hScale := float64(img.Width()) / float64(mask.Width())
+	vScale := float64(img.Height()) / float64(mask.Height())
+	if err := mask.ResizeWithVScale(hScale, vScale, vips.KernelLinear); err != nil {
+		return nil, err
+	}
+	if err := mask.Embed(0, 0, img.Width(), img.Height(), vips.ExtendCopy); err != nil {
+		return nil, err
+	}
+	if err := mask.Linear1(1.0/255, 0); err != nil {
+		return nil, err
+	}
+
+	// The excess of red over the average of green and blue is taken from the red band where the mask is set
+	correction, err := img.Copy()
+	if err != nil {
+		return nil, err
+	}
+	defer correction.Close()
+	if err := correction.ExtractBand(0, 3); err != nil {
+		return nil, err
+	}
+	if err := correction.Recomb([][]float64{{1, -0.5, -0.5}}); err != nil {
+		return nil, err
+	}
+	// Casting clips the excess at 0, so pixels that aren't red are left alone
+	if err := correction.Cast(vips.BandFormatUchar); err != nil {
+		return nil, err
+	}
+	if err := correction.Multiply(mask); err != nil {
+		return nil, err
+	}
+	if err := correction.Linear1(-1, 0); err != nil {
+		return nil, err
+	}
+	zeros := make([]float64, img.Bands()-1)
+	if err := correction.BandJoinConst(zeros); err != nil {
+		return nil, err
+	}
+
+	if err := img.Add(correction); err != nil {
+		return nil, err
+	}
+	if err := img.Cast(vips.BandFormatUchar); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// redEyeMask returns a mask of the red eyes of the sRGB image, detected on a downscaled copy and at its size,
+// and whether there are any.
+func redEyeMask(img *vips.ImageRef) (*vips.ImageRef, bool, error) {
+	sample, err := img.Copy()
+	if err != nil {
+		return nil, false, err
+	}
+	defer sample.Close()
+	if sample.Pages() > 1 {
+		if err := sample.SetPageHeight(sample.Height()); err != nil {
+			return nil, false, err
+		}
+	}
+	longEdge := sample.Width()
+	if sample.Height() > longEdge {
+		longEdge = sample.Height()
+	}
+	if longEdge > redEyeSampleSize {
+		if err := sample.Resize(float64(redEyeSampleSize)/float64(longEdge), vips.KernelLinear); err != nil {
+			return nil, false, err
+		}
+	}
+	pixels, err := sample.ToBytes()
+	if err != nil {
+		return nil, false, err
+	}
+
+	width, height, bands := sample.Width(), sample.Height(), sample.Bands()
+	red := make([]bool, width*height)
+	for i := range red {
+		r, g, b := int(pixels[i*bands]), int(pixels[i*bands+1]), int(pixels[i*bands+2])
+		if g < b {
+			g = b
+		}
+		red[i] = r >= redEyeMinRed && r-g >= redEyeMinRedness
+	}
+
+	shorter := width
+	if height < shorter {
+		shorter = height
+	}
+	maxSize := int(redEyeMaxSize*float64(shorter)) + 1
+	mask := image.NewGray(image.Rect(0, 0, width, height))
+	found := false
+	seen := make([]bool, len(red))
+	for start := range red {
+		if !red[start] || seen[start] {
+			continue
+		}
+		patch := redPatch(red, seen, width, start)
+
+		left, top, right, bottom := width, height, 0, 0
+		for _, i := range patch {
+			x, y := i%width, i/width
+			if x < left {
+				left = x
+			}
+			if x >= right {
+				right = x + 1
+			}
+			if y < top {
+				top = y
+			}
+			if y >= bottom {
+				bottom = y + 1
+			}
+		}
+		boxWidth, boxHeight := right-left, bottom-top
+		if boxWidth > maxSize || boxHeight > maxSize || boxWidth > 2*boxHeight || boxHeight > 2*boxWidth ||
+			float64(len(patch)) < redEyeMinFill*float64(boxWidth*boxHeight) {
+			continue
+		}
+
+		// Grown by a pixel to cover the edges of the pupil
+		for _, i := range patch {
+			x, y := i%width, i/width
+			for dy := -1; dy <= 1; dy++ {
+				for dx := -1; dx <= 1; dx++ {
+					mask.SetGray(x+dx, y+dy, color.Gray{Y: 255})
+				}
+			}
+		}
+		found = true
+	}
+	if !found {
+		return nil, false, nil
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, mask); err != nil {
+		return nil, false, err
+	}
+	maskImage, err := vips.NewImageFromBuffer(buf.Bytes())
+	if err != nil {
+		return nil, false, err
+	}
+	return maskImage, true, nil
+}
+
+// redPatch returns the pixels of the 4-connected patch of red pixels that start belongs to, marking them seen.
+func redPatch(red, seen []bool, width, start int) []int {
+	var patch []int
+	stack := []int{start}
+	seen[start] = true
+	for len(stack) > 0 {
+		i := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		patch = append(patch, i)
+
+		x := i % width
+		neighbors := [4]int{i - width, i + width, -1, -1}
+		if x > 0 {
+			neighbors[2] = i - 1
+		}
+		if x < width-1 {
+			neighbors[3] = i + 1
+		}
+		for _, n := range neighbors {
+			if n >= 0 && n < len(red) && red[n] && !seen[n] {
+				seen[n] = true
+				stack = append(stack, n)
+			}
+		}
+	}
+	return patch
+}
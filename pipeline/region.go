@@ -0,0 +1,98 @@
+package pipeline
+
+import (
+	"math"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// clipRegion clips the region at left, top of the given size to the image, or returns the whole image for a
+// width of 0. It reports false for regions entirely outside of the image.
+func clipRegion(img *vips.ImageRef, left, top, width, height int) (int, int, int, int, bool) {
+	if width == 0 {
+		return 0, 0, img.Width(), img.PageHeight(), true
+	}
+	if left >= img.Width() || top >= img.PageHeight() {
+		return 0, 0, 0, 0, false
+	}
+	if left+width > img.Width() {
+		width = img.Width() - left
+	}
+	if top+height > img.PageHeight() {
+		height = img.PageHeight() - top
+	}
+	return left, top, width, height, true
+}
+
+// blurRegion blurs the region of the image, in every frame of animations. The blur is relative to the size of
+// the region, an amount of 1 blurring it as heavily as Obscure does whole images.
+func blurRegion(img *vips.ImageRef, amount float64, left, top, width, height int) (*vips.ImageRef, error) {
+	if img.Pages() > 1 {
+		return mapFrames(img, func(frame *vips.ImageRef) (*vips.ImageRef, error) {
+			return blurRegion(frame, amount, left, top, width, height)
+		})
+	}
+
+	left, top, width, height, ok := clipRegion(img, left, top, width, height)
+	if !ok {
+		return img, nil
+	}
+	area, err := img.Copy()
+	if err != nil {
+		return nil, err
+	}
+	defer area.Close()
+	if err := area.ExtractArea(left, top, width, height); err != nil {
+		return nil, err
+	}
+	sigma := math.Max(float64(width), float64(height)) / 20
+	if err := area.GaussianBlur(amount * math.Max(sigma, 10)); err != nil {
+		return nil, err
+	}
+	if err := img.Insert(area, left, top, false, nil); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// pixelate replaces the region of the image, or the whole image for a width of 0, with blocks of size by size
+// pixels of its average color, in every frame of animations.
+func pixelate(img *vips.ImageRef, size, left, top, width, height int) (*vips.ImageRef, error) {
+	if img.Pages() > 1 {
+		return mapFrames(img, func(frame *vips.ImageRef) (*vips.ImageRef, error) {
+			return pixelate(frame, size, left, top, width, height)
+		})
+	}
+
+	left, top, width, height, ok := clipRegion(img, left, top, width, height)
+	if !ok {
+		return img, nil
+	}
+	area, err := img.Copy()
+	if err != nil {
+		return nil, err
+	}
+	defer area.Close()
+	if err := area.ExtractArea(left, top, width, height); err != nil {
+		return nil, err
+	}
+
+	// Shrinking averages each block to a pixel, zooming repeats it; the last blocks may be partial
+	across := (width + size - 1) / size
+	down := (height + size - 1) / size
+	if err := area.ResizeWithVScale(float64(across)/float64(width), float64(down)/float64(height), vips.KernelLinear); err != nil {
+		return nil, err
+	}
+	if err := area.Zoom(size, size); err != nil {
+		return nil, err
+	}
+	// Rounding in the resize can leave a pixel more or less than the blocks cover
+	if err := area.Embed(0, 0, width, height, vips.ExtendCopy); err != nil {
+		return nil, err
+	}
+
+	if err := img.Insert(area, left, top, false, nil); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
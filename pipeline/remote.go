@@ -0,0 +1,43 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// maxRemoteResponseSize is the maximum accepted size of an image returned by an external processing service.
+const maxRemoteResponseSize = 64 * 1024 * 1024 // 64MB
+
+// postImage sends a request body to an external processing service and returns the response body.
+func postImage(ctx context.Context, client *http.Client, endpoint, contentType string, body io.Reader) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned a %d status code", req.URL.Host, resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxRemoteResponseSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxRemoteResponseSize {
+		return nil, fmt.Errorf("response from %s exceeds the allowed limit", req.URL.Host)
+	}
+
+	return data, nil
+}
@@ -0,0 +1,105 @@
+package pipeline
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// Restrictions limit the operations, output formats and values requests may use. Operation names are those
+// returned by Options.Operations; denying "upscale" also denies "upscale-ai". Formats are names accepted by
+// ParseFormatName. Zero values impose no limit.
+type Restrictions struct {
+	AllowedOperations []string `json:"AllowedOperations"`
+	DeniedOperations  []string `json:"DeniedOperations"`
+	AllowedFormats    []string `json:"AllowedFormats"`
+	DeniedFormats     []string `json:"DeniedFormats"`
+	MaxBlur           float64  `json:"MaxBlur"`
+	MaxSharpen        float64  `json:"MaxSharpen"`
+	MaxWidth          int      `json:"MaxWidth"`
+	MaxHeight         int      `json:"MaxHeight"`
+}
+
+// ForbiddenError is returned for options that the restrictions don't allow.
+type ForbiddenError struct {
+	Reason string
+}
+
+func (e *ForbiddenError) Error() string {
+	return e.Reason
+}
+
+// Validate checks that the format names are known.
+func (r *Restrictions) Validate() error {
+	for _, name := range append(append([]string{}, r.AllowedFormats...), r.DeniedFormats...) {
+		if _, err := ParseFormatName(name); name == "" || err != nil {
+			return fmt.Errorf("unknown format in restrictions: %q", name)
+		}
+	}
+	return nil
+}
+
+// Check returns a *ForbiddenError if the options use an operation, format or value the restrictions don't allow.
+func (r *Restrictions) Check(opts *Options) error {
+	for _, operation := range opts.Operations() {
+		if len(r.AllowedOperations) > 0 && !matchOperation(r.AllowedOperations, operation) {
+			return &ForbiddenError{Reason: fmt.Sprintf("operation %s is not allowed", operation)}
+		}
+		if matchOperation(r.DeniedOperations, operation) {
+			return &ForbiddenError{Reason: fmt.Sprintf("operation %s is not allowed", operation)}
+		}
+	}
+
+	if opts.Format != vips.ImageTypeUnknown {
+		if len(r.AllowedFormats) > 0 && !matchFormat(r.AllowedFormats, opts) {
+			return &ForbiddenError{Reason: fmt.Sprintf("output format %s is not allowed", formatName(opts.Format))}
+		}
+		if matchFormat(r.DeniedFormats, opts) {
+			return &ForbiddenError{Reason: fmt.Sprintf("output format %s is not allowed", formatName(opts.Format))}
+		}
+	}
+
+	if r.MaxBlur > 0 && opts.BlurAmount > r.MaxBlur {
+		return &ForbiddenError{Reason: fmt.Sprintf("blur must not exceed %g", r.MaxBlur)}
+	}
+	if r.MaxSharpen > 0 && opts.SharpenAmount > r.MaxSharpen {
+		return &ForbiddenError{Reason: fmt.Sprintf("sharpen must not exceed %g", r.MaxSharpen)}
+	}
+	if r.MaxWidth > 0 && opts.Width > r.MaxWidth {
+		return &ForbiddenError{Reason: fmt.Sprintf("width must not exceed %d", r.MaxWidth)}
+	}
+	if r.MaxHeight > 0 && opts.Height > r.MaxHeight {
+		return &ForbiddenError{Reason: fmt.Sprintf("height must not exceed %d", r.MaxHeight)}
+	}
+	// The orientation isn't known yet, so edges are held to the larger limit
+	if edge := opts.LongEdge + opts.ShortEdge; edge > 0 && (r.MaxWidth > 0 || r.MaxHeight > 0) {
+		limit := r.MaxWidth
+		if r.MaxHeight > limit {
+			limit = r.MaxHeight
+		}
+		if edge > limit {
+			return &ForbiddenError{Reason: fmt.Sprintf("edge length must not exceed %d", limit)}
+		}
+	}
+
+	return nil
+}
+
+func matchOperation(names []string, operation string) bool {
+	for _, name := range names {
+		if operation == name || strings.HasPrefix(operation, name+"-") {
+			return true
+		}
+	}
+	return false
+}
+
+func matchFormat(names []string, opts *Options) bool {
+	for _, name := range names {
+		if format, _ := ParseFormatName(name); format == opts.Format {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,177 @@
+package pipeline
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"net/url"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// SelfTestResult is the outcome of one check of SelfTest.
+type SelfTestResult struct {
+	Check string `json:"check"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// selfTestOperations are the transformations SelfTest runs, by name.
+var selfTestOperations = []struct{ name, query string }{
+	{"resize", "width=32"},
+	{"fit", "width=24&height=24&fit=contain"},
+	{"gravity", "width=24&height=24&fit=cover&gravity=northeast"},
+	{"smart crop", "width=24&height=24&crop=smart"},
+	{"crop", "crop=4,4,32,32"},
+	{"rotate", "rotate=30"},
+	{"skew", "skew=10"},
+	{"straighten", "straighten=auto"},
+	{"blur", "blur=2"},
+	{"sharpen", "sharpen=1"},
+	{"enhance", "enhance=true"},
+	{"upscale", "width=128&up=true"},
+	{"placeholder", "placeholder=gradient"},
+}
+
+// SelfTest checks what this build of libvips can do, e.g. to debug the libraries of a container image. Test
+// images drawn in memory, opaque, transparent, gray and animated, are encoded in every format of this build
+// that isn't disabled and decoded back, and the main transformations are run on the opaque one. Failed
+// checks report their error.
+func SelfTest() []SelfTestResult {
+	var results []SelfTestResult
+	check := func(name string, err error) bool {
+		result := SelfTestResult{Check: name, OK: err == nil}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+		return err == nil
+	}
+
+	images, err := selfTestImages()
+	if !check("draw test images", err) {
+		return results
+	}
+
+	for _, name := range formatNames() {
+		format, _ := ParseFormatName(name)
+		for _, testImage := range images {
+			// Only GIFs are checked for animation, the other formats export the first frame or all frames stacked
+			if testImage.name == "animated" && format != vips.ImageTypeGIF {
+				continue
+			}
+			data, err := selfTestEncode(testImage.data, format)
+			if !check(fmt.Sprintf("encode %s (%s)", name, testImage.name), err) {
+				continue
+			}
+			check(fmt.Sprintf("decode %s (%s)", name, testImage.name), selfTestDecode(data, testImage.frames))
+		}
+	}
+
+	for _, operation := range selfTestOperations {
+		check(operation.name, selfTestTransform(images[0].data, operation.query))
+	}
+	return results
+}
+
+type selfTestImage struct {
+	name   string
+	data   []byte
+	frames int
+}
+
+// selfTestImages draws the test images as PNGs and a GIF, the opaque one first.
+func selfTestImages() ([]selfTestImage, error) {
+	opaque := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	transparent := image.NewNRGBA(image.Rect(0, 0, 48, 48))
+	gray := image.NewGray(image.Rect(0, 0, 32, 32))
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			opaque.SetRGBA(x, y, color.RGBA{R: uint8(x * 4), G: uint8(y * 5), B: uint8(255 - x*2), A: 255})
+			if x < 48 {
+				transparent.SetNRGBA(x, y, color.NRGBA{R: 200, G: uint8(x * 5), B: 40, A: uint8(y * 5)})
+			}
+			if x < 32 && y < 32 {
+				gray.SetGray(x, y, color.Gray{Y: uint8((x + y) * 4)})
+			}
+		}
+	}
+
+	animation := &gif.GIF{}
+	palette := color.Palette{color.Black, color.White, color.RGBA{R: 255, A: 255}}
+	for i := 0; i < 3; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 24, 24), palette)
+		for x := 0; x < 24; x++ {
+			frame.SetColorIndex(x, (x+i*8)%24, 2)
+		}
+		animation.Image = append(animation.Image, frame)
+		animation.Delay = append(animation.Delay, 10)
+	}
+
+	var images []selfTestImage
+	for _, img := range []struct {
+		name string
+		img  image.Image
+	}{{"opaque", opaque}, {"transparent", transparent}, {"gray", gray}} {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img.img); err != nil {
+			return nil, err
+		}
+		images = append(images, selfTestImage{name: img.name, data: buf.Bytes(), frames: 1})
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, animation); err != nil {
+		return nil, err
+	}
+	return append(images, selfTestImage{name: "animated", data: buf.Bytes(), frames: len(animation.Image)}), nil
+}
+
+func selfTestEncode(data []byte, format vips.ImageType) ([]byte, error) {
+	img, err := Load(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer img.Close()
+	out, _, err := ExportImage(img, 0, format)
+	return out, err
+}
+
+// selfTestDecode loads the encoded image and checks that its frames came through.
+func selfTestDecode(data []byte, frames int) error {
+	img, err := Load(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	if img.Pages() != frames {
+		return fmt.Errorf("decoded %d frames of %d", img.Pages(), frames)
+	}
+	// libvips decodes lazily, so the pixels are only read when the image is encoded again
+	_, _, err = ExportImage(img, 0, vips.ImageTypePNG)
+	return err
+}
+
+func selfTestTransform(data []byte, query string) error {
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return err
+	}
+	opts, err := ParseOptions(values)
+	if err != nil {
+		return err
+	}
+	img, err := Load(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	img, err = Transform(img, opts)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	_, _, err = ExportImage(img, 0, vips.ImageTypePNG)
+	return err
+}
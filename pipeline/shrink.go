@@ -0,0 +1,104 @@
+package pipeline
+
+import (
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// maxJPEGShrink is the largest factor the JPEG decoder shrinks by.
+const maxJPEGShrink = 8
+
+// ShrinkTarget returns the size an image can be decoded at, at least, and still be transformed as opts asks,
+// for LoadSized. A zero width or height doesn't constrain that dimension; 0, 0 means the image is needed at
+// its full size because opts doesn't resize it or its other transformations depend on the image's pixel size,
+// like blurs and crop regions. upright tells whether the size applies to the image rotated upright as its EXIF
+// orientation says, which Transform does unless opts.KeepOrientation is set.
+func ShrinkTarget(opts *Options) (width, height int, upright bool) {
+	if opts.BlurAmount != 0 || opts.AIUpscale || opts.CropWidth != 0 || opts.Pixelate != 0 || opts.IIIF != nil ||
+		opts.SliceTop != 0 || opts.SliceRight != 0 || opts.SliceBottom != 0 || opts.SliceLeft != 0 {
+		return 0, 0, false
+	}
+
+	width, height = opts.Width, opts.Height
+	// The edge lengths apply to either dimension depending on the orientation
+	if edge := opts.LongEdge + opts.ShortEdge; edge > 0 {
+		width, height = edge, edge
+	}
+	// So do the dimensions of rotated or skewed images
+	if opts.Rotation != 0 || opts.Straighten || opts.SkewX != 0 || opts.SkewY != 0 {
+		if width < height {
+			width = height
+		}
+		height = width
+	}
+	return width, height, !opts.KeepOrientation
+}
+
+// shrinkOnLoad sets the import parameters that decode the image at a reduced size that is still at least
+// width × height, upright or as stored.
+func shrinkOnLoad(data []byte, imageType vips.ImageType, width, height int, upright bool, params *vips.ImportParams) error {
+	switch imageType {
+	case vips.ImageTypeJPEG:
+		header, err := vips.LoadImageFromBuffer(data, vips.NewImportParams())
+		if err != nil {
+			return err
+		}
+		defer header.Close()
+
+		// Orientations 5 to 8 are rotated by 90 degrees, so the upright box applies to the other dimensions
+		if upright && header.Orientation() >= 5 {
+			width, height = height, width
+		}
+		factor := 1
+		for factor < maxJPEGShrink && fits(header.Width()/(factor*2), header.Height()/(factor*2), width, height) {
+			factor *= 2
+		}
+		if factor > 1 {
+			params.JpegShrinkFactor.Set(factor)
+		}
+	case vips.ImageTypeTIFF:
+		page, err := pyramidLevel(data, width, height)
+		if err != nil {
+			return err
+		}
+		if page > 0 {
+			params.Page.Set(page)
+		}
+	}
+	return nil
+}
+
+// pyramidLevel returns the page of a pyramidal TIFF with the smallest level that is still at least
+// width × height, or 0 for the full-resolution image. Pages that aren't smaller than the one before end
+// the pyramid, so multi-page documents are read from their first page.
+func pyramidLevel(data []byte, width, height int) (int, error) {
+	first, err := vips.LoadImageFromBuffer(data, vips.NewImportParams())
+	if err != nil {
+		return 0, err
+	}
+	pages, levelWidth := first.Pages(), first.Width()
+	first.Close()
+
+	level := 0
+	for page := 1; page < pages; page++ {
+		params := vips.NewImportParams()
+		params.Page.Set(page)
+		img, err := vips.LoadImageFromBuffer(data, params)
+		if err != nil {
+			return 0, err
+		}
+		smaller := img.Width() < levelWidth && fits(img.Width(), img.Height(), width, height)
+		levelWidth = img.Width()
+		img.Close()
+
+		if !smaller {
+			break
+		}
+		level = page
+	}
+	return level, nil
+}
+
+// fits reports whether an image of imgWidth × imgHeight is at least width × height.
+func fits(imgWidth, imgHeight, width, height int) bool {
+	return imgWidth >= width && imgHeight >= height
+}
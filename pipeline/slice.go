@@ -0,0 +1,119 @@
+package pipeline
+
+import (
+	"math"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// nineSlice resizes the image, or each frame of animations, to exactly width by height as a nine-patch: the
+// corners within the top, right, bottom and left insets keep their size, the edges between them are stretched
+// along their length only, and the center both ways. Chat bubbles, frames and other UI chrome keep crisp
+// borders at any size. Insets that don't fit the image or the output are scaled down together.
+func nineSlice(img *vips.ImageRef, width, height, top, right, bottom, left int) (*vips.ImageRef, error) {
+	if img.Pages() > 1 {
+		return mapFrames(img, func(frame *vips.ImageRef) (*vips.ImageRef, error) {
+			return nineSlice(frame, width, height, top, right, bottom, left)
+		})
+	}
+
+	// The source keeps a center to stretch, the output may be all borders
+	fromColumns := fitSlices(left, right, img.Width(), 1)
+	fromRows := fitSlices(top, bottom, img.Height(), 1)
+	toColumns := fitSlices(fromColumns[0], fromColumns[2], width, 0)
+	toRows := fitSlices(fromRows[0], fromRows[2], height, 0)
+
+	var out *vips.ImageRef
+	y := 0
+	for i := range fromRows {
+		var row *vips.ImageRef
+		x := 0
+		for j := range fromColumns {
+			if fromColumns[j] == 0 || fromRows[i] == 0 || toColumns[j] == 0 || toRows[i] == 0 {
+				x += fromColumns[j]
+				continue
+			}
+			piece, err := slicePiece(img, x, y, fromColumns[j], fromRows[i], toColumns[j], toRows[i])
+			if err != nil {
+				closeAll(row, out)
+				return nil, err
+			}
+			row, err = joinPiece(row, piece, vips.DirectionHorizontal)
+			if err != nil {
+				closeAll(out)
+				return nil, err
+			}
+			x += fromColumns[j]
+		}
+		y += fromRows[i]
+		if row == nil {
+			continue
+		}
+		var err error
+		if out, err = joinPiece(out, row, vips.DirectionVertical); err != nil {
+			return nil, err
+		}
+	}
+	img.Close()
+	return out, nil
+}
+
+// fitSlices splits an edge of the size into start, middle and end slices. The start and end slices are
+// scaled down together when they don't leave room for a middle of at least minMiddle.
+func fitSlices(start, end, size, minMiddle int) [3]int {
+	if room := size - minMiddle; start+end > room {
+		scaled := int(math.Round(float64(start) * float64(room) / float64(start+end)))
+		start, end = scaled, room-scaled
+	}
+	return [3]int{start, size - start - end, end}
+}
+
+// slicePiece extracts an area of the image and resizes it to toWidth by toHeight.
+func slicePiece(img *vips.ImageRef, left, top, width, height, toWidth, toHeight int) (*vips.ImageRef, error) {
+	piece, err := img.Copy()
+	if err != nil {
+		return nil, err
+	}
+	if err := piece.ExtractArea(left, top, width, height); err != nil {
+		piece.Close()
+		return nil, err
+	}
+	if toWidth != width || toHeight != height {
+		hScale := float64(toWidth) / float64(width)
+		vScale := float64(toHeight) / float64(height)
+		if err := piece.ResizeWithVScale(hScale, vScale, vips.KernelAuto); err != nil {
+			piece.Close()
+			return nil, err
+		}
+	}
+	// Rounding in the resize can be a pixel off, which would misalign the pieces
+	if piece.Width() != toWidth || piece.Height() != toHeight {
+		if err := piece.Embed(0, 0, toWidth, toHeight, vips.ExtendCopy); err != nil {
+			piece.Close()
+			return nil, err
+		}
+	}
+	return piece, nil
+}
+
+// joinPiece appends the piece to the image in the direction, or returns it if there is no image yet. The
+// piece is closed either way.
+func joinPiece(img, piece *vips.ImageRef, direction vips.Direction) (*vips.ImageRef, error) {
+	if img == nil {
+		return piece, nil
+	}
+	defer piece.Close()
+	if err := img.Join(piece, direction); err != nil {
+		img.Close()
+		return nil, err
+	}
+	return img, nil
+}
+
+func closeAll(images ...*vips.ImageRef) {
+	for _, img := range images {
+		if img != nil {
+			img.Close()
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package pipeline
+
+import (
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// UnsupportedFormats returns the names of the formats this build of libvips can't decode or encode, such as
+// AVIF when libheif was built without an AV1 encoder. Encoders are checked by exporting a small test image.
+// Formats left out with build tags or disabled aren't checked.
+func UnsupportedFormats() (loaders, savers []string, err error) {
+	img, err := vips.Black(16, 16)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer img.Close()
+	if err := img.ToColorSpace(vips.InterpretationSRGB); err != nil {
+		return nil, nil, err
+	}
+
+	for _, name := range formatNames() {
+		format, _ := ParseFormatName(name)
+		if !vips.IsTypeSupported(format) {
+			loaders = append(loaders, name)
+		}
+		if _, _, err := ExportImage(img, 0, format); err != nil {
+			savers = append(savers, name)
+		}
+	}
+	return loaders, savers, nil
+}
@@ -0,0 +1,134 @@
+package pipeline
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// unsafeSVGElements are removed from SVGs together with their content.
+var unsafeSVGElements = map[string]bool{
+	"script":        true,
+	"foreignobject": true,
+	"iframe":        true,
+	"embed":         true,
+	"object":        true,
+}
+
+// SanitizeSVG removes what can run code or load external resources from an SVG document: script and
+// foreignObject elements, event handler attributes, links to anything but fragments in the document and
+// embedded raster images, DOCTYPEs (and the entities they can declare) and stylesheet processing instructions.
+// The rest of the document is copied byte for byte.
+func SanitizeSVG(data []byte) ([]byte, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.Strict = false
+
+	var out bytes.Buffer
+	var skipDepth int
+	var offset int64
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		raw := data[offset:decoder.InputOffset()]
+		offset = decoder.InputOffset()
+
+		if skipDepth > 0 {
+			switch token.(type) {
+			case xml.StartElement:
+				skipDepth++
+			case xml.EndElement:
+				skipDepth--
+			}
+			continue
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			if unsafeSVGElements[strings.ToLower(t.Name.Local)] {
+				// Self-closing elements have no end element to wait for
+				if !bytes.HasSuffix(bytes.TrimSpace(raw), []byte("/>")) {
+					skipDepth = 1
+				}
+				continue
+			}
+			if !safeSVGAttributes(t.Attr) {
+				writeStartElement(&out, t, raw)
+				continue
+			}
+		case xml.Directive:
+			continue
+		case xml.ProcInst:
+			if t.Target != "xml" {
+				continue
+			}
+		}
+		out.Write(raw)
+	}
+
+	if skipDepth > 0 {
+		return nil, fmt.Errorf("unexpected end of SVG")
+	}
+	return out.Bytes(), nil
+}
+
+// safeSVGAttributes reports whether none of the attributes would be removed.
+func safeSVGAttributes(attrs []xml.Attr) bool {
+	for _, attr := range attrs {
+		if !safeSVGAttribute(attr) {
+			return false
+		}
+	}
+	return true
+}
+
+func safeSVGAttribute(attr xml.Attr) bool {
+	name := strings.ToLower(attr.Name.Local)
+	if strings.HasPrefix(name, "on") {
+		return false
+	}
+
+	value := strings.ToLower(strings.TrimSpace(attr.Value))
+	switch name {
+	case "href", "src":
+		return strings.HasPrefix(value, "#") ||
+			(strings.HasPrefix(value, "data:image/") && !strings.HasPrefix(value, "data:image/svg"))
+	case "style":
+		return !strings.Contains(value, "url(") || strings.Contains(value, "url(#") || strings.Contains(value, "url('#") || strings.Contains(value, `url("#`)
+	}
+	return !strings.Contains(value, "javascript:")
+}
+
+// writeStartElement writes the start tag with only its safe attributes.
+func writeStartElement(out *bytes.Buffer, element xml.StartElement, raw []byte) {
+	out.WriteByte('<')
+	out.WriteString(qualifiedName(element.Name))
+	for _, attr := range element.Attr {
+		if !safeSVGAttribute(attr) {
+			continue
+		}
+		out.WriteByte(' ')
+		out.WriteString(qualifiedName(attr.Name))
+		out.WriteString(`="`)
+		_ = xml.EscapeText(out, []byte(attr.Value))
+		out.WriteByte('"')
+	}
+	if bytes.HasSuffix(bytes.TrimSpace(raw), []byte("/>")) {
+		out.WriteString("/>")
+	} else {
+		out.WriteByte('>')
+	}
+}
+
+func qualifiedName(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	return name.Space + ":" + name.Local
+}
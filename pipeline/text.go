@@ -0,0 +1,145 @@
+package pipeline
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// textFont is the font family captions are rendered in. At the default 72 DPI, the point size of the font
+// given to libvips is its size in pixels.
+const textFont = "sans"
+
+// Placeholders of captions, replaced per request by ExpandText.
+const (
+	TextFieldUser   = "user"
+	TextFieldTenant = "tenant"
+	TextFieldDate   = "date"
+)
+
+var textPlaceholder = regexp.MustCompile(`\{(user|tenant|date)\}`)
+
+// ExpandText replaces the {user}, {tenant} and {date} placeholders of a caption with the values of fields,
+// and reports whether it had any. A placeholder without a value is an error, so that captions marking an
+// image for its viewer are never rendered without the mark.
+func ExpandText(text string, fields map[string]string) (string, bool, error) {
+	var missing string
+	expanded := textPlaceholder.ReplaceAllStringFunc(text, func(placeholder string) string {
+		value, ok := fields[placeholder[1:len(placeholder)-1]]
+		if !ok && missing == "" {
+			missing = placeholder
+		}
+		return value
+	})
+	if missing != "" {
+		return "", true, fmt.Errorf("no value for %s in text", missing)
+	}
+	return expanded, textPlaceholder.MatchString(text), nil
+}
+
+// drawText renders opts.Text onto the image, or onto each frame of animations, wrapped to the width of the
+// image less the margins and placed at opts.TextPosition. Text isn't drawn over transparent areas.
+func drawText(img *vips.ImageRef, opts *Options) (*vips.ImageRef, error) {
+	if img.Pages() > 1 {
+		return mapFrames(img, func(frame *vips.ImageRef) (*vips.ImageRef, error) {
+			return drawText(frame, opts)
+		})
+	}
+
+	width, height := img.Width(), img.Height()
+	size := opts.TextSize
+	if size == 0 {
+		// Legible on thumbnails, and about a title's size on share images
+		size = height / 20
+		if size < 12 {
+			size = 12
+		}
+	}
+	margin := size
+	if 2*margin >= width {
+		margin = 0
+	}
+
+	label := &vips.LabelParams{
+		// libvips renders Pango markup, which the caption mustn't be able to use
+		Text:      html.EscapeString(opts.Text),
+		Font:      fmt.Sprintf("%s %d", textFont, size),
+		Width:     vips.ValueOf(float64(width - 2*margin)),
+		Opacity:   1,
+		Color:     opts.TextColor,
+		Alignment: textAlignment(opts.TextPosition),
+	}
+	// The label is drawn onto a single pixel first to measure it, as the image is enlarged to fit it
+	measure, err := vips.Black(1, 1)
+	if err != nil {
+		return nil, err
+	}
+	defer measure.Close()
+	if err := measure.Label(label); err != nil {
+		return nil, err
+	}
+	left, top := overlayOffset(opts.TextPosition, width-2*margin-measure.Width(), height-2*margin-measure.Height())
+	if top < 0 {
+		// Captions too long for the image start at the top, the rest is cut off
+		top = 0
+	}
+	label.OffsetX = vips.ValueOf(float64(margin + left))
+	label.OffsetY = vips.ValueOf(float64(margin + top))
+
+	if img.Bands() < 3 {
+		if err := img.ToColorSpace(vips.InterpretationSRGB); err != nil {
+			return nil, err
+		}
+	}
+	if !img.HasAlpha() {
+		if err := labelWithin(img, label); err != nil {
+			return nil, err
+		}
+		return img, nil
+	}
+
+	// The label is drawn on the color bands only
+	alpha, err := img.Copy()
+	if err != nil {
+		return nil, err
+	}
+	defer alpha.Close()
+	if err := alpha.ExtractBand(img.Bands()-1, 1); err != nil {
+		return nil, err
+	}
+	if err := img.ExtractBand(0, img.Bands()-1); err != nil {
+		return nil, err
+	}
+	if err := labelWithin(img, label); err != nil {
+		return nil, err
+	}
+	if err := img.BandJoin(alpha); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// labelWithin draws the label onto the image, cutting off what falls outside of it rather than enlarging it.
+func labelWithin(img *vips.ImageRef, label *vips.LabelParams) error {
+	width, height := img.Width(), img.Height()
+	if err := img.Label(label); err != nil {
+		return err
+	}
+	if img.Width() == width && img.Height() == height {
+		return nil
+	}
+	return img.ExtractArea(0, 0, width, height)
+}
+
+// textAlignment aligns the lines of a caption to the side of the image it is placed at.
+func textAlignment(position string) vips.Align {
+	switch position {
+	case PositionLeft, PositionTopLeft, PositionBottomLeft:
+		return vips.AlignLow
+	case PositionRight, PositionTopRight, PositionBottomRight:
+		return vips.AlignHigh
+	}
+	return vips.AlignCenter
+}
@@ -0,0 +1,321 @@
+package pipeline
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// ErrUnsupportedTIFF is returned by ExtractTIFFLevel for data that isn't a classic (not BigTIFF) tiled or
+// stripped TIFF.
+var ErrUnsupportedTIFF = errors.New("unsupported TIFF layout")
+
+const (
+	tagImageWidth      = 256
+	tagImageLength     = 257
+	tagStripOffsets    = 273
+	tagStripByteCounts = 279
+	tagTileOffsets     = 324
+	tagTileByteCounts  = 325
+
+	// maxTIFFLevels limits the directories read when looking for a pyramid level.
+	maxTIFFLevels = 32
+	// tiffReadGap is the largest gap between tiles that are still read with a single request.
+	tiffReadGap = 64 << 10
+)
+
+// tiffTypeSizes are the sizes of the TIFF field types.
+var tiffTypeSizes = map[uint16]int64{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8, 13: 4}
+
+// tiffDroppedTags aren't copied by ExtractTIFFLevel: the subfile type of the reduced level, and the tags
+// pointing to other directories.
+var tiffDroppedTags = map[uint16]bool{254: true, 330: true, 34665: true, 34853: true, 40965: true}
+
+// tiffEntry is a field of a TIFF directory. Values that don't fit in the entry are read when needed.
+type tiffEntry struct {
+	tag, typ uint16
+	count    uint32
+	raw      [4]byte // the value, or the offset of the value
+}
+
+// tiffReader reads the parts of a TIFF file, up to a total number of bytes.
+type tiffReader struct {
+	r     io.ReaderAt
+	order tiffByteOrder
+	left  int64
+}
+
+// tiffByteOrder is binary.LittleEndian or binary.BigEndian.
+type tiffByteOrder interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+}
+
+// ExtractTIFFLevel reads the smallest level of a pyramidal TIFF that is still at least width × height, and
+// returns it as a TIFF file of its own. Only the directories and the tiles or strips of that level are read,
+// so a thumbnail of a huge original needs a fraction of its size when r reads with HTTP range requests.
+// Reading more than maxBytes in total fails.
+func ExtractTIFFLevel(r io.ReaderAt, width, height int, maxBytes int64) ([]byte, error) {
+	t := &tiffReader{r: r, left: maxBytes}
+	header, err := t.read(0, 8)
+	if err != nil {
+		return nil, err
+	}
+	switch string(header[:4]) {
+	case "II*\x00":
+		t.order = binary.LittleEndian
+	case "MM\x00*":
+		t.order = binary.BigEndian
+	default:
+		return nil, ErrUnsupportedTIFF
+	}
+
+	var level []tiffEntry
+	levelWidth := uint32(0)
+	offset := t.order.Uint32(header[4:])
+	for i := 0; offset != 0 && i < maxTIFFLevels; i++ {
+		entries, next, err := t.readDirectory(int64(offset))
+		if err != nil {
+			return nil, err
+		}
+		w, h := t.scalar(entries, tagImageWidth), t.scalar(entries, tagImageLength)
+		if level != nil && (w >= levelWidth || !fits(int(w), int(h), width, height)) {
+			break
+		}
+		level, levelWidth, offset = entries, w, next
+	}
+	if level == nil {
+		return nil, ErrUnsupportedTIFF
+	}
+	return t.extract(level, header[:4])
+}
+
+func (t *tiffReader) read(offset int64, n int64) ([]byte, error) {
+	if n > t.left {
+		return nil, fmt.Errorf("TIFF level exceeds the allowed size")
+	}
+	t.left -= n
+
+	buf := make([]byte, n)
+	if read, err := t.r.ReadAt(buf, offset); read < len(buf) {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf, nil
+}
+
+// readDirectory reads the directory at offset and returns its entries and the offset of the next one.
+func (t *tiffReader) readDirectory(offset int64) ([]tiffEntry, uint32, error) {
+	head, err := t.read(offset, 2)
+	if err != nil {
+		return nil, 0, err
+	}
+	count := int64(t.order.Uint16(head))
+	if count == 0 {
+		return nil, 0, ErrUnsupportedTIFF
+	}
+	body, err := t.read(offset+2, count*12+4)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	entries := make([]tiffEntry, 0, count)
+	for i := int64(0); i < count; i++ {
+		field := body[i*12:]
+		entry := tiffEntry{tag: t.order.Uint16(field), typ: t.order.Uint16(field[2:]), count: t.order.Uint32(field[4:])}
+		copy(entry.raw[:], field[8:12])
+		// Readers skip fields of unknown types
+		if tiffTypeSizes[entry.typ] == 0 {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, t.order.Uint32(body[count*12:]), nil
+}
+
+// size returns the length of the entry's value in bytes.
+func (e *tiffEntry) size() int64 {
+	return tiffTypeSizes[e.typ] * int64(e.count)
+}
+
+// value returns the entry's value, reading it from the file if it doesn't fit in the entry.
+func (t *tiffReader) value(e *tiffEntry) ([]byte, error) {
+	if e.size() <= 4 {
+		return e.raw[:e.size()], nil
+	}
+	return t.read(int64(t.order.Uint32(e.raw[:])), e.size())
+}
+
+// scalar returns the single SHORT or LONG value of the tag, or 0.
+func (t *tiffReader) scalar(entries []tiffEntry, tag uint16) uint32 {
+	for _, e := range entries {
+		if e.tag == tag && e.count == 1 {
+			switch e.typ {
+			case 3:
+				return uint32(t.order.Uint16(e.raw[:]))
+			case 4:
+				return t.order.Uint32(e.raw[:])
+			}
+		}
+	}
+	return 0
+}
+
+// uints returns the SHORT or LONG values of the tag.
+func (t *tiffReader) uints(entries []tiffEntry, tag uint16) ([]int64, error) {
+	for i := range entries {
+		e := &entries[i]
+		if e.tag != tag {
+			continue
+		}
+		if e.typ != 3 && e.typ != 4 {
+			return nil, ErrUnsupportedTIFF
+		}
+		data, err := t.value(e)
+		if err != nil {
+			return nil, err
+		}
+		values := make([]int64, e.count)
+		for j := range values {
+			if e.typ == 3 {
+				values[j] = int64(t.order.Uint16(data[j*2:]))
+			} else {
+				values[j] = int64(t.order.Uint32(data[j*4:]))
+			}
+		}
+		return values, nil
+	}
+	return nil, ErrUnsupportedTIFF
+}
+
+// extract writes a TIFF file with the given directory and its image data, in the byte order of the source.
+func (t *tiffReader) extract(level []tiffEntry, magic []byte) ([]byte, error) {
+	offsetsTag, countsTag := uint16(tagTileOffsets), uint16(tagTileByteCounts)
+	if t.scalar(level, tagImageWidth) == 0 {
+		return nil, ErrUnsupportedTIFF
+	}
+	offsets, err := t.uints(level, offsetsTag)
+	if err != nil {
+		offsetsTag, countsTag = tagStripOffsets, tagStripByteCounts
+		if offsets, err = t.uints(level, offsetsTag); err != nil {
+			return nil, err
+		}
+	}
+	counts, err := t.uints(level, countsTag)
+	if err != nil {
+		return nil, err
+	}
+	if len(counts) != len(offsets) {
+		return nil, ErrUnsupportedTIFF
+	}
+
+	var entries []tiffEntry
+	for _, e := range level {
+		if !tiffDroppedTags[e.tag] {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].tag < entries[j].tag })
+
+	// The directory follows the header, then the values that don't fit in their entries, then the image data
+	values := make([][]byte, len(entries))
+	end := int64(8 + 2 + len(entries)*12 + 4)
+	for i := range entries {
+		e := &entries[i]
+		if e.tag == offsetsTag {
+			// The new offsets are written as LONGs once the image data is laid out
+			e.typ = 4
+			values[i] = make([]byte, 4*len(offsets))
+		} else if values[i], err = t.value(e); err != nil {
+			return nil, err
+		}
+		if len(values[i]) > 4 {
+			end += int64(len(values[i])) + int64(len(values[i])%2)
+		}
+	}
+
+	chunks, err := t.readChunks(offsets, counts)
+	if err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		if entries[i].tag != offsetsTag {
+			continue
+		}
+		next := end
+		for j, chunk := range chunks {
+			t.order.PutUint32(values[i][j*4:], uint32(next))
+			next += int64(len(chunk))
+		}
+		if next > 1<<32-1 {
+			return nil, ErrUnsupportedTIFF
+		}
+	}
+
+	out := make([]byte, 8, end)
+	copy(out, magic)
+	t.order.PutUint32(out[4:], 8)
+	out = t.order.AppendUint16(out, uint16(len(entries)))
+	valueOffset := int64(8 + 2 + len(entries)*12 + 4)
+	for i, e := range entries {
+		out = t.order.AppendUint16(out, e.tag)
+		out = t.order.AppendUint16(out, e.typ)
+		out = t.order.AppendUint32(out, e.count)
+		if len(values[i]) <= 4 {
+			var raw [4]byte
+			copy(raw[:], values[i])
+			out = append(out, raw[:]...)
+			continue
+		}
+		out = t.order.AppendUint32(out, uint32(valueOffset))
+		valueOffset += int64(len(values[i])) + int64(len(values[i])%2)
+	}
+	out = t.order.AppendUint32(out, 0)
+	for _, value := range values {
+		if len(value) > 4 {
+			out = append(out, value...)
+			if len(value)%2 == 1 {
+				out = append(out, 0)
+			}
+		}
+	}
+	for _, chunk := range chunks {
+		out = append(out, chunk...)
+	}
+	return out, nil
+}
+
+// readChunks reads the tiles or strips at the given offsets. Chunks that are close together in the file
+// are read at once.
+func (t *tiffReader) readChunks(offsets, counts []int64) ([][]byte, error) {
+	order := make([]int, len(offsets))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return offsets[order[i]] < offsets[order[j]] })
+
+	chunks := make([][]byte, len(offsets))
+	for i := 0; i < len(order); {
+		start, end := offsets[order[i]], offsets[order[i]]+counts[order[i]]
+		j := i + 1
+		for ; j < len(order) && offsets[order[j]] <= end+tiffReadGap; j++ {
+			if chunkEnd := offsets[order[j]] + counts[order[j]]; chunkEnd > end {
+				end = chunkEnd
+			}
+		}
+
+		span, err := t.read(start, end-start)
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range order[i:j] {
+			chunks[k] = span[offsets[k]-start : offsets[k]-start+counts[k]]
+		}
+		i = j
+	}
+	return chunks, nil
+}
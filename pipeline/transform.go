@@ -0,0 +1,468 @@
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// InvalidImageError is returned by Load for data that isn't a supported image or exceeds the size limits.
+type InvalidImageError struct {
+	Reason string
+}
+
+func (e *InvalidImageError) Error() string {
+	return e.Reason
+}
+
+// Load decodes an image from the reader. GIFs are loaded with all of their frames so animations are kept.
+// The format is detected from the data, and images in other formats or larger than MaxImageWidth and
+// MaxImageHeight are rejected with an *InvalidImageError before their pixels are decoded.
+func Load(reader io.Reader) (*vips.ImageRef, error) {
+	return LoadSized(reader, 0, 0, false)
+}
+
+// LoadSized is like Load, but decodes large images at a reduced size when no more than width × height
+// pixels are needed, see ShrinkTarget: JPEGs are shrunk by the decoder by up to 8 and pyramidal TIFFs are
+// read from their smallest level that is still large enough. A zero width or height doesn't constrain that
+// dimension, and upright applies the size to the image rotated upright as its EXIF orientation says. The
+// size limits apply to the reduced image, so huge originals can still be served as thumbnails.
+func LoadSized(reader io.Reader, width, height int, upright bool) (*vips.ImageRef, error) {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	imageType := vips.DetermineImageType(data)
+	if !FormatSupported(imageType) {
+		return nil, &InvalidImageError{Reason: "unsupported image format"}
+	}
+
+	params := vips.NewImportParams()
+	if imageType == vips.ImageTypeGIF {
+		params.NumPages.Set(-1)
+	}
+	if width > 0 || height > 0 {
+		if err := shrinkOnLoad(data, imageType, width, height, upright, params); err != nil {
+			return nil, err
+		}
+	}
+
+	img, err := vips.LoadImageFromBuffer(data, params)
+	if err != nil {
+		return nil, err
+	}
+
+	// Frames are stacked vertically, so animations are limited in their total size too
+	if img.Width() > MaxImageWidth || img.PageHeight() > MaxImageHeight ||
+		int64(img.Width())*int64(img.Height()) > int64(MaxImageWidth)*int64(MaxImageHeight) {
+		img.Close()
+		return nil, &InvalidImageError{Reason: fmt.Sprintf("image dimensions %dx%d exceed the allowed limit", img.Width(), img.PageHeight())}
+	}
+	return img, nil
+}
+
+// Transform rotates the image upright as its EXIF orientation says, unless opts.KeepOrientation is set, then
+// applies the IIIF request, frame range, pixelation, region blur, crop, trim, straighten, skew, rotation,
+// flip, blur, resize, red-eye removal, white balance, exposure, enhance, color, tone, curves, color
+// blindness, sharpen, grain, custom operations, padding, extension, radius, border, shadow, background,
+// overlay fill, text, placeholder and metadata options to the image, in that order. With opts.Pipeline,
+// rotation, flip, blur, resize and sharpening run in its order instead, together where rotation would, unless
+// sharpening comes last. The returned image must be used in place of the one passed in.
+func Transform(img *vips.ImageRef, opts *Options) (*vips.ImageRef, error) {
+	var err error
+
+	if !opts.KeepOrientation && img.Orientation() > 1 {
+		if err := img.AutoRotate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.IIIF != nil {
+		img, err = opts.IIIF.Apply(img)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.FrameStart != 0 || opts.FrameEnd != 0 || opts.Speed != 0 || opts.FPS != 0 {
+		img, err = trimAnimation(img, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.Pixelate > 0 {
+		img, err = pixelate(img, opts.Pixelate, opts.PixelateX, opts.PixelateY, opts.PixelateWidth, opts.PixelateHeight)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.BlurAmount > 0 && opts.BlurWidth > 0 {
+		img, err = blurRegion(img, opts.BlurAmount, opts.BlurX, opts.BlurY, opts.BlurWidth, opts.BlurHeight)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.CropWidth > 0 && opts.CropByGravity {
+		img, err = cropAtGravity(img, opts.Gravity, opts.CropWidth, opts.CropHeight)
+		if err != nil {
+			return nil, err
+		}
+	} else if opts.CropWidth > 0 {
+		img, err = crop(img, opts.CropX, opts.CropY, opts.CropWidth, opts.CropHeight)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.Trim > 0 {
+		img, err = trim(img, opts.Trim)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.Straighten {
+		img, err = straighten(img)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.SkewX != 0 || opts.SkewY != 0 {
+		img, err = skew(img, opts.SkewX, opts.SkewY)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// pipeline= runs these in its own order. Sharpening that comes last runs after the color adjustments as
+	// it does by default, so giving the default order doesn't change the image.
+	steps := opts.Pipeline
+	if steps == nil {
+		steps = orderedSteps
+	}
+	sharpenLast := steps[len(steps)-1] == StepSharpen
+	if sharpenLast {
+		steps = steps[:len(steps)-1]
+	}
+	for _, step := range steps {
+		img, err = runStep(img, opts, step)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.RedEye {
+		img, err = removeRedEye(img)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.WhiteBalance {
+		img, err = whiteBalance(img)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.Exposure != 0 {
+		img, err = exposure(img, opts.Exposure)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.Enhance {
+		img, err = enhance(img)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.Brightness != 0 || opts.Saturation != 0 || opts.Hue != 0 || opts.Grayscale {
+		img, err = adjustColors(img, opts.Brightness, opts.Saturation, opts.Hue, opts.Grayscale)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case opts.Tint != nil:
+		img, err = tint(img, *opts.Tint)
+	case opts.Sepia:
+		img, err = sepia(img)
+	case opts.Duotone != nil:
+		img, err = duotone(img, opts.Duotone[0], opts.Duotone[1])
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Curves != nil {
+		img, err = applyCurves(img, opts.Curves)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.ColorBlindness != "" {
+		img, err = simulateColorBlindness(img, opts.ColorBlindness)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if sharpenLast {
+		img, err = runStep(img, opts, StepSharpen)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.Grain > 0 {
+		img, err = addGrain(img, opts.Grain)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(opts.Custom) > 0 {
+		img, err = applyCustomSteps(img, opts.Custom)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.PadTop != 0 || opts.PadRight != 0 || opts.PadBottom != 0 || opts.PadLeft != 0 {
+		width := opts.PadLeft + img.Width() + opts.PadRight
+		height := opts.PadTop + img.PageHeight() + opts.PadBottom
+		img, err = pad(img, opts.PadLeft, opts.PadTop, width, height, opts.Background)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.ExtendFill != "" {
+		img, err = extend(img, opts.ExtendTop, opts.ExtendRight, opts.ExtendBottom, opts.ExtendLeft, opts.ExtendFill, opts.Background)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.Radius != 0 {
+		img, err = roundCorners(img, opts.Radius)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.BorderWidth != 0 {
+		img, err = border(img, opts.BorderWidth, opts.BorderColor, opts.Radius)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.ShadowColor != nil {
+		img, err = shadow(img, opts.ShadowX, opts.ShadowY, opts.ShadowBlur, *opts.ShadowColor)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.Background != nil && img.HasAlpha() {
+		if err := img.Flatten(opts.Background); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.OverlayFill != nil {
+		img, err = fillOverlay(img, opts.OverlayFill, opts.OverlayOpacity)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.Text != "" {
+		img, err = drawText(img, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.Placeholder != "" {
+		img, err = placeholder(img, opts.Placeholder)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.StripMetadata {
+		err := img.RemoveMetadata()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return img, nil
+}
+
+// resizeImage scales the image to the given width and/or height. Downscaling always uses the automatic kernel,
+// upscaling (only when allowed) uses upscaleKernel and enlarges by at most maxUpscale unless it is 0.
+func resizeImage(img *vips.ImageRef, width, height int, upscale bool, upscaleKernel vips.Kernel, maxUpscale float64) (*vips.ImageRef, error) {
+	if width == 0 && height == 0 {
+		return img, nil
+	}
+
+	scale := -1.0
+	if width == 0 && height != 0 {
+		scale = float64(height) / float64(img.PageHeight())
+	}
+	if height == 0 && width != 0 {
+		scale = float64(width) / float64(img.Width())
+	}
+
+	if (upscale || scale <= 1) && scale != -1.0 {
+		scale = capScale(scale, maxUpscale)
+		kernel := vips.KernelAuto
+		if scale > 1 {
+			kernel = upscaleKernel
+		}
+		err := img.Resize(scale, kernel)
+		if err != nil {
+			return nil, err
+		}
+		return img, nil
+	}
+
+	hScale := float64(width) / float64(img.Width())
+	vScale := float64(height) / float64(img.PageHeight())
+	if upscale || (hScale <= 1 && vScale <= 1) {
+		hScale, vScale = capScale(hScale, maxUpscale), capScale(vScale, maxUpscale)
+		kernel := vips.KernelAuto
+		if hScale > 1 || vScale > 1 {
+			kernel = upscaleKernel
+		}
+		err := img.ResizeWithVScale(hScale, vScale, kernel)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return img, nil
+}
+
+// FitWithin shrinks the image to fit within the given width and page height, keeping its aspect ratio.
+// A zero limit doesn't constrain that dimension. Images that already fit are returned as they are.
+func FitWithin(img *vips.ImageRef, maxWidth, maxHeight int) (*vips.ImageRef, error) {
+	scale := 1.0
+	if maxWidth > 0 && img.Width() > maxWidth {
+		scale = float64(maxWidth) / float64(img.Width())
+	}
+	if maxHeight > 0 && img.PageHeight() > maxHeight {
+		scale = math.Min(scale, float64(maxHeight)/float64(img.PageHeight()))
+	}
+	if scale == 1 {
+		return img, nil
+	}
+
+	if err := img.Resize(scale, vips.KernelAuto); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// Fit modes for fit=.
+const (
+	// FitCover scales the image to cover the box and crops the overflow, around the center by default.
+	FitCover = "cover"
+	// FitContain scales the image to fit within the box and pads it to the box.
+	FitContain = "contain"
+	// FitPad is FitContain without ever enlarging the image, even with upscale.
+	FitPad = "pad"
+	// FitFill stretches the image to the box, ignoring its aspect ratio.
+	FitFill = "fill"
+	// FitInside scales the image to fit within the box; the output may be smaller than the box.
+	FitInside = "inside"
+)
+
+// Gravities for gravity=, the part of the image kept when cropping.
+const (
+	GravityCenter    = "center"
+	GravityNorth     = "north"
+	GravitySouth     = "south"
+	GravityEast      = "east"
+	GravityWest      = "west"
+	GravityNorthEast = "northeast"
+	GravityNorthWest = "northwest"
+	GravitySouthEast = "southeast"
+	GravitySouthWest = "southwest"
+	// GravitySmart keeps the part libvips finds most interesting to people: faces, skin and saturated colors,
+	// for thumbnails of editorial photos.
+	GravitySmart = "smart"
+	// GravityEntropy keeps the part with the most detail.
+	GravityEntropy = "entropy"
+)
+
+// CropSmart crops to the box of w and h around the most interesting part of the image (crop=smart).
+const CropSmart = "smart"
+
+// fitImage resizes the image to the width × height box as the fit mode asks. Images are only enlarged when
+// upscale is set, by at most maxUpscale unless it is 0; cover, contain, pad and fill still output the exact
+// box then, padding the image with the background color, or transparency if it is nil.
+func fitImage(img *vips.ImageRef, width, height int, fit, gravity string, upscale bool, upscaleKernel vips.Kernel, maxUpscale float64, background *vips.Color) (*vips.ImageRef, error) {
+	hScale := float64(width) / float64(img.Width())
+	vScale := float64(height) / float64(img.PageHeight())
+	switch fit {
+	case FitCover:
+		hScale = math.Max(hScale, vScale)
+		vScale = hScale
+	case FitContain, FitInside, FitPad:
+		hScale = math.Min(hScale, vScale)
+		vScale = hScale
+	}
+	if !upscale || fit == FitPad {
+		hScale, vScale = math.Min(hScale, 1), math.Min(vScale, 1)
+	}
+	hScale, vScale = capScale(hScale, maxUpscale), capScale(vScale, maxUpscale)
+
+	kernel := vips.KernelAuto
+	if hScale > 1 || vScale > 1 {
+		kernel = upscaleKernel
+	}
+	if hScale != 1 || vScale != 1 {
+		if err := img.ResizeWithVScale(hScale, vScale, kernel); err != nil {
+			return nil, err
+		}
+	}
+	if fit == FitInside {
+		return img, nil
+	}
+
+	// Crop the overflow at the gravity, then center what is left in the box
+	if img.Width() > width || img.PageHeight() > height {
+		var err error
+		if img, err = cropAtGravity(img, gravity, width, height); err != nil {
+			return nil, err
+		}
+	}
+	if img.Width() < width || img.PageHeight() < height {
+		left, top := (width-img.Width())/2, (height-img.PageHeight())/2
+		return pad(img, left, top, width, height, background)
+	}
+	return img, nil
+}
+
+func capScale(scale, maxUpscale float64) float64 {
+	if maxUpscale > 0 && scale > maxUpscale {
+		return maxUpscale
+	}
+	return scale
+}
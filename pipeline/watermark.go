@@ -0,0 +1,227 @@
+package pipeline
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+const (
+	// MaxWatermarkPayload is the maximum length in bytes of an invisible watermark payload.
+	MaxWatermarkPayload = 32
+
+	// watermarkBlockSize is the edge in pixels of the blocks that each carry one payload bit.
+	watermarkBlockSize = 8
+
+	// watermarkCellSize is the edge in pixels of the cells sharing one pattern value. Cells larger than a
+	// pixel keep the pattern out of the frequencies that chroma subsampling and JPEG quantization discard.
+	watermarkCellSize = 2
+
+	// watermarkStrength is how far the brightness of a cell is pushed up or down to encode a bit.
+	watermarkStrength = 3
+)
+
+// watermarkFrameBits is the number of bits in a frame: a length byte, the padded payload and a CRC-16.
+const watermarkFrameBits = (1 + MaxWatermarkPayload + 2) * 8
+
+// EmbedWatermark hides payload in the image with a keyed spread-spectrum brightness pattern of +-3 levels.
+// Each payload bit is repeated over many 8x8 blocks, so it survives JPEG/WebP compression down to quality 60,
+// but not resizing or cropping. Images too small to hold the payload are returned unmarked. The image is converted to
+// sRGB and loses its metadata; the returned image replaces img.
+func EmbedWatermark(img *vips.ImageRef, key, payload string) (*vips.ImageRef, error) {
+	frame, err := watermarkFrame(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	pixels, err := toNRGBA(img)
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := pixels.Bounds()
+	blocksX := bounds.Dx() / watermarkBlockSize
+	blocksY := bounds.Dy() / watermarkBlockSize
+	if blocksX*blocksY < watermarkFrameBits {
+		return img, nil
+	}
+
+	seed := watermarkSeed(key)
+	for y := 0; y < blocksY*watermarkBlockSize; y++ {
+		for x := 0; x < blocksX*watermarkBlockSize; x++ {
+			i := pixels.PixOffset(x, y)
+			if pixels.Pix[i+3] == 0 {
+				continue
+			}
+
+			bit := (y/watermarkBlockSize*blocksX + x/watermarkBlockSize) % watermarkFrameBits
+			delta := watermarkPattern(seed, x/watermarkCellSize, y/watermarkCellSize) * watermarkStrength
+			if frame[bit/8]&(0x80>>(bit%8)) == 0 {
+				delta = -delta
+			}
+
+			for c := 0; c < 3; c++ {
+				value := int(pixels.Pix[i+c]) + delta
+				if value < 0 {
+					value = 0
+				} else if value > 255 {
+					value = 255
+				}
+				pixels.Pix[i+c] = uint8(value)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := (&png.Encoder{CompressionLevel: png.BestSpeed}).Encode(&buf, pixels); err != nil {
+		return nil, err
+	}
+	marked, err := vips.NewImageFromBuffer(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	img.Close()
+	return marked, nil
+}
+
+// DetectWatermark recovers a payload embedded with EmbedWatermark and the same key.
+// It returns an error if the image carries no readable watermark.
+func DetectWatermark(img *vips.ImageRef, key string) (string, error) {
+	pixels, err := toNRGBA(img)
+	if err != nil {
+		return "", err
+	}
+
+	bounds := pixels.Bounds()
+	blocksX := bounds.Dx() / watermarkBlockSize
+	blocksY := bounds.Dy() / watermarkBlockSize
+	if blocksX*blocksY < watermarkFrameBits {
+		return "", fmt.Errorf("image is too small to carry a watermark")
+	}
+
+	// Sum the luminance of each cell
+	cellsX := blocksX * watermarkBlockSize / watermarkCellSize
+	cellsY := blocksY * watermarkBlockSize / watermarkCellSize
+	luminance := make([]int, cellsX*cellsY)
+	for y := 0; y < cellsY*watermarkCellSize; y++ {
+		for x := 0; x < cellsX*watermarkCellSize; x++ {
+			i := pixels.PixOffset(x, y)
+			luminance[y/watermarkCellSize*cellsX+x/watermarkCellSize] += 299*int(pixels.Pix[i]) + 587*int(pixels.Pix[i+1]) + 114*int(pixels.Pix[i+2])
+		}
+	}
+
+	// Correlate the high-passed luminance with the pattern to suppress the image content
+	seed := watermarkSeed(key)
+	correlation := make([]int64, watermarkFrameBits)
+	cell := func(x, y int) int {
+		return luminance[y*cellsX+x]
+	}
+	for y := 1; y < cellsY-1; y++ {
+		for x := 1; x < cellsX-1; x++ {
+			highPass := 4*cell(x, y) - cell(x-1, y) - cell(x+1, y) - cell(x, y-1) - cell(x, y+1)
+			bit := (y*watermarkCellSize/watermarkBlockSize*blocksX + x*watermarkCellSize/watermarkBlockSize) % watermarkFrameBits
+			correlation[bit] += int64(watermarkPattern(seed, x, y) * highPass)
+		}
+	}
+
+	frame := make([]byte, watermarkFrameBits/8)
+	for bit, sum := range correlation {
+		if sum > 0 {
+			frame[bit/8] |= 0x80 >> (bit % 8)
+		}
+	}
+
+	length := int(frame[0])
+	checksum := binary.BigEndian.Uint16(frame[len(frame)-2:])
+	if length > MaxWatermarkPayload || crc16(frame[:len(frame)-2]) != checksum {
+		return "", fmt.Errorf("no watermark found")
+	}
+
+	return string(frame[1 : 1+length]), nil
+}
+
+// watermarkFrame lays out the payload as a length byte, the zero-padded payload and a CRC-16.
+func watermarkFrame(payload string) ([]byte, error) {
+	if len(payload) > MaxWatermarkPayload {
+		return nil, fmt.Errorf("watermark payload exceeds %d bytes", MaxWatermarkPayload)
+	}
+
+	frame := make([]byte, watermarkFrameBits/8)
+	frame[0] = byte(len(payload))
+	copy(frame[1:], payload)
+	binary.BigEndian.PutUint16(frame[len(frame)-2:], crc16(frame[:len(frame)-2]))
+	return frame, nil
+}
+
+func watermarkSeed(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// watermarkPattern returns the keyed pseudo-random sign (+1 or -1) of a cell.
+func watermarkPattern(seed uint64, x, y int) int {
+	// splitmix64 of the seeded cell position
+	h := seed ^ (uint64(x) << 32) ^ uint64(y)
+	h += 0x9e3779b97f4a7c15
+	h = (h ^ (h >> 30)) * 0xbf58476d1ce4e5b9
+	h = (h ^ (h >> 27)) * 0x94d049bb133111eb
+	h ^= h >> 31
+	if h&1 == 0 {
+		return -1
+	}
+	return 1
+}
+
+// crc16 computes the CRC-16/CCITT-FALSE checksum of data.
+func crc16(data []byte) uint16 {
+	crc := uint16(0xffff)
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// toNRGBA converts the first frame of the image to 8-bit sRGB pixels.
+func toNRGBA(img *vips.ImageRef) (*image.NRGBA, error) {
+	frame, err := img.Copy()
+	if err != nil {
+		return nil, err
+	}
+	defer frame.Close()
+
+	if frame.Pages() > 1 {
+		if err := frame.ExtractArea(0, 0, frame.Width(), frame.PageHeight()); err != nil {
+			return nil, err
+		}
+	}
+	if err := frame.ToColorSpace(vips.InterpretationSRGB); err != nil {
+		return nil, err
+	}
+
+	data, _, err := frame.ExportPng(vips.NewPngExportParams())
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	pixels := image.NewNRGBA(decoded.Bounds())
+	draw.Draw(pixels, pixels.Bounds(), decoded, decoded.Bounds().Min, draw.Src)
+	return pixels, nil
+}
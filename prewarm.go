@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	v1 "github.com/arkami8/image-gem/api/v1"
+	"github.com/arkami8/image-gem/config"
+)
+
+// prewarm requests the paths listed at source from the handler in-process, so that the cache holds the
+// recently popular images before the instance takes traffic. The source is a file or an http(s) URL in the
+// format of parseRequestPaths, e.g. an access log of another instance. The requests are in the batch priority
+// class, so traffic taken meanwhile comes first. Prewarming stops at the timeout.
+func prewarm(handler http.Handler, source string, concurrency int, timeout time.Duration) {
+	start := time.Now()
+	paths, err := readPrewarmPaths(source)
+	if err != nil {
+		log.Printf("warning: cannot prewarm the cache: %s", err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(v1.WithPriority(context.Background(), config.PriorityBatch), timeout)
+	defer cancel()
+
+	var warmed, failed int64
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range jobs {
+				recorder := httptest.NewRecorder()
+				handler.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil).WithContext(ctx))
+				if recorder.Code == http.StatusOK {
+					atomic.AddInt64(&warmed, 1)
+				} else {
+					atomic.AddInt64(&failed, 1)
+				}
+			}
+		}()
+	}
+
+feed:
+	for _, path := range paths {
+		select {
+		case jobs <- path:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	log.Printf("prewarmed %d of %d paths in %s, %d failed", warmed, len(paths), time.Since(start).Round(time.Millisecond), failed)
+}
+
+// readPrewarmPaths reads the request paths from a file or an http(s) URL.
+func readPrewarmPaths(source string) ([]string, error) {
+	var reader io.Reader
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		client := &http.Client{Timeout: time.Minute}
+		resp, err := client.Get(source)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("Received a %d status code from %s", resp.StatusCode, source)
+		}
+		reader = resp.Body
+	} else {
+		file, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		reader = file
+	}
+	return parseRequestPaths(reader)
+}
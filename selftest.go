@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/arkami8/image-gem/pipeline"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// SelfTest runs the selftest subcommand. It prints which formats this build of libvips encodes and decodes and
+// which transformations work, see pipeline.SelfTest, and fails if any check does.
+//
+//	selftest
+func SelfTest(args []string) error {
+	fmt.Printf("libvips %d.%d.%d\n", vips.MajorVersion, vips.MinorVersion, vips.MicroVersion)
+	failed := 0
+	results := pipeline.SelfTest()
+	for _, result := range results {
+		if result.OK {
+			fmt.Printf("ok    %s\n", result.Check)
+			continue
+		}
+		failed++
+		fmt.Printf("FAIL  %s: %s\n", result.Check, result.Error)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(results))
+	}
+	return nil
+}
@@ -2,20 +2,19 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"time"
 
-	v1 "github.com/arkami8/image-gem/api/v1"
+	"github.com/arkami8/image-gem/api"
+	"github.com/arkami8/image-gem/cache"
 	"github.com/arkami8/image-gem/config"
-
-	gorillaHandlers "github.com/gorilla/handlers"
-	"github.com/gorilla/mux"
-	"github.com/rs/cors"
-	"github.com/unrolled/secure"
+	"github.com/arkami8/image-gem/statedb"
 )
 
 func Serve() {
@@ -23,35 +22,19 @@ func Serve() {
 	flag.DurationVar(&wait, "graceful-timeout", time.Minute*1, "the duration for which the server gracefully wait for existing connections to finish - e.g. 30s or 1m")
 	flag.Parse()
 
-	// Create router and register subrouters (subdomains)
-	r := mux.NewRouter()
-
-	r.HandleFunc("/img/url/{url:.*}", v1.ImageGet).Methods("GET")
-
-	// Add middleware handlers
-	recoveryHandler := gorillaHandlers.RecoveryHandler(gorillaHandlers.PrintRecoveryStack(true))(r)
-	secureOptions := secure.Options{
-		ContentTypeNosniff: true,
-		FrameDeny:          true,
-		BrowserXssFilter:   true,
-		IsDevelopment:      false,
-	}
-	secureHandler := secure.New(secureOptions)
-	gzipHandler := gorillaHandlers.CompressHandler(secureHandler.Handler(recoveryHandler))
-	corsOptions := cors.Options{
-		AllowedOrigins: config.CORSAllowedOrigins,
-	}
-	c := cors.New(corsOptions)
-	corsHandler := c.Handler(gzipHandler)
-
 	// Sets up server values
+	handler := api.NewRouter()
 	srv := &http.Server{
-		Handler:      corsHandler,
-		Addr:         config.ServerPort,
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 30 * time.Second,
-		IdleTimeout:  60 * time.Second,
+		Handler:           handler,
+		Addr:              config.ServerPort,
+		ReadTimeout:       config.ServerReadTimeout,
+		WriteTimeout:      config.ServerWriteTimeout,
+		IdleTimeout:       config.ServerIdleTimeout,
+		ReadHeaderTimeout: config.ServerReadHeaderTimeout,
+		MaxHeaderBytes:    config.ServerMaxHeaderBytes,
 	}
+	// Fingerprint the TLS ClientHellos for the bot hook, once TLS is served
+	api.FingerprintTLS(srv)
 
 	// Set SSL
 	// srv.TLSConfig = &tls.Config{
@@ -63,14 +46,34 @@ func Serve() {
 	// 	Certificates: []tls.Certificate{cert},
 	// }
 
+	// Bind before serving so that a port in use or a bad address stops the server right away
+	addr := srv.Addr
+	if addr == "" {
+		addr = ":http"
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("error: cannot listen on %s: %s", addr, err.Error())
+	}
+	log.Printf("listening on %s", listener.Addr())
+
+	// Report the instance as not ready until the cache is warm
+	if config.PrewarmURLs != "" {
+		api.SetReady(false)
+		go func() {
+			prewarm(handler, config.PrewarmURLs, config.PrewarmConcurrency, config.PrewarmTimeout)
+			api.SetReady(true)
+		}()
+	}
+
 	// Run server
 	go func() {
 		// TODO: offer TLS
-		if err := srv.ListenAndServe(); err != nil {
-			log.Fatalf("error: cannot listen and serve: %s", err.Error())
+		if err := srv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("error: cannot serve: %s", err.Error())
 		}
-		// if err := srv.ListenAndServeTLS("", ""); err != nil {
-		// 	log.Fatalf("error: cannot listen and serve: %s", err.Error())
+		// if err := srv.ServeTLS(listener, "", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		// 	log.Fatalf("error: cannot serve: %s", err.Error())
 		// }
 	}()
 
@@ -80,11 +83,17 @@ func Serve() {
 	<-ch
 	ctx, cancel := context.WithTimeout(context.Background(), wait)
 	defer cancel()
-	err := srv.Shutdown(ctx)
+	err = srv.Shutdown(ctx)
 	if err != nil {
 		log.Fatal(err)
 		return
 	}
+	if err := cache.Close(); err != nil {
+		log.Printf("warning: cannot close cache: %s", err.Error())
+	}
+	if err := statedb.Close(); err != nil {
+		log.Printf("warning: cannot close state database: %s", err.Error())
+	}
 	log.Println("shutting down")
 	os.Exit(0)
 }
@@ -0,0 +1,30 @@
+package serverless
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/arkami8/image-gem/api"
+	"github.com/arkami8/image-gem/startup"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+var (
+	initOnce sync.Once
+	router   http.Handler
+)
+
+// HTTPFunction is an entry point for HTTP-triggered cloud functions such as Google Cloud Functions.
+// Deployments reference it from their function package, e.g. functions.HTTP("ImageGem", serverless.HTTPFunction).
+// The first invocation of each instance runs the startup sequence of the server, see startup.Init.
+func HTTPFunction(w http.ResponseWriter, r *http.Request) {
+	initOnce.Do(func() {
+		vips.LoggingSettings(nil, vips.LogLevelWarning)
+		startup.Init()
+
+		router = api.NewRouter()
+	})
+
+	router.ServeHTTP(w, r)
+}
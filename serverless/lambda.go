@@ -0,0 +1,181 @@
+package serverless
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+// LambdaHandler adapts an http.Handler to AWS Lambda. It accepts both API Gateway REST (payload v1)
+// and HTTP API / function URL (payload v2) proxy events. Response bodies are always base64 encoded,
+// so REST APIs need "*/*" registered as a binary media type.
+type LambdaHandler struct {
+	handler http.Handler
+}
+
+// NewLambdaHandler returns a Lambda handler that serves events with the given http.Handler.
+func NewLambdaHandler(handler http.Handler) *LambdaHandler {
+	return &LambdaHandler{handler: handler}
+}
+
+// StartLambda blocks, serving Lambda invocations with the given http.Handler.
+func StartLambda(handler http.Handler) {
+	lambda.Start(NewLambdaHandler(handler).Invoke)
+}
+
+// Invoke decodes a proxy event, serves it and encodes the matching proxy response.
+func (h *LambdaHandler) Invoke(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+	var probe struct {
+		Version string `json:"version"`
+	}
+	if err := json.Unmarshal(payload, &probe); err != nil {
+		return nil, err
+	}
+
+	if probe.Version == "2.0" {
+		var event events.APIGatewayV2HTTPRequest
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return nil, err
+		}
+		return h.serveV2(ctx, event)
+	}
+
+	var event events.APIGatewayProxyRequest
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, err
+	}
+	return h.serveV1(ctx, event)
+}
+
+func (h *LambdaHandler) serveV1(ctx context.Context, event events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	query := url.Values{}
+	for key, values := range event.MultiValueQueryStringParameters {
+		query[key] = values
+	}
+	if len(query) == 0 {
+		for key, value := range event.QueryStringParameters {
+			query.Set(key, value)
+		}
+	}
+
+	r, err := newRequest(ctx, event.HTTPMethod, event.Path, query.Encode(), event.Body, event.IsBase64Encoded)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+	for key, values := range event.MultiValueHeaders {
+		r.Header[http.CanonicalHeaderKey(key)] = values
+	}
+	if len(event.MultiValueHeaders) == 0 {
+		for key, value := range event.Headers {
+			r.Header.Set(key, value)
+		}
+	}
+	r.RemoteAddr = event.RequestContext.Identity.SourceIP
+
+	w := newResponseWriter()
+	h.handler.ServeHTTP(w, r)
+
+	return events.APIGatewayProxyResponse{
+		StatusCode:        w.statusCode(),
+		MultiValueHeaders: w.header,
+		Body:              base64.StdEncoding.EncodeToString(w.body.Bytes()),
+		IsBase64Encoded:   true,
+	}, nil
+}
+
+func (h *LambdaHandler) serveV2(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	r, err := newRequest(ctx, event.RequestContext.HTTP.Method, event.RawPath, event.RawQueryString, event.Body, event.IsBase64Encoded)
+	if err != nil {
+		return events.APIGatewayV2HTTPResponse{}, err
+	}
+	for key, value := range event.Headers {
+		r.Header.Set(key, value)
+	}
+	if len(event.Cookies) > 0 {
+		r.Header.Set("Cookie", strings.Join(event.Cookies, "; "))
+	}
+	r.RemoteAddr = event.RequestContext.HTTP.SourceIP
+
+	w := newResponseWriter()
+	h.handler.ServeHTTP(w, r)
+
+	headers := make(map[string]string, len(w.header))
+	for key, values := range w.header {
+		if key == "Set-Cookie" {
+			continue
+		}
+		headers[key] = strings.Join(values, ",")
+	}
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode:      w.statusCode(),
+		Headers:         headers,
+		Cookies:         w.header.Values("Set-Cookie"),
+		Body:            base64.StdEncoding.EncodeToString(w.body.Bytes()),
+		IsBase64Encoded: true,
+	}, nil
+}
+
+func newRequest(ctx context.Context, method, path, rawQuery, body string, isBase64Encoded bool) (*http.Request, error) {
+	var payload []byte
+	if isBase64Encoded {
+		decoded, err := base64.StdEncoding.DecodeString(body)
+		if err != nil {
+			return nil, err
+		}
+		payload = decoded
+	} else {
+		payload = []byte(body)
+	}
+
+	target := path
+	if rawQuery != "" {
+		target += "?" + rawQuery
+	}
+
+	return http.NewRequestWithContext(ctx, method, target, bytes.NewReader(payload))
+}
+
+// responseWriter buffers a complete response so it can be returned as a single proxy response.
+type responseWriter struct {
+	header http.Header
+	body   bytes.Buffer
+	status int
+}
+
+func newResponseWriter() *responseWriter {
+	return &responseWriter{header: http.Header{}}
+}
+
+func (w *responseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.body.Write(p)
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+// statusCode returns the status of the response, 200 when the handler wrote neither a header nor a body,
+// as net/http does.
+func (w *responseWriter) statusCode() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
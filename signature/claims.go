@@ -0,0 +1,38 @@
+package signature
+
+import (
+	"context"
+	"net/url"
+)
+
+// Query parameters of the claims of signed URLs.
+const (
+	ParamUser   = "user"
+	ParamTenant = "tenant"
+)
+
+// Claims are facts about the viewer of an image that the application vouches for by signing them, in the
+// user and tenant parameters of a signed URL or in a Session, e.g. to mark preview images per viewer.
+type Claims struct {
+	User   string
+	Tenant string
+}
+
+// URLClaims returns the claims in the query parameters of a signed URL. They are only to be trusted once
+// the URL is verified.
+func URLClaims(query url.Values) Claims {
+	return Claims{User: query.Get(ParamUser), Tenant: query.Get(ParamTenant)}
+}
+
+type contextKey struct{}
+
+// WithClaims returns a context carrying the verified claims of a request.
+func WithClaims(ctx context.Context, claims Claims) context.Context {
+	return context.WithValue(ctx, contextKey{}, claims)
+}
+
+// ClaimsFromContext returns the verified claims of a request, which are empty if it had none.
+func ClaimsFromContext(ctx context.Context) Claims {
+	claims, _ := ctx.Value(contextKey{}).(Claims)
+	return claims
+}
@@ -0,0 +1,59 @@
+package signature
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+)
+
+// ErrUndecryptable is returned by DecryptURL for tokens that weren't encrypted with the key.
+var ErrUndecryptable = errors.New("invalid encrypted URL")
+
+// EncryptURL encrypts a source URL with AES-GCM into a token for the /img/enc/ path, so that the origin
+// location, e.g. a presigned URL with credentials, isn't visible to clients. The key is 16, 24 or 32 bytes.
+//
+// The token is the unpadded base64url encoding of a 12 byte nonce followed by the sealed URL. The nonce is
+// derived from the URL with HMAC-SHA256, so a URL always encrypts to the same token and caches keep working;
+// this only reveals which tokens are for the same URL.
+func EncryptURL(key []byte, sourceURL string) (string, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(sourceURL))
+	nonce := mac.Sum(nil)[:aead.NonceSize()]
+
+	sealed := aead.Seal(nonce, nonce, []byte(sourceURL), nil)
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// DecryptURL returns the source URL encrypted in a token by EncryptURL.
+func DecryptURL(key []byte, token string) (string, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", ErrUndecryptable
+	}
+	sourceURL, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", ErrUndecryptable
+	}
+	return string(sourceURL), nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,139 @@
+package signature
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/arkami8/image-gem/cache"
+)
+
+// nonceStore remembers the nonces of signed URLs that have been used, until the URLs expire.
+type nonceStore interface {
+	// use records the nonce and reports whether it hadn't been used yet.
+	use(nonce string, expires time.Time) (bool, error)
+}
+
+var std nonceStore = &memoryNonces{nonces: map[string]time.Time{}}
+
+// InitNonces keeps the used nonces in files in dir, so that instances sharing the directory reject each other's
+// replays and restarts don't forget them. Until it's called, nonces are kept in memory.
+func InitNonces(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	std = &diskNonces{dir: dir}
+	return nil
+}
+
+// InitRedisNonces keeps the used nonces in Redis, so that instances without a shared directory reject each
+// other's replays. Each nonce is set only if absent and expires with its URL.
+func InitRedisNonces(store *cache.Redis) {
+	std = &redisNonces{store: store}
+}
+
+func useNonce(nonce string, expires time.Time) (bool, error) {
+	return std.use(nonce, expires)
+}
+
+// memoryNonces is the nonce store of a single instance.
+type memoryNonces struct {
+	mu     sync.Mutex
+	nonces map[string]time.Time
+}
+
+func (m *memoryNonces) use(nonce string, expires time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if until, ok := m.nonces[nonce]; ok && now.Before(until) {
+		return false, nil
+	}
+	m.nonces[nonce] = expires
+
+	// Forget expired nonces once in a while
+	if len(m.nonces)%1024 == 0 {
+		for n, until := range m.nonces {
+			if now.After(until) {
+				delete(m.nonces, n)
+			}
+		}
+	}
+	return true, nil
+}
+
+// diskNonces creates a file per nonce, relying on exclusive creation for instances that share the directory.
+type diskNonces struct {
+	dir   string
+	mu    sync.Mutex
+	count int
+}
+
+func (d *diskNonces) use(nonce string, expires time.Time) (bool, error) {
+	sum := sha256.Sum256([]byte(nonce))
+	path := filepath.Join(d.dir, hex.EncodeToString(sum[:]))
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, os.ErrExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	_, err = file.WriteString(strconv.FormatInt(expires.Unix(), 10))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return false, err
+	}
+
+	d.mu.Lock()
+	d.count++
+	purge := d.count%1024 == 0
+	d.mu.Unlock()
+	if purge {
+		go d.purge()
+	}
+	return true, nil
+}
+
+// purge removes the files of expired nonces.
+func (d *diskNonces) purge() {
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	for _, entry := range entries {
+		path := filepath.Join(d.dir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		if seconds, err := strconv.ParseInt(string(data), 10, 64); err == nil && now.After(time.Unix(seconds, 0)) {
+			os.Remove(path)
+		}
+	}
+}
+
+// redisNonces relies on SET NX for instances sharing the Redis server.
+type redisNonces struct {
+	store *cache.Redis
+}
+
+func (r *redisNonces) use(nonce string, expires time.Time) (bool, error) {
+	sum := sha256.Sum256([]byte(nonce))
+	// A TTL of 0 wouldn't expire, so URLs about to expire keep their nonce for a moment
+	ttl := time.Until(expires)
+	if ttl < time.Second {
+		ttl = time.Second
+	}
+	return r.store.SetNX(hex.EncodeToString(sum[:]), []byte(strconv.FormatInt(expires.Unix(), 10)), ttl)
+}
@@ -0,0 +1,80 @@
+package signature
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Session authorizes all the image URLs under a path prefix until it expires. It is set by the application
+// as a cookie, so pages with many images don't need to sign each URL.
+type Session struct {
+	Expires time.Time
+	// Prefix is the escaped path prefix the session is valid for, e.g. "/img/url/cdn.example.com/gallery/".
+	// Empty allows every image URL.
+	Prefix string
+	// Claims are vouched for on every request of the session.
+	Claims Claims
+}
+
+// SignSession returns the cookie value for the session: its base64-encoded fields and their signature.
+func SignSession(key []byte, session Session) string {
+	fields := url.Values{}
+	fields.Set("exp", strconv.FormatInt(session.Expires.Unix(), 10))
+	if session.Prefix != "" {
+		fields.Set("prefix", session.Prefix)
+	}
+	if session.Claims.User != "" {
+		fields.Set("user", session.Claims.User)
+	}
+	if session.Claims.Tenant != "" {
+		fields.Set("tenant", session.Claims.Tenant)
+	}
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fields.Encode()))
+	return payload + "." + signSession(key, payload)
+}
+
+// VerifySession checks the signature and expiry of the cookie value and that the session covers the
+// escaped path, and returns the session.
+func VerifySession(key []byte, value, path string, now time.Time) (Session, error) {
+	payload, sig, ok := strings.Cut(value, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(signSession(key, payload))) {
+		return Session{}, ErrInvalid
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return Session{}, ErrInvalid
+	}
+	fields, err := url.ParseQuery(string(decoded))
+	if err != nil {
+		return Session{}, ErrInvalid
+	}
+	seconds, err := strconv.ParseInt(fields.Get("exp"), 10, 64)
+	if err != nil {
+		return Session{}, ErrInvalid
+	}
+	if now.After(time.Unix(seconds, 0)) {
+		return Session{}, ErrExpired
+	}
+	if !strings.HasPrefix(path, fields.Get("prefix")) {
+		return Session{}, ErrInvalid
+	}
+	return Session{
+		Expires: time.Unix(seconds, 0),
+		Prefix:  fields.Get("prefix"),
+		Claims:  Claims{User: fields.Get("user"), Tenant: fields.Get("tenant")},
+	}, nil
+}
+
+// signSession signs the payload of a session. The context string keeps session signatures from being valid
+// as URL signatures and the other way around.
+func signSession(key []byte, payload string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("session\n" + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
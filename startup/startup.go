@@ -0,0 +1,137 @@
+package startup
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/arkami8/image-gem/audit"
+	"github.com/arkami8/image-gem/cache"
+	"github.com/arkami8/image-gem/config"
+	"github.com/arkami8/image-gem/dedup"
+	"github.com/arkami8/image-gem/geo"
+	"github.com/arkami8/image-gem/links"
+	"github.com/arkami8/image-gem/pipeline"
+	"github.com/arkami8/image-gem/signature"
+	"github.com/arkami8/image-gem/statedb"
+	"github.com/arkami8/image-gem/storage"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// Init reads the config, starts libvips and opens the stores the config asks for, exiting on errors. The server,
+// the Lambda handler and the cloud function entry point all call it before serving; vips.Shutdown is left to
+// the caller.
+func Init() {
+	config.ReadConfig()
+
+	// libvips is started once the config sets the limits of its operation cache
+	vips.Startup(config.VipsCache.VipsConfig())
+
+	loaders, savers, err := pipeline.UnsupportedFormats()
+	if err != nil {
+		log.Fatalf("error: cannot check the formats supported by libvips: %s", err.Error())
+	}
+	if len(loaders) > 0 {
+		log.Printf("warning: libvips can't decode %s", strings.Join(loaders, ", "))
+	}
+	if len(savers) > 0 {
+		log.Printf("warning: libvips can't encode %s", strings.Join(savers, ", "))
+	}
+
+	for domain, defaults := range config.DomainDefaults {
+		if _, err := pipeline.ParseOptions(defaults); err != nil {
+			log.Fatalf("error: invalid defaults for %s: %s", domain, err.Error())
+		}
+	}
+
+	for domain, script := range config.DomainPolicies {
+		if _, err := pipeline.CompilePolicy(script); err != nil {
+			log.Fatalf("error: invalid policy for %s: %s", domain, err.Error())
+		}
+	}
+
+	if config.AuditLogPath != "" {
+		err := audit.Init(config.AuditLogPath, int64(config.AuditLogMaxSizeMB)*1024*1024, config.AuditLogMaxBackups)
+		if err != nil {
+			log.Fatalf("error: cannot open audit log: %s", err.Error())
+		}
+	}
+	// The config is only read at startup, so each load is a deploy or restart with possibly changed settings
+	audit.Record(nil, "config.load", "sha256="+config.Digest)
+
+	if config.DedupStoreDir != "" {
+		if err := dedup.Init(config.DedupStoreDir, time.Duration(config.DedupURLTTLSeconds)*time.Second); err != nil {
+			log.Fatalf("error: cannot open dedup store: %s", err.Error())
+		}
+	}
+
+	if len(config.CacheTiers) > 0 {
+		tiers, err := openCacheTiers(config.CacheTiers)
+		if err != nil {
+			log.Fatalf("error: cannot open cache: %s", err.Error())
+		}
+		cache.Init(tiers...)
+	}
+
+	driver, dataSource := statedb.DriverSQLite, config.SQLitePath
+	if config.PostgresURL != "" {
+		driver, dataSource = statedb.DriverPostgres, config.PostgresURL
+	}
+	if dataSource != "" {
+		if err := statedb.Init(driver, dataSource); err != nil {
+			log.Fatalf("error: cannot open state database: %s", err.Error())
+		}
+	}
+
+	switch store := config.LinkStore; store.Type {
+	case "redis":
+		links.Init(cache.NewRedis(store.Address, store.Password, store.DB, store.Prefix, 0))
+	case "sqlite", "postgres":
+		links.Init(statedb.Default().KV(store.Prefix))
+	}
+
+	if store := config.NonceStore; store.Type == "redis" {
+		signature.InitRedisNonces(cache.NewRedis(store.Address, store.Password, store.DB, store.Prefix, 0))
+	} else if config.NonceStoreDir != "" {
+		if err := signature.InitNonces(config.NonceStoreDir); err != nil {
+			log.Fatalf("error: cannot open nonce store: %s", err.Error())
+		}
+	}
+
+	if config.GeoIPDatabase != "" {
+		if err := geo.Init(config.GeoIPDatabase); err != nil {
+			log.Fatalf("error: cannot open GeoIP database: %s", err.Error())
+		}
+	}
+}
+
+// openCacheTiers creates the configured cache tiers.
+func openCacheTiers(configs []config.CacheTier) ([]cache.Cache, error) {
+	var tiers []cache.Cache
+	for _, tier := range configs {
+		switch tier.Type {
+		case "memory":
+			tiers = append(tiers, cache.NewMemory(tier.MaxBytes))
+		case "disk":
+			disk, err := cache.NewDisk(tier.Dir, tier.MaxBytes)
+			if err != nil {
+				return nil, err
+			}
+			tiers = append(tiers, disk)
+		case "redis":
+			ttl := time.Duration(tier.TTLSeconds) * time.Second
+			tiers = append(tiers, cache.NewRedis(tier.Address, tier.Password, tier.DB, tier.Prefix, ttl))
+		case "s3":
+			store := &storage.S3{
+				Endpoint:        config.ObjectStoreEndpoint,
+				Region:          config.ObjectStoreRegion,
+				Bucket:          config.ObjectStoreBucket,
+				AccessKeyID:     config.ObjectStoreAccessKeyID,
+				SecretAccessKey: config.ObjectStoreSecretAccessKey,
+			}
+			tiers = append(tiers, cache.NewS3(store, tier.Prefix))
+		}
+	}
+	return tiers, nil
+}
@@ -0,0 +1,33 @@
+package statedb
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// JobState returns the state last saved for the key of a job, e.g. a file of a watched directory, and
+// false if there is none.
+func (d *DB) JobState(job, key string) (string, bool, error) {
+	var state string
+	err := d.db.QueryRow(d.rebind("SELECT state FROM jobs WHERE job = ? AND key = ?"), job, key).Scan(&state)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return state, true, nil
+}
+
+// SetJobState saves the state of the key of a job.
+func (d *DB) SetJobState(job, key, state string) error {
+	return d.exec("INSERT INTO jobs (job, key, state, updated) VALUES (?, ?, ?, ?) "+
+		"ON CONFLICT (job, key) DO UPDATE SET state = excluded.state, updated = excluded.updated",
+		job, key, state, time.Now().UTC().Format(time.RFC3339))
+}
+
+// DeleteJobState forgets the state of the key of a job.
+func (d *DB) DeleteJobState(job, key string) error {
+	return d.exec("DELETE FROM jobs WHERE job = ? AND key = ?", job, key)
+}
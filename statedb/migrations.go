@@ -0,0 +1,109 @@
+package statedb
+
+import (
+	"time"
+)
+
+// migration upgrades the schema by one version, with statements for each driver.
+type migration struct {
+	sqlite   string
+	postgres string
+}
+
+// migrations are applied in order by Open; the version of a database is the number it has had. Released
+// migrations must not be changed, only followed by new ones.
+var migrations = []migration{
+	{
+		// The SQLite tables may predate the migrations
+		sqlite: `
+CREATE TABLE IF NOT EXISTS kv (
+	namespace TEXT NOT NULL,
+	key TEXT NOT NULL,
+	value BLOB NOT NULL,
+	PRIMARY KEY (namespace, key)
+);
+CREATE TABLE IF NOT EXISTS usage (
+	day TEXT NOT NULL,
+	host TEXT NOT NULL,
+	requests INTEGER NOT NULL,
+	bytes INTEGER NOT NULL,
+	PRIMARY KEY (day, host)
+);
+CREATE TABLE IF NOT EXISTS jobs (
+	job TEXT NOT NULL,
+	key TEXT NOT NULL,
+	state TEXT NOT NULL,
+	updated TEXT NOT NULL,
+	PRIMARY KEY (job, key)
+);`,
+		postgres: `
+CREATE TABLE kv (
+	namespace TEXT NOT NULL,
+	key TEXT NOT NULL,
+	value BYTEA NOT NULL,
+	PRIMARY KEY (namespace, key)
+);
+CREATE TABLE usage (
+	day TEXT NOT NULL,
+	host TEXT NOT NULL,
+	requests BIGINT NOT NULL,
+	bytes BIGINT NOT NULL,
+	PRIMARY KEY (day, host)
+);
+CREATE TABLE jobs (
+	job TEXT NOT NULL,
+	key TEXT NOT NULL,
+	state TEXT NOT NULL,
+	updated TEXT NOT NULL,
+	PRIMARY KEY (job, key)
+);`,
+	},
+}
+
+// migrationLock is the PostgreSQL advisory lock held while migrating, so that instances starting at once
+// don't apply the same migrations.
+const migrationLock = 0x696d6765
+
+// migrate applies the migrations the database hasn't had yet, in a single transaction.
+func (d *DB) migrate() error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if d.driver == DriverPostgres {
+		if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", migrationLock); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, applied TEXT NOT NULL)"); err != nil {
+		return err
+	}
+
+	var version int
+	if err := tx.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version); err != nil {
+		return err
+	}
+	for ; version < len(migrations); version++ {
+		statements := migrations[version].sqlite
+		if d.driver == DriverPostgres {
+			statements = migrations[version].postgres
+		}
+		if _, err := tx.Exec(statements); err != nil {
+			return err
+		}
+		applied := time.Now().UTC().Format(time.RFC3339)
+		if _, err := tx.Exec(d.rebind("INSERT INTO schema_migrations (version, applied) VALUES (?, ?)"), version+1, applied); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Version returns the schema version of the database, the number of migrations it has had.
+func (d *DB) Version() (int, error) {
+	var version int
+	err := d.db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	return version, err
+}
@@ -0,0 +1,169 @@
+// Package statedb keeps state in an SQL database: short links, request usage counters and the state of
+// batch jobs. An embedded SQLite database gives single-node deployments persistence without running a
+// server, and PostgreSQL shares the state between the instances of a cluster. The schema is created and
+// upgraded by Open.
+package statedb
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Drivers of the databases.
+const (
+	DriverSQLite   = "sqlite3"
+	DriverPostgres = "postgres"
+)
+
+// DriverFor returns the driver of a data source: DriverPostgres for postgres:// and postgresql:// URLs, and
+// DriverSQLite for file paths.
+func DriverFor(dataSource string) string {
+	if strings.HasPrefix(dataSource, "postgres://") || strings.HasPrefix(dataSource, "postgresql://") {
+		return DriverPostgres
+	}
+	return DriverSQLite
+}
+
+// usageFlushInterval is how often the usage counted in memory is added to the database.
+const usageFlushInterval = 10 * time.Second
+
+// DB is an open database.
+type DB struct {
+	db     *sql.DB
+	driver string
+
+	mu      sync.Mutex
+	pending map[usageKey]Usage
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// Open opens the database, a file path for DriverSQLite or a connection URL for DriverPostgres, and applies
+// the migrations it hasn't had yet. Usage counted with CountUsage is written every few seconds and by Close.
+func Open(driver, dataSource string) (*DB, error) {
+	switch driver {
+	case DriverSQLite:
+		dataSource += "?_journal_mode=WAL&_busy_timeout=5000"
+	case DriverPostgres:
+	default:
+		return nil, fmt.Errorf("unsupported database driver: %s", driver)
+	}
+
+	db, err := sql.Open(driver, dataSource)
+	if err != nil {
+		return nil, err
+	}
+	d := &DB{db: db, driver: driver, pending: make(map[usageKey]Usage), done: make(chan struct{}), stopped: make(chan struct{})}
+	if err := d.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cannot migrate database: %w", err)
+	}
+
+	go d.flushLoop()
+	return d, nil
+}
+
+// Close writes the pending usage and closes the database.
+func (d *DB) Close() error {
+	close(d.done)
+	<-d.stopped
+	err := d.flushUsage()
+	if closeErr := d.db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// rebind replaces the ? placeholders of a query with the $1, $2... of PostgreSQL.
+func (d *DB) rebind(query string) string {
+	if d.driver != DriverPostgres {
+		return query
+	}
+	var rebound strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			rebound.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		rebound.WriteRune(c)
+	}
+	return rebound.String()
+}
+
+func (d *DB) exec(query string, args ...any) error {
+	_, err := d.db.Exec(d.rebind(query), args...)
+	return err
+}
+
+var std *DB
+
+// Init opens the database for the package-level functions. Until Init is called, Enabled reports false and
+// CountUsage does nothing.
+func Init(driver, dataSource string) error {
+	db, err := Open(driver, dataSource)
+	if err != nil {
+		return err
+	}
+	std = db
+	return nil
+}
+
+// Enabled reports whether the database has been initialized.
+func Enabled() bool {
+	return std != nil
+}
+
+// Default returns the database opened by Init, or nil.
+func Default() *DB {
+	return std
+}
+
+// Close closes the database opened by Init.
+func Close() error {
+	if std == nil {
+		return nil
+	}
+	return std.Close()
+}
+
+// KV is a cache.Cache of the entries of a namespace, e.g. to store short links.
+type KV struct {
+	db        *DB
+	namespace string
+}
+
+// KV returns the store of the entries of the namespace.
+func (d *DB) KV(namespace string) *KV {
+	return &KV{db: d, namespace: namespace}
+}
+
+func (kv *KV) Get(key string) ([]byte, bool, error) {
+	var value []byte
+	err := kv.db.db.QueryRow(kv.db.rebind("SELECT value FROM kv WHERE namespace = ? AND key = ?"), kv.namespace, key).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+func (kv *KV) Set(key string, data []byte) error {
+	return kv.db.exec("INSERT INTO kv (namespace, key, value) VALUES (?, ?, ?) "+
+		"ON CONFLICT (namespace, key) DO UPDATE SET value = excluded.value", kv.namespace, key, data)
+}
+
+func (kv *KV) Delete(key string) error {
+	return kv.db.exec("DELETE FROM kv WHERE namespace = ? AND key = ?", kv.namespace, key)
+}
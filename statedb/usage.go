@@ -0,0 +1,132 @@
+package statedb
+
+import (
+	"log"
+	"strings"
+	"time"
+)
+
+// dayFormat is the format of the days usage is counted by, in UTC.
+const dayFormat = "2006-01-02"
+
+// Usage is the number of images served for a source host on a day, and their total size.
+type Usage struct {
+	Day      string `json:"day"`
+	Host     string `json:"host"`
+	Requests int64  `json:"requests"`
+	Bytes    int64  `json:"bytes"`
+}
+
+type usageKey struct {
+	day  string
+	host string
+}
+
+// CountUsage counts an image of the given size served for the source host in the database opened by Init.
+func CountUsage(host string, size int64) {
+	if std != nil {
+		std.CountUsage(host, size)
+	}
+}
+
+// CountUsage counts an image of the given size served for the source host. The counts are kept in memory
+// and added to the database every few seconds, so it's cheap enough to call for every request.
+func (d *DB) CountUsage(host string, size int64) {
+	key := usageKey{day: time.Now().UTC().Format(dayFormat), host: host}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	usage := d.pending[key]
+	usage.Requests++
+	usage.Bytes += size
+	d.pending[key] = usage
+}
+
+// Usage returns the usage of the days from and to, inclusive, as YYYY-MM-DD; empty doesn't limit them.
+// A non-empty host only returns the usage of that source host.
+func (d *DB) Usage(from, to, host string) ([]Usage, error) {
+	var conditions []string
+	var args []any
+	for _, filter := range []struct{ condition, value string }{{"day >= ?", from}, {"day <= ?", to}, {"host = ?", host}} {
+		if filter.value != "" {
+			conditions = append(conditions, filter.condition)
+			args = append(args, filter.value)
+		}
+	}
+	query := "SELECT day, host, requests, bytes FROM usage"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	rows, err := d.db.Query(d.rebind(query+" ORDER BY day, host"), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usages := []Usage{}
+	for rows.Next() {
+		var usage Usage
+		if err := rows.Scan(&usage.Day, &usage.Host, &usage.Requests, &usage.Bytes); err != nil {
+			return nil, err
+		}
+		usages = append(usages, usage)
+	}
+	return usages, rows.Err()
+}
+
+func (d *DB) flushLoop() {
+	defer close(d.stopped)
+	ticker := time.NewTicker(usageFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+			if err := d.flushUsage(); err != nil {
+				log.Printf("warning: cannot write usage counters: %s", err.Error())
+			}
+		}
+	}
+}
+
+// flushUsage adds the usage counted in memory to the database. Counts that can't be written are kept for
+// the next attempt.
+func (d *DB) flushUsage() error {
+	d.mu.Lock()
+	pending := d.pending
+	d.pending = make(map[usageKey]Usage)
+	d.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	err := d.addUsage(pending)
+	if err != nil {
+		d.mu.Lock()
+		for key, usage := range pending {
+			current := d.pending[key]
+			current.Requests += usage.Requests
+			current.Bytes += usage.Bytes
+			d.pending[key] = current
+		}
+		d.mu.Unlock()
+	}
+	return err
+}
+
+func (d *DB) addUsage(pending map[usageKey]Usage) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	for key, usage := range pending {
+		_, err := tx.Exec(d.rebind("INSERT INTO usage (day, host, requests, bytes) VALUES (?, ?, ?, ?) "+
+			"ON CONFLICT (day, host) DO UPDATE SET requests = usage.requests + excluded.requests, bytes = usage.bytes + excluded.bytes"),
+			key.day, key.host, usage.Requests, usage.Bytes)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
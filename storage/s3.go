@@ -0,0 +1,222 @@
+// Package storage issues presigned requests for an S3-compatible object store, so clients can upload
+// originals directly to the store instead of through the server, and reads and writes objects of the store.
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3 is an S3-compatible bucket addressed path-style, e.g. https://s3.eu-west-1.amazonaws.com/bucket/key.
+type S3 struct {
+	Endpoint        string
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// Client sends the requests of Get, Put and Delete. http.DefaultClient is used if it is nil.
+	Client *http.Client
+}
+
+// ErrNotFound is returned by Get for objects that don't exist.
+var ErrNotFound = errors.New("object not found")
+
+// requestExpiry is how long the presigned URLs of Get, Put and Delete are valid.
+const requestExpiry = time.Minute
+
+// ObjectURL returns the URL of an object in the bucket.
+func (s *S3) ObjectURL(key string) string {
+	return strings.TrimRight(s.Endpoint, "/") + "/" + uriEncode(s.Bucket, false) + "/" + uriEncode(key, false)
+}
+
+// PresignPut returns a URL that accepts a PUT of the object until it expires. The upload must be sent
+// with the given Content-Type header, which is part of the signature.
+func (s *S3) PresignPut(key, contentType string, expires time.Duration) (string, error) {
+	objectURL, err := url.Parse(s.ObjectURL(key))
+	if err != nil {
+		return "", err
+	}
+	headers := map[string]string{"content-type": strings.TrimSpace(contentType)}
+	return s.presign("PUT", objectURL, headers, expires, time.Now()), nil
+}
+
+// Get downloads an object.
+func (s *S3) Get(key string) ([]byte, error) {
+	resp, err := s.do("GET", key, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: received a %d status code", key, resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// Put uploads an object, replacing any object with the same key.
+func (s *S3) Put(key, contentType string, data []byte) error {
+	resp, err := s.do("PUT", key, data, contentType)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("PUT %s: received a %d status code", key, resp.StatusCode)
+	}
+	return nil
+}
+
+// Delete removes an object. Deleting an object that doesn't exist succeeds.
+func (s *S3) Delete(key string) error {
+	resp, err := s.do("DELETE", key, nil, "")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("DELETE %s: received a %d status code", key, resp.StatusCode)
+	}
+	return nil
+}
+
+// do sends a request for an object with a presigned URL.
+func (s *S3) do(method, key string, body []byte, contentType string) (*http.Response, error) {
+	objectURL, err := url.Parse(s.ObjectURL(key))
+	if err != nil {
+		return nil, err
+	}
+	headers := map[string]string{}
+	if contentType != "" {
+		headers["content-type"] = contentType
+	}
+
+	req, err := http.NewRequest(method, s.presign(method, objectURL, headers, requestExpiry, time.Now()), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
+// presign signs a request with AWS Signature Version 4 in the query string. The host header is always signed.
+func (s *S3) presign(method string, objectURL *url.URL, headers map[string]string, expires time.Duration, now time.Time) string {
+	now = now.UTC()
+	date := now.Format("20060102")
+	amzDate := now.Format("20060102T150405Z")
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+
+	signed := map[string]string{"host": objectURL.Host}
+	for name, value := range headers {
+		signed[strings.ToLower(name)] = value
+	}
+	names := make([]string, 0, len(signed))
+	for name := range signed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + signed[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalQuery := canonicalQueryString(map[string]string{
+		"X-Amz-Algorithm":     "AWS4-HMAC-SHA256",
+		"X-Amz-Credential":    s.AccessKeyID + "/" + scope,
+		"X-Amz-Date":          amzDate,
+		"X-Amz-Expires":       fmt.Sprint(int(expires.Seconds())),
+		"X-Amz-SignedHeaders": signedHeaders,
+	})
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		objectURL.EscapedPath(),
+		canonicalQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(requestHash[:])}, "\n")
+
+	signingKey := []byte("AWS4" + s.SecretAccessKey)
+	for _, part := range []string{date, s.Region, "s3", "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	presigned := *objectURL
+	presigned.RawQuery = canonicalQuery + "&X-Amz-Signature=" + signature
+	return presigned.String()
+}
+
+// NewKey returns a random object key under the prefix with the given extension, e.g. "uploads/3f9c….jpg".
+func NewKey(prefix, extension string) (string, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return strings.Trim(prefix, "/") + "/" + hex.EncodeToString(random) + extension, nil
+}
+
+func canonicalQueryString(query map[string]string) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		pairs[i] = uriEncode(key, true) + "=" + uriEncode(query[key], true)
+	}
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode percent-encodes everything but the RFC 3986 unreserved characters, as SigV4 requires.
+// Slashes are kept unless encodeSlash is set.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/arkami8/image-gem/pipeline"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// manifestEntry is a single job in a transform manifest.
+type manifestEntry struct {
+	Input  string `json:"input"`
+	Params string `json:"params"`
+	Output string `json:"output"`
+}
+
+// Transform runs the transform subcommand, which processes local files with the same pipeline as the server.
+//
+//	transform [-params "w=300&f=webp"] [-o output | -outdir dir] input...
+//	transform -manifest manifest.json
+//
+// A manifest is a JSON array of {"input", "params", "output"} objects.
+func Transform(args []string) error {
+	fs := flag.NewFlagSet("transform", flag.ExitOnError)
+	params := fs.String("params", "", "transformation parameters as a query string, e.g. w=300&f=webp")
+	output := fs.String("o", "", "output file (only with a single input)")
+	outputDir := fs.String("outdir", ".", "output directory, files keep their base name with the extension of the output format")
+	manifestPath := fs.String("manifest", "", "JSON manifest of {input, params, output} jobs")
+	_ = fs.Parse(args)
+
+	var entries []manifestEntry
+	if *manifestPath != "" {
+		file, err := ioutil.ReadFile(*manifestPath)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(file, &entries); err != nil {
+			return fmt.Errorf("invalid manifest %s: %v", *manifestPath, err)
+		}
+	} else {
+		if fs.NArg() == 0 {
+			return fmt.Errorf("no input files given")
+		}
+		if *output != "" && fs.NArg() > 1 {
+			return fmt.Errorf("-o can only be used with a single input, use -outdir instead")
+		}
+		for _, input := range fs.Args() {
+			entries = append(entries, manifestEntry{Input: input, Params: *params, Output: *output})
+		}
+	}
+
+	failed := 0
+	for _, entry := range entries {
+		written, err := transformFile(entry, *outputDir)
+		if err != nil {
+			log.Printf("error: %s: %s", entry.Input, err.Error())
+			failed++
+			continue
+		}
+		log.Printf("%s -> %s", entry.Input, written)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d images failed", failed, len(entries))
+	}
+	return nil
+}
+
+// transformFile processes one entry and returns the path of the written file.
+// When the entry has no output path, the file is written to outputDir.
+func transformFile(entry manifestEntry, outputDir string) (string, error) {
+	query, err := url.ParseQuery(entry.Params)
+	if err != nil {
+		return "", err
+	}
+	opts, err := pipeline.ParseOptions(query)
+	if err != nil {
+		return "", err
+	}
+	if err := checkLocalOptions(opts); err != nil {
+		return "", err
+	}
+
+	data, err := ioutil.ReadFile(entry.Input)
+	if err != nil {
+		return "", err
+	}
+
+	img, err := pipeline.Load(bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	defer img.Close()
+
+	targetFormat := opts.Format
+	if img.Format() == vips.ImageTypeGIF && targetFormat == vips.ImageTypeUnknown {
+		targetFormat = vips.ImageTypeGIF
+	}
+
+	img, err = pipeline.Transform(img, opts)
+	if err != nil {
+		return "", err
+	}
+	defer img.Close()
+
+	imgBytes, metadata, err := pipeline.Export(img, pipeline.ExportOptions{Quality: opts.Quality, Colors: opts.Colors, Dither: opts.Dither}, targetFormat)
+	if err != nil {
+		return "", err
+	}
+
+	outputPath := entry.Output
+	if outputPath == "" {
+		name := strings.TrimSuffix(filepath.Base(entry.Input), filepath.Ext(entry.Input))
+		outputPath = filepath.Join(outputDir, name+metadata.Format.FileExt())
+	}
+	if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
+		return "", err
+	}
+
+	return outputPath, ioutil.WriteFile(outputPath, imgBytes, 0644)
+}
+
+// checkLocalOptions rejects the options only the server applies, as they need the request or an external
+// service, so local files aren't written differently than the server would serve them.
+func checkLocalOptions(opts *pipeline.Options) error {
+	var unsupported []string
+	if opts.AutoFormat {
+		unsupported = append(unsupported, "format=auto")
+	}
+	if opts.Overlay != "" {
+		unsupported = append(unsupported, "overlay")
+	}
+	if opts.RemoveBackground {
+		unsupported = append(unsupported, "bg=remove")
+	}
+	if opts.Watermark != "" {
+		unsupported = append(unsupported, "wm")
+	}
+	if opts.AIUpscale {
+		unsupported = append(unsupported, "up=ai")
+	}
+	if len(unsupported) > 0 {
+		return fmt.Errorf("%s can only be used with the server", strings.Join(unsupported, ", "))
+	}
+	return nil
+}
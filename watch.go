@@ -0,0 +1,165 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/arkami8/image-gem/statedb"
+)
+
+// renditionFlags collects repeated -rendition name=params flags.
+type renditionFlags map[string]string
+
+func (f renditionFlags) String() string {
+	return fmt.Sprint(map[string]string(f))
+}
+
+func (f renditionFlags) Set(value string) error {
+	name, params, ok := strings.Cut(value, ":")
+	if !ok || name == "" {
+		return fmt.Errorf("rendition must be name:params, e.g. thumb:w=200&f=webp")
+	}
+	f[name] = params
+	return nil
+}
+
+// fileState is the size and modification time a file had when it was last seen.
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+// String encodes the state for the job state of the state database.
+func (s fileState) String() string {
+	return fmt.Sprintf("%d %d", s.size, s.modTime.UnixNano())
+}
+
+// Watch runs the watch subcommand. It polls the input directory and writes every configured rendition of new
+// or changed files to <out>/<rendition>/<relative path>. A file is processed once its size and modification
+// time are unchanged between two polls, so files that are still being copied in are skipped, and is tried
+// again until all of its renditions are written. With -state, the processed files are remembered in an SQLite
+// database or a PostgreSQL one given by a postgres:// URL, so they aren't processed again after a restart.
+//
+//	watch -in incoming -out renditions -rendition thumb:w=200&f=webp -rendition large:w=1600
+func Watch(args []string) error {
+	renditions := renditionFlags{}
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	inputDir := fs.String("in", "", "directory to watch for new or changed images")
+	outputDir := fs.String("out", "", "directory the renditions are written to")
+	interval := fs.Duration("interval", 2*time.Second, "how often the input directory is scanned")
+	statePath := fs.String("state", "", "SQLite database or postgres:// URL remembering the processed files across restarts")
+	fs.Var(renditions, "rendition", "rendition as name:params, can be repeated")
+	_ = fs.Parse(args)
+
+	if *inputDir == "" || *outputDir == "" {
+		return fmt.Errorf("both -in and -out are required")
+	}
+	if len(renditions) == 0 {
+		return fmt.Errorf("at least one -rendition is required")
+	}
+
+	var db *statedb.DB
+	if *statePath != "" {
+		var err error
+		if db, err = statedb.Open(statedb.DriverFor(*statePath), *statePath); err != nil {
+			return err
+		}
+		defer db.Close()
+	}
+	// The state is kept per output directory, which may be watched with different inputs
+	job := "watch " + *outputDir
+
+	pending := map[string]fileState{}
+	processed := map[string]fileState{}
+
+	log.Printf("watching %s every %s", *inputDir, *interval)
+	for {
+		seen := map[string]bool{}
+		err := filepath.Walk(*inputDir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+				return nil
+			}
+			seen[path] = true
+
+			state := fileState{size: info.Size(), modTime: info.ModTime()}
+			if processed[path] == state {
+				return nil
+			}
+			if _, ok := processed[path]; !ok && db != nil {
+				saved, ok, err := db.JobState(job, path)
+				if err != nil {
+					log.Printf("warning: cannot read state of %s: %s", path, err.Error())
+				} else if ok && saved == state.String() {
+					processed[path] = state
+					return nil
+				}
+			}
+
+			// Wait for the file to stop changing before processing it
+			if pending[path] != state {
+				pending[path] = state
+				return nil
+			}
+			delete(pending, path)
+
+			rel, err := filepath.Rel(*inputDir, filepath.Dir(path))
+			if err != nil {
+				return err
+			}
+			failed := false
+			for name, params := range renditions {
+				entry := manifestEntry{Input: path, Params: params}
+				written, err := transformFile(entry, filepath.Join(*outputDir, name, rel))
+				if err != nil {
+					log.Printf("error: %s (%s): %s", path, name, err.Error())
+					failed = true
+					continue
+				}
+				log.Printf("%s -> %s", path, written)
+			}
+
+			// Files are only marked processed once all of their renditions are written, so failed ones and
+			// those interrupted by a crash are processed again
+			if failed {
+				return nil
+			}
+			processed[path] = state
+			if db != nil {
+				if err := db.SetJobState(job, path, state.String()); err != nil {
+					log.Printf("warning: cannot save state of %s: %s", path, err.Error())
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("error: cannot scan %s: %s", *inputDir, err.Error())
+		}
+
+		// Forget files that were removed so they are processed again if they come back
+		for path := range processed {
+			if !seen[path] {
+				delete(processed, path)
+				if db != nil {
+					if err := db.DeleteJobState(job, path); err != nil {
+						log.Printf("warning: cannot delete state of %s: %s", path, err.Error())
+					}
+				}
+			}
+		}
+		for path := range pending {
+			if !seen[path] {
+				delete(pending, path)
+			}
+		}
+
+		time.Sleep(*interval)
+	}
+}